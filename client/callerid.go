@@ -0,0 +1,99 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// On servers supporting caller-id, users with user mode +g only receive
+// private messages from nicks on their ACCEPT list. These helpers manage
+// that list, and return an error without sending anything if the server
+// doesn't advertise CALLERID in ISUPPORT.
+
+// AcceptAdd adds nicks to our caller-id ACCEPT list.
+//   ACCEPT nick1,nick2
+func (conn *Conn) AcceptAdd(nicks ...string) error {
+	return conn.accept("AcceptAdd", "", nicks)
+}
+
+// AcceptDel removes nicks from our caller-id ACCEPT list.
+//   ACCEPT -nick1,-nick2
+func (conn *Conn) AcceptDel(nicks ...string) error {
+	return conn.accept("AcceptDel", "-", nicks)
+}
+
+// AcceptList asks the server for our caller-id ACCEPT list. An ACCEPT_LIST
+// event is dispatched with the accepted nicks in Args once it's received.
+//   ACCEPT *
+func (conn *Conn) AcceptList() error {
+	return conn.accept("AcceptList", "", []string{"*"})
+}
+
+func (conn *Conn) accept(fn, prefix string, nicks []string) error {
+	if _, ok := conn.Supports("CALLERID"); !ok {
+		return fmt.Errorf("irc.%s(): server does not support CALLERID", fn)
+	}
+	if len(nicks) == 0 {
+		return fmt.Errorf("irc.%s(): no nicks given", fn)
+	}
+	conn.Raw(ACCEPT + " " + prefix + strings.Join(nicks, ","+prefix))
+	return nil
+}
+
+// Handle 281 RPL_ACCEPTLIST, collecting nicks until the list ends.
+//   :server 281 me nick1 nick2
+func (conn *Conn) h_281(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	conn.acceptMu.Lock()
+	defer conn.acceptMu.Unlock()
+	conn.acceptList = append(conn.acceptList, line.Args[1:]...)
+}
+
+// Handle 282 RPL_ENDOFACCEPT, dispatching ACCEPT_LIST with the nicks
+// received in any preceding 281 replies.
+//   :server 282 me :End of /ACCEPT list
+func (conn *Conn) h_282(line *Line) {
+	conn.acceptMu.Lock()
+	nicks := conn.acceptList
+	conn.acceptList = nil
+	conn.acceptMu.Unlock()
+	l := line.Copy()
+	l.Cmd, l.Args = ACCEPT_LIST, nicks
+	l.Internal = true
+	conn.dispatch(l)
+}
+
+// Handle 716 ERR_TARGUMODEG, telling us nick has caller-id enabled and
+// didn't get our message. CALLERID_BLOCKED is dispatched with nick in Args[0].
+//   :server 716 me nick :is in +g mode (server-side ignore.)
+func (conn *Conn) h_716(line *Line) {
+	conn.callerID(CALLERID_BLOCKED, line, 1)
+}
+
+// Handle 717 RPL_TARGNOTIFY, telling us nick has been told we tried to
+// message them. CALLERID_NOTIFIED is dispatched with nick in Args[0].
+//   :server 717 me nick :has been informed that you messaged them.
+func (conn *Conn) h_717(line *Line) {
+	conn.callerID(CALLERID_NOTIFIED, line, 1)
+}
+
+// Handle 718 RPL_UMODEGMSG, telling us nick tried to message us while we
+// have caller-id enabled. CALLERID_MESSAGE is dispatched with nick in Args[0]
+// and their user@host in Args[1], so they can be accepted with AcceptAdd.
+//   :server 718 me nick user@host :is messaging you, and you have umode +g.
+func (conn *Conn) h_718(line *Line) {
+	conn.callerID(CALLERID_MESSAGE, line, 2)
+}
+
+// callerID dispatches a caller-id event with n args from line after our nick.
+func (conn *Conn) callerID(ev string, line *Line, n int) {
+	if !line.argslen(n) {
+		return
+	}
+	l := line.Copy()
+	l.Cmd, l.Args = ev, l.Args[1:n+1]
+	l.Internal = true
+	conn.dispatch(l)
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAccept(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Nothing is sent if the server doesn't support caller-id.
+	if err := c.AcceptAdd("nick1"); err == nil {
+		t.Errorf("No error adding to ACCEPT list without CALLERID.")
+	}
+	s.nc.ExpectNothing()
+
+	c.h_005(ParseLine(":irc.server.org 005 test CALLERID=g :are supported by this server"))
+	if err := c.AcceptAdd("nick1", "nick2"); err != nil {
+		t.Errorf("Unexpected error from AcceptAdd: %v", err)
+	}
+	s.nc.Expect("ACCEPT nick1,nick2")
+	if err := c.AcceptDel("nick1", "nick2"); err != nil {
+		t.Errorf("Unexpected error from AcceptDel: %v", err)
+	}
+	s.nc.Expect("ACCEPT -nick1,-nick2")
+	if err := c.AcceptList(); err != nil {
+		t.Errorf("Unexpected error from AcceptList: %v", err)
+	}
+	s.nc.Expect("ACCEPT *")
+	if err := c.AcceptDel(); err == nil {
+		t.Errorf("No error removing no nicks from ACCEPT list.")
+	}
+	s.nc.ExpectNothing()
+}
+
+func TestAcceptListEvent(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	got := make(chan string, 1)
+	c.HandleFunc(ACCEPT_LIST, func(conn *Conn, line *Line) {
+		got <- strings.Join(line.Args, " ")
+	})
+	c.h_281(ParseLine(":irc.server.org 281 test nick1 nick2"))
+	c.h_281(ParseLine(":irc.server.org 281 test nick3"))
+	c.h_282(ParseLine(":irc.server.org 282 test :End of /ACCEPT list"))
+	if nicks := <-got; nicks != "nick1 nick2 nick3" {
+		t.Errorf("Bad ACCEPT_LIST event: %q", nicks)
+	}
+
+	// The list starts afresh for the next reply.
+	c.h_282(ParseLine(":irc.server.org 282 test :End of /ACCEPT list"))
+	if nicks := <-got; nicks != "" {
+		t.Errorf("Bad empty ACCEPT_LIST event: %q", nicks)
+	}
+}
+
+func TestCallerIDEvents(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	got := make(chan string, 1)
+	for _, ev := range []string{CALLERID_BLOCKED, CALLERID_NOTIFIED, CALLERID_MESSAGE} {
+		c.HandleFunc(ev, func(conn *Conn, line *Line) {
+			got <- line.Cmd + " " + strings.Join(line.Args, " ")
+		})
+	}
+	tests := []struct{ in, out string }{
+		{":irc.server.org 716 test nick1 :is in +g mode (server-side ignore.)",
+			"CALLERID_BLOCKED nick1"},
+		{":irc.server.org 717 test nick1 :has been informed that you messaged them.",
+			"CALLERID_NOTIFIED nick1"},
+		{":irc.server.org 718 test nick2 ident@host :is messaging you, and you have umode +g.",
+			"CALLERID_MESSAGE nick2 ident@host"},
+	}
+	for i, test := range tests {
+		l := ParseLine(test.in)
+		switch l.Cmd {
+		case "716":
+			c.h_716(l)
+		case "717":
+			c.h_717(l)
+		case "718":
+			c.h_718(l)
+		}
+		if out := <-got; out != test.out {
+			t.Errorf("test %d: expected %q, got %q", i, test.out, out)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// Standard IRCv3 capabilities, for checking Config.RequestCaps.
+var knownCaps = map[string]bool{
+	"account-notify":    true,
+	"account-tag":       true,
+	"away-notify":       true,
+	"batch":             true,
+	"cap-notify":        true,
+	"chghost":           true,
+	"echo-message":      true,
+	"extended-join":     true,
+	"extended-monitor":  true,
+	"identify-msg":      true,
+	"invite-notify":     true,
+	"labeled-response":  true,
+	"message-tags":      true,
+	"multi-prefix":      true,
+	"sasl":              true,
+	"server-time":       true,
+	"setname":           true,
+	"standard-replies":  true,
+	"sts":               true,
+	"tls":               true,
+	"userhost-in-names": true,
+}
+
+// Handler to keep track of the IRCv3 capabilities advertised by the server
+// in CAP LS, acknowledged in response to CAP REQ, and later withdrawn with
+// CAP DEL. A CAP_ACK or CAP_NAK event is dispatched for each capability in
+// ACK and NAK replies, with the bare capability name in Args[0] and the CAP
+// line in Raw. CAP_ACK events also have "enabled" or "disabled" in Args[1],
+// since an ACK of "-cap" means the capability was disabled. If we are
+// negotiating capabilities during registration, it also sends the CAP REQs
+// and CAP END as appropriate.
+//   :server CAP me LS [*] :cap1 cap2=value
+//   :server CAP me ACK :cap1 -cap2
+//   :server CAP me NAK :cap1
+//   :server CAP me DEL :cap1
+//   :server CAP me NEW :cap1=value
+func (conn *Conn) h_CAP(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	var ev, sts string
+	var req [][]string
+	end := false
+	sub := strings.ToUpper(line.Args[1])
+	conn.capMu.Lock()
+	switch sub {
+	case "LS", "NEW":
+		for _, c := range strings.Fields(line.Text()) {
+			kv := strings.SplitN(c, "=", 2)
+			if len(kv) == 1 {
+				kv = append(kv, "")
+			}
+			conn.capsAvail[kv[0]] = kv[1]
+			if kv[0] == "sts" {
+				sts = kv[1]
+			}
+		}
+		// "*" before the list means more LS lines are to come
+		if conn.capNeg && sub == "LS" && (len(line.Args) < 4 || line.Args[2] != "*") {
+			req = conn.capRequests()
+			conn.capReqs = len(req)
+			end = conn.capReqs == 0
+		}
+	case "ACK":
+		ev = CAP_ACK
+		for _, c := range strings.Fields(line.Text()) {
+			if name, enabled := capName(c); enabled {
+				conn.caps[name] = true
+			} else {
+				delete(conn.caps, name)
+			}
+		}
+		end = conn.capReplied()
+	case "NAK":
+		ev = CAP_NAK
+		end = conn.capReplied()
+	case "DEL":
+		for _, c := range strings.Fields(line.Text()) {
+			delete(conn.caps, c)
+			delete(conn.capsAvail, c)
+		}
+	}
+	mech := ""
+	if end {
+		// with SASL, CAP END waits until we've tried to authenticate
+		if mech = conn.saslStart(); mech == "" {
+			conn.capNeg = false
+		} else {
+			end = false
+		}
+	}
+	conn.capMu.Unlock()
+	if sts != "" {
+		_, secure := conn.TLSConnectionState()
+		conn.stsPolicy(sts, secure)
+	}
+	for _, r := range req {
+		conn.Cap("REQ", r...)
+	}
+	if mech != "" {
+		conn.Raw(AUTHENTICATE + " " + mech)
+	}
+	if end {
+		conn.Cap("END")
+	}
+	if ev == "" {
+		return
+	}
+	for _, c := range strings.Fields(line.Text()) {
+		name, enabled := capName(c)
+		l := line.Copy()
+		l.Cmd, l.Args = ev, []string{name}
+		l.Internal = true
+		if ev == CAP_ACK {
+			if enabled {
+				l.Args = append(l.Args, "enabled")
+			} else {
+				l.Args = append(l.Args, "disabled")
+			}
+		}
+		conn.dispatch(l)
+	}
+}
+
+// capName strips the modifiers from a capability in a CAP ACK or NAK,
+// returning the bare name and false if it is being disabled.
+func capName(c string) (string, bool) {
+	return strings.TrimLeft(c, "-~="), !strings.HasPrefix(c, "-")
+}
+
+// capRequests works out which CAP REQs to send once the server has finished
+// advertising its capabilities. Advertised capabilities are requested
+// together, while unadvertised ones are requested individually if
+// Config.RequestUnadvertisedCaps is set. conn.capMu must be held.
+func (conn *Conn) capRequests() [][]string {
+	var adv []string
+	var req [][]string
+	for _, c := range conn.requestCaps() {
+		if _, ok := conn.capsAvail[c]; ok {
+			adv = append(adv, c)
+		} else if conn.cfg.RequestUnadvertisedCaps {
+			req = append(req, []string{c})
+		} else {
+			logging.Warn("irc.CAP(): not requesting unadvertised capability %s", c)
+		}
+	}
+	if len(adv) > 0 {
+		req = append([][]string{adv}, req...)
+	}
+	return req
+}
+
+// The capability requested by Config.SuppressNamesOnJoin.
+const noImplicitNames = "draft/no-implicit-names"
+
+// requestCaps returns Config.RequestCaps without duplicates, warning about
+// any unknown capabilities. Those with a vendor or draft/ prefix are assumed
+// to be correct, since there are too many to list. Capabilities needed by
+// other Config options are added to the end.
+func (conn *Conn) requestCaps() []string {
+	custom := make(map[string]bool)
+	for _, c := range conn.cfg.CustomCaps {
+		custom[c] = true
+	}
+	req := conn.cfg.RequestCaps
+	if conn.cfg.SuppressNamesOnJoin {
+		req = append(req[:len(req):len(req)], noImplicitNames)
+	}
+	if len(conn.cfg.SASLMechs) > 0 {
+		req = append(req[:len(req):len(req)], "sasl")
+	}
+	seen := make(map[string]bool)
+	caps := make([]string, 0, len(req))
+	for _, c := range req {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		if !knownCaps[c] && !custom[c] && !strings.Contains(c, "/") {
+			logging.Warn("irc.CAP(): requesting unknown capability %s", c)
+		}
+		caps = append(caps, c)
+	}
+	return caps
+}
+
+// capReplied records a reply to one of our CAP REQs during negotiation,
+// returning true once all have been replied to. conn.capMu must be held.
+func (conn *Conn) capReplied() bool {
+	if !conn.capNeg || conn.capReqs == 0 {
+		return false
+	}
+	conn.capReqs--
+	return conn.capReqs == 0
+}
+
+// HasCapability returns true if the server has acknowledged the named
+// IRCv3 capability for the current connection.
+func (conn *Conn) HasCapability(name string) bool {
+	conn.capMu.RLock()
+	defer conn.capMu.RUnlock()
+	return conn.caps[name]
+}
+
+// CapAvailable returns the value the server advertised for the named IRCv3
+// capability in CAP LS or CAP NEW, and whether it was advertised at all,
+// regardless of whether we requested it. Use HasCapability to check whether
+// it is enabled.
+func (conn *Conn) CapAvailable(name string) (value string, ok bool) {
+	conn.capMu.RLock()
+	defer conn.capMu.RUnlock()
+	value, ok = conn.capsAvail[name]
+	return
+}
+
+// Caps returns the IRCv3 capabilities acknowledged by the server for the
+// current connection, mapped to the values advertised for them in CAP LS.
+// Capabilities without a value map to the empty string, e.g.
+//   "sasl":         "PLAIN,EXTERNAL"
+//   "multiline":    "max-bytes=4096"
+//   "echo-message": ""
+func (conn *Conn) Caps() map[string]string {
+	conn.capMu.RLock()
+	defer conn.capMu.RUnlock()
+	caps := make(map[string]string, len(conn.caps))
+	for c := range conn.caps {
+		caps[c] = conn.capsAvail[c]
+	}
+	return caps
+}
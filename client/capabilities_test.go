@@ -0,0 +1,218 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test the handler for CAP messages
+func TestCAP(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.h_CAP(ParseLine(":irc.server.org CAP test ACK :multi-prefix away-notify"))
+	if !c.HasCapability("multi-prefix") || !c.HasCapability("away-notify") {
+		t.Errorf("Acknowledged capabilities not recorded.")
+	}
+	if c.HasCapability("sasl") {
+		t.Errorf("Capability recorded without acknowledgement.")
+	}
+
+	// Disabling or deleting capabilities should forget them.
+	c.h_CAP(ParseLine(":irc.server.org CAP test ACK :-multi-prefix"))
+	c.h_CAP(ParseLine(":irc.server.org CAP test DEL :away-notify"))
+	if c.HasCapability("multi-prefix") || c.HasCapability("away-notify") {
+		t.Errorf("Disabled capabilities still recorded.")
+	}
+}
+
+func TestCAPValues(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.h_CAP(ParseLine(":irc.server.org CAP test LS * :sasl=PLAIN,EXTERNAL echo-message"))
+	c.h_CAP(ParseLine(":irc.server.org CAP test LS :draft/multiline=max-bytes=4096,max-lines=10 sts=duration=300"))
+	c.h_CAP(ParseLine(":irc.server.org CAP test ACK :sasl echo-message draft/multiline"))
+	exp := map[string]string{
+		"sasl":            "PLAIN,EXTERNAL",
+		"echo-message":    "",
+		"draft/multiline": "max-bytes=4096,max-lines=10",
+	}
+	if caps := c.Caps(); !reflect.DeepEqual(caps, exp) {
+		t.Errorf("Bad acknowledged capabilities: %v", caps)
+	}
+
+	// Disabled capabilities aren't returned any more.
+	c.h_CAP(ParseLine(":irc.server.org CAP test ACK :-echo-message"))
+	delete(exp, "echo-message")
+	if caps := c.Caps(); !reflect.DeepEqual(caps, exp) {
+		t.Errorf("Bad acknowledged capabilities after disabling: %v", caps)
+	}
+
+	// Advertised capabilities are available whether or not they're enabled.
+	if v, ok := c.CapAvailable("sts"); !ok || v != "duration=300" {
+		t.Errorf("Advertised capability sts not available: %q, %v", v, ok)
+	}
+	if v, ok := c.CapAvailable("echo-message"); !ok || v != "" {
+		t.Errorf("Disabled capability echo-message not available: %q, %v", v, ok)
+	}
+	if _, ok := c.CapAvailable("away-notify"); ok {
+		t.Errorf("Unadvertised capability away-notify available.")
+	}
+	c.h_CAP(ParseLine(":irc.server.org CAP test NEW :away-notify"))
+	if _, ok := c.CapAvailable("away-notify"); !ok {
+		t.Errorf("Capability from CAP NEW not available.")
+	}
+	c.h_CAP(ParseLine(":irc.server.org CAP test DEL :sts"))
+	if _, ok := c.CapAvailable("sts"); ok {
+		t.Errorf("Capability removed by CAP DEL still available.")
+	}
+}
+
+func TestCAPEvents(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	var mu sync.Mutex
+	acks, naks := []string{}, []string{}
+	c.HandleFunc(CAP_ACK, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		acks = append(acks, line.Args[0]+" "+line.Args[1])
+		if !strings.HasPrefix(line.Raw, ":irc.server.org CAP test ACK :") {
+			t.Errorf("CAP_ACK has wrong raw line: %q", line.Raw)
+		}
+		if !line.Internal {
+			t.Errorf("CAP_ACK not marked as internal.")
+		}
+	})
+	c.HandleFunc(CAP_NAK, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		naks = append(naks, line.Args[0])
+	})
+
+	c.h_CAP(ParseLine(":irc.server.org CAP test ACK :multi-prefix sasl"))
+	c.h_CAP(ParseLine(":irc.server.org CAP test NAK :away-notify"))
+	c.h_CAP(ParseLine(":irc.server.org CAP test ACK :-multi-prefix"))
+	c.h_CAP(ParseLine(":irc.server.org CAP test LS :multi-prefix sasl away-notify"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(acks) != 3 || acks[0] != "multi-prefix enabled" ||
+		acks[1] != "sasl enabled" || acks[2] != "multi-prefix disabled" {
+		t.Errorf("Incorrect CAP_ACK events dispatched: %v", acks)
+	}
+	if len(naks) != 1 || naks[0] != "away-notify" {
+		t.Errorf("Incorrect CAP_NAK events dispatched: %v", naks)
+	}
+	if c.HasCapability("away-notify") {
+		t.Errorf("NAKed capability recorded as acknowledged.")
+	}
+}
+
+// Test capability negotiation during registration
+func TestCAPNegotiation(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	s.st.EXPECT().RequestNick("test").Return(c.cfg.Me).Times(4)
+	c.cfg.RequestCaps = []string{"multi-prefix", "sasl", "draft/unknown"}
+	c.h_REGISTER(&Line{Cmd: REGISTER})
+	s.nc.Expect("CAP LS 302")
+	s.nc.Expect("NICK test")
+	s.nc.Expect("USER test 12 * :Testing IRC")
+	s.nc.ExpectNothing()
+
+	// Nothing should be requested until the final LS line arrives, and
+	// unadvertised capabilities are skipped by default.
+	c.h_CAP(ParseLine(":irc.server.org CAP * LS * :multi-prefix away-notify"))
+	s.nc.ExpectNothing()
+	c.h_CAP(ParseLine(":irc.server.org CAP * LS :sasl=PLAIN,EXTERNAL"))
+	s.nc.Expect("CAP REQ :multi-prefix sasl")
+	s.nc.ExpectNothing()
+	c.h_CAP(ParseLine(":irc.server.org CAP * ACK :multi-prefix sasl"))
+	s.nc.Expect("CAP END")
+	s.nc.ExpectNothing()
+
+	// Negotiation should complete even if nothing is requested.
+	c.caps, c.capsAvail = map[string]bool{}, map[string]string{}
+	c.cfg.RequestCaps = []string{"draft/unknown"}
+	c.h_REGISTER(&Line{Cmd: REGISTER})
+	s.nc.Expect("CAP LS 302")
+	s.nc.Expect("NICK test")
+	s.nc.Expect("USER test 12 * :Testing IRC")
+	c.h_CAP(ParseLine(":irc.server.org CAP * LS :multi-prefix"))
+	s.nc.Expect("CAP END")
+	s.nc.ExpectNothing()
+
+	// Unadvertised capabilities are requested separately if configured,
+	// and CAP END is only sent once every request has been answered.
+	c.caps, c.capsAvail = map[string]bool{}, map[string]string{}
+	c.cfg.RequestCaps = []string{"draft/unknown", "multi-prefix"}
+	c.cfg.RequestUnadvertisedCaps = true
+	c.h_REGISTER(&Line{Cmd: REGISTER})
+	s.nc.Expect("CAP LS 302")
+	s.nc.Expect("NICK test")
+	s.nc.Expect("USER test 12 * :Testing IRC")
+	c.h_CAP(ParseLine(":irc.server.org CAP * LS :multi-prefix"))
+	s.nc.Expect("CAP REQ :multi-prefix")
+	s.nc.Expect("CAP REQ :draft/unknown")
+	s.nc.ExpectNothing()
+	c.h_CAP(ParseLine(":irc.server.org CAP * ACK :multi-prefix"))
+	s.nc.ExpectNothing()
+	c.h_CAP(ParseLine(":irc.server.org CAP * NAK :draft/unknown"))
+	s.nc.Expect("CAP END")
+	s.nc.ExpectNothing()
+	if !c.HasCapability("multi-prefix") || c.HasCapability("draft/unknown") {
+		t.Errorf("Negotiated capabilities recorded incorrectly.")
+	}
+
+	// Capabilities listed twice must only be requested once, otherwise
+	// we'd wait forever for a reply to the duplicate request.
+	c.caps, c.capsAvail = map[string]bool{}, map[string]string{}
+	c.cfg.RequestCaps = []string{"sasl", "draft/unknown", "sasl", "draft/unknown"}
+	c.h_REGISTER(&Line{Cmd: REGISTER})
+	s.nc.Expect("CAP LS 302")
+	s.nc.Expect("NICK test")
+	s.nc.Expect("USER test 12 * :Testing IRC")
+	c.h_CAP(ParseLine(":irc.server.org CAP * LS :sasl=PLAIN"))
+	s.nc.Expect("CAP REQ :sasl")
+	s.nc.Expect("CAP REQ :draft/unknown")
+	s.nc.ExpectNothing()
+	c.h_CAP(ParseLine(":irc.server.org CAP * ACK :sasl"))
+	s.nc.ExpectNothing()
+	c.h_CAP(ParseLine(":irc.server.org CAP * NAK :draft/unknown"))
+	s.nc.Expect("CAP END")
+	s.nc.ExpectNothing()
+}
+
+func TestRequestCaps(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.cfg.RequestCaps = []string{"sasl", "multi-prefix", "sasl", "mutli-prefix",
+		"znc.in/self-message", "example", "multi-prefix"}
+	c.cfg.CustomCaps = []string{"example"}
+	exp := []string{"sasl", "multi-prefix", "mutli-prefix",
+		"znc.in/self-message", "example"}
+	if caps := c.requestCaps(); !reflect.DeepEqual(caps, exp) {
+		t.Errorf("Bad capabilities to request: %v", caps)
+	}
+
+	// SuppressNamesOnJoin adds the capability it needs, once.
+	c.cfg.SuppressNamesOnJoin = true
+	exp = append(exp, "draft/no-implicit-names")
+	if caps := c.requestCaps(); !reflect.DeepEqual(caps, exp) {
+		t.Errorf("Bad capabilities to request: %v", caps)
+	}
+	c.cfg.RequestCaps = []string{"draft/no-implicit-names"}
+	if caps := c.requestCaps(); len(caps) != 1 {
+		t.Errorf("Bad capabilities to request: %v", caps)
+	}
+	if len(c.cfg.RequestCaps) != 1 {
+		t.Errorf("RequestCaps modified: %v", c.cfg.RequestCaps)
+	}
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"time"
+
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// The replies we wait for after joining a channel before dispatching
+// CHANNEL_SYNCED. 333 RPL_TOPICWHOTIME is only waited for once we've seen
+// a 332 RPL_TOPIC, since servers send neither for a channel with no topic.
+// With draft/no-implicit-names there's no 366, so 315 RPL_ENDOFWHO for the
+// channel is waited for instead.
+const (
+	syncNames    = 1 << iota // 366 RPL_ENDOFNAMES
+	syncModes                // 324 RPL_CHANNELMODEIS
+	syncCreated              // 329 RPL_CREATIONTIME
+	syncTopicWho             // 333 RPL_TOPICWHOTIME
+)
+
+// chanSync tracks the replies still to come for a channel we've just joined.
+type chanSync struct {
+	need   int
+	cancel func()
+}
+
+// startSync is called when we join a channel that's new to the state
+// tracker, to dispatch CHANNEL_SYNCED once we know all about it.
+func (conn *Conn) startSync(channel string) {
+	d := conn.cfg.ChannelSyncTimeout
+	if d <= 0 {
+		d = 5 * time.Second
+	}
+	cs := &chanSync{need: syncNames | syncModes | syncCreated}
+	k := conn.Casefold(channel)
+	cs.cancel = conn.After(d, func(conn *Conn) {
+		conn.chanSyncMu.Lock()
+		timedOut := conn.chanSyncs[k] == cs
+		if timedOut {
+			delete(conn.chanSyncs, k)
+		}
+		conn.chanSyncMu.Unlock()
+		if timedOut {
+			logging.Debug("irc.CHANNEL_SYNCED(): gave up waiting for "+
+				"replies for %s after %s", channel, d)
+			conn.channelSynced(channel)
+		}
+	})
+	conn.chanSyncMu.Lock()
+	defer conn.chanSyncMu.Unlock()
+	if old := conn.chanSyncs[k]; old != nil {
+		old.cancel()
+	}
+	conn.chanSyncs[k] = cs
+}
+
+// synced records that a reply for a channel we're syncing has arrived,
+// dispatching CHANNEL_SYNCED if it was the last one we were waiting for.
+func (conn *Conn) synced(channel string, part int) {
+	k := conn.Casefold(channel)
+	conn.chanSyncMu.Lock()
+	cs := conn.chanSyncs[k]
+	if cs == nil {
+		conn.chanSyncMu.Unlock()
+		return
+	}
+	cs.need &^= part
+	done := cs.need == 0
+	if done {
+		delete(conn.chanSyncs, k)
+	}
+	conn.chanSyncMu.Unlock()
+	if done {
+		cs.cancel()
+		conn.channelSynced(channel)
+	}
+}
+
+// awaitSync adds part to the replies we're waiting for for a channel, if
+// we're syncing it.
+func (conn *Conn) awaitSync(channel string, part int) {
+	conn.chanSyncMu.Lock()
+	defer conn.chanSyncMu.Unlock()
+	if cs := conn.chanSyncs[conn.Casefold(channel)]; cs != nil {
+		cs.need |= part
+	}
+}
+
+// channelSynced dispatches CHANNEL_SYNCED for a channel, unless we've
+// left it in the meantime.
+func (conn *Conn) channelSynced(channel string) {
+	st := conn.st
+	if st == nil {
+		return
+	}
+	ch := st.GetChannel(channel)
+	if ch == nil {
+		return
+	}
+	conn.dispatch(&Line{Cmd: CHANNEL_SYNCED, Args: []string{ch.Name},
+		Internal: true, Time: time.Now()})
+}
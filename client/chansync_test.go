@@ -0,0 +1,100 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/lfkeitel/goirc/state"
+)
+
+func TestChannelSynced(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	synced := make(chan string, 1)
+	c.HandleFunc(CHANNEL_SYNCED, func(conn *Conn, line *Line) {
+		synced <- line.Args[0]
+	})
+	notSynced := func() {
+		select {
+		case ch := <-synced:
+			t.Fatalf("CHANNEL_SYNCED dispatched early for %s", ch)
+		default:
+		}
+	}
+	chan1 := &state.Channel{Name: "#test1"}
+
+	// The event is only sent once every reply has arrived, including a 333
+	// if we've seen a 332.
+	c.startSync("#test1")
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(chan1),
+		s.st.EXPECT().Topic("#test1", "a topic"),
+		s.st.EXPECT().GetChannel("#test1").Return(chan1),
+		s.st.EXPECT().ChannelModes("#test1", "+nt"),
+		s.st.EXPECT().GetChannel("#test1").Return(chan1),
+		s.st.EXPECT().ChannelCreated("#test1", time.Unix(1234567000, 0)),
+		s.st.EXPECT().GetChannel("#test1").Return(chan1),
+		s.st.EXPECT().TopicInfo("#test1", "user1", time.Unix(1234567890, 0)),
+	)
+	c.h_332(ParseLine(":irc.server.org 332 test #test1 :a topic"))
+	c.h_324(ParseLine(":irc.server.org 324 test #test1 +nt"))
+	c.h_329(ParseLine(":irc.server.org 329 test #test1 1234567000"))
+	notSynced()
+	c.h_333(ParseLine(":irc.server.org 333 test #test1 user1 1234567890"))
+	notSynced()
+	s.st.EXPECT().GetChannel("#test1").Return(chan1)
+	c.h_366(ParseLine(":irc.server.org 366 test #test1 :End of /NAMES list."))
+	if ch := <-synced; ch != "#test1" {
+		t.Errorf("CHANNEL_SYNCED dispatched for wrong channel %s", ch)
+	}
+
+	// Replies after the channel has synced don't dispatch it again.
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(chan1),
+		s.st.EXPECT().ChannelModes("#test1", "+n"),
+	)
+	c.h_324(ParseLine(":irc.server.org 324 test #test1 +n"))
+	notSynced()
+
+	// With draft/no-implicit-names, there's no 366, so the end of the WHO
+	// for the channel stands in for it.
+	c.caps[noImplicitNames] = true
+	chan4 := &state.Channel{Name: "#test4"}
+	c.startSync("#test4")
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test4").Return(chan4),
+		s.st.EXPECT().ChannelModes("#test4", "+nt"),
+		s.st.EXPECT().GetChannel("#test4").Return(chan4),
+		s.st.EXPECT().ChannelCreated("#test4", time.Unix(1234567000, 0)),
+	)
+	c.h_324(ParseLine(":irc.server.org 324 test #test4 +nt"))
+	c.h_329(ParseLine(":irc.server.org 329 test #test4 1234567000"))
+	notSynced()
+	s.st.EXPECT().GetChannel("#test4").Return(chan4)
+	c.h_ST315(ParseLine(":irc.server.org 315 test #test4 :End of /WHO list."))
+	if ch := <-synced; ch != "#test4" {
+		t.Errorf("CHANNEL_SYNCED dispatched for wrong channel %s", ch)
+	}
+	delete(c.caps, noImplicitNames)
+
+	// If the server doesn't send everything, it's sent after a timeout.
+	c.cfg.ChannelSyncTimeout = 10 * time.Millisecond
+	s.st.EXPECT().GetChannel("#test2").Return(&state.Channel{Name: "#test2"})
+	c.startSync("#test2")
+	select {
+	case ch := <-synced:
+		if ch != "#test2" {
+			t.Errorf("CHANNEL_SYNCED dispatched for wrong channel %s", ch)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("CHANNEL_SYNCED not dispatched after timeout.")
+	}
+
+	// Unless we've left the channel in the meantime.
+	s.st.EXPECT().GetChannel("#test3").Return(nil)
+	c.startSync("#test3")
+	<-time.After(50 * time.Millisecond)
+	notSynced()
+}
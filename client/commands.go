@@ -3,22 +3,36 @@ package client
 import (
 	"fmt"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lfkeitel/goirc/logging"
+	"github.com/lfkeitel/goirc/state"
 )
 
+// How long Quit waits for the send queue to drain if Config.FlushOnQuit
+// is set before closing the connection.
+var quitFlushTimeout = 30 * time.Second
+
 const (
 	REGISTER     = "REGISTER"
 	CONNECTED    = "CONNECTED"
 	DISCONNECTED = "DISCONNECTED"
+	ACCEPT       = "ACCEPT"
+	AUTHENTICATE = "AUTHENTICATE"
 	ACTION       = "ACTION"
 	AWAY         = "AWAY"
 	CAP          = "CAP"
+	CHGHOST      = "CHGHOST"
 	CTCP         = "CTCP"
 	CTCPREPLY    = "CTCPREPLY"
 	ERROR        = "ERROR"
 	INVITE       = "INVITE"
 	JOIN         = "JOIN"
 	KICK         = "KICK"
+	LUSERS       = "LUSERS"
 	MODE         = "MODE"
+	NAMES        = "NAMES"
 	NICK         = "NICK"
 	NOTICE       = "NOTICE"
 	OPER         = "OPER"
@@ -28,8 +42,12 @@ const (
 	PONG         = "PONG"
 	PRIVMSG      = "PRIVMSG"
 	QUIT         = "QUIT"
+	RENAME       = "RENAME"
+	TAGMSG       = "TAGMSG"
+	TIME         = "TIME"
 	TOPIC        = "TOPIC"
 	USER         = "USER"
+	USERHOST     = "USERHOST"
 	VERSION      = "VERSION"
 	VHOST        = "VHOST"
 	WHO          = "WHO"
@@ -37,6 +55,150 @@ const (
 	defaultSplit = 450
 )
 
+// Events dispatched by the client in response to changes in its own state,
+// rather than in direct response to a line from the server.
+const (
+	STATE_TRACKING_ENABLED  = "STATE_TRACKING_ENABLED"
+	STATE_TRACKING_DISABLED = "STATE_TRACKING_DISABLED"
+	CAP_ACK                 = "CAP_ACK"
+	CAP_NAK                 = "CAP_NAK"
+	DRY_RUN                 = "DRY_RUN"
+	TOO_MANY_CHANNELS       = "TOO_MANY_CHANNELS"
+	ACCEPT_LIST             = "ACCEPT_LIST"
+	CALLERID_BLOCKED        = "CALLERID_BLOCKED"
+	CALLERID_NOTIFIED       = "CALLERID_NOTIFIED"
+	CALLERID_MESSAGE        = "CALLERID_MESSAGE"
+	TYPING                  = "TYPING"
+	AWAY_SET                = "AWAY_SET"
+	AWAY_CLEARED            = "AWAY_CLEARED"
+	JOIN_FAILED             = "JOIN_FAILED"
+	SELF_PART               = "SELF_PART"
+	SELF_JOIN               = "SELF_JOIN"
+	SELF_NICK               = "SELF_NICK"
+	SELF_PRIVMSG            = "SELF_PRIVMSG"
+	FORWARD                 = "FORWARD"
+	SASL_MECHS              = "SASL_MECHS"
+	CHANNEL_URL             = "CHANNEL_URL"
+	UNAVAILABLE             = "UNAVAILABLE"
+	FORCED_NICK             = "FORCED_NICK"
+	UMODE_SYNC              = "UMODE_SYNC"
+	FORCED_JOIN             = "FORCED_JOIN"
+	TOPIC_INFO              = "TOPIC_INFO"
+	CHANNEL_SYNCED          = "CHANNEL_SYNCED"
+	SERVER_SHUTDOWN         = "SERVER_SHUTDOWN"
+	STATE_READY             = "STATE_READY"
+)
+
+// NotOnChannelError is returned by commands that act on a channel, such as
+// Kick and Mode, if Config.ValidateTargets is set and the state tracker says
+// we're not on the channel. The command is not sent to the server.
+type NotOnChannelError struct {
+	Cmd, Channel string
+}
+
+func (e *NotOnChannelError) Error() string {
+	return fmt.Sprintf("irc.%s(): not on channel %s", e.Cmd, e.Channel)
+}
+
+// checkOn returns a *NotOnChannelError if Config.ValidateTargets is set and
+// the state tracker doesn't know about the channel target t. The check is
+// skipped without state tracking, or if t isn't a channel.
+func (conn *Conn) checkOn(cmd, t string) error {
+	if !conn.cfg.ValidateTargets || conn.st == nil || !conn.IsChannel(t) {
+		return nil
+	}
+	if conn.st.GetChannel(t) == nil {
+		return &NotOnChannelError{Cmd: cmd, Channel: t}
+	}
+	return nil
+}
+
+// ModeratedError is returned by Privmsg if Config.WarnOnModeratedSend is set
+// and the state tracker says the channel is moderated and we can't speak
+// there. The message is not sent to the server.
+type ModeratedError struct {
+	Channel string
+}
+
+func (e *ModeratedError) Error() string {
+	return fmt.Sprintf("irc.Privmsg(): channel %s is moderated and we "+
+		"have no voice", e.Channel)
+}
+
+// checkModerated returns a *ModeratedError if Config.WarnOnModeratedSend is
+// set and the state tracker says channel target t is moderated (+m) and we
+// have no voice or higher privilege on it. The check is skipped without
+// state tracking, or if t isn't a channel we know about.
+func (conn *Conn) checkModerated(t string) error {
+	st := conn.st
+	if !conn.cfg.WarnOnModeratedSend || st == nil || !conn.IsChannel(t) {
+		return nil
+	}
+	ch := st.GetChannel(t)
+	if ch == nil || ch.Modes == nil || !ch.Modes.Moderated {
+		return nil
+	}
+	if cp, ok := ch.Nicks[conn.Me().Nick]; ok && cp != nil &&
+		(cp.Owner || cp.Admin || cp.Op || cp.HalfOp || cp.Voice) {
+		return nil
+	}
+	return &ModeratedError{Channel: t}
+}
+
+// LimitError is returned by commands that would exceed a limit the server
+// advertises in ISUPPORT, e.g. Join if we'd be on more channels than
+// CHANLIMIT allows. The command is not sent to the server.
+type LimitError struct {
+	// The command, ISUPPORT token, and what would exceed the limit.
+	Cmd, Token, Target string
+	// The characters sharing the limit, e.g. "#&" for CHANLIMIT.
+	Chars string
+	Limit int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("irc.%s(): %s would exceed %s=%s:%d",
+		e.Cmd, e.Target, e.Token, e.Chars, e.Limit)
+}
+
+// checkChanLimit returns a *LimitError if joining channels, a comma
+// separated list, would put us on more channels than CHANLIMIT allows.
+// The check is skipped without state tracking.
+func (conn *Conn) checkChanLimit(channels string) error {
+	if conn.st == nil {
+		return nil
+	}
+	var me *state.Nick
+	joining := make(map[string]int)
+	for _, ch := range strings.Split(channels, ",") {
+		if ch == "" {
+			continue
+		}
+		limit, prefixes, ok := conn.ChanLimit(ch[0])
+		if !ok {
+			continue
+		}
+		if me == nil {
+			me = conn.Me()
+		}
+		if _, on := me.Channels[ch]; on {
+			continue
+		}
+		joining[prefixes]++
+		n := joining[prefixes]
+		for c := range me.Channels {
+			if strings.IndexByte(prefixes, c[0]) != -1 {
+				n++
+			}
+		}
+		if n > limit {
+			return &LimitError{Cmd: JOIN, Token: "CHANLIMIT", Target: ch,
+				Chars: prefixes, Limit: limit}
+		}
+	}
+	return nil
+}
+
 // cutNewLines() pares down a string to the part before the first "\r" or "\n".
 func cutNewLines(s string) string {
 	r := strings.SplitN(s, "\r", 2)
@@ -67,7 +229,7 @@ func indexFragment(s string) int {
 // splitMessage splits a message > splitLen chars at:
 //   1. the end of the last sentence fragment before splitLen
 //   2. the end of the last word before splitLen
-//   3. splitLen itself
+//   3. splitLen itself, or just before it if that's inside a UTF-8 rune
 func splitMessage(msg string, splitLen int) (msgs []string) {
 	// This is quite short ;-)
 	if splitLen < 13 {
@@ -77,6 +239,9 @@ func splitMessage(msg string, splitLen int) (msgs []string) {
 		idx := indexFragment(msg[:splitLen-3])
 		if idx < 0 {
 			idx = splitLen - 3
+			for idx > 1 && !utf8.RuneStart(msg[idx]) {
+				idx--
+			}
 		}
 		msgs = append(msgs, msg[:idx]+"...")
 		msg = msg[idx:]
@@ -86,18 +251,45 @@ func splitMessage(msg string, splitLen int) (msgs []string) {
 
 // Raw sends a raw line to the server, should really only be used for
 // debugging purposes but may well come in handy.
-func (conn *Conn) Raw(rawline string) {
+//
+// Like the other commands that send to the server, Raw never blocks: lines
+// are queued and written by a separate goroutine, which is held back by
+// flood protection instead of the caller. It's therefore safe to send from
+// within a handler. The exception is Quit with Config.FlushOnQuit set,
+// which waits for the QUIT to be written. What isn't safe is a handler
+// waiting for the server's reply, e.g. reading the channel returned by
+// RequestWhois, since replies are dispatched on the same goroutine; do
+// that in a new goroutine instead.
+//
+// The queue isn't bounded, so sending faster than flood protection allows
+// for long periods grows it, and the delay before each line is sent,
+// without limit. Config.OnSendDelay reports how long lines are waiting.
+func (conn *Conn) Raw(rawline string) { conn.raw(rawline, prioNormal) }
+
+// raw is Raw with a priority for the send queue.
+func (conn *Conn) raw(rawline string, prio priority) {
 	// Avoid command injection by enforcing one command per line.
-	conn.out <- cutNewLines(rawline)
+	line := cutNewLines(rawline)
+	if !conn.queue(line) {
+		conn.enqueue(line, prio)
+	}
 }
 
 // Pass sends a PASS command to the server.
 //     PASS password
 func (conn *Conn) Pass(password string) { conn.Raw(PASS + " " + password) }
 
-// Nick sends a NICK command to the server.
+// Nick sends a NICK command to the server, and records nick as
+// conn.Me().RequestedNick, whatever the server eventually makes of it.
 //     NICK nick
-func (conn *Conn) Nick(nick string) { conn.Raw(NICK + " " + nick) }
+func (conn *Conn) Nick(nick string) {
+	conn.Raw(NICK + " " + nick)
+	if st := conn.st; st != nil {
+		st.RequestNick(nick)
+	} else {
+		conn.cfg.Me.RequestedNick = nick
+	}
+}
 
 // User sends a USER command to the server.
 //     USER ident 12 * :name
@@ -106,82 +298,181 @@ func (conn *Conn) User(ident, name string) {
 }
 
 // Join sends a JOIN command to the server with an optional key.
+// If the state tracker is enabled, it returns a *LimitError if joining
+// would put us on more channels than the server's CHANLIMIT allows.
 //     JOIN channel [key]
-func (conn *Conn) Join(channel string, key ...string) {
+func (conn *Conn) Join(channel string, key ...string) error {
+	if f := strings.Fields(channel); len(f) > 0 {
+		if err := conn.checkChanLimit(f[0]); err != nil {
+			return err
+		}
+	}
 	k := ""
 	if len(key) > 0 {
 		k = " " + key[0]
+		if conn.cfg.RetryUnavailable > 0 {
+			conn.unavailMu.Lock()
+			conn.unavailTrack(conn.Casefold(channel)).key = key[0]
+			conn.unavailMu.Unlock()
+		}
 	}
 	conn.Raw(JOIN + " " + channel + k)
+	return nil
 }
 
 // Part sends a PART command to the server with an optional part message.
+// It returns a *NotOnChannelError if Config.ValidateTargets is set and we're
+// not on the channel.
 //     PART channel [:message]
-func (conn *Conn) Part(channel string, message ...string) {
+func (conn *Conn) Part(channel string, message ...string) error {
+	if err := conn.checkOn(PART, channel); err != nil {
+		return err
+	}
 	msg := strings.Join(message, " ")
 	if msg != "" {
 		msg = " :" + msg
 	}
 	conn.Raw(PART + " " + channel + msg)
+	return nil
 }
 
+// Names sends a NAMES command to the server.
+//     NAMES channel
+func (conn *Conn) Names(channel string) { conn.Raw(NAMES + " " + channel) }
+
 // Kick sends a KICK command to remove a nick from a channel.
+// It returns a *NotOnChannelError if Config.ValidateTargets is set and we're
+// not on the channel.
 //     KICK channel nick [:message]
-func (conn *Conn) Kick(channel, nick string, message ...string) {
+func (conn *Conn) Kick(channel, nick string, message ...string) error {
+	if err := conn.checkOn(KICK, channel); err != nil {
+		return err
+	}
 	msg := strings.Join(message, " ")
 	if msg != "" {
 		msg = " :" + msg
 	}
 	conn.Raw(KICK + " " + channel + " " + nick + msg)
+	return nil
 }
 
 // Quit sends a QUIT command to the server with an optional quit message.
+// The server closing the connection afterwards counts as DisconnectClosed
+// for Config.ShouldReconnect. If Config.FlushOnQuit is set, Quit returns
+// once the QUIT and everything queued before it has been sent.
 //     QUIT [:message]
 func (conn *Conn) Quit(message ...string) {
 	msg := strings.Join(message, " ")
 	if msg == "" {
 		msg = conn.cfg.QuitMessage
 	}
+	conn.setDisconnectReason(DisconnectClosed)
+	if !conn.cfg.FlushOnQuit || !conn.Connected() {
+		conn.Raw(QUIT + " :" + msg)
+		return
+	}
+	sent := make(chan struct{})
+	conn.quitMu.Lock()
+	conn.quitWaiters = append(conn.quitWaiters, sent)
+	conn.quitMu.Unlock()
+	timeout := time.After(quitFlushTimeout)
 	conn.Raw(QUIT + " :" + msg)
+	select {
+	case <-sent:
+	case <-timeout:
+		logging.Warn("irc.Quit(): send queue not flushed after %s, "+
+			"closing connection", quitFlushTimeout)
+		conn.Close()
+	}
+}
+
+// quitSent tells anyone waiting in Quit that line has been sent,
+// if it is a QUIT.
+func (conn *Conn) quitSent(line string) {
+	if strings.EqualFold(strings.SplitN(line, " ", 2)[0], QUIT) {
+		conn.quitDone()
+	}
+}
+
+// quitDone stops any calls to Quit waiting, either because their QUIT has
+// been sent or because the connection has been closed and it never will be.
+func (conn *Conn) quitDone() {
+	conn.quitMu.Lock()
+	defer conn.quitMu.Unlock()
+	for _, ch := range conn.quitWaiters {
+		close(ch)
+	}
+	conn.quitWaiters = nil
 }
 
 // Whois sends a WHOIS command to the server.
 //     WHOIS nick
 func (conn *Conn) Whois(nick string) { conn.Raw(WHOIS + " " + nick) }
 
+// WhoisMulti sends WHOIS commands for each of nicks, batching them into
+// comma-separated lists of as many as the server's TARGMAX allows for WHOIS.
+// If the server hasn't advertised a limit, a WHOIS is sent for each nick.
+//     WHOIS nick1,nick2,...
+func (conn *Conn) WhoisMulti(nicks []string) {
+	for _, t := range conn.targetBatches(WHOIS, nicks) {
+		conn.Whois(t)
+	}
+}
+
 // Who sends a WHO command to the server.
 //     WHO nick
 func (conn *Conn) Who(nick string) { conn.Raw(WHO + " " + nick) }
 
+// WhoMulti sends WHO commands for each of targets, batched as with
+// WhoisMulti using the server's TARGMAX for WHO.
+//     WHO target1,target2,...
+func (conn *Conn) WhoMulti(targets []string) {
+	for _, t := range conn.targetBatches(WHO, targets) {
+		conn.Who(t)
+	}
+}
+
+// Userhost sends a USERHOST command to the server.
+//     USERHOST nick [nick ...]
+func (conn *Conn) Userhost(nick ...string) {
+	conn.Raw(USERHOST + " " + strings.Join(nick, " "))
+}
+
 // Privmsg sends a PRIVMSG to the target nick or channel t.
 // If msg is longer than Config.SplitLen characters, multiple PRIVMSGs
 // will be sent to the target containing sequential parts of msg.
+// It returns a *ModeratedError if Config.WarnOnModeratedSend is set and
+// the server would drop the message because the channel is moderated.
 // PRIVMSG t :msg
-func (conn *Conn) Privmsg(t, msg string) {
+func (conn *Conn) Privmsg(t, msg string) error {
+	if err := conn.checkModerated(t); err != nil {
+		return err
+	}
 	prefix := PRIVMSG + " " + t + " :"
 	for _, s := range splitMessage(msg, conn.cfg.SplitLen) {
 		conn.Raw(prefix + s)
 	}
+	return nil
 }
 
 // Privmsgln is the variadic version of Privmsg that formats the message
 // that is sent to the target nick or channel t using the
 // fmt.Sprintln function.
 // Note: Privmsgln doesn't add the '\n' character at the end of the message.
-func (conn *Conn) Privmsgln(t string, a ...interface{}) {
+func (conn *Conn) Privmsgln(t string, a ...interface{}) error {
 	msg := fmt.Sprintln(a...)
 	// trimming the new-line character added by the fmt.Sprintln function,
 	// since it's irrelevant.
 	msg = msg[:len(msg)-1]
-	conn.Privmsg(t, msg)
+	return conn.Privmsg(t, msg)
 }
 
 // Privmsgf is the variadic version of Privmsg that formats the message
 // that is sent to the target nick or channel t using the
 // fmt.Sprintf function.
-func (conn *Conn) Privmsgf(t, format string, a ...interface{}) {
+func (conn *Conn) Privmsgf(t, format string, a ...interface{}) error {
 	msg := fmt.Sprintf(format, a...)
-	conn.Privmsg(t, msg)
+	return conn.Privmsg(t, msg)
 }
 
 // Notice sends a NOTICE to the target nick or channel t.
@@ -194,17 +485,46 @@ func (conn *Conn) Notice(t, msg string) {
 	}
 }
 
+// NoticeMulti sends a NOTICE with msg to each of targets, batching them
+// into comma-separated lists of as many as the server's TARGMAX allows for
+// NOTICE. If the server hasn't advertised a limit, a NOTICE is sent to each
+// target separately. Long messages are split as with Notice.
+//     NOTICE t1,t2,... :msg
+func (conn *Conn) NoticeMulti(targets []string, msg string) {
+	for _, t := range conn.targetBatches(NOTICE, targets) {
+		conn.Notice(t, msg)
+	}
+}
+
+// targetBatches joins targets into comma-separated lists of at most the
+// number of targets the server allows for cmd, or one each if it hasn't
+// said how many it allows.
+func (conn *Conn) targetBatches(cmd string, targets []string) []string {
+	n, ok := conn.TargMax(cmd)
+	if !ok {
+		n = 1
+	} else if n <= 0 {
+		n = len(targets)
+	}
+	var batches []string
+	for len(targets) > 0 {
+		if n > len(targets) {
+			n = len(targets)
+		}
+		batches = append(batches, strings.Join(targets[:n], ","))
+		targets = targets[n:]
+	}
+	return batches
+}
+
 // Ctcp sends a (generic) CTCP message to the target nick
 // or channel t, with an optional argument.
 //     PRIVMSG t :\001CTCP arg\001
 func (conn *Conn) Ctcp(t, ctcp string, arg ...string) {
 	// We need to split again here to ensure
 	for _, s := range splitMessage(strings.Join(arg, " "), conn.cfg.SplitLen) {
-		if s != "" {
-			s = " " + s
-		}
 		// Using Raw rather than PRIVMSG here to avoid double-split problems.
-		conn.Raw(PRIVMSG + " " + t + " :\001" + strings.ToUpper(ctcp) + s + "\001")
+		conn.Raw(PRIVMSG + " " + t + " :" + EncodeCTCP(ctcp, s))
 	}
 }
 
@@ -213,32 +533,49 @@ func (conn *Conn) Ctcp(t, ctcp string, arg ...string) {
 //     NOTICE t :\001CTCP arg\001
 func (conn *Conn) CtcpReply(t, ctcp string, arg ...string) {
 	for _, s := range splitMessage(strings.Join(arg, " "), conn.cfg.SplitLen) {
-		if s != "" {
-			s = " " + s
-		}
 		// Using Raw rather than NOTICE here to avoid double-split problems.
-		conn.Raw(NOTICE + " " + t + " :\001" + strings.ToUpper(ctcp) + s + "\001")
+		conn.Raw(NOTICE + " " + t + " :" + EncodeCTCP(ctcp, s))
 	}
 }
 
 // Version sends a CTCP "VERSION" to the target nick or channel t.
 func (conn *Conn) Version(t string) { conn.Ctcp(t, VERSION) }
 
-// Action sends a CTCP "ACTION" to the target nick or channel t.
-func (conn *Conn) Action(t, msg string) { conn.Ctcp(t, ACTION, msg) }
+// Action sends a CTCP "ACTION" to the target nick or channel t. Long
+// actions are split over several lines like Privmsg, each one a complete
+// ACTION no longer than SplitLen including the CTCP framing.
+func (conn *Conn) Action(t, msg string) {
+	splitLen := conn.cfg.SplitLen
+	if splitLen < 13 {
+		splitLen = defaultSplit
+	}
+	// "\001ACTION " and "\001" take up this much of each line
+	if splitLen -= len(ACTION) + 3; splitLen < 13 {
+		splitLen = 13
+	}
+	for _, s := range splitMessage(msg, splitLen) {
+		conn.Raw(PRIVMSG + " " + t + " :" + EncodeCTCP(ACTION, s))
+	}
+}
 
 // Topic() sends a TOPIC command for a channel.
 // If no topic is provided this requests that a 332 response is sent by the
 // server for that channel, which can then be handled to retrieve the current
-// channel topic. If a topic is provided the channel's topic will be set.
+// channel topic. If a topic is provided the channel's topic will be set, and
+// a *NotOnChannelError is returned if Config.ValidateTargets is set and we're
+// not on the channel.
 //     TOPIC channel
 //     TOPIC channel :topic
-func (conn *Conn) Topic(channel string, topic ...string) {
+func (conn *Conn) Topic(channel string, topic ...string) error {
 	t := strings.Join(topic, " ")
 	if t != "" {
+		if err := conn.checkOn(TOPIC, channel); err != nil {
+			return err
+		}
 		t = " :" + t
 	}
 	conn.Raw(TOPIC + " " + channel + t)
+	return nil
 }
 
 // Mode sends a MODE command for a target nick or channel t.
@@ -247,23 +584,121 @@ func (conn *Conn) Topic(channel string, topic ...string) {
 // with spaces and sent to the server. This allows e.g.
 //     conn.Mode("#channel", "+nsk", "mykey")
 //
+// Setting modes on a channel returns a *NotOnChannelError if
+// Config.ValidateTargets is set and we're not on the channel.
 //     MODE t
 //     MODE t modestring
-func (conn *Conn) Mode(t string, modestring ...string) {
+func (conn *Conn) Mode(t string, modestring ...string) error {
 	mode := strings.Join(modestring, " ")
 	if mode != "" {
+		if err := conn.checkOn(MODE, t); err != nil {
+			return err
+		}
 		mode = " " + mode
 	}
 	conn.Raw(MODE + " " + t + mode)
+	return nil
+}
+
+// Ban adds masks to a channel's ban list, sending as few MODE commands as
+// the server's MODES limit allows. It returns a *LimitError if there are more
+// masks than the server's MAXLIST allows for bans. Since the existing list
+// isn't known, the server may still refuse masks if the list is nearly full.
+// Like Mode, it returns a *NotOnChannelError if Config.ValidateTargets is set
+// and we're not on the channel.
+//     MODE channel +bbb mask1 mask2 mask3
+func (conn *Conn) Ban(channel string, masks ...string) error {
+	return conn.listModes(channel, 'b', true, masks)
+}
+
+// Unban removes masks from a channel's ban list, sending as few MODE
+// commands as the server's MODES limit allows.
+//     MODE channel -bbb mask1 mask2 mask3
+func (conn *Conn) Unban(channel string, masks ...string) error {
+	return conn.listModes(channel, 'b', false, masks)
+}
+
+// Op gives channel operator privileges to nicks, e.g. to auto-op a list of
+// users, sending as few MODE commands as the server's MODES limit allows.
+// Like Mode, it returns a *NotOnChannelError if Config.ValidateTargets is set
+// and we're not on the channel.
+//     MODE channel +ooo nick1 nick2 nick3
+func (conn *Conn) Op(channel string, nicks ...string) error {
+	return conn.privModes(channel, 'o', true, nicks)
+}
+
+// Deop takes channel operator privileges from nicks, as with Op.
+//     MODE channel -ooo nick1 nick2 nick3
+func (conn *Conn) Deop(channel string, nicks ...string) error {
+	return conn.privModes(channel, 'o', false, nicks)
+}
+
+// Voice gives voice to nicks, as with Op.
+//     MODE channel +vvv nick1 nick2 nick3
+func (conn *Conn) Voice(channel string, nicks ...string) error {
+	return conn.privModes(channel, 'v', true, nicks)
+}
+
+// Devoice takes voice from nicks, as with Op.
+//     MODE channel -vvv nick1 nick2 nick3
+func (conn *Conn) Devoice(channel string, nicks ...string) error {
+	return conn.privModes(channel, 'v', false, nicks)
+}
+
+// privModes gives or takes the channel privilege mode m from nicks.
+func (conn *Conn) privModes(channel string, m byte, add bool, nicks []string) error {
+	ops := make([]state.ModeOp, len(nicks))
+	for i, nick := range nicks {
+		ops[i] = state.ModeOp{Add: add, Mode: m, Arg: nick}
+	}
+	return conn.SetModes(channel, ops)
+}
+
+// SetModes sets or unsets the modes in ops on channel, sending as few MODE
+// commands as the server's MODES limit allows. Ops can be built by hand, or
+// parsed from a mode string with ParseModeChange, e.g. to op many nicks
+//     ops := ParseModeChange("+oooooo", nicks, conn.ModeTypes())
+// Like Mode, it returns a *NotOnChannelError if Config.ValidateTargets is set
+// and we're not on the channel.
+//     MODE channel +ooo-v nick1 nick2 nick3 nick4
+func (conn *Conn) SetModes(channel string, ops []ModeOp) error {
+	if err := conn.checkOn(MODE, channel); err != nil {
+		return err
+	}
+	conn.sendModes(channel, ops)
+	return nil
+}
+
+// listModes adds or removes masks from a channel's list mode m.
+func (conn *Conn) listModes(channel string, m byte, add bool, masks []string) error {
+	if err := conn.checkOn(MODE, channel); err != nil {
+		return err
+	}
+	if limit, modes, ok := conn.MaxList(m); ok && add && len(masks) > limit {
+		return &LimitError{Cmd: MODE, Token: "MAXLIST",
+			Target: fmt.Sprintf("%d masks for %s", len(masks), channel),
+			Chars:  modes, Limit: limit}
+	}
+	ops := make([]state.ModeOp, len(masks))
+	for i, mask := range masks {
+		ops[i] = state.ModeOp{Add: add, Mode: m, Arg: mask}
+	}
+	conn.sendModes(channel, ops)
+	return nil
 }
 
 // Away sends an AWAY command to the server.
 // If a message is provided it sets the client's away status with that message,
-// otherwise it resets the client's away status.
+// otherwise it resets the client's away status. Me().Away is updated when the
+// server confirms the change, at which point an AWAY_SET or AWAY_CLEARED event
+// is dispatched.
 //     AWAY
 //     AWAY :message
 func (conn *Conn) Away(message ...string) {
 	msg := strings.Join(message, " ")
+	conn.awayMu.Lock()
+	conn.awayMsg = msg
+	conn.awayMu.Unlock()
 	if msg != "" {
 		msg = " :" + msg
 	}
@@ -271,9 +706,15 @@ func (conn *Conn) Away(message ...string) {
 }
 
 // Invite sends an INVITE command to the server.
+// It returns a *NotOnChannelError if Config.ValidateTargets is set and we're
+// not on the channel.
 //     INVITE nick channel
-func (conn *Conn) Invite(nick, channel string) {
+func (conn *Conn) Invite(nick, channel string) error {
+	if err := conn.checkOn(INVITE, channel); err != nil {
+		return err
+	}
 	conn.Raw(INVITE + " " + nick + " " + channel)
+	return nil
 }
 
 // Oper sends an OPER command to the server.
@@ -3,6 +3,9 @@ package client
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/lfkeitel/goirc/state"
 )
 
 func TestCutNewLines(t *testing.T) {
@@ -65,6 +68,8 @@ func TestSplitMessage(t *testing.T) {
 		{"0123456789012345", 0, []string{"0123456789012345"}},
 		{"0123456789012345", 15, []string{"012345678901...", "2345"}},
 		{"0123456789012345", 16, []string{"0123456789012345"}},
+		// Splitting at splitLen mustn't break multi-byte runes.
+		{"aéééééééé", 15, []string{"aééééé...", "ééé"}},
 	}
 	for i, test := range tests {
 		out := splitMessage(test.in, test.sp)
@@ -85,6 +90,7 @@ func TestClientCommands(t *testing.T) {
 	c.Pass("password")
 	s.nc.Expect("PASS password")
 
+	s.st.EXPECT().RequestNick("test").Return(c.cfg.Me)
 	c.Nick("test")
 	s.nc.Expect("NICK test")
 
@@ -99,6 +105,9 @@ func TestClientCommands(t *testing.T) {
 	c.Join("#foo bar")
 	s.nc.Expect("JOIN #foo bar")
 
+	c.Names("#foo")
+	s.nc.Expect("NAMES #foo")
+
 	c.Part("#foo")
 	s.nc.Expect("PART #foo")
 	c.Part("#foo", "Screw you guys...")
@@ -115,6 +124,9 @@ func TestClientCommands(t *testing.T) {
 	c.Who("*@some.host.com")
 	s.nc.Expect("WHO *@some.host.com")
 
+	c.Userhost("somebody", "someone")
+	s.nc.Expect("USERHOST somebody someone")
+
 	c.Privmsg("#foo", "bar")
 	s.nc.Expect("PRIVMSG #foo :bar")
 
@@ -179,6 +191,13 @@ func TestClientCommands(t *testing.T) {
 	c.Action("#foo", "pokes somebody")
 	s.nc.Expect("PRIVMSG #foo :\001ACTION pokes somebody\001")
 
+	// Each part of a long ACTION is framed, and the framing counts
+	// towards SplitLen.
+	c.Action("#foo", "pokes somebody with a stick")
+	s.nc.Expect("PRIVMSG #foo :\001ACTION pokes ...\001")
+	s.nc.Expect("PRIVMSG #foo :\001ACTION somebody ...\001")
+	s.nc.Expect("PRIVMSG #foo :\001ACTION with a stick\001")
+
 	c.Topic("#foo")
 	s.nc.Expect("TOPIC #foo")
 	c.Topic("#foo", "la la la")
@@ -203,3 +222,277 @@ func TestClientCommands(t *testing.T) {
 	c.VHost("user", "pass")
 	s.nc.Expect("VHOST user pass")
 }
+
+func TestNoticeMulti(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Without TARGMAX, each target gets its own NOTICE.
+	c.NoticeMulti([]string{"#a", "#b"}, "hello")
+	s.nc.Expect("NOTICE #a :hello")
+	s.nc.Expect("NOTICE #b :hello")
+
+	c.h_005(ParseLine(":irc.server.org 005 test TARGMAX=PRIVMSG:4,NOTICE:2,JOIN: :are supported by this server"))
+	c.NoticeMulti([]string{"#a", "#b", "#c"}, "hello")
+	s.nc.Expect("NOTICE #a,#b :hello")
+	s.nc.Expect("NOTICE #c :hello")
+
+	c.cfg.SplitLen = 23
+	//                                        01234567890123456789012345678901234567
+	c.NoticeMulti([]string{"#a", "#b"}, "something much much longer that splits")
+	s.nc.Expect("NOTICE #a,#b :something much much ...")
+	s.nc.Expect("NOTICE #a,#b :longer that splits")
+
+	c.NoticeMulti(nil, "hello")
+	s.nc.ExpectNothing()
+
+	// An empty limit means there isn't one.
+	c.h_005(ParseLine(":irc.server.org 005 test TARGMAX=NOTICE: :are supported by this server"))
+	c.NoticeMulti([]string{"#a", "#b", "#c"}, "hello")
+	s.nc.Expect("NOTICE #a,#b,#c :hello")
+}
+
+func TestWhoisWhoMulti(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Without TARGMAX, each nick gets its own WHOIS and WHO.
+	c.WhoisMulti([]string{"user1", "user2"})
+	s.nc.Expect("WHOIS user1")
+	s.nc.Expect("WHOIS user2")
+	c.WhoMulti([]string{"user1", "user2"})
+	s.nc.Expect("WHO user1")
+	s.nc.Expect("WHO user2")
+
+	c.h_005(ParseLine(":irc.server.org 005 test TARGMAX=WHOIS:2,WHO:3 :are supported by this server"))
+	c.WhoisMulti([]string{"user1", "user2", "user3"})
+	s.nc.Expect("WHOIS user1,user2")
+	s.nc.Expect("WHOIS user3")
+	c.WhoMulti([]string{"user1", "user2", "user3"})
+	s.nc.Expect("WHO user1,user2,user3")
+
+	c.WhoisMulti(nil)
+	c.WhoMulti(nil)
+	s.nc.ExpectNothing()
+}
+
+func TestValidateTargets(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Without ValidateTargets, commands are sent regardless.
+	if err := c.Kick("#foo", "somebody"); err != nil {
+		t.Errorf("Kick returned error without ValidateTargets: %v", err)
+	}
+	s.nc.Expect("KICK #foo somebody")
+
+	c.cfg.ValidateTargets = true
+	s.st.EXPECT().GetChannel("#foo").Return(nil)
+	err := c.Kick("#foo", "somebody")
+	if e, ok := err.(*NotOnChannelError); !ok || e.Cmd != KICK || e.Channel != "#foo" {
+		t.Errorf("Kick on unknown channel returned wrong error: %v", err)
+	}
+	s.st.EXPECT().GetChannel("#foo").Return(nil)
+	if _, ok := c.Mode("#foo", "+o somebody").(*NotOnChannelError); !ok {
+		t.Errorf("Mode on unknown channel didn't return NotOnChannelError.")
+	}
+	s.nc.ExpectNothing()
+
+	// Querying modes or topics, or setting our own modes, isn't checked.
+	c.Mode("#foo")
+	s.nc.Expect("MODE #foo")
+	c.Mode("test", "+i")
+	s.nc.Expect("MODE test +i")
+	c.Topic("#foo")
+	s.nc.Expect("TOPIC #foo")
+
+	s.st.EXPECT().GetChannel("#bar").Return(&state.Channel{Name: "#bar"})
+	if err := c.Invite("somebody", "#bar"); err != nil {
+		t.Errorf("Invite on known channel returned error: %v", err)
+	}
+	s.nc.Expect("INVITE somebody #bar")
+
+	// Without state tracking the check is skipped.
+	c.st = nil
+	if err := c.Part("#foo"); err != nil {
+		t.Errorf("Part returned error without state tracking: %v", err)
+	}
+	s.nc.Expect("PART #foo")
+	c.st = s.st
+}
+
+func TestWarnOnModeratedSend(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Without WarnOnModeratedSend, messages are sent regardless.
+	if err := c.Privmsg("#foo", "hi"); err != nil {
+		t.Errorf("Privmsg returned error without WarnOnModeratedSend: %v", err)
+	}
+	s.nc.Expect("PRIVMSG #foo :hi")
+
+	c.cfg.WarnOnModeratedSend = true
+	moderated := &state.Channel{Name: "#foo",
+		Modes: &state.ChanMode{Moderated: true},
+		Nicks: map[string]*state.ChanPrivs{"test": {}}}
+	s.st.EXPECT().GetChannel("#foo").Return(moderated)
+	s.st.EXPECT().Me().Return(c.cfg.Me)
+	err := c.Privmsgf("#foo", "%s", "hi")
+	if e, ok := err.(*ModeratedError); !ok || e.Channel != "#foo" {
+		t.Errorf("Privmsg to moderated channel returned wrong error: %v", err)
+	}
+	s.nc.ExpectNothing()
+
+	// Voice, or the channel not being moderated, lets us speak.
+	moderated.Nicks["test"].Voice = true
+	s.st.EXPECT().GetChannel("#foo").Return(moderated)
+	s.st.EXPECT().Me().Return(c.cfg.Me)
+	if err := c.Privmsg("#foo", "hi"); err != nil {
+		t.Errorf("Privmsg with voice returned error: %v", err)
+	}
+	s.nc.Expect("PRIVMSG #foo :hi")
+	s.st.EXPECT().GetChannel("#bar").Return(&state.Channel{Name: "#bar",
+		Modes: &state.ChanMode{}})
+	if err := c.Privmsg("#bar", "hi"); err != nil {
+		t.Errorf("Privmsg to unmoderated channel returned error: %v", err)
+	}
+	s.nc.Expect("PRIVMSG #bar :hi")
+
+	// Messages to nicks aren't checked.
+	c.Privmsg("somebody", "hi")
+	s.nc.Expect("PRIVMSG somebody :hi")
+}
+
+func TestJoinChanLimit(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.h_005(ParseLine(":irc.server.org 005 test CHANLIMIT=#&:2 " +
+		":are supported by this server"))
+	me := &state.Nick{Nick: "test",
+		Channels: map[string]*state.ChanPrivs{"#foo": {}}}
+
+	// We're on one channel, so can join another, or rejoin the first.
+	s.st.EXPECT().Me().Return(me).Times(3)
+	if err := c.Join("&bar"); err != nil {
+		t.Errorf("Join returned unexpected error: %v", err)
+	}
+	s.nc.Expect("JOIN &bar")
+	if err := c.Join("#foo,+baz"); err != nil {
+		t.Errorf("Join returned unexpected error: %v", err)
+	}
+	s.nc.Expect("JOIN #foo,+baz")
+
+	// But not two more.
+	err := c.Join("#bar,#baz key1,key2")
+	if e, ok := err.(*LimitError); !ok || e.Token != "CHANLIMIT" ||
+		e.Target != "#baz" || e.Limit != 2 {
+		t.Errorf("Join over CHANLIMIT returned wrong error: %v", err)
+	}
+	s.nc.ExpectNothing()
+}
+
+func TestBan(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// By default, 3 modes are sent per line.
+	c.Ban("#foo", "a!*@*", "b!*@*", "c!*@*", "d!*@*")
+	s.nc.Expect("MODE #foo +bbb a!*@* b!*@* c!*@*")
+	s.nc.Expect("MODE #foo +b d!*@*")
+
+	c.h_005(ParseLine(":irc.server.org 005 test MODES=2 MAXLIST=beI:3 " +
+		":are supported by this server"))
+	c.Unban("#foo", "a!*@*", "b!*@*", "c!*@*", "d!*@*")
+	s.nc.Expect("MODE #foo -bb a!*@* b!*@*")
+	s.nc.Expect("MODE #foo -bb c!*@* d!*@*")
+
+	err := c.Ban("#foo", "a!*@*", "b!*@*", "c!*@*", "d!*@*")
+	if e, ok := err.(*LimitError); !ok || e.Token != "MAXLIST" || e.Limit != 3 {
+		t.Errorf("Ban over MAXLIST returned wrong error: %v", err)
+	}
+	s.nc.ExpectNothing()
+}
+
+func TestSetModes(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	nicks := []string{"a", "b", "c", "d"}
+	ops := state.ParseModeChange("+oooo-m+v", append(nicks, "e"), c.ModeTypes())
+	c.SetModes("#foo", ops)
+	s.nc.Expect("MODE #foo +ooo a b c")
+	s.nc.Expect("MODE #foo +o-m+v d e")
+
+	// MODES=0 means there's no limit.
+	c.h_005(ParseLine(":irc.server.org 005 test MODES= :are supported by this server"))
+	c.SetModes("#foo", ops)
+	s.nc.Expect("MODE #foo +oooo-m+v a b c d e")
+
+	// Channels we're not on are refused when validating targets.
+	c.cfg.ValidateTargets = true
+	s.st.EXPECT().GetChannel("#bar").Return(nil)
+	err := c.SetModes("#bar", ops)
+	if e, ok := err.(*NotOnChannelError); !ok || e.Channel != "#bar" {
+		t.Errorf("SetModes on unknown channel returned wrong error: %v", err)
+	}
+	s.nc.ExpectNothing()
+}
+
+func TestOpVoice(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// By default, 3 modes are sent per line.
+	c.Op("#foo", "a", "b", "c", "d", "e", "f", "g")
+	s.nc.Expect("MODE #foo +ooo a b c")
+	s.nc.Expect("MODE #foo +ooo d e f")
+	s.nc.Expect("MODE #foo +o g")
+	c.Devoice("#foo", "a", "b")
+	s.nc.Expect("MODE #foo -vv a b")
+
+	// Otherwise the advertised MODES limit is honoured.
+	c.h_005(ParseLine(":irc.server.org 005 test MODES=4 :are supported by this server"))
+	c.Deop("#foo", "a", "b", "c", "d", "e")
+	s.nc.Expect("MODE #foo -oooo a b c d")
+	s.nc.Expect("MODE #foo -o e")
+	c.Voice("#foo", "a", "b", "c", "d")
+	s.nc.Expect("MODE #foo +vvvv a b c d")
+
+	// Nothing is sent without any nicks.
+	c.Op("#foo")
+	s.nc.ExpectNothing()
+}
+
+func TestFlushOnQuit(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.cfg.FlushOnQuit = true
+	c.Privmsg("#foo", "Goodbye, cruel world!")
+	quit := callCheck(t)
+	go func() {
+		c.Quit()
+		quit.call()
+	}()
+	s.nc.Expect("PRIVMSG #foo :Goodbye, cruel world!")
+	s.nc.Expect("QUIT :GoBye!")
+	quit.assertWasCalled("Quit did not return after QUIT was sent.")
+	c.quitMu.Lock()
+	if len(c.quitWaiters) != 0 {
+		t.Errorf("Quit still waiting after QUIT was sent.")
+	}
+	c.quitMu.Unlock()
+
+	// Closing the connection stops Quit waiting for a QUIT never sent.
+	sent := make(chan struct{})
+	c.quitMu.Lock()
+	c.quitWaiters = append(c.quitWaiters, sent)
+	c.quitMu.Unlock()
+	c.Close()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Errorf("Quit still waiting after the connection was closed.")
+	}
+}
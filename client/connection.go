@@ -3,10 +3,13 @@ package client
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -40,9 +43,187 @@ type Conn struct {
 	sock        net.Conn
 	io          *bufio.ReadWriter
 	in          chan *Line
-	out         chan string
+	out         chan outLine
 	connected   bool
 
+	// ISUPPORT tokens sent by the server in 005 replies
+	supMu    sync.RWMutex
+	supports map[string]string
+	network  string     // guessed from 001 if Config.GuessNetwork is set
+	server   ServerInfo // from 004 and 351 replies
+	// channel limits learned from 405 replies, by channel prefix
+	chanLimits map[byte]int
+
+	// IRCv3 capabilities acknowledged by the server
+	capMu     sync.RWMutex
+	caps      map[string]bool
+	capsAvail map[string]string // advertised in CAP LS
+	capReqs   int               // CAP REQs awaiting ACK or NAK
+	capNeg    bool              // negotiating capabilities at registration
+
+	// SASL mechanisms from Config.SASLMechs left to try, those the server
+	// says it supports in 908 RPL_SASLMECHS, the one being tried now, and
+	// whether we've authenticated on this connection.
+	saslQueue []string
+	saslAvail []string
+	saslMech  string
+	saslDone  bool
+
+	// The nick we first registered with, which Config.RecoverNickAfterSASL
+	// tries to get back, and the nick we've sent a NICK to recover until
+	// the server refuses it.
+	recoverMu     sync.Mutex
+	preferredNick string
+	recovering    string
+
+	// Lines queued until registration completes,
+	// if Config.QueueUntilRegistered is set, and the channel Ready returns,
+	// which is closed once the server has sent its MOTD and, if
+	// Config.WaitForIdentify is set, we've identified to services.
+	regMu      sync.Mutex
+	registered bool
+	queued     []string
+	ready      chan struct{}
+	motdDone   bool
+	identified bool
+
+	// When we last sent automatic CTCP replies to each nick,
+	// if Config.CTCPReplyRateLimit is set, CTCP PINGs sent by
+	// CtcpPing that are waiting for a reply, by timestamp token, and
+	// when we last sent each nick a CTCP VERSION for Config.VersionOnJoin.
+	ctcpMu        sync.Mutex
+	ctcpLast      map[string]time.Time
+	ctcpPings     map[string]*ctcpPing
+	ctcpVersioned map[string]time.Time
+
+	// Channels waiting to be joined by JoinAll, the channel we're currently
+	// joining, and the handlers and timer waiting for the server's reply.
+	joinMu       sync.Mutex
+	joinQueue    []string
+	joining      string
+	joinRemovers []Remover
+	joinTimer    *time.Timer
+
+	// JOINs sent by JoinWait that are waiting for replies, by case-folded
+	// channel, and the handlers following their progress.
+	joinWaitMu       sync.Mutex
+	joinWaits        map[string]*joinWait
+	joinWaitRemovers []Remover
+
+	// Keys for channels we've sent JOINs for and how many times we've
+	// retried each after 437 ERR_UNAVAILRESOURCE, if Config.RetryUnavailable
+	// is set, by case-folded channel, and the handlers forgetting them once
+	// the JOIN succeeds or fails.
+	unavailMu       sync.Mutex
+	unavail         map[string]*unavailJoin
+	unavailRemovers []Remover
+
+	// The message sent with our last AWAY, for when the server confirms it.
+	awayMu  sync.Mutex
+	awayMsg string
+
+	// When we last told each target we're actively typing.
+	typingMu   sync.Mutex
+	typingLast map[string]time.Time
+
+	// Channels with Config.ChannelModeDefaults that we've just joined, by
+	// case-folded name, until 366 tells us whether we created them.
+	joinedMu sync.Mutex
+	joined   map[string]bool
+
+	// Channels we've just joined that we're waiting for replies about
+	// before dispatching CHANNEL_SYNCED, by casefolded name.
+	chanSyncMu sync.Mutex
+	chanSyncs  map[string]*chanSync
+
+	// Channels we've sent a JOIN for, by case-folded name, until the server
+	// confirms or refuses it, to tell our JOINs from forced ones, and the
+	// number of JOINs queued to be sent, for STATE_READY.
+	joinsMu     sync.Mutex
+	joinsSent   map[string]bool
+	joinsQueued int
+
+	// WHOIS requests made with RequestWhois that are waiting for replies,
+	// by case-folded nick, and the handlers collecting those replies.
+	whoisMu       sync.Mutex
+	whoisPending  map[string]*whoisReq
+	whoisRemovers []Remover
+
+	// WHOX requests made with WhoX that are waiting for replies, by token,
+	// the WHOX tokens of the WHOs we've sent that the server hasn't yet
+	// finished replying to, or "" for plain WHOs, by case-folded mask in
+	// the order they were sent, the handler collecting replies, and the
+	// last token used.
+	whoxMu       sync.Mutex
+	whoxPending  map[string]*whoxReq
+	whoxSent     map[string][]string
+	whoxRemovers []Remover
+	whoxToken    int
+
+	// The LUSERS sent by Lusers that's waiting for replies, if any.
+	lusersMu      sync.Mutex
+	lusersPending *lusersReq
+
+	// Listener for the built-in ident server, if Config.Identd is set.
+	identMu sync.Mutex
+	identLn net.Listener
+
+	// When unknownNicks last sent a WHO for each case-folded channel, if
+	// Config.UnknownNicks is UnknownNickWho.
+	unknownMu  sync.Mutex
+	unknownWho map[string]time.Time
+
+	// Nicks received in 281 RPL_ACCEPTLIST replies, until 282 ends the list.
+	acceptMu   sync.Mutex
+	acceptList []string
+
+	// Why we're about to be disconnected, if we know, how many times in a
+	// row we've tried to reconnect, and the timer for the next attempt.
+	reconnMu       sync.Mutex
+	discReason     DisconnectReason
+	reconnAttempts int
+	reconnTimer    timer
+
+	// Calls to Quit waiting for their QUIT to be sent, if Config.FlushOnQuit.
+	quitMu      sync.Mutex
+	quitWaiters []chan struct{}
+
+	// Per-source dispatch workers, if Config.DispatchWorkers > 0.
+	workers []chan *Line
+
+	// When we last received each msgid, if Config.DedupWindow > 0.
+	// Kept across reconnects.
+	dedupMu    sync.Mutex
+	dedupSeen  map[string]time.Time
+	dedupSwept time.Time
+
+	// Events held back from handlers while dispatch is paused, and whether
+	// ResumeDispatch is still delivering them.
+	pauseMu   sync.Mutex
+	paused    bool
+	replaying bool
+	pauseBuf  []*Line
+
+	// Lines sent while conn.out was full, waiting for send to make room,
+	// so that sending never blocks the caller, and low priority lines
+	// waiting for everything else to be sent first. Neither is bounded.
+	backlogMu  sync.Mutex
+	backlog    []outLine
+	lowBacklog []outLine
+
+	// Serialises writes to Config.Transcript from send and recv.
+	transcriptMu sync.Mutex
+
+	// The payload of the last PING sent by ping and when it was sent,
+	// until it's answered, a channel closed when it is, and the round trip
+	// time of the last one that was.
+	pingMu       sync.Mutex
+	pingSeq      uint64
+	pingToken    string
+	pingSent     time.Time
+	pingAnswered chan struct{}
+	lag          time.Duration
+
 	// Control channel and WaitGroup for goroutines
 	die chan struct{}
 	wg  sync.WaitGroup
@@ -52,6 +233,20 @@ type Conn struct {
 	lastsent time.Time
 }
 
+// FlushMode controls when lines written to the server are flushed from the
+// client's write buffer to the connection.
+type FlushMode int
+
+const (
+	// Flush each line as soon as it's written, for the lowest latency.
+	FlushEachLine FlushMode = iota
+	// Only flush once no more lines are waiting to be sent, so that lines
+	// sent in quick succession go out in fewer writes to the connection.
+	// Lines are still flushed before flood protection holds one back, and
+	// QUITs are always flushed straight away.
+	FlushBatch
+)
+
 // Config contains options that can be passed to Client to change the
 // behaviour of the library during use. It is recommended that NewConfig
 // is used to create this struct rather than instantiating one directly.
@@ -74,6 +269,13 @@ type Config struct {
 	SSL       bool
 	SSLConfig *tls.Config
 
+	// If set, IRCv3 STS policies advertised by servers are kept here, so
+	// that once a server has told us to use TLS, we keep doing so when
+	// connecting to it, even after restarting. The policy for the host in
+	// Server is applied when connecting, setting SSL and the port. See
+	// NewMemoryPolicyStore and NewFilePolicyStore.
+	PolicyStore PolicyStore
+
 	// To connect via proxy set the proxy url here.
 	// Changing these after connection will have no effect until the
 	// client reconnects.
@@ -82,14 +284,225 @@ type Config struct {
 	// Local address to bind to when connecting to the server.
 	LocalAddr string
 
+	// Address for a minimal built-in ident server (RFC 1413) to listen on,
+	// usually ":113", which some networks query while we connect. It only
+	// answers queries for our connection to the server, with Me.Ident, and
+	// is stopped when we disconnect. Listening on port 113 usually needs
+	// privileges, and only one client can listen on it at a time; if the
+	// listener can't be started a warning is logged and we connect anyway.
+	// To run ident elsewhere, see Conn.IdentPorts. Disabled by default.
+	Identd string
+
+	// IRCv3 capabilities to request from the server during registration.
+	// If any are set, the client sends CAP LS before registering, requests
+	// those capabilities the server advertises, then sends CAP END once the
+	// server has replied to every request. Use Conn.HasCapability to check
+	// which capabilities were acknowledged. Duplicates are ignored, and a
+	// warning is logged for any that aren't standard IRCv3 capabilities,
+	// vendor-specific ones like "znc.in/self-message", or in CustomCaps.
+	RequestCaps []string
+
+	// Set this to true to negotiate the draft/no-implicit-names capability,
+	// if the server advertises it, so that joining a channel doesn't send
+	// a NAMES reply. This saves a lot of traffic when joining very large
+	// channels. The state tracker then learns who is on a channel from the
+	// WHO it sends on joining instead, so until that reply arrives the
+	// channel appears empty, and if the server truncates or rate-limits
+	// WHO replies the membership will be incomplete. CHANNEL_SYNCED waits
+	// for the end of the WHO rather than of NAMES. On servers without the
+	// capability this has no effect.
+	SuppressNamesOnJoin bool
+
+	// SASL mechanisms to authenticate with while registering, in order of
+	// preference, e.g. []string{"EXTERNAL", "PLAIN"}. If any are set, the
+	// sasl capability is requested, and if the server doesn't support a
+	// mechanism or authentication with it fails, the next is tried. Once
+	// they're exhausted registration continues without authenticating.
+	// PLAIN and EXTERNAL are supported; EXTERNAL uses the TLS client
+	// certificate in SSLConfig.
+	SASLMechs []string
+
+	// The account name and password for SASL PLAIN.
+	SASLLogin, SASLPassword string
+
+	// Set this to true to try to get back the nick we first registered
+	// with once registration completes, if SASL authentication succeeded
+	// but we ended up with a nick from NewNick, e.g. because a ghost from
+	// an unclean disconnect held it. Many services release or recover the
+	// nick when its owner authenticates. If the server refuses the NICK
+	// with 433 or 437, we keep the nick we have instead of trying another.
+	RecoverNickAfterSASL bool
+
+	// Non-standard capabilities RequestCaps may contain without a warning.
+	CustomCaps []string
+
+	// Set this to true to request capabilities in RequestCaps even if the
+	// server did not advertise them. Each is requested separately, so that
+	// the server NAKing it does not prevent other capabilities from being
+	// acknowledged. By default unadvertised capabilities are not requested.
+	RequestUnadvertisedCaps bool
+
+	// Number of recent JOIN, PART, KICK, MODE and NICK events to keep for
+	// each channel when state tracking is enabled, retrievable with
+	// state.Channel.RecentEvents. Defaults to 0, i.e. none are kept. Unlike
+	// most of Config, this is only read when state tracking is enabled, so
+	// changing it later has no effect until tracking is disabled and then
+	// enabled again.
+	ChannelEventHistory int
+
+	// Set this to true to have the state tracker record when each nick last
+	// sent a PRIVMSG, NOTICE or ACTION to each channel we share with it, in
+	// state.ChanPrivs.LastActive. This costs a tracker update per message.
+	TrackActivity bool
+
+	// What the state tracker does when a MODE or KICK on a channel we're on
+	// comes from, or gives privileges to, a nick it doesn't know is on the
+	// channel, e.g. because a JOIN was missed while reconnecting. By default
+	// the nick is ignored. See UnknownNickPolicy.
+	UnknownNicks UnknownNickPolicy
+
+	// Nicks of network services, which set modes and kick on channels
+	// without being on them. UnknownNicks isn't applied to them, nor to
+	// servers. Defaults to ChanServ, NickServ, OperServ and BotServ.
+	ServiceNicks []string
+
+	// Maximum number of nicks and channels the state tracker keeps track of,
+	// to bound its memory use on large networks. Once over the limit, the
+	// least recently used nicks that we don't share a channel with are
+	// forgotten, as are the least recently used channels. A warning is
+	// logged for each. Defaults to 0, i.e. no limit. Like
+	// ChannelEventHistory, these are only read when state tracking is
+	// enabled.
+	MaxTrackedNicks, MaxTrackedChannels int
+
+	// If set, this overrides how nick and channel names are normalized
+	// before they're compared, both by Casefold and by the state tracker,
+	// for networks whose rules the standard CASEMAPPING values don't cover.
+	// By default names are case-folded according to CASEMAPPING.
+	Normalizer func(string) string
+
+	// Set this to true to have commands that act on a channel, like Kick
+	// and Mode, check that the state tracker thinks we're on the channel
+	// before sending them, returning a *NotOnChannelError if not. This
+	// saves a pointless round trip to get ERR_NOTONCHANNEL from the server.
+	// The check is skipped if state tracking is disabled.
+	ValidateTargets bool
+
+	// Set this to true to have Privmsg return a *ModeratedError rather than
+	// sending a message to a channel the state tracker says is moderated
+	// (+m) when we have no voice or higher privilege there, since the server
+	// would silently drop it. The check is skipped if state tracking is
+	// disabled.
+	WarnOnModeratedSend bool
+
+	// Modes to set on channels we create, by channel name, e.g.
+	//   ChannelModeDefaults: map[string]string{"#bots": "+nt"}
+	// A channel is taken to be newly created if we're its only member and
+	// we're an operator once its NAMES have arrived after we join it. This
+	// needs state tracking enabled.
+	ChannelModeDefaults map[string]string
+
+	// If set, periodically send a WHO for every channel we're on, to keep the
+	// away status and hosts of nicks fresh in the state tracker. The WHOs are
+	// skipped if the server has acknowledged both the away-notify and
+	// chghost capabilities, which keep this information fresh anyway.
+	WhoRefreshInterval time.Duration
+
+	// Set this to true to stop the client sending anything to the server
+	// other than the commands needed to register and keep the connection
+	// alive, i.e. PASS, NICK, USER, CAP, AUTHENTICATE, PING, PONG and QUIT.
+	// Other lines are logged and dispatched in DRY_RUN events instead, with
+	// the line that would have been sent in Args[0]. This is useful to test
+	// a bot's behaviour against a live server before letting it loose.
+	DryRun bool
+
+	// Set this to true to queue commands sent before registration with the
+	// server completes, sending them once we receive 001 RPL_WELCOME. This
+	// avoids e.g. JOINs being rejected because they were sent too early.
+	// Commands needed to register, like NICK and CAP, are never queued.
+	QueueUntilRegistered bool
+
+	// If set, the channel returned by Ready isn't closed until we've
+	// identified to services as well as received the MOTD, which is when
+	// a NOTICE sent to us by IdentifyNick matches this pattern, e.g.
+	//   regexp.MustCompile("You are now identified")
+	// or the server sends 900 RPL_LOGGEDIN. This stops a bot that
+	// identifies to NickServ itself from joining channels that need a
+	// registered nick too early. If we haven't identified IdentifyTimeout
+	// after the MOTD, a warning is logged and we're ready anyway.
+	WaitForIdentify *regexp.Regexp
+
+	// How long to wait to identify if WaitForIdentify is set.
+	// Defaults to 30 seconds if zero.
+	IdentifyTimeout time.Duration
+
+	// The nick of the services that tell us we've identified, for
+	// WaitForIdentify. NOTICEs from anyone else are ignored, so they can't
+	// be spoofed. Defaults to NickServ.
+	IdentifyNick string
+
+	// When we join a channel with state tracking enabled, a CHANNEL_SYNCED
+	// event is dispatched with the channel in Args[0] once the server has
+	// sent its members, modes, creation time and topic, so the channel
+	// returned by the state tracker is fully populated. If some of these
+	// never arrive, as some servers don't send them all, the event is sent
+	// anyway after ChannelSyncTimeout. Defaults to 5 seconds if zero.
+	ChannelSyncTimeout time.Duration
+
+	// With state tracking enabled, a STATE_READY event is dispatched after
+	// each connection once the channel returned by Ready is closed and
+	// every channel we've asked to join since, e.g. to rejoin channels
+	// after reconnecting, has been joined and synced or refused, so the
+	// state tracker can be trusted again. If that takes too long, the event
+	// is sent anyway after StateReadyTimeout. Defaults to 30 seconds if
+	// zero.
+	StateReadyTimeout time.Duration
+
+	// Set this to true to send a USERHOST for our own nick after registration
+	// if the server did not tell us our hostname in the 001 welcome message.
+	// This ensures Me().Host is populated even without state tracking.
+	ResolveOwnHost bool
+
+	// Set this to true to guess the network name from the 001 welcome message,
+	// e.g. "Welcome to the FooNet IRC Network", until the server sends its
+	// NETWORK ISUPPORT token. See Conn.Network.
+	GuessNetwork bool
+
+	// If set, the client marks itself away with this message as soon as it
+	// has registered, e.g. to signal that it is automated. Use Conn.Away
+	// with no message to come back.
+	AwayOnConnect string
+
+	// Raw lines sent in order as soon as the client has registered, after
+	// AwayOnConnect, like the "perform" list of traditional clients, e.g.
+	//   []string{"MODE mybot +B", "PRIVMSG NickServ :IDENTIFY secret"}
+	// They're subject to flood protection as usual. Passwords in IDENTIFY
+	// commands for IdentifyNick are masked in the debug log and Transcript,
+	// as for OnSendDelay; mask any others yourself, or use SASL. Lines containing a
+	// carriage return or newline are logged and skipped, rather than
+	// sending a truncated command.
+	OnConnect []string
+
 	// Replaceable function to customise the 433 handler's new nick.
 	// By default an underscore "_" is appended to the current nick.
+	// It's also used if the nick is temporarily unavailable with 437.
 	NewNick func(string) string
 
+	// If set, a JOIN refused with 437 ERR_UNAVAILRESOURCE because the
+	// channel is temporarily unavailable, e.g. after a netsplit, is retried
+	// after this long, up to three times, before JOIN_FAILED is dispatched.
+	// By default JOIN_FAILED is dispatched straight away.
+	RetryUnavailable time.Duration
+
 	// Client->server ping frequency, in seconds. Defaults to 3m.
 	// Set to 0 to disable client-side pings.
 	PingFreq time.Duration
 
+	// The payload of the PINGs sent every PingFreq. By default each PING
+	// has a unique token, which is matched against PONGs to measure Lag.
+	// Set this for servers that are picky about what they're sent.
+	PingPayload string
+
 	// The duration before a connection timeout is triggered. Defaults to 1m.
 	// Set to 0 to wait indefinitely.
 	Timeout time.Duration
@@ -97,12 +510,98 @@ type Config struct {
 	// Set this to true to disable flood protection and false to re-enable.
 	Flood bool
 
+	// When lines are flushed to the server. Defaults to FlushEachLine;
+	// FlushBatch saves syscalls when sending many lines at once.
+	WriteBufferFlush FlushMode
+
+	// If set, this is called after each line is sent to the server with
+	// how long it waited to be sent since it was queued, both behind other
+	// lines and held back by flood protection. It's called from the
+	// goroutine sending lines, so shouldn't block. Passwords in PASS,
+	// AUTHENTICATE, and IDENTIFY commands for IdentifyNick are masked.
+	OnSendDelay func(raw string, waited time.Duration)
+
+	// If set, every line sent to and received from the server is written
+	// here as it happens, prefixed with ">> " or "<< " respectively, e.g. to
+	// capture a session as a golden file for tests to replay. Passwords are
+	// masked as for OnSendDelay. Write errors are logged and otherwise
+	// ignored.
+	Transcript io.Writer
+
+	// Set this to true to bypass flood protection when the state tracker
+	// shows we are an IRC operator, or when sending to a channel where we
+	// hold any of the privileges in FloodExemptModes. Many servers exempt
+	// such users from flood limits. Requires state tracking.
+	FloodExemptWhenOp bool
+
+	// Channel privilege mode characters that exempt us from flood
+	// protection when FloodExemptWhenOp is set. Defaults to "qao".
+	FloodExemptModes string
+
+	// Set this to true to send the WHOs and WHOISes the state tracker uses
+	// to fill in nicks and channels with low priority, so they're only
+	// passed to flood protection once nothing else is waiting to be sent.
+	// This keeps a bot responsive while it backfills state, e.g. after
+	// joining several busy channels.
+	LowPriorityQueries bool
+
 	// Sent as the reply to a CTCP VERSION message.
 	Version string
 
+	// If set, CTCP TIME messages are answered with our local time in this
+	// layout for time.Format, e.g. time.RFC1123. Defaults to "", i.e. they
+	// aren't answered, since the reply gives away our timezone.
+	TimeFormat string
+
+	// If set, automatic replies to CTCP VERSION, PING and TIME are sent at most
+	// once per CTCPReplyRateLimit to each nick, to stop CTCP floods from
+	// getting us killed by the server's flood protection. Excess requests
+	// are dropped silently. Defaults to 0, i.e. every request is answered.
+	CTCPReplyRateLimit time.Duration
+
+	// Set this to true to send a CTCP VERSION to nicks that join channels
+	// we're on, e.g. to catalogue the clients people use. Requires state
+	// tracking, since replies are recorded in the nicks' ClientVersion; see
+	// Conn.ClientVersion. Each nick is asked at most once per
+	// VersionOnJoinWindow, which defaults to an hour, and nicks joining the
+	// channels in VersionOnJoinSkip aren't asked at all. The queries are
+	// subject to flood protection as usual.
+	VersionOnJoin       bool
+	VersionOnJoinWindow time.Duration
+	VersionOnJoinSkip   []string
+
 	// Sent as the default QUIT message if Quit is called with no args.
 	QuitMessage string
 
+	// Set this to true to have Quit wait until everything queued to be sent
+	// before the QUIT has gone out, so that messages sent just before
+	// quitting aren't lost. If the queue hasn't drained within 30 seconds
+	// the connection is closed without waiting any longer.
+	FlushOnQuit bool
+
+	// If set, this is called when the connection to the server is lost to
+	// decide whether to reconnect, and how long to wait first. It is passed
+	// why we were disconnected and the number of attempts made since we last
+	// registered successfully, starting at 1. It's also called if an attempt
+	// to reconnect fails. Handlers and state tracking are kept across
+	// reconnections. By default the client doesn't reconnect.
+	ShouldReconnect func(reason DisconnectReason, attempt int) (bool, time.Duration)
+
+	// If set, NOTICEs from the server and ERRORs whose text matches this
+	// pattern are taken to announce that the server is shutting down or
+	// restarting, e.g.
+	//   regexp.MustCompile(`(?i)server (is )?(shutting down|restarting|terminating)`)
+	// There's no standard wording, so by default nothing is recognised.
+	// A SERVER_SHUTDOWN event is dispatched with the text in Args[0], and
+	// ShouldReconnect is passed DisconnectServerShutdown when the server
+	// drops us. To fail over, a handler for SERVER_SHUTDOWN can change
+	// Server to a backup before the reconnection happens.
+	ShutdownPattern *regexp.Regexp
+
+	// Schedules reconnections and STATE_READY checks; replaced by tests to
+	// control time. If nil, the real clock is used.
+	clock clock
+
 	// Configurable panic recovery for all handlers.
 	// Defaults to logging an error, see LogPanic.
 	Recover func(*Conn, *Line)
@@ -110,6 +609,42 @@ type Config struct {
 	// Split PRIVMSGs, NOTICEs and CTCPs longer than SplitLen characters
 	// over multiple lines. Default to 450 if not set.
 	SplitLen int
+
+	// Dispatch lines to foreground handlers using this many worker
+	// goroutines. Lines are partitioned between workers by DispatchKey,
+	// so lines from the same source are handled in the order they were
+	// received while different sources are handled concurrently.
+	// Internal handlers, including state tracking, always run in order.
+	// Defaults to 0, which dispatches every line strictly in order.
+	DispatchWorkers int
+
+	// Replaceable function to choose the partition key for a line when
+	// DispatchWorkers > 0. By default lines are partitioned by source nick,
+	// or by server name for lines that have no nick.
+	DispatchKey func(*Line) string
+
+	// If set, a line received within DedupWindow of one with the same msgid
+	// tag isn't dispatched to handlers added with Handle, HandleBG or
+	// HandleFunc, so that bouncers replaying lines we've already seen, e.g.
+	// after a reconnect, don't get them handled twice. The internal
+	// handlers, including state tracking, still see every line, and lines
+	// without a msgid are never dropped. Defaults to 0, i.e. every line is
+	// dispatched.
+	DedupWindow time.Duration
+
+	// The number of events buffered while dispatch is paused with
+	// PauseDispatch, to be delivered by ResumeDispatch. Events received once
+	// the buffer is full are dropped. Defaults to 0, i.e. every event is
+	// dropped while paused.
+	PauseBuffer int
+
+	// Set this to true to dispatch our own JOINs, PARTs and NICKs, and our
+	// PRIVMSGs echoed back with echo-message, to handlers added with Handle
+	// and friends as SELF_JOIN, SELF_PART, SELF_NICK and SELF_PRIVMSG events
+	// instead, so that handlers for the usual events don't react to our own
+	// actions. Internal handlers, including state tracking, still see them
+	// as usual.
+	SuppressSelfEvents bool
 }
 
 // NewConfig creates a Config struct containing sensible defaults.
@@ -118,7 +653,7 @@ type Config struct {
 // name, but these are optional.
 func NewConfig(nick string, args ...string) *Config {
 	cfg := &Config{
-		Me:       &state.Nick{Nick: nick},
+		Me:       &state.Nick{Nick: nick, RequestedNick: nick},
 		PingFreq: 3 * time.Minute,
 		NewNick:  func(s string) string { return s + "_" },
 		Recover:  (*Conn).LogPanic, // in dispatch.go
@@ -135,6 +670,7 @@ func NewConfig(nick string, args ...string) *Config {
 	}
 	cfg.Version = "Powered by GoIRC"
 	cfg.QuitMessage = "GoBye!"
+	cfg.FloodExemptModes = "qao"
 	return cfg
 }
 
@@ -153,7 +689,7 @@ func Client(cfg *Config) *Conn {
 		cfg = NewConfig("__idiot__")
 	}
 	if cfg.Me == nil || cfg.Me.Nick == "" || cfg.Me.Ident == "" {
-		cfg.Me = &state.Nick{Nick: "__idiot__"}
+		cfg.Me = &state.Nick{Nick: "__idiot__", RequestedNick: "__idiot__"}
 		cfg.Me.Ident = "goirc"
 		cfg.Me.Name = "Powered by GoIRC"
 	}
@@ -174,13 +710,28 @@ func Client(cfg *Config) *Conn {
 	}
 
 	conn := &Conn{
-		cfg:         cfg,
-		dialer:      dialer,
-		intHandlers: handlerSet(),
-		fgHandlers:  handlerSet(),
-		bgHandlers:  handlerSet(),
-		stRemovers:  make([]Remover, 0, len(stHandlers)),
-		lastsent:    time.Now(),
+		cfg:          cfg,
+		dialer:       dialer,
+		intHandlers:  handlerSet(),
+		fgHandlers:   handlerSet(),
+		bgHandlers:   handlerSet(),
+		stRemovers:   make([]Remover, 0, len(stHandlers)),
+		ready:        make(chan struct{}),
+		supports:     make(map[string]string),
+		chanLimits:   make(map[byte]int),
+		caps:         make(map[string]bool),
+		ctcpLast:     make(map[string]time.Time),
+		ctcpPings:    make(map[string]*ctcpPing),
+		typingLast:   make(map[string]time.Time),
+		joinWaits:    make(map[string]*joinWait),
+		unavail:      make(map[string]*unavailJoin),
+		joined:       make(map[string]bool),
+		chanSyncs:    make(map[string]*chanSync),
+		joinsSent:    make(map[string]bool),
+		whoisPending: make(map[string]*whoisReq),
+		whoxPending:  make(map[string]*whoxReq),
+		whoxSent:     make(map[string][]string),
+		lastsent:     time.Now(),
 	}
 	conn.addIntHandlers()
 	return conn
@@ -195,6 +746,42 @@ func (conn *Conn) Connected() bool {
 	return conn.connected
 }
 
+// LocalAddr returns the local address of the connection to the server,
+// after any proxy or TLS handshake, or nil if we're not connected.
+func (conn *Conn) LocalAddr() net.Addr {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	if !conn.connected || conn.sock == nil {
+		return nil
+	}
+	return conn.sock.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the connection to the server,
+// or nil if we're not connected. When connecting through a proxy, this is
+// the proxy's address.
+func (conn *Conn) RemoteAddr() net.Addr {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	if !conn.connected || conn.sock == nil {
+		return nil
+	}
+	return conn.sock.RemoteAddr()
+}
+
+// TLSConnectionState returns details of the TLS connection to the server,
+// such as the version and cipher suite negotiated, and false if we're not
+// connected or not using TLS.
+func (conn *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	s, ok := conn.sock.(*tls.Conn)
+	if !conn.connected || !ok {
+		return tls.ConnectionState{}, false
+	}
+	return s.ConnectionState(), true
+}
+
 // Config returns a pointer to the Config struct used by the client.
 // Many of the elements of Config may be changed at any point to
 // affect client behaviour. To disable flood protection temporarily,
@@ -224,39 +811,83 @@ func (conn *Conn) StateTracker() state.Tracker {
 	return conn.st
 }
 
+// SharedChannels returns the channels that both we and nick are on, sorted,
+// according to the state tracker. It returns nil if state tracking is
+// disabled or the tracker doesn't know about nick.
+func (conn *Conn) SharedChannels(nick string) []string {
+	st := conn.st
+	if st == nil {
+		return nil
+	}
+	nk := st.GetNick(nick)
+	if nk == nil {
+		return nil
+	}
+	// We only track channels we're on, so all of nick's channels are shared.
+	channels := make([]string, 0, len(nk.Channels))
+	for ch := range nk.Channels {
+		channels = append(channels, ch)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
 // EnableStateTracking causes the client to track information about
 // all channels it is joined to, and all the nicks in those channels.
 // This can be rather handy for a number of bot-writing tasks. See
-// the state package for more details.
+// the state package for more details. A STATE_TRACKING_ENABLED event
+// is dispatched once tracking is enabled.
 //
-// NOTE: Calling this while connected to an IRC server may cause the
-// state tracker to become very confused all over STDERR if logging
-// is enabled. State tracking should enabled before connecting or
-// at a pinch while the client is not joined to any channels.
+// If the client is already connected, it will WHOIS itself to discover
+// the channels it is on, then request the modes and NAMES of each channel
+// so the tracker can be populated. Until these replies arrive the tracked
+// state will be incomplete, and there may be warnings all over STDERR if
+// logging is enabled, so it is best to enable state tracking before
+// connecting where possible.
 func (conn *Conn) EnableStateTracking() {
 	conn.mu.Lock()
-	defer conn.mu.Unlock()
-	if conn.st == nil {
-		n := conn.cfg.Me
-		conn.st = state.NewTracker(n.Nick)
-		conn.st.NickInfo(n.Nick, n.Ident, n.Host, n.Name)
-		conn.cfg.Me = conn.st.Me()
-		conn.addSTHandlers()
+	if conn.st != nil {
+		conn.mu.Unlock()
+		return
+	}
+	n := conn.cfg.Me
+	st := state.NewTracker(n.Nick)
+	st.SetEventHistory(conn.cfg.ChannelEventHistory)
+	st.SetLimits(conn.cfg.MaxTrackedNicks, conn.cfg.MaxTrackedChannels)
+	st.SetNormalizer(conn.Casefold)
+	conn.st = st
+	conn.st.NickInfo(n.Nick, n.Ident, n.Host, n.Name)
+	if n.RequestedNick != "" {
+		conn.st.RequestNick(n.RequestedNick)
+	}
+	conn.cfg.Me = conn.st.Me()
+	conn.addSTHandlers()
+	connected := conn.connected
+	conn.mu.Unlock()
+	if connected {
+		// 319 replies are handled by h_319 to populate our channels.
+		conn.query(WHOIS, n.Nick)
 	}
+	conn.dispatch(&Line{Cmd: STATE_TRACKING_ENABLED, Internal: true, Time: time.Now()})
 }
 
 // DisableStateTracking causes the client to stop tracking information
 // about the channels and nicks it knows of. It will also wipe current
-// state from the state tracker.
+// state from the state tracker. A STATE_TRACKING_DISABLED event is
+// dispatched once tracking is disabled. It is safe to call this while
+// connected to a server.
 func (conn *Conn) DisableStateTracking() {
 	conn.mu.Lock()
-	defer conn.mu.Unlock()
-	if conn.st != nil {
-		conn.cfg.Me = conn.st.Me()
-		conn.delSTHandlers()
-		conn.st.Wipe()
-		conn.st = nil
+	if conn.st == nil {
+		conn.mu.Unlock()
+		return
 	}
+	conn.cfg.Me = conn.st.Me()
+	conn.delSTHandlers()
+	conn.st.Wipe()
+	conn.st = nil
+	conn.mu.Unlock()
+	conn.dispatch(&Line{Cmd: STATE_TRACKING_DISABLED, Internal: true, Time: time.Now()})
 }
 
 // Per-connection state initialisation.
@@ -264,8 +895,63 @@ func (conn *Conn) initialise() {
 	conn.io = nil
 	conn.sock = nil
 	conn.in = make(chan *Line, 32)
-	conn.out = make(chan string, 32)
+	conn.out = make(chan outLine, 32)
+	conn.backlogMu.Lock()
+	conn.backlog, conn.lowBacklog = nil, nil
+	conn.backlogMu.Unlock()
 	conn.die = make(chan struct{})
+	conn.supMu.Lock()
+	conn.supports = make(map[string]string)
+	conn.network = ""
+	conn.server = ServerInfo{}
+	conn.chanLimits = make(map[byte]int)
+	conn.supMu.Unlock()
+	conn.capMu.Lock()
+	conn.caps = make(map[string]bool)
+	conn.capsAvail = make(map[string]string)
+	conn.capReqs, conn.capNeg = 0, false
+	conn.saslQueue, conn.saslAvail, conn.saslMech = nil, nil, ""
+	conn.saslDone = false
+	conn.capMu.Unlock()
+	conn.recoverMu.Lock()
+	conn.recovering = ""
+	conn.recoverMu.Unlock()
+	// Lines queued before we connected are kept to be sent after 001.
+	conn.regMu.Lock()
+	conn.registered = false
+	conn.motdDone, conn.identified = false, false
+	conn.regMu.Unlock()
+	// Nothing from the last connection's replies is still in progress.
+	conn.joinedMu.Lock()
+	conn.joined = make(map[string]bool)
+	conn.joinedMu.Unlock()
+	conn.chanSyncMu.Lock()
+	conn.chanSyncs = make(map[string]*chanSync)
+	conn.chanSyncMu.Unlock()
+	conn.joinsMu.Lock()
+	conn.joinsSent = make(map[string]bool)
+	conn.joinsQueued = 0
+	conn.joinsMu.Unlock()
+	conn.whoxMu.Lock()
+	conn.whoxSent = make(map[string][]string)
+	conn.whoxMu.Unlock()
+	conn.unknownMu.Lock()
+	conn.unknownWho = nil
+	conn.unknownMu.Unlock()
+	conn.acceptMu.Lock()
+	conn.acceptList = nil
+	conn.acceptMu.Unlock()
+	conn.pingMu.Lock()
+	conn.pingToken, conn.pingAnswered, conn.lag = "", nil, 0
+	conn.pingMu.Unlock()
+	// Unless we're told otherwise, a disconnection will be a network error.
+	conn.reconnMu.Lock()
+	conn.discReason = DisconnectNetwork
+	conn.reconnMu.Unlock()
+	conn.workers = nil
+	for i := 0; i < conn.cfg.DispatchWorkers; i++ {
+		conn.workers = append(conn.workers, make(chan *Line, 32))
+	}
 	if conn.st != nil {
 		conn.st.Wipe()
 	}
@@ -300,7 +986,7 @@ func (conn *Conn) Connect() error {
 	// so the connect mechanics have been delegated to internalConnect.
 	err := conn.internalConnect()
 	if err == nil {
-		conn.dispatch(&Line{Cmd: REGISTER, Time: time.Now()})
+		conn.dispatch(&Line{Cmd: REGISTER, Internal: true, Time: time.Now()})
 	}
 	return err
 }
@@ -325,6 +1011,18 @@ func (conn *Conn) internalConnect() error {
 			conn.cfg.Server = net.JoinHostPort(conn.cfg.Server, "6667")
 		}
 	}
+	conn.applySTS()
+
+	if conn.cfg.Identd != "" {
+		if err := conn.startIdentd(); err != nil {
+			logging.Warn("irc.Connect(): Not running identd: %v", err)
+		}
+		defer func() {
+			if !conn.connected {
+				conn.stopIdentd()
+			}
+		}()
+	}
 
 	if conn.cfg.Proxy != "" {
 		proxyURL, err := url.Parse(conn.cfg.Proxy)
@@ -379,6 +1077,14 @@ func (conn *Conn) postConnect(start bool) {
 			conn.wg.Add(1)
 			go conn.ping()
 		}
+		if conn.cfg.WhoRefreshInterval > 0 {
+			conn.wg.Add(1)
+			go conn.whoRefresh()
+		}
+		for _, w := range conn.workers {
+			conn.wg.Add(1)
+			go conn.worker(w)
+		}
 	}
 }
 
@@ -394,14 +1100,16 @@ func hasPort(s string) bool {
 func (conn *Conn) send() {
 	for {
 		select {
-		case line := <-conn.out:
-			if err := conn.write(line); err != nil {
+		case o := <-conn.out:
+			if err := conn.write(o.line, o.queued); err != nil {
 				logging.Error("irc.send(): %s", err.Error())
-				// We can't defer this, because Close() waits for it.
+				// We can't defer this, because close() waits for it.
 				conn.wg.Done()
-				conn.Close()
+				conn.close()
 				return
 			}
+			conn.quitSent(o.line)
+			conn.refill()
 		case <-conn.die:
 			// control channel closed, bail out
 			conn.wg.Done()
@@ -411,8 +1119,10 @@ func (conn *Conn) send() {
 }
 
 // recv is started as a goroutine after a connection is established.
-// It receives "\r\n" terminated lines from the server, parses them into
-// Lines, and sends them to the input channel.
+// It receives "\r\n" or "\n" terminated lines from the server, parses them
+// into Lines, and sends them to the input channel. Lines are buffered until
+// the terminator arrives, so those split across reads (even mid-rune) are
+// reassembled intact. Blank lines are ignored.
 func (conn *Conn) recv() {
 	for {
 		s, err := conn.io.ReadString('\n')
@@ -420,15 +1130,19 @@ func (conn *Conn) recv() {
 			if err != io.EOF {
 				logging.Error("irc.recv(): %s", err.Error())
 			}
-			// We can't defer this, because Close() waits for it.
+			// We can't defer this, because close() waits for it.
 			conn.wg.Done()
-			conn.Close()
+			conn.close()
 			return
 		}
 		s = strings.Trim(s, "\r\n")
+		if s == "" {
+			continue
+		}
 		logging.Debug("<- %s", s)
+		conn.transcribe("<< ", s)
 
-		if line := ParseLine(s); line != nil {
+		if line := parseLine(s, conn.HasCapability("identify-msg")); line != nil {
 			line.Time = time.Now()
 			conn.in <- line
 		} else {
@@ -445,7 +1159,27 @@ func (conn *Conn) ping() {
 	for {
 		select {
 		case <-tick.C:
-			conn.Ping(fmt.Sprintf("%d", time.Now().UnixNano()))
+			payload, _ := conn.pingPayload()
+			conn.Ping(payload)
+		case <-conn.die:
+			// control channel closed, bail out
+			tick.Stop()
+			return
+		}
+	}
+}
+
+// whoRefresh is started as a goroutine after a connection is established, as
+// long as Config.WhoRefreshInterval > 0. Every interval it sends a WHO for
+// each channel we're on, unless the server's capabilities make it pointless.
+// The WHOs are sent through the usual flood control.
+func (conn *Conn) whoRefresh() {
+	defer conn.wg.Done()
+	tick := time.NewTicker(conn.cfg.WhoRefreshInterval)
+	for {
+		select {
+		case <-tick.C:
+			conn.refreshWho()
 		case <-conn.die:
 			// control channel closed, bail out
 			tick.Stop()
@@ -454,6 +1188,18 @@ func (conn *Conn) ping() {
 	}
 }
 
+// refreshWho sends a WHO for each channel the state tracker knows we're on.
+func (conn *Conn) refreshWho() {
+	st := conn.st
+	if st == nil ||
+		(conn.HasCapability("away-notify") && conn.HasCapability("chghost")) {
+		return
+	}
+	for ch := range st.Me().Channels {
+		conn.query(WHO, ch)
+	}
+}
+
 // runLoop is started as a goroutine after a connection is established.
 // It pulls Lines from the input channel and dispatches them to any
 // handlers that have been registered for that IRC verb.
@@ -462,7 +1208,11 @@ func (conn *Conn) runLoop() {
 	for {
 		select {
 		case line := <-conn.in:
-			conn.dispatch(line)
+			if len(conn.workers) > 0 {
+				conn.dispatchPartitioned(line)
+			} else {
+				conn.dispatch(line)
+			}
 		case <-conn.die:
 			// control channel closed, bail out
 			return
@@ -471,10 +1221,26 @@ func (conn *Conn) runLoop() {
 }
 
 // write writes a \r\n terminated line of output to the connected server,
-// using Hybrid's algorithm to rate limit if conn.cfg.Flood is false.
-func (conn *Conn) write(line string) error {
-	if !conn.cfg.Flood {
+// using Hybrid's algorithm to rate limit if conn.cfg.Flood is false. The
+// line was queued to be sent at queued, or just now if that's zero.
+func (conn *Conn) write(line string, queued time.Time) error {
+	conn.joinQueued(line, -1)
+	if conn.cfg.DryRun && !essential(line) {
+		logging.Info("irc.DryRun(): not sending %s", line)
+		// Handlers may send lines themselves, so don't block send() on them.
+		go conn.dispatch(&Line{Cmd: DRY_RUN, Internal: true, Raw: line,
+			Args: []string{line}, Time: time.Now()})
+		return nil
+	}
+	if queued.IsZero() {
+		queued = time.Now()
+	}
+	if !conn.cfg.Flood && !conn.floodExempt(line) {
 		if t := conn.rateLimit(len(line)); t != 0 {
+			// don't hold back lines already written while we sleep
+			if err := conn.io.Flush(); err != nil {
+				return err
+			}
 			// sleep for the current line's time value before sending it
 			logging.Info("irc.rateLimit(): Flood! Sleeping for %.2f secs.",
 				t.Seconds())
@@ -482,19 +1248,252 @@ func (conn *Conn) write(line string) error {
 		}
 	}
 
+	conn.whoSent(line)
+	conn.joinSent(line)
 	if _, err := conn.io.WriteString(line + "\r\n"); err != nil {
 		return err
 	}
-	if err := conn.io.Flush(); err != nil {
-		return err
-	}
-	if strings.HasPrefix(line, "PASS") {
-		line = "PASS **************"
+	if conn.cfg.WriteBufferFlush != FlushBatch || len(conn.out) == 0 ||
+		strings.HasPrefix(line, QUIT) {
+		if err := conn.io.Flush(); err != nil {
+			return err
+		}
 	}
+	line = conn.mask(line)
 	logging.Debug("-> %s", line)
+	conn.transcribe(">> ", line)
+	if f := conn.cfg.OnSendDelay; f != nil {
+		f(line, time.Since(queued))
+	}
 	return nil
 }
 
+// mask returns line with any password in it masked, for logging: those in
+// PASS and AUTHENTICATE, and in IDENTIFY commands for Config.IdentifyNick.
+//   PRIVMSG NickServ :IDENTIFY [account] password
+//   NICKSERV IDENTIFY [account] password
+func (conn *Conn) mask(line string) string {
+	const masked = "**************"
+	if strings.HasPrefix(line, "PASS") {
+		return "PASS " + masked
+	}
+	if arg := strings.TrimPrefix(line, AUTHENTICATE+" "); arg != line &&
+		arg != "+" && !saslMechs[arg] {
+		return AUTHENTICATE + " " + masked
+	}
+	f := strings.SplitN(line, " ", 3)
+	var text string
+	switch strings.ToUpper(f[0]) {
+	case PRIVMSG:
+		if len(f) < 3 || conn.Casefold(strings.SplitN(f[1], "@", 2)[0]) !=
+			conn.Casefold(conn.identifyNick()) {
+			return line
+		}
+		text = f[2]
+	case "NICKSERV", "NS":
+		if len(f) < 2 {
+			return line
+		}
+		text = strings.Join(f[1:], " ")
+	default:
+		return line
+	}
+	const identify = "IDENTIFY "
+	text = strings.TrimPrefix(text, ":")
+	if len(text) <= len(identify) || !strings.EqualFold(text[:len(identify)], identify) {
+		return line
+	}
+	// text is the end of line
+	return line[:len(line)-len(text)+len(identify)] + masked
+}
+
+// transcribe writes a line sent or received to Config.Transcript, if set.
+func (conn *Conn) transcribe(prefix, line string) {
+	w := conn.cfg.Transcript
+	if w == nil {
+		return
+	}
+	conn.transcriptMu.Lock()
+	defer conn.transcriptMu.Unlock()
+	if _, err := io.WriteString(w, prefix+line+"\n"); err != nil {
+		logging.Warn("irc.Transcript(): %s", err)
+	}
+}
+
+// Ready returns a channel that's closed once registration with the server
+// has completed and it has sent its MOTD, or 422 ERR_NOMOTD if it has none,
+// which is when most servers are ready for us to join channels. If
+// Config.WaitForIdentify is set, it also waits for us to identify. Each
+// connection gets a new channel, so Ready should be called again after
+// disconnecting; the channel it returns then is closed once the next
+// connection is ready.
+func (conn *Conn) Ready() <-chan struct{} {
+	conn.regMu.Lock()
+	defer conn.regMu.Unlock()
+	return conn.ready
+}
+
+// setReady closes the channel returned by Ready, if it isn't already.
+func (conn *Conn) setReady() {
+	conn.regMu.Lock()
+	select {
+	case <-conn.ready:
+		conn.regMu.Unlock()
+		return
+	default:
+		close(conn.ready)
+	}
+	conn.regMu.Unlock()
+	conn.awaitStateReady()
+}
+
+// outLine is a line waiting to be sent, and when it was queued.
+type outLine struct {
+	line   string
+	queued time.Time
+}
+
+// priority says whether a line may be held back behind others sent later.
+type priority int
+
+const (
+	prioNormal priority = iota
+	// Low priority lines are only passed to send when nothing else is
+	// waiting, one at a time, so they never delay more than one line.
+	prioLow
+)
+
+// enqueue passes line to send via conn.out without blocking, adding it to
+// the backlog if conn.out is full or lines are already waiting there. Low
+// priority lines go to their own backlog until send is otherwise idle.
+func (conn *Conn) enqueue(line string, prio priority) {
+	conn.joinQueued(line, 1)
+	o := outLine{line, time.Now()}
+	conn.backlogMu.Lock()
+	defer conn.backlogMu.Unlock()
+	if prio == prioLow {
+		conn.lowBacklog = append(conn.lowBacklog, o)
+		conn.trickle()
+		return
+	}
+	if len(conn.backlog) == 0 {
+		select {
+		case conn.out <- o:
+			return
+		default:
+		}
+	}
+	conn.backlog = append(conn.backlog, o)
+}
+
+// refill moves as many lines from the backlog to conn.out as fit. It's
+// called by send after each line it takes, so the backlog can't be left
+// waiting while conn.out is empty.
+func (conn *Conn) refill() {
+	conn.backlogMu.Lock()
+	defer conn.backlogMu.Unlock()
+	for len(conn.backlog) > 0 {
+		select {
+		case conn.out <- conn.backlog[0]:
+			conn.backlog = conn.backlog[1:]
+		default:
+			return
+		}
+	}
+	conn.backlog = nil
+	conn.trickle()
+}
+
+// trickle passes the next low priority line to send if nothing else is
+// waiting to be sent. conn.backlogMu must be held.
+func (conn *Conn) trickle() {
+	if len(conn.lowBacklog) == 0 || len(conn.backlog) > 0 || len(conn.out) > 0 {
+		return
+	}
+	select {
+	case conn.out <- conn.lowBacklog[0]:
+		conn.lowBacklog = conn.lowBacklog[1:]
+	default:
+	}
+	if len(conn.lowBacklog) == 0 {
+		conn.lowBacklog = nil
+	}
+}
+
+// query sends a WHO or WHOIS for target on behalf of the state tracker,
+// with low priority if Config.LowPriorityQueries is set.
+func (conn *Conn) query(cmd, target string) {
+	prio := prioNormal
+	if conn.cfg.LowPriorityQueries {
+		prio = prioLow
+	}
+	conn.raw(cmd+" "+target, prio)
+}
+
+// queue holds on to line until registration completes if
+// Config.QueueUntilRegistered is set, returning true if it did so.
+func (conn *Conn) queue(line string) bool {
+	if !conn.cfg.QueueUntilRegistered || essential(line) {
+		return false
+	}
+	conn.regMu.Lock()
+	defer conn.regMu.Unlock()
+	if conn.registered {
+		return false
+	}
+	conn.queued = append(conn.queued, line)
+	return true
+}
+
+// flushQueued marks registration as complete and sends any lines queued
+// while registering. The lock is held while sending to preserve ordering.
+func (conn *Conn) flushQueued() {
+	conn.regMu.Lock()
+	defer conn.regMu.Unlock()
+	conn.registered = true
+	for _, line := range conn.queued {
+		conn.enqueue(line, prioNormal)
+	}
+	conn.queued = nil
+}
+
+// essential returns true if line is needed to register with the server or
+// keep the connection alive, and so must be sent even with Config.DryRun
+// and never queued with Config.QueueUntilRegistered.
+func essential(line string) bool {
+	cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+	switch cmd {
+	case PASS, NICK, USER, CAP, AUTHENTICATE, PING, PONG, QUIT:
+		return true
+	}
+	return false
+}
+
+// floodExempt returns true if Config.FloodExemptWhenOp is set and the state
+// tracker says we are an oper, or privileged in every channel line is sent to.
+func (conn *Conn) floodExempt(line string) bool {
+	// DisableStateTracking may nil conn.st while we're in here.
+	st := conn.st
+	if !conn.cfg.FloodExemptWhenOp || st == nil {
+		return false
+	}
+	me := st.Me()
+	if me.Modes != nil && me.Modes.Oper {
+		return true
+	}
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return false
+	}
+	for _, target := range strings.Split(f[1], ",") {
+		cp, _ := st.IsOn(target, me.Nick)
+		if !cp.HasAny(conn.cfg.FloodExemptModes) {
+			return false
+		}
+	}
+	return true
+}
+
 // rateLimit implements Hybrid's flood control algorithm for outgoing lines.
 func (conn *Conn) rateLimit(chars int) time.Duration {
 	// Hybrid's algorithm allows for 2 seconds per line and an additional
@@ -514,10 +1513,19 @@ func (conn *Conn) rateLimit(chars int) time.Duration {
 	return 0
 }
 
-// Close tears down all connection-related state. It is called when either
-// the sending or receiving goroutines encounter an error.
-// It may also be used to forcibly shut down the connection to the server.
+// Close tears down all connection-related state.
+// It may be used to forcibly shut down the connection to the server,
+// and cancels any pending reconnection.
 func (conn *Conn) Close() error {
+	conn.setDisconnectReason(DisconnectClosed)
+	conn.stopReconnecting()
+	return conn.close()
+}
+
+// close does the work for Close. It is called directly when either the
+// sending or receiving goroutines encounter an error, after which
+// Config.ShouldReconnect may have us reconnect.
+func (conn *Conn) close() error {
 	// Guard against double-call of Close() if we get an error in send()
 	// as calling sock.Close() will cause recv() to receive EOF in readstring()
 	conn.mu.Lock()
@@ -528,6 +1536,7 @@ func (conn *Conn) Close() error {
 	logging.Info("irc.Close(): Disconnected from server.")
 	conn.connected = false
 	err := conn.sock.Close()
+	conn.stopIdentd()
 	close(conn.die)
 	// Drain both in and out channels to avoid a deadlock if the buffers
 	// have filled. See TestSendDeadlockOnFullBuffer in connection_test.go.
@@ -535,12 +1544,40 @@ func (conn *Conn) Close() error {
 	conn.drainOut()
 	conn.wg.Wait()
 	conn.mu.Unlock()
+	conn.abandon()
+	conn.regMu.Lock()
+	select {
+	case <-conn.ready:
+		// the connection was ready, so the next one needs a new channel;
+		// otherwise anyone waiting on it is waiting for the next one
+		conn.ready = make(chan struct{})
+	default:
+	}
+	conn.regMu.Unlock()
 	// Dispatch after closing connection but before reinit
 	// so event handlers can still access state information.
-	conn.dispatch(&Line{Cmd: DISCONNECTED, Time: time.Now()})
+	conn.dispatch(&Line{Cmd: DISCONNECTED, Internal: true, Time: time.Now()})
+	conn.reconnMu.Lock()
+	reason := conn.discReason
+	conn.reconnMu.Unlock()
+	conn.maybeReconnect(reason)
 	return err
 }
 
+// ErrDisconnected is the error given to requests still waiting for the
+// server's replies when the connection is closed.
+var ErrDisconnected = errors.New("irc: disconnected before the server replied")
+
+// abandon fails the requests still waiting for the server's replies when
+// the connection is closed, since they won't get them now.
+func (conn *Conn) abandon() {
+	conn.whoxFail(ErrDisconnected)
+	conn.whoisFail(ErrDisconnected)
+	conn.joinWaitFail(ErrDisconnected)
+	conn.ctcpPingFail()
+	conn.quitDone()
+}
+
 // drainIn sends all data buffered in conn.in to /dev/null.
 func (conn *Conn) drainIn() {
 	for {
@@ -552,8 +1589,14 @@ func (conn *Conn) drainIn() {
 	}
 }
 
-// drainOut does the same for conn.out. Generics!
+// drainOut does the same for conn.out and the backlog. Generics!
 func (conn *Conn) drainOut() {
+	conn.backlogMu.Lock()
+	conn.backlog, conn.lowBacklog = nil, nil
+	conn.backlogMu.Unlock()
+	conn.joinsMu.Lock()
+	conn.joinsQueued = 0
+	conn.joinsMu.Unlock()
 	for {
 		select {
 		case <-conn.out:
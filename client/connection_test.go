@@ -1,6 +1,10 @@
 package client
 
 import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
 	"testing"
@@ -155,8 +159,8 @@ func TestClientAndStateTracking(t *testing.T) {
 
 	// Finally, check state tracking handlers were all removed correctly
 	for k, _ := range stHandlers {
-		if _, ok := c.intHandlers.set[strings.ToLower(k)]; ok && k != "NICK" {
-			// A bit leaky, because intHandlers adds a NICK handler.
+		if _, ok := c.intHandlers.set[strings.ToLower(k)]; ok && intHandlers[k] == nil {
+			// A bit leaky, because intHandlers adds e.g. a NICK handler.
 			t.Errorf("State handler for '%s' not removed correctly.", k)
 		}
 	}
@@ -166,6 +170,80 @@ func TestClientAndStateTracking(t *testing.T) {
 	ctrl.Finish()
 }
 
+func TestStateTrackingWhileConnected(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	enabled, disabled := callCheck(t), callCheck(t)
+	c.HandleFunc(STATE_TRACKING_ENABLED, func(conn *Conn, line *Line) {
+		enabled.call()
+	})
+	c.HandleFunc(STATE_TRACKING_DISABLED, func(conn *Conn, line *Line) {
+		disabled.call()
+	})
+
+	// Enabling state tracking while connected should WHOIS ourselves
+	// to find out which channels we're on.
+	c.st = nil
+	go c.EnableStateTracking()
+	s.nc.Expect("WHOIS test")
+	enabled.assertWasCalled("Enabling state tracking did not dispatch event.")
+	if c.st == nil || len(c.stRemovers) != len(stHandlers) {
+		t.Errorf("State tracker not enabled correctly.")
+	}
+
+	// Enabling it a second time should do nothing.
+	go c.EnableStateTracking()
+	s.nc.ExpectNothing()
+	enabled.assertNotCalled("Enabling state tracking twice dispatched event.")
+
+	go c.DisableStateTracking()
+	disabled.assertWasCalled("Disabling state tracking did not dispatch event.")
+	if c.st != nil || len(c.stRemovers) != 0 {
+		t.Errorf("State tracker not disabled correctly.")
+	}
+}
+
+func TestSharedChannels(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	s.st.EXPECT().GetNick("user1").Return(&state.Nick{Nick: "user1",
+		Channels: map[string]*state.ChanPrivs{"#b": {}, "#a": {Op: true}}})
+	if ch := c.SharedChannels("user1"); !reflect.DeepEqual(ch, []string{"#a", "#b"}) {
+		t.Errorf("Wrong shared channels: %q", ch)
+	}
+	s.st.EXPECT().GetNick("user2").Return(nil)
+	if ch := c.SharedChannels("user2"); ch != nil {
+		t.Errorf("Shared channels for unknown nick: %q", ch)
+	}
+
+	c.st = nil
+	if ch := c.SharedChannels("user1"); ch != nil {
+		t.Errorf("Shared channels without state tracking: %q", ch)
+	}
+	c.st = s.st
+}
+
+func TestAddrs(t *testing.T) {
+	c, s := setUp(t)
+
+	if a := c.LocalAddr(); a == nil || a.String() != "127.0.0.1:12345" {
+		t.Errorf("Wrong local address: %v", a)
+	}
+	if a := c.RemoteAddr(); a == nil || a.String() != "127.0.0.1:6667" {
+		t.Errorf("Wrong remote address: %v", a)
+	}
+
+	s.tearDown()
+	if a := c.LocalAddr(); a != nil {
+		t.Errorf("Local address after disconnect: %v", a)
+	}
+	if a := c.RemoteAddr(); a != nil {
+		t.Errorf("Remote address after disconnect: %v", a)
+	}
+}
+
 func TestSendExitsOnDie(t *testing.T) {
 	// Passing a second value to setUp stops goroutines from starting
 	c, s := setUp(t, false)
@@ -173,7 +251,7 @@ func TestSendExitsOnDie(t *testing.T) {
 
 	// Assert that before send is running, nothing should be sent to the socket
 	// but writes to the buffered channel "out" should not block.
-	c.out <- "SENT BEFORE START"
+	c.out <- outLine{line: "SENT BEFORE START"}
 	s.nc.ExpectNothing()
 
 	// We want to test that the a goroutine calling send will exit correctly.
@@ -191,7 +269,7 @@ func TestSendExitsOnDie(t *testing.T) {
 	s.nc.Expect("SENT BEFORE START")
 
 	// Send another line, just to be sure :-)
-	c.out <- "SENT AFTER START"
+	c.out <- outLine{line: "SENT AFTER START"}
 	s.nc.Expect("SENT AFTER START")
 
 	// Now, use the control channel to exit send and kill the goroutine.
@@ -205,10 +283,70 @@ func TestSendExitsOnDie(t *testing.T) {
 	s.nc.ExpectNothing()
 
 	// Sending more on c.out shouldn't reach the network.
-	c.out <- "SENT AFTER END"
+	c.out <- outLine{line: "SENT AFTER END"}
 	s.nc.ExpectNothing()
 }
 
+func TestSendNeverBlocks(t *testing.T) {
+	// Passing a second value to setUp stops goroutines from starting
+	c, s := setUp(t, false)
+	defer s.tearDown()
+
+	// Sending far more than conn.out holds mustn't block, even though
+	// nothing is reading from it yet.
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.Raw(fmt.Sprintf("PRIVMSG #foo :%d", i))
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("Raw blocked with a full send buffer.")
+	}
+
+	// Once send starts, every line is sent, in order.
+	c.wg.Add(1)
+	go c.send()
+	for i := 0; i < 100; i++ {
+		s.nc.Expect(fmt.Sprintf("PRIVMSG #foo :%d", i))
+	}
+}
+
+func TestSendLowPriority(t *testing.T) {
+	// Passing a second value to setUp stops goroutines from starting
+	c, s := setUp(t, false)
+	defer s.tearDown()
+
+	// Low priority lines only reach conn.out while nothing else is waiting,
+	// so at most one of them is sent ahead of later lines.
+	c.cfg.LowPriorityQueries = true
+	c.query(WHO, "#foo")
+	c.query(WHO, "#bar")
+	c.query(WHOIS, "user1")
+	for i := 0; i < 3; i++ {
+		c.Raw(fmt.Sprintf("PRIVMSG #foo :%d", i))
+	}
+	c.wg.Add(1)
+	go c.send()
+	s.nc.Expect("WHO #foo")
+	for i := 0; i < 3; i++ {
+		s.nc.Expect(fmt.Sprintf("PRIVMSG #foo :%d", i))
+	}
+	s.nc.Expect("WHO #bar")
+	s.nc.Expect("WHOIS user1")
+	s.nc.ExpectNothing()
+
+	// Without LowPriorityQueries, queries are sent in order as usual.
+	c.cfg.LowPriorityQueries = false
+	c.query(WHO, "#foo")
+	c.Raw("PRIVMSG #foo :3")
+	s.nc.Expect("WHO #foo")
+	s.nc.Expect("PRIVMSG #foo :3")
+}
+
 func TestSendExitsOnWriteError(t *testing.T) {
 	// Passing a second value to setUp stops goroutines from starting
 	c, s := setUp(t, false)
@@ -226,7 +364,7 @@ func TestSendExitsOnWriteError(t *testing.T) {
 	}()
 
 	// Send a line to be sure things are good.
-	c.out <- "SENT AFTER START"
+	c.out <- outLine{line: "SENT AFTER START"}
 	s.nc.Expect("SENT AFTER START")
 
 	// Now, close the underlying socket to cause write() to return an error.
@@ -235,7 +373,7 @@ func TestSendExitsOnWriteError(t *testing.T) {
 	s.nc.Close()
 	// Sending more on c.out shouldn't reach the network, but we need to send
 	// *something* to trigger a call to write() that will fail.
-	c.out <- "SENT AFTER END"
+	c.out <- outLine{line: "SENT AFTER END"}
 	exited.assertWasCalled("Didn't exit after signal.")
 	s.nc.ExpectNothing()
 }
@@ -265,7 +403,7 @@ func TestSendDeadlockOnFullBuffer(t *testing.T) {
 	// send() will read a line from conn.out on its first loop iteration:
 	go func() {
 		for i := 0; i < 33; i++ {
-			c.out <- "FILL BUFFER WITH CRAP"
+			c.out <- outLine{line: "FILL BUFFER WITH CRAP"}
 		}
 	}()
 	// Then we add a handler that tries to write a line to conn.out:
@@ -356,6 +494,18 @@ func TestRecv(t *testing.T) {
 		t.Errorf("Bad second line received on input channel.")
 	}
 
+	// Lines split across reads, even in the middle of a rune, should be
+	// reassembled, and "\n" on its own should terminate a line.
+	s.nc.In <- ":nick!ident@host PRIVMSG #foo :h\xc3"
+	s.nc.In <- "\xa9llo\r"
+	s.nc.In <- "\n\r\n:nick!ident@host PRIVMSG #foo :bye\n"
+	if l := reader(); l == nil || l.Text() != "h\u00e9llo" {
+		t.Errorf("Line split across reads not reassembled: %#v", l)
+	}
+	if l := reader(); l == nil || l.Text() != "bye" {
+		t.Errorf("Line terminated by bare newline not received: %#v", l)
+	}
+
 	// Test that recv does something useful with a line it can't parse
 	// (not that there are many, ParseLine is forgiving).
 	s.nc.Send(":textwithnospaces")
@@ -396,8 +546,8 @@ func TestPing(t *testing.T) {
 	reader := func() string {
 		select {
 		case <-time.After(res):
-		case s := <-c.out:
-			return s
+		case o := <-c.out:
+			return o.line
 		}
 		return ""
 	}
@@ -512,7 +662,7 @@ func TestWrite(t *testing.T) {
 	defer s.ctrl.Finish()
 
 	// Write should just write a line to the socket.
-	if err := c.write("yo momma"); err != nil {
+	if err := c.write("yo momma", time.Time{}); err != nil {
 		t.Errorf("Write returned unexpected error %v", err)
 	}
 	s.nc.Expect("yo momma")
@@ -524,7 +674,7 @@ func TestWrite(t *testing.T) {
 	}
 
 	c.cfg.Flood = false
-	if err := c.write("she so useless"); err != nil {
+	if err := c.write("she so useless", time.Time{}); err != nil {
 		t.Errorf("Write returned unexpected error %v", err)
 	}
 	s.nc.Expect("she so useless")
@@ -536,11 +686,129 @@ func TestWrite(t *testing.T) {
 
 	// Finally, test the error state by closing the socket then writing.
 	s.nc.Close()
-	if err := c.write("she can't pass unit tests"); err == nil {
+	if err := c.write("she can't pass unit tests", time.Time{}); err == nil {
 		t.Errorf("Expected write to return error after socket close.")
 	}
 }
 
+func TestWriteBufferFlush(t *testing.T) {
+	c, s := setUp(t, false)
+	defer s.ctrl.Finish()
+
+	// Lines are held in the buffer while more are waiting to be sent.
+	c.cfg.WriteBufferFlush = FlushBatch
+	c.out <- outLine{line: "PRIVMSG #foo :two"}
+	if err := c.write("PRIVMSG #foo :one", time.Time{}); err != nil {
+		t.Errorf("Write returned unexpected error %v", err)
+	}
+	s.nc.ExpectNothing()
+	if err := c.write((<-c.out).line, time.Time{}); err != nil {
+		t.Errorf("Write returned unexpected error %v", err)
+	}
+	s.nc.Expect("PRIVMSG #foo :one\r\nPRIVMSG #foo :two")
+
+	// QUITs are flushed regardless.
+	c.out <- outLine{line: "PRIVMSG #foo :three"}
+	c.write("QUIT :bye", time.Time{})
+	s.nc.Expect("QUIT :bye")
+	<-c.out
+
+	// By default, every line is flushed.
+	c.cfg.WriteBufferFlush = FlushEachLine
+	c.out <- outLine{line: "PRIVMSG #foo :five"}
+	c.write("PRIVMSG #foo :four", time.Time{})
+	s.nc.Expect("PRIVMSG #foo :four")
+	<-c.out
+}
+
+func TestOnSendDelay(t *testing.T) {
+	c, s := setUp(t, false)
+	defer s.tearDown()
+
+	var sent []string
+	var delay time.Duration
+	c.cfg.OnSendDelay = func(raw string, waited time.Duration) {
+		sent = append(sent, raw)
+		delay = waited
+	}
+	for _, l := range []string{"PRIVMSG #foo :bar", "PASS secret", "AUTHENTICATE PLAIN",
+		"AUTHENTICATE c2VjcmV0", "PRIVMSG NickServ :IDENTIFY secret",
+		"PRIVMSG nickserv@services.example.com :identify acct secret",
+		"NS IDENTIFY secret", "PRIVMSG #foo :IDENTIFY secret"} {
+		if err := c.write(l, time.Time{}); err != nil {
+			t.Errorf("Write returned unexpected error %v", err)
+		}
+		s.nc.Expect(l)
+	}
+	exp := []string{"PRIVMSG #foo :bar", "PASS **************",
+		"AUTHENTICATE PLAIN", "AUTHENTICATE **************",
+		"PRIVMSG NickServ :IDENTIFY **************",
+		"PRIVMSG nickserv@services.example.com :identify **************",
+		"NS IDENTIFY **************", "PRIVMSG #foo :IDENTIFY secret"}
+	if !reflect.DeepEqual(sent, exp) {
+		t.Errorf("OnSendDelay called with %q, expected %q", sent, exp)
+	}
+
+	// The delay includes the time spent waiting in the queue.
+	if err := c.write("PRIVMSG #foo :baz", time.Now().Add(-time.Second)); err != nil {
+		t.Errorf("Write returned unexpected error %v", err)
+	}
+	s.nc.Expect("PRIVMSG #foo :baz")
+	if delay < time.Second {
+		t.Errorf("OnSendDelay called with delay %s, expected at least 1s", delay)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	var buf bytes.Buffer
+	c.cfg.Transcript = &buf
+	c.Pass("secret")
+	s.nc.Expect("PASS secret")
+	s.nc.Send("PING :1234")
+	s.nc.Expect("PONG :1234")
+	<-time.After(5 * time.Millisecond)
+
+	c.transcriptMu.Lock()
+	defer c.transcriptMu.Unlock()
+	exp := ">> PASS **************\n<< PING :1234\n>> PONG :1234\n"
+	if buf.String() != exp {
+		t.Errorf("Transcript was %q, expected %q", buf.String(), exp)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	c, s := setUp(t, false)
+	defer s.tearDown()
+
+	c.cfg.DryRun = true
+	dry := callCheck(t)
+	c.HandleFunc(DRY_RUN, func(conn *Conn, line *Line) {
+		if line.Args[0] != "PRIVMSG #foo :bar" {
+			t.Errorf("DRY_RUN event has wrong line: %q", line.Args[0])
+		}
+		dry.call()
+	})
+
+	// Normal commands should be dispatched but not sent.
+	if err := c.write("PRIVMSG #foo :bar", time.Time{}); err != nil {
+		t.Errorf("Write returned unexpected error %v", err)
+	}
+	dry.assertWasCalled("DRY_RUN event not dispatched.")
+	s.nc.ExpectNothing()
+
+	// Essential protocol messages should still be sent.
+	for _, l := range []string{"PONG :1234", "NICK test", "CAP END"} {
+		if err := c.write(l, time.Time{}); err != nil {
+			t.Errorf("Write returned unexpected error %v", err)
+		}
+		s.nc.Expect(l)
+	}
+	dry.assertNotCalled("DRY_RUN event dispatched for essential line.")
+}
+
 func TestRateLimit(t *testing.T) {
 	c, s := setUp(t)
 	defer s.tearDown()
@@ -583,3 +851,215 @@ func TestRateLimit(t *testing.T) {
 		t.Errorf("l=%d, badness=%d", l, c.badness)
 	}
 }
+
+func TestFloodExempt(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Nothing should be asked of the state tracker when not enabled.
+	if c.floodExempt("PRIVMSG #foo :bar") {
+		t.Errorf("Flood exempt when FloodExemptWhenOp = false.")
+	}
+
+	c.cfg.FloodExemptWhenOp = true
+	me := &state.Nick{Nick: "test", Modes: &state.NickMode{}}
+	gomock.InOrder(
+		s.st.EXPECT().Me().Return(me),
+		s.st.EXPECT().IsOn("#foo", "test").Return(&state.ChanPrivs{Op: true}, true),
+		s.st.EXPECT().Me().Return(me),
+		s.st.EXPECT().IsOn("#foo", "test").Return(&state.ChanPrivs{Op: true}, true),
+		s.st.EXPECT().IsOn("#bar", "test").Return(&state.ChanPrivs{Admin: true}, true),
+		s.st.EXPECT().Me().Return(me),
+		s.st.EXPECT().IsOn("#foo", "test").Return(&state.ChanPrivs{Op: true}, true),
+		s.st.EXPECT().IsOn("#baz", "test").Return(nil, false),
+		s.st.EXPECT().Me().Return(me),
+		s.st.EXPECT().IsOn("#bar", "test").Return(&state.ChanPrivs{Voice: true}, true),
+		s.st.EXPECT().Me().Return(me),
+		s.st.EXPECT().IsOn("somebody", "test").Return(nil, false),
+	)
+	if !c.floodExempt("PRIVMSG #foo :baz") {
+		t.Errorf("Not flood exempt when opped in channel.")
+	}
+	if !c.floodExempt("PRIVMSG #foo,#bar :baz") {
+		t.Errorf("Not flood exempt when privileged in every channel.")
+	}
+	// Every target must be privileged.
+	if c.floodExempt("PRIVMSG #foo,#baz :baz") {
+		t.Errorf("Flood exempt when not privileged in every channel.")
+	}
+	if c.floodExempt("MODE #bar +b *!*@host") {
+		t.Errorf("Flood exempt when only voiced in channel.")
+	}
+	if c.floodExempt("PRIVMSG somebody :hi") {
+		t.Errorf("Flood exempt when sending to a nick.")
+	}
+
+	// Opers are exempt everywhere.
+	me.Modes.Oper = true
+	s.st.EXPECT().Me().Return(me)
+	if !c.floodExempt("PRIVMSG somebody :hi") {
+		t.Errorf("Not flood exempt when an oper.")
+	}
+}
+
+func TestWhoRefresh(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	s.st.EXPECT().Me().Return(&state.Nick{Nick: "test",
+		Channels: map[string]*state.ChanPrivs{"#test1": {}}})
+	c.refreshWho()
+	s.nc.Expect("WHO #test1")
+
+	// With only one of the capabilities we still need to refresh.
+	c.caps["away-notify"] = true
+	s.st.EXPECT().Me().Return(&state.Nick{Nick: "test",
+		Channels: map[string]*state.ChanPrivs{"#test2": {}}})
+	c.refreshWho()
+	s.nc.Expect("WHO #test2")
+
+	// But with both, WHOs are pointless.
+	c.caps["chghost"] = true
+	c.refreshWho()
+	s.nc.ExpectNothing()
+}
+
+func TestReady(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	ready := c.Ready()
+	done := make(chan struct{})
+	go func() {
+		<-ready
+		close(done)
+	}()
+	c.dispatch(ParseLine(":irc.server.org 375 test :- irc.server.org Message of the Day -"))
+	select {
+	case <-done:
+		t.Errorf("Ready before end of MOTD.")
+	case <-time.After(5 * time.Millisecond):
+	}
+	c.dispatch(ParseLine(":irc.server.org 376 test :End of /MOTD command."))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Not ready after end of MOTD.")
+	}
+	// Until we reconnect, the same closed channel is returned.
+	c.dispatch(ParseLine(":irc.server.org 422 test :MOTD File is missing"))
+	if c.Ready() != ready {
+		t.Errorf("Ready channel replaced without reconnecting.")
+	}
+
+	// Once disconnected, we're no longer ready.
+	c.Close()
+	select {
+	case <-c.Ready():
+		t.Errorf("Still ready after disconnecting.")
+	default:
+	}
+}
+
+func TestWaitForIdentify(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	isReady := func() bool {
+		select {
+		case <-c.Ready():
+			return true
+		case <-time.After(5 * time.Millisecond):
+			return false
+		}
+	}
+	reconnect := func() {
+		c.regMu.Lock()
+		c.motdDone, c.identified = false, false
+		c.ready = make(chan struct{})
+		c.regMu.Unlock()
+	}
+	c.cfg.WaitForIdentify = regexp.MustCompile("You are now identified")
+	c.cfg.IdentifyTimeout = time.Hour
+
+	// Identifying before the MOTD ends counts.
+	c.h_IDENTIFIED(ParseLine(":NickServ!NickServ@services. NOTICE test :You are now identified for test."))
+	c.h_READY(ParseLine(":irc.server.org 376 test :End of /MOTD command."))
+	if !isReady() {
+		t.Errorf("Not ready after identifying and end of MOTD.")
+	}
+
+	// Otherwise, we wait for a matching notice to us.
+	reconnect()
+	c.h_READY(ParseLine(":irc.server.org 376 test :End of /MOTD command."))
+	c.h_IDENTIFIED(ParseLine(":NickServ!NickServ@services. NOTICE test :This nickname is registered."))
+	c.h_IDENTIFIED(ParseLine(":user!user@host NOTICE #test :You are now identified"))
+	c.h_IDENTIFIED(ParseLine(":user!user@host NOTICE test :You are now identified"))
+	if isReady() {
+		t.Errorf("Ready before identifying.")
+	}
+	c.h_IDENTIFIED(ParseLine(":NickServ!NickServ@services. NOTICE test :You are now identified for test."))
+	if !isReady() {
+		t.Errorf("Not ready after identifying.")
+	}
+
+	// Other networks' services can be named instead.
+	reconnect()
+	c.cfg.IdentifyNick = "AuthServ"
+	c.h_READY(ParseLine(":irc.server.org 376 test :End of /MOTD command."))
+	c.h_IDENTIFIED(ParseLine(":NickServ!NickServ@services. NOTICE test :You are now identified for test."))
+	if isReady() {
+		t.Errorf("Ready after identifying to the wrong nick.")
+	}
+	c.h_IDENTIFIED(ParseLine(":AuthServ!AuthServ@services. NOTICE test :You are now identified for test."))
+	if !isReady() {
+		t.Errorf("Not ready after identifying to IdentifyNick.")
+	}
+
+	// Or 900 RPL_LOGGEDIN.
+	reconnect()
+	c.h_READY(ParseLine(":irc.server.org 422 test :MOTD File is missing"))
+	c.h_IDENTIFIED(ParseLine(":irc.server.org 900 test test!test@host test :You are now logged in as test"))
+	if !isReady() {
+		t.Errorf("Not ready after 900.")
+	}
+
+	// We give up waiting after IdentifyTimeout.
+	reconnect()
+	c.cfg.IdentifyTimeout = 10 * time.Millisecond
+	c.h_READY(ParseLine(":irc.server.org 376 test :End of /MOTD command."))
+	if isReady() {
+		t.Errorf("Ready before identifying.")
+	}
+	select {
+	case <-c.Ready():
+	case <-time.After(time.Second):
+		t.Errorf("Not ready after IdentifyTimeout.")
+	}
+}
+
+func TestQueueUntilRegistered(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.cfg.QueueUntilRegistered = true
+	c.Join("#foo")
+	c.Privmsg("#foo", "hello")
+	s.nc.ExpectNothing()
+
+	// Registration commands shouldn't be queued.
+	s.st.EXPECT().RequestNick("test").Return(c.cfg.Me)
+	c.Nick("test")
+	s.nc.Expect("NICK test")
+	s.nc.ExpectNothing()
+
+	c.st = nil
+	c.h_001(ParseLine(":irc.server.org 001 test :Welcome to IRC test!ident@somehost.com"))
+	c.st = s.st
+	s.nc.Expect("JOIN #foo")
+	s.nc.Expect("PRIVMSG #foo :hello")
+
+	// Once registered, commands are sent immediately.
+	c.Join("#bar")
+	s.nc.Expect("JOIN #bar")
+}
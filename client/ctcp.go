@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// How long CtcpPing waits for a reply before giving up.
+var ctcpPingTimeout = time.Minute
+
+// ctcpPing is a CTCP PING sent by CtcpPing that's waiting for a reply.
+// done is closed once it's no longer waiting.
+type ctcpPing struct {
+	nick  string
+	sent  time.Time
+	rtt   chan time.Duration
+	timer *time.Timer
+	done  chan struct{}
+}
+
+// CTCPDelim is the byte that delimits CTCP messages embedded
+// in the text of a PRIVMSG or NOTICE.
+const CTCPDelim = "\001"
+
+// EncodeCTCP wraps a CTCP command and its (optional) arguments in
+// CTCP delimiters, ready to be sent as the text of a PRIVMSG or NOTICE.
+// The command is upper-cased.
+//   EncodeCTCP("ping", "1234") == "\001PING 1234\001"
+func EncodeCTCP(cmd, args string) string {
+	if args != "" {
+		args = " " + args
+	}
+	return CTCPDelim + strings.ToUpper(cmd) + args + CTCPDelim
+}
+
+// DecodeCTCP unwraps the CTCP command and its arguments from the text of a
+// PRIVMSG or NOTICE. The command is upper-cased. The closing delimiter is
+// optional, since some clients don't send it. If the text is not a CTCP
+// message, isCTCP is false and cmd and args are empty.
+//   DecodeCTCP("\001PING 1234\001") == "PING", "1234", true
+func DecodeCTCP(text string) (cmd, args string, isCTCP bool) {
+	if !strings.HasPrefix(text, CTCPDelim) {
+		return "", "", false
+	}
+	text = strings.TrimSuffix(text[1:], CTCPDelim)
+	t := strings.SplitN(text, " ", 2)
+	if t[0] == "" || strings.Contains(t[0], CTCPDelim) {
+		return "", "", false
+	}
+	if len(t) > 1 {
+		args = t[1]
+	}
+	return strings.ToUpper(t[0]), args, true
+}
+
+// ctcpReplyAllowed returns true if we should send an automatic CTCP reply to
+// nick, given Config.CTCPReplyRateLimit, and records that we are doing so.
+func (conn *Conn) ctcpReplyAllowed(nick string) bool {
+	limit := conn.cfg.CTCPReplyRateLimit
+	if limit <= 0 {
+		return true
+	}
+	now, nick := time.Now(), conn.Casefold(nick)
+	conn.ctcpMu.Lock()
+	defer conn.ctcpMu.Unlock()
+	if last, ok := conn.ctcpLast[nick]; ok && now.Sub(last) < limit {
+		logging.Debug("irc.CTCP(): dropping reply to %s, rate limited", nick)
+		return false
+	}
+	// Forget nicks we've not replied to recently, so this doesn't grow
+	// without bound under a flood from many different nicks.
+	for n, last := range conn.ctcpLast {
+		if now.Sub(last) >= limit {
+			delete(conn.ctcpLast, n)
+		}
+	}
+	conn.ctcpLast[nick] = now
+	return true
+}
+
+// versionOnJoin sends a CTCP VERSION to a nick other than us that has
+// joined channel, if Config.VersionOnJoin is set and we haven't asked it
+// recently.
+func (conn *Conn) versionOnJoin(channel, nick string) {
+	if !conn.cfg.VersionOnJoin || conn.Casefold(nick) == conn.Casefold(conn.Me().Nick) {
+		return
+	}
+	ch := conn.Casefold(channel)
+	for _, c := range conn.cfg.VersionOnJoinSkip {
+		if conn.Casefold(c) == ch {
+			return
+		}
+	}
+	window := conn.cfg.VersionOnJoinWindow
+	if window <= 0 {
+		window = time.Hour
+	}
+	now, k := time.Now(), conn.Casefold(nick)
+	conn.ctcpMu.Lock()
+	if conn.ctcpVersioned == nil {
+		conn.ctcpVersioned = make(map[string]time.Time)
+	}
+	if last, ok := conn.ctcpVersioned[k]; ok && now.Sub(last) < window {
+		conn.ctcpMu.Unlock()
+		return
+	}
+	// Forget nicks we've not asked recently, as in ctcpReplyAllowed.
+	for n, last := range conn.ctcpVersioned {
+		if now.Sub(last) >= window {
+			delete(conn.ctcpVersioned, n)
+		}
+	}
+	conn.ctcpVersioned[k] = now
+	conn.ctcpMu.Unlock()
+	conn.Version(nick)
+}
+
+// ClientVersion returns the reply nick sent to a CTCP VERSION, as recorded
+// by the state tracker, e.g. because of Config.VersionOnJoin. It returns
+// false if state tracking is disabled, the tracker doesn't know about nick,
+// or nick hasn't replied.
+func (conn *Conn) ClientVersion(nick string) (string, bool) {
+	st := conn.st
+	if st == nil {
+		return "", false
+	}
+	nk := st.GetNick(nick)
+	if nk == nil || nk.ClientVersion == "" {
+		return "", false
+	}
+	return nk.ClientVersion, true
+}
+
+// CtcpPing sends a CTCP PING to nick with the current time as its token, and
+// returns a channel that receives the round-trip time when nick echoes the
+// token back in its CTCP PING reply. If no reply is received before ctx is
+// done, or within a minute at most, the channel is closed without a value
+// being sent.
+//   PRIVMSG nick :\001PING 1234567890\001
+func (conn *Conn) CtcpPing(ctx context.Context, nick string) (<-chan time.Duration, error) {
+	if conn.IsChannel(nick) {
+		return nil, fmt.Errorf("irc.CtcpPing(): %s is a channel, not a nick", nick)
+	}
+	now := time.Now()
+	token := strconv.FormatInt(now.UnixNano(), 10)
+	p := &ctcpPing{nick: conn.Casefold(nick), sent: now,
+		rtt: make(chan time.Duration, 1), done: make(chan struct{})}
+	conn.ctcpMu.Lock()
+	conn.ctcpPings[token] = p
+	p.timer = time.AfterFunc(ctcpPingTimeout, func() {
+		conn.ctcpPingDone(token, "", time.Time{})
+	})
+	conn.ctcpMu.Unlock()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.ctcpPingDone(token, "", time.Time{})
+			case <-p.done:
+			}
+		}()
+	}
+	conn.Ctcp(nick, PING, token)
+	return p.rtt, nil
+}
+
+// ctcpPingFail gives up on every pending CTCP PING, e.g. because we've
+// been disconnected.
+func (conn *Conn) ctcpPingFail() {
+	conn.ctcpMu.Lock()
+	tokens := make([]string, 0, len(conn.ctcpPings))
+	for t := range conn.ctcpPings {
+		tokens = append(tokens, t)
+	}
+	conn.ctcpMu.Unlock()
+	for _, t := range tokens {
+		conn.ctcpPingDone(t, "", time.Time{})
+	}
+}
+
+// ctcpPingDone sends the round-trip time to whoever is waiting for the CTCP
+// PING reply with the given token, received at time at, as long as it came
+// from the nick the PING was sent to. An empty nick means we've given up.
+func (conn *Conn) ctcpPingDone(token, nick string, at time.Time) {
+	conn.ctcpMu.Lock()
+	defer conn.ctcpMu.Unlock()
+	p, ok := conn.ctcpPings[token]
+	if !ok || (nick != "" && conn.Casefold(nick) != p.nick) {
+		return
+	}
+	delete(conn.ctcpPings, token)
+	p.timer.Stop()
+	if nick != "" {
+		p.rtt <- at.Sub(p.sent)
+	}
+	close(p.rtt)
+	close(p.done)
+}
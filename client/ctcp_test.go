@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/lfkeitel/goirc/state"
+)
+
+func TestEncodeCTCP(t *testing.T) {
+	tests := []struct{ cmd, args, out string }{
+		{"ping", "1234", "\001PING 1234\001"},
+		{"VERSION", "", "\001VERSION\001"},
+		{"action", "pokes somebody", "\001ACTION pokes somebody\001"},
+	}
+	for i, test := range tests {
+		if out := EncodeCTCP(test.cmd, test.args); out != test.out {
+			t.Errorf("test %d: expected %q, got %q", i, test.out, out)
+		}
+	}
+}
+
+func TestDecodeCTCP(t *testing.T) {
+	tests := []struct {
+		in, cmd, args string
+		ok            bool
+	}{
+		{"\001PING 1234\001", "PING", "1234", true},
+		{"\001version\001", "VERSION", "", true},
+		{"\001ACTION pokes somebody\001", "ACTION", "pokes somebody", true},
+		{"\001\001", "", "", false},
+		{"\001", "", "", false},
+		{"\001 1234\001", "", "", false},
+		// The closing delimiter is optional.
+		{"\001PING 1234", "PING", "1234", true},
+		{"just some text", "", "", false},
+	}
+	for i, test := range tests {
+		cmd, args, ok := DecodeCTCP(test.in)
+		if cmd != test.cmd || args != test.args || ok != test.ok {
+			t.Errorf("test %d: expected %q %q %t, got %q %q %t", i,
+				test.cmd, test.args, test.ok, cmd, args, ok)
+		}
+	}
+}
+
+func TestCTCPReplyRateLimit(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.cfg.CTCPReplyRateLimit = time.Hour
+	c.h_CTCP(ParseLine(":blah!moo@cows.com PRIVMSG test :\001VERSION\001"))
+	s.nc.Expect("NOTICE blah :\001VERSION Powered by GoIRC\001")
+
+	// Further requests from the same nick should be dropped ...
+	c.h_CTCP(ParseLine(":blah!moo@cows.com PRIVMSG test :\001PING 1234\001"))
+	c.h_CTCP(ParseLine(":BLAH!moo@cows.com PRIVMSG test :\001VERSION\001"))
+	s.nc.ExpectNothing()
+
+	// ... but other nicks should still get replies.
+	c.h_CTCP(ParseLine(":other!moo@cows.com PRIVMSG test :\001PING 1234\001"))
+	s.nc.Expect("NOTICE other :\001PING 1234\001")
+
+	// Unknown CTCPs don't count towards the limit.
+	c.h_CTCP(ParseLine(":third!moo@cows.com PRIVMSG test :\001UNKNOWN ctcp\001"))
+	c.h_CTCP(ParseLine(":third!moo@cows.com PRIVMSG test :\001VERSION\001"))
+	s.nc.Expect("NOTICE third :\001VERSION Powered by GoIRC\001")
+
+	// Once the limit expires, replies are sent again.
+	c.cfg.CTCPReplyRateLimit = time.Nanosecond
+	c.h_CTCP(ParseLine(":blah!moo@cows.com PRIVMSG test :\001PING 1234\001"))
+	s.nc.Expect("NOTICE blah :\001PING 1234\001")
+}
+
+func TestCtcpPing(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if _, err := c.CtcpPing(context.Background(), "#channel"); err == nil {
+		t.Errorf("No error pinging a channel.")
+	}
+	s.nc.ExpectNothing()
+
+	rtt, err := c.CtcpPing(context.Background(), "blah")
+	if err != nil {
+		t.Fatalf("Unexpected error from CtcpPing: %v", err)
+	}
+	c.ctcpMu.Lock()
+	if len(c.ctcpPings) != 1 {
+		t.Fatalf("CTCP PING not recorded: %v", c.ctcpPings)
+	}
+	var token string
+	var sent time.Time
+	for tok, p := range c.ctcpPings {
+		token, sent = tok, p.sent
+	}
+	c.ctcpMu.Unlock()
+	s.nc.Expect("PRIVMSG blah :\001PING " + token + "\001")
+
+	// Replies from other nicks or with other tokens are ignored.
+	reply := func(src, tok string) {
+		l := ParseLine(src + " NOTICE test :\001PING " + tok + "\001")
+		l.Time = sent.Add(time.Second)
+		c.h_CTCPREPLY(l)
+	}
+	reply(":other!moo@cows.com", token)
+	reply(":blah!moo@cows.com", "1234")
+	select {
+	case d := <-rtt:
+		t.Fatalf("Round-trip time sent for the wrong reply: %s", d)
+	default:
+	}
+
+	reply(":BLAH!moo@cows.com", token)
+	if d, ok := <-rtt; !ok || d != time.Second {
+		t.Errorf("Bad round-trip time: %s, %t", d, ok)
+	}
+	if _, ok := <-rtt; ok {
+		t.Errorf("Channel not closed after reply.")
+	}
+
+	// Unanswered pings time out and close the channel.
+	defer func(d time.Duration) { ctcpPingTimeout = d }(ctcpPingTimeout)
+	ctcpPingTimeout = time.Millisecond
+	rtt, _ = c.CtcpPing(context.Background(), "blah")
+	<-s.nc.Out
+	select {
+	case d, ok := <-rtt:
+		if ok {
+			t.Errorf("Round-trip time sent for timed out ping: %s", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Channel not closed after timeout.")
+	}
+
+	// As do pings whose context is done first.
+	ctcpPingTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	rtt, _ = c.CtcpPing(ctx, "blah")
+	<-s.nc.Out
+	cancel()
+	select {
+	case d, ok := <-rtt:
+		if ok {
+			t.Errorf("Round-trip time sent for cancelled ping: %s", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Channel not closed after cancellation.")
+	}
+
+	// Or that are still pending when we're disconnected.
+	rtt, _ = c.CtcpPing(context.Background(), "blah")
+	<-s.nc.Out
+	c.ctcpPingFail()
+	if d, ok := <-rtt; ok {
+		t.Errorf("Round-trip time sent after disconnect: %s", d)
+	}
+	c.ctcpMu.Lock()
+	if len(c.ctcpPings) != 0 {
+		t.Errorf("CTCP PING state not cleaned up: %v", c.ctcpPings)
+	}
+	c.ctcpMu.Unlock()
+}
+
+func TestVersionOnJoin(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Nothing is sent unless VersionOnJoin is set.
+	c.versionOnJoin("#test1", "user1")
+	s.nc.ExpectNothing()
+
+	c.cfg.VersionOnJoin = true
+	c.cfg.VersionOnJoinSkip = []string{"#Quiet"}
+	s.st.EXPECT().Me().Return(c.cfg.Me).Times(4)
+	c.versionOnJoin("#test1", "user1")
+	s.nc.Expect("PRIVMSG user1 :\001VERSION\001")
+
+	// Each nick is only asked once per window, whichever channel it joins.
+	c.versionOnJoin("#test2", "USER1")
+	s.nc.ExpectNothing()
+
+	// We don't ask ourselves, or nicks joining skipped channels.
+	c.versionOnJoin("#test1", "test")
+	c.versionOnJoin("#quiet", "user2")
+	s.nc.ExpectNothing()
+
+	// Once the window expires, nicks are asked again.
+	c.cfg.VersionOnJoinWindow = time.Nanosecond
+	s.st.EXPECT().Me().Return(c.cfg.Me)
+	c.versionOnJoin("#test2", "user1")
+	s.nc.Expect("PRIVMSG user1 :\001VERSION\001")
+
+	// Replies are recorded against nicks the tracker knows about.
+	nk := &state.Nick{Nick: "user1", ClientVersion: "irssi v1.2.3"}
+	gomock.InOrder(
+		s.st.EXPECT().GetNick("user1").Return(nk),
+		s.st.EXPECT().NickVersion("user1", "irssi v1.2.3").Return(nk),
+		s.st.EXPECT().GetNick("user2").Return(nil),
+		s.st.EXPECT().GetNick("user1").Return(nk),
+		s.st.EXPECT().GetNick("user2").Return(nil),
+	)
+	c.h_CTCPREPLY(ParseLine(":user1!moo@cows.com NOTICE test :\001VERSION irssi v1.2.3\001"))
+	c.h_CTCPREPLY(ParseLine(":user2!moo@cows.com NOTICE test :\001VERSION HexChat\001"))
+	if v, ok := c.ClientVersion("user1"); !ok || v != "irssi v1.2.3" {
+		t.Errorf("Bad client version for user1: %q, %t", v, ok)
+	}
+	if v, ok := c.ClientVersion("user2"); ok {
+		t.Errorf("Client version for unknown nick: %q", v)
+	}
+}
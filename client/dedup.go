@@ -0,0 +1,41 @@
+package client
+
+import (
+	"time"
+)
+
+// duplicate returns true if a line with the same msgid tag was received
+// less than Config.DedupWindow before this one. Lines without a msgid
+// aren't checked: the same raw line can legitimately arrive twice, e.g.
+// when someone joins, parts and rejoins, or for identical WHO replies. The
+// msgid is recorded as seen either way, so a steady stream of duplicates
+// keeps being dropped. It's called by dispatch after the internal
+// handlers have run, so only handlers added by the user miss duplicates.
+func (conn *Conn) duplicate(line *Line) bool {
+	window := conn.cfg.DedupWindow
+	if window <= 0 || line.Internal {
+		return false
+	}
+	id := line.MsgID()
+	if id == "" {
+		return false
+	}
+	conn.dedupMu.Lock()
+	defer conn.dedupMu.Unlock()
+	if conn.dedupSeen == nil {
+		conn.dedupSeen = make(map[string]time.Time)
+	}
+	// Sweep out expired entries at most once a window, so the map only
+	// holds roughly a window's worth of msgids.
+	if line.Time.Sub(conn.dedupSwept) >= window {
+		for k, t := range conn.dedupSeen {
+			if line.Time.Sub(t) >= window {
+				delete(conn.dedupSeen, k)
+			}
+		}
+		conn.dedupSwept = line.Time
+	}
+	last, ok := conn.dedupSeen[id]
+	conn.dedupSeen[id] = line.Time
+	return ok && line.Time.Sub(last) < window
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	c, s := setUp(t, false)
+	defer s.tearDown()
+
+	now := time.Unix(1234567890, 0)
+	at := func(raw string, after time.Duration) *Line {
+		l := ParseLine(raw)
+		l.Time = now.Add(after)
+		return l
+	}
+
+	// Nothing is a duplicate with DedupWindow unset.
+	if c.duplicate(at(":nick!user@host PRIVMSG #chan :hi", 0)) ||
+		c.duplicate(at(":nick!user@host PRIVMSG #chan :hi", 0)) {
+		t.Errorf("Line dropped as duplicate without DedupWindow.")
+	}
+
+	c.cfg.DedupWindow = 5 * time.Second
+	tests := []struct {
+		raw   string
+		after time.Duration
+		dup   bool
+	}{
+		// Lines without a msgid are never duplicates, as the same line
+		// can legitimately be sent again, e.g. on rejoining a channel.
+		{":nick!user@host PRIVMSG #chan :hello", 0, false},
+		{":nick!user@host PRIVMSG #chan :hello", time.Second, false},
+		{":nick!user@host JOIN #chan", time.Second, false},
+		{":nick!user@host JOIN #chan", time.Second, false},
+		// Lines with the same msgid are, whatever else differs.
+		{"@msgid=abc :nick!user@host PRIVMSG #chan :one", 2 * time.Second, false},
+		{"@msgid=abc;time=2009-02-13T23:31:30.000Z :nick!user@host PRIVMSG #chan :one", 3 * time.Second, true},
+		{"@msgid=abd :nick!user@host PRIVMSG #chan :one", 3 * time.Second, false},
+		{"@msgid=abe :nick!user@host PRIVMSG #chan :two", 3 * time.Second, false},
+		// Once the window has passed, lines are seen afresh.
+		{"@msgid=abc :nick!user@host PRIVMSG #chan :one", 10 * time.Second, false},
+	}
+	for i, test := range tests {
+		if dup := c.duplicate(at(test.raw, test.after)); dup != test.dup {
+			t.Errorf("%d: duplicate(%q) = %t, expected %t", i, test.raw, dup, test.dup)
+		}
+	}
+
+	// Expired entries are swept out of the map.
+	c.dedupMu.Lock()
+	defer c.dedupMu.Unlock()
+	if len(c.dedupSeen) != 1 {
+		t.Errorf("Expected 1 msgid remembered after sweep, got %d", len(c.dedupSeen))
+	}
+}
+
+func TestDedupDispatch(t *testing.T) {
+	c, s := setUp(t, false)
+	defer s.tearDown()
+
+	c.cfg.DedupWindow = 5 * time.Second
+	internal, user := 0, 0
+	c.handle("DEDUP", HandlerFunc(func(conn *Conn, line *Line) { internal++ }))
+	c.HandleFunc("DEDUP", func(conn *Conn, line *Line) { user++ })
+
+	// Internal handlers see duplicates; others don't.
+	c.dispatch(ParseLine("@msgid=abc :nick!user@host DEDUP #chan"))
+	c.dispatch(ParseLine("@msgid=abc :nick!user@host DEDUP #chan"))
+	c.dispatch(ParseLine(":nick!user@host DEDUP #chan"))
+	c.dispatch(ParseLine(":nick!user@host DEDUP #chan"))
+	if internal != 4 || user != 3 {
+		t.Errorf("Internal handlers called %d times, others %d; expected 4, 3",
+			internal, user)
+	}
+}
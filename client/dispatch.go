@@ -1,6 +1,7 @@
 package client
 
 import (
+	"hash/fnv"
 	"runtime"
 	"strings"
 	"sync"
@@ -83,6 +84,10 @@ func (hs *hSet) add(ev string, h Handler) Remover {
 	hs.Lock()
 	defer hs.Unlock()
 	ev = strings.ToLower(ev)
+	if n, ok := numericsByName[ev]; ok {
+		// handlers for e.g. RPL_WELCOME are run for 001
+		ev = n
+	}
 	l, ok := hs.set[ev]
 	if !ok {
 		l = &hList{}
@@ -144,6 +149,17 @@ func (hs *hSet) getHandlers(ev string) []*hNode {
 	return handlers
 }
 
+// count adds the number of handlers for each event to counts.
+func (hs *hSet) count(counts map[string]int) {
+	hs.RLock()
+	defer hs.RUnlock()
+	for ev, list := range hs.set {
+		for hn := list.start; hn != nil; hn = hn.next {
+			counts[ev]++
+		}
+	}
+}
+
 func (hs *hSet) dispatch(conn *Conn, line *Line) {
 	ev := strings.ToLower(line.Cmd)
 	wg := &sync.WaitGroup{}
@@ -181,15 +197,113 @@ func (conn *Conn) HandleFunc(name string, hf HandlerFunc) Remover {
 	return conn.Handle(name, hf)
 }
 
+// RegisteredEvents returns the number of handlers added with Handle,
+// HandleBG or HandleFunc for each event, keyed by lower-cased event name.
+// Handlers added for a numeric's symbolic name are counted under the numeric.
+// The client's own internal handlers are not included.
+func (conn *Conn) RegisteredEvents() map[string]int {
+	counts := make(map[string]int)
+	conn.fgHandlers.count(counts)
+	conn.bgHandlers.count(counts)
+	return counts
+}
+
 func (conn *Conn) dispatch(line *Line) {
 	// We run the internal handlers first, including all state tracking ones.
 	// This ensures that user-supplied handlers that use the tracker have a
 	// consistent view of the connection state in handlers that mutate it.
 	conn.intHandlers.dispatch(conn, line)
+	line = conn.selfEvent(line)
+	if conn.duplicate(line) {
+		logging.Debug("irc.dispatch(): dropping duplicate %s", line.Cmd)
+		return
+	}
+	if conn.held(line) {
+		return
+	}
 	go conn.bgHandlers.dispatch(conn, line)
 	conn.fgHandlers.dispatch(conn, line)
 }
 
+// dispatchPartitioned runs the internal handlers for a line in order, then
+// hands it to the worker responsible for the line's source so that the
+// foreground handlers for lines from one source are run sequentially.
+func (conn *Conn) dispatchPartitioned(line *Line) {
+	conn.intHandlers.dispatch(conn, line)
+	line = conn.selfEvent(line)
+	if conn.duplicate(line) {
+		logging.Debug("irc.dispatch(): dropping duplicate %s", line.Cmd)
+		return
+	}
+	if conn.held(line) {
+		return
+	}
+	go conn.bgHandlers.dispatch(conn, line)
+	select {
+	case conn.workerFor(line) <- line:
+	case <-conn.die:
+	}
+}
+
+// Events dispatched in place of our own lines if Config.SuppressSelfEvents.
+var selfEvents = map[string]string{
+	JOIN:    SELF_JOIN,
+	PART:    SELF_PART,
+	NICK:    SELF_NICK,
+	PRIVMSG: SELF_PRIVMSG,
+}
+
+// selfEvent returns the SELF_* event that handlers other than the internal
+// ones should see instead of line if Config.SuppressSelfEvents is set and
+// line is one of ours, or line otherwise. It is called after the internal
+// handlers have run, so our nick has already changed for a NICK.
+func (conn *Conn) selfEvent(line *Line) *Line {
+	ev, ok := selfEvents[line.Cmd]
+	if !conn.cfg.SuppressSelfEvents || !ok || line.Internal || line.Nick == "" {
+		return line
+	}
+	me := conn.Casefold(conn.Me().Nick)
+	if conn.Casefold(line.Nick) != me &&
+		!(line.Cmd == NICK && line.argslen(0) && conn.Casefold(line.Args[0]) == me) {
+		return line
+	}
+	l := line.Copy()
+	l.Cmd = ev
+	if ev == SELF_PART && len(l.Args) == 1 {
+		// as dispatched by h_PART, the part message is always in Args[1]
+		l.Args = append(l.Args, "")
+	}
+	return l
+}
+
+// workerFor hashes the dispatch key of a line to pick a worker.
+func (conn *Conn) workerFor(line *Line) chan *Line {
+	var key string
+	if conn.cfg.DispatchKey != nil {
+		key = conn.cfg.DispatchKey(line)
+	} else if key = line.Nick; key == "" {
+		key = line.Src
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return conn.workers[h.Sum32()%uint32(len(conn.workers))]
+}
+
+// worker is started as a goroutine for each of Config.DispatchWorkers after
+// a connection is established. It runs foreground handlers for the lines
+// it is given, and is killed when Conn.die is closed.
+func (conn *Conn) worker(in chan *Line) {
+	defer conn.wg.Done()
+	for {
+		select {
+		case line := <-in:
+			conn.fgHandlers.dispatch(conn, line)
+		case <-conn.die:
+			return
+		}
+	}
+}
+
 // LogPanic is used as the default panic catcher for the client. If, like me,
 // you are not good with computer, and you'd prefer your bot not to vanish into
 // the ether whenever you make unfortunate programming mistakes, you may find
@@ -1,6 +1,10 @@
 package client
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -199,3 +203,139 @@ func TestPanicRecovery(t *testing.T) {
 	c.in <- ParseLine(":nick!user@host.com PRIVMSG #channel :OH NO PIGEONS")
 	recovered.assertWasCalled("Failed to recover panic!")
 }
+
+func TestDispatchWorkers(t *testing.T) {
+	// Passing a second value to setUp stops goroutines from starting
+	c, s := setUp(t, false)
+	defer s.tearDown()
+
+	c.cfg.DispatchWorkers = 4
+	for i := 0; i < c.cfg.DispatchWorkers; i++ {
+		c.workers = append(c.workers, make(chan *Line, 32))
+	}
+
+	// Lines from the same source should always go to the same worker.
+	l1 := ParseLine(":nick1!user@host.com PRIVMSG #channel :one")
+	l2 := ParseLine(":nick1!user@host.com PRIVMSG #other :two")
+	if c.workerFor(l1) != c.workerFor(l2) {
+		t.Errorf("Lines from the same nick partitioned to different workers.")
+	}
+	c.cfg.DispatchKey = func(l *Line) string { return l.Target() }
+	if c.workerFor(l1) == c.workerFor(l2) && c.workerFor(l1) ==
+		c.workerFor(ParseLine(":nick1!user@host.com PRIVMSG #third :three")) {
+		t.Errorf("DispatchKey not used to partition lines.")
+	}
+	c.cfg.DispatchKey = nil
+
+	// Check that ordering is preserved per source.
+	var mu sync.Mutex
+	seen := make(map[string][]string)
+	done := make(chan struct{})
+	c.HandleFunc(PRIVMSG, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[line.Nick] = append(seen[line.Nick], line.Text())
+		if len(seen["nick1"])+len(seen["nick2"]) == 20 {
+			close(done)
+		}
+	})
+	c.wg.Add(1 + len(c.workers))
+	go c.runLoop()
+	for _, w := range c.workers {
+		go c.worker(w)
+	}
+	for i := 0; i < 10; i++ {
+		for _, n := range []string{"nick1", "nick2"} {
+			c.in <- ParseLine(fmt.Sprintf(":%s!user@host.com PRIVMSG #channel :%d", n, i))
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("Not all lines were dispatched to workers.")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for n, texts := range seen {
+		for i, text := range texts {
+			if text != fmt.Sprintf("%d", i) {
+				t.Errorf("Lines from %s dispatched out of order: %v", n, texts)
+				break
+			}
+		}
+	}
+}
+
+func TestRegisteredEvents(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if ev := c.RegisteredEvents(); len(ev) != 0 {
+		t.Errorf("Internal handlers included in registered events: %v", ev)
+	}
+	nop := func(conn *Conn, line *Line) {}
+	r := c.HandleFunc(PRIVMSG, nop)
+	c.HandleFunc("privmsg", nop)
+	c.HandleBG(PRIVMSG, HandlerFunc(nop))
+	c.HandleFunc(CONNECTED, nop)
+	exp := map[string]int{"privmsg": 3, "connected": 1}
+	if ev := c.RegisteredEvents(); !reflect.DeepEqual(ev, exp) {
+		t.Errorf("Expected registered events %v, got %v", exp, ev)
+	}
+	r.Remove()
+	exp["privmsg"] = 2
+	if ev := c.RegisteredEvents(); !reflect.DeepEqual(ev, exp) {
+		t.Errorf("Expected registered events %v, got %v", exp, ev)
+	}
+}
+
+func TestSuppressSelfEvents(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+	c.st = nil
+	defer func() { c.st = s.st }()
+
+	var mu sync.Mutex
+	events := []string{}
+	record := func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, line.Cmd+" "+strings.Join(line.Args, "|"))
+	}
+	for _, ev := range []string{JOIN, PART, NICK, PRIVMSG,
+		SELF_JOIN, SELF_PART, SELF_NICK, SELF_PRIVMSG} {
+		c.HandleFunc(ev, record)
+	}
+	lines := []string{
+		":test!ident@host JOIN #a",
+		":other!ident@host JOIN #a",
+		":test!ident@host PRIVMSG #a :hello",
+		":other!ident@host PRIVMSG #a :hi",
+		":test!ident@host NICK :test2",
+		":test2!ident@host PART #a",
+	}
+	for _, l := range lines {
+		c.dispatch(ParseLine(l))
+	}
+	c.cfg.SuppressSelfEvents = true
+	c.cfg.Me.Nick = "test"
+	for _, l := range lines {
+		c.dispatch(ParseLine(l))
+	}
+	// Our nick was still changed by the internal NICK handler.
+	if c.cfg.Me.Nick != "test2" {
+		t.Errorf("NICK did not result in changing our nick.")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	exp := []string{
+		"JOIN #a", "JOIN #a", "PRIVMSG #a|hello", "PRIVMSG #a|hi",
+		"NICK test2", "PART #a",
+		"SELF_JOIN #a", "JOIN #a", "SELF_PRIVMSG #a|hello", "PRIVMSG #a|hi",
+		"SELF_NICK test2", "SELF_PART #a|",
+	}
+	if !reflect.DeepEqual(events, exp) {
+		t.Errorf("Incorrect events:\n%q\nwant\n%q", events, exp)
+	}
+}
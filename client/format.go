@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// IRC formatting control codes.
+const (
+	fmtBold      = '\x02'
+	fmtColor     = '\x03'
+	fmtReset     = '\x0f'
+	fmtReverse   = '\x16'
+	fmtItalic    = '\x1d'
+	fmtUnderline = '\x1f'
+)
+
+// mIRC colors, for use with Color.
+const (
+	White = iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Purple
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+)
+
+// Bold returns s wrapped in bold control codes.
+func Bold(s string) string { return wrapFormat(fmtBold, s) }
+
+// Underline returns s wrapped in underline control codes.
+func Underline(s string) string { return wrapFormat(fmtUnderline, s) }
+
+// wrapFormat wraps s in the toggle code c. Any c already in s is dropped
+// so nesting doesn't toggle the format off early, and it is reapplied
+// after any reset code in s.
+func wrapFormat(c byte, s string) string {
+	code := string(c)
+	s = strings.Replace(s, code, "", -1)
+	s = strings.Replace(s, string(fmtReset), string(fmtReset)+code, -1)
+	return code + s + code
+}
+
+// Color returns s in foreground color fg on background color bg, which
+// may be -1 to keep the current background. Colors set within s are
+// honoured, but when they end the outer colors are restored, so
+//   Color(Red, -1, "a "+Color(Blue, -1, "b")+" c")
+// has both "a" and "c" in red.
+func Color(fg, bg int, s string) string {
+	code := fmt.Sprintf("%c%02d", fmtColor, fg)
+	if bg >= 0 {
+		code += fmt.Sprintf(",%02d", bg)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(code)
+	for i := 0; i < len(s); i++ {
+		buf.WriteByte(s[i])
+		switch {
+		case s[i] == fmtReset:
+			buf.WriteString(code)
+		case s[i] == fmtColor && digits(s[i+1:]) == 0:
+			// A bare \x03 ends a nested color; switch back to ours.
+			buf.Truncate(buf.Len() - 1)
+			buf.WriteString(code)
+		}
+	}
+	buf.WriteByte(fmtColor)
+	return buf.String()
+}
+
+// StripFormatting removes mIRC formatting from s: bold, italic, underline,
+// reverse and reset codes, and color codes along with the (up to two digit)
+// foreground and background colors that follow them.
+func StripFormatting(s string) string {
+	if strings.IndexFunc(s, isFormatting) == -1 {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case fmtBold, fmtReset, fmtReverse, fmtItalic, fmtUnderline:
+		case fmtColor:
+			// \x03[fg[,bg]], where fg and bg are one or two digits.
+			fg := digits(s[i+1:])
+			i += fg
+			if fg > 0 && i+2 < len(s) && s[i+1] == ',' && digits(s[i+2:]) > 0 {
+				i += 1 + digits(s[i+2:])
+			}
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+func isFormatting(r rune) bool {
+	switch r {
+	case fmtBold, fmtColor, fmtReset, fmtReverse, fmtItalic, fmtUnderline:
+		return true
+	}
+	return false
+}
+
+// digits returns the number of digits, up to two, at the start of s.
+func digits(s string) int {
+	n := 0
+	for n < 2 && n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// StripCTCP removes CTCP framing from s, returning the text of a CTCP
+// message without its \001 delimiters or CTCP command, e.g.
+//   StripCTCP("\001ACTION waves\001") == "waves"
+// Text that isn't a CTCP message is returned with any stray \001s removed.
+func StripCTCP(s string) string {
+	if strings.HasPrefix(s, "\001") {
+		s = strings.TrimSuffix(s[1:], "\001")
+		if idx := strings.Index(s, " "); idx != -1 {
+			s = s[idx+1:]
+		} else {
+			s = ""
+		}
+	}
+	return strings.Replace(s, "\001", "", -1)
+}
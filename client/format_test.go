@@ -0,0 +1,66 @@
+package client
+
+import "testing"
+
+func TestStripFormatting(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"plain text", "plain text"},
+		{"\x02bold\x02 \x1funderline\x1f \x1ditalic\x1d", "bold underline italic"},
+		{"\x16reverse\x0f reset", "reverse reset"},
+		{"\x034red\x03 \x0304,12red on blue\x03", "red red on blue"},
+		// Only two digits are color, and a comma needs a foreground.
+		{"\x03123", "3"},
+		{"\x034,", ","},
+		{"\x03,5", ",5"},
+		{"\x0312,345", "5"},
+	}
+	for _, test := range tests {
+		if out := StripFormatting(test.in); out != test.out {
+			t.Errorf("StripFormatting(%q) = %q, want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestStripCTCP(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"plain text", "plain text"},
+		{"\001ACTION waves\001", "waves"},
+		{"\001ACTION waves", "waves"},
+		{"\001VERSION\001", ""},
+		{"stray\001 delims\001", "stray delims"},
+	}
+	for _, test := range tests {
+		if out := StripCTCP(test.in); out != test.out {
+			t.Errorf("StripCTCP(%q) = %q, want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestFormatHelpers(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{Bold("bold"), "\x02bold\x02"},
+		{Underline("under"), "\x1funder\x1f"},
+		{Color(Red, -1, "red"), "\x0304red\x03"},
+		{Color(White, Blue, "1st"), "\x0300,021st\x03"},
+		// Nesting shouldn't turn formatting off early.
+		{Bold("a " + Bold("b") + " c"), "\x02a b c\x02"},
+		{Bold("a\x0fb"), "\x02a\x0f\x02b\x02"},
+		{Color(Red, -1, "a "+Color(Blue, -1, "b")+" c"),
+			"\x0304a \x0302b\x0304 c\x03"},
+		{Color(Red, Black, "a\x0fb"), "\x0304,01a\x0f\x0304,01b\x03"},
+	}
+	for i, test := range tests {
+		if test.in != test.out {
+			t.Errorf("Test %d: got %q, want %q", i, test.in, test.out)
+		}
+	}
+	if s := Color(Red, -1, Bold("a")+Underline("b")); StripFormatting(s) != "ab" {
+		t.Errorf("Formatted text not stripped cleanly: %q", StripFormatting(s))
+	}
+}
@@ -4,18 +4,67 @@ package client
 // to manage tracking an irc connection etc.
 
 import (
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/lfkeitel/goirc/logging"
+	"github.com/lfkeitel/goirc/state"
 )
 
 // sets up the internal event handlers to do essential IRC protocol things
 var intHandlers = map[string]HandlerFunc{
-	REGISTER: (*Conn).h_REGISTER,
-	"001":    (*Conn).h_001,
-	"433":    (*Conn).h_433,
-	CTCP:     (*Conn).h_CTCP,
-	NICK:     (*Conn).h_NICK,
-	PING:     (*Conn).h_PING,
+	REGISTER:     (*Conn).h_REGISTER,
+	"001":        (*Conn).h_001,
+	"004":        (*Conn).h_004,
+	"005":        (*Conn).h_005,
+	"221":        (*Conn).h_221,
+	"281":        (*Conn).h_281,
+	"282":        (*Conn).h_282,
+	"302":        (*Conn).h_302,
+	"305":        (*Conn).h_305,
+	"306":        (*Conn).h_306,
+	"315":        (*Conn).h_315,
+	"328":        (*Conn).h_328,
+	"333":        (*Conn).h_333,
+	"351":        (*Conn).h_351,
+	"376":        (*Conn).h_READY,
+	"403":        (*Conn).h_JOINFAILED,
+	"405":        (*Conn).h_405,
+	"422":        (*Conn).h_READY,
+	"433":        (*Conn).h_433,
+	"437":        (*Conn).h_437,
+	"470":        (*Conn).h_470,
+	"471":        (*Conn).h_JOINFAILED,
+	"473":        (*Conn).h_JOINFAILED,
+	"474":        (*Conn).h_JOINFAILED,
+	"475":        (*Conn).h_JOINFAILED,
+	"476":        (*Conn).h_JOINFAILED,
+	"477":        (*Conn).h_JOINFAILED,
+	"480":        (*Conn).h_JOINFAILED,
+	"716":        (*Conn).h_716,
+	"717":        (*Conn).h_717,
+	"718":        (*Conn).h_718,
+	"900":        (*Conn).h_IDENTIFIED,
+	"902":        (*Conn).h_SASLDONE,
+	"903":        (*Conn).h_SASLDONE,
+	"904":        (*Conn).h_SASLDONE,
+	"905":        (*Conn).h_SASLDONE,
+	"906":        (*Conn).h_SASLDONE,
+	"907":        (*Conn).h_SASLDONE,
+	"908":        (*Conn).h_908,
+	AUTHENTICATE: (*Conn).h_AUTHENTICATE,
+	CAP:          (*Conn).h_CAP,
+	CTCP:         (*Conn).h_CTCP,
+	CTCPREPLY:    (*Conn).h_CTCPREPLY,
+	ERROR:        (*Conn).h_ERROR,
+	JOIN:         (*Conn).h_FORCEDJOIN,
+	NICK:         (*Conn).h_NICK,
+	NOTICE:       (*Conn).h_NOTICE,
+	PING:         (*Conn).h_PING,
+	PONG:         (*Conn).h_PONG,
+	TAGMSG:       (*Conn).h_TAGMSG,
 }
 
 func (conn *Conn) addIntHandlers() {
@@ -26,24 +75,59 @@ func (conn *Conn) addIntHandlers() {
 	}
 }
 
-// Basic ping/pong handler
+// Basic ping/pong handler. Internal handlers are active as soon as we've
+// connected, so this also answers the PING cookies some servers send before
+// they'll let us register. PONGs are never held back by
+// Config.QueueUntilRegistered or Config.DryRun.
+//   PING :cookie
 func (conn *Conn) h_PING(line *Line) {
+	if !line.argslen(0) {
+		return
+	}
 	conn.Pong(line.Args[0])
 }
 
 // Handler for initial registration with server once tcp connection is made.
 func (conn *Conn) h_REGISTER(line *Line) {
+	if len(conn.cfg.RequestCaps) > 0 || conn.cfg.SuppressNamesOnJoin ||
+		len(conn.cfg.SASLMechs) > 0 || conn.cfg.PolicyStore != nil {
+		// registration is suspended until we send CAP END in h_CAP
+		conn.capMu.Lock()
+		conn.capNeg = true
+		conn.capMu.Unlock()
+		conn.Raw(CAP + " LS 302")
+	}
 	if conn.cfg.Pass != "" {
 		conn.Pass(conn.cfg.Pass)
 	}
+	conn.recoverMu.Lock()
+	if conn.preferredNick == "" {
+		conn.preferredNick = conn.cfg.Me.Nick
+	}
+	conn.recoverMu.Unlock()
 	conn.Nick(conn.cfg.Me.Nick)
 	conn.User(conn.cfg.Me.Ident, conn.cfg.Me.Name)
 }
 
 // Handler to trigger a CONNECTED event on receipt of numeric 001
 func (conn *Conn) h_001(line *Line) {
-	// we're connected!
-	conn.dispatch(&Line{Cmd: CONNECTED, Time: time.Now()})
+	// we're connected! send anything queued while we were registering
+	conn.flushQueued()
+	conn.reconnMu.Lock()
+	conn.reconnAttempts = 0
+	conn.reconnMu.Unlock()
+	conn.recoverNick()
+	if conn.cfg.AwayOnConnect != "" {
+		conn.Away(conn.cfg.AwayOnConnect)
+	}
+	for _, l := range conn.cfg.OnConnect {
+		if l == "" || strings.ContainsAny(l, "\r\n") {
+			logging.Warn("irc.OnConnect(): skipping bad line %q", conn.mask(l))
+			continue
+		}
+		conn.Raw(l)
+	}
+	conn.dispatch(&Line{Cmd: CONNECTED, Internal: true, Time: time.Now()})
 	// and we're being given our hostname (from the server's perspective)
 	t := line.Args[len(line.Args)-1]
 	if idx := strings.LastIndex(t, " "); idx != -1 {
@@ -57,18 +141,246 @@ func (conn *Conn) h_001(line *Line) {
 			}
 		}
 	}
+	if conn.cfg.GuessNetwork {
+		conn.guessNetwork(line.Text())
+	}
+	// if we weren't given our hostname, optionally ask the server for it
+	if conn.cfg.ResolveOwnHost {
+		if me := conn.Me(); me.Host == "" {
+			conn.Userhost(me.Nick)
+		}
+	}
+}
+
+// Handler for the end of the MOTD, or 422 ERR_NOMOTD if there isn't one,
+// to close the channel returned by Ready, unless we're waiting to identify
+// to services first.
+//   :server 376 me :End of /MOTD command.
+func (conn *Conn) h_READY(line *Line) {
+	if conn.cfg.WaitForIdentify == nil {
+		conn.setReady()
+		return
+	}
+	conn.regMu.Lock()
+	first := !conn.motdDone
+	conn.motdDone = true
+	identified := conn.identified
+	conn.regMu.Unlock()
+	if identified {
+		conn.setReady()
+		return
+	}
+	if !first {
+		return
+	}
+	d := conn.cfg.IdentifyTimeout
+	if d <= 0 {
+		d = 30 * time.Second
+	}
+	conn.After(d, func(conn *Conn) {
+		select {
+		case <-conn.Ready():
+		default:
+			logging.Warn("irc.Ready(): not identified after %s, continuing", d)
+			conn.setReady()
+		}
+	})
+}
+
+// Handler for NOTICEs, which may tell us we've identified or that the
+// server is going down.
+func (conn *Conn) h_NOTICE(line *Line) {
+	conn.h_IDENTIFIED(line)
+	conn.h_SHUTDOWN(line)
+}
+
+// Handler for NOTICEs from Config.IdentifyNick matching
+// Config.WaitForIdentify, or 900 RPL_LOGGEDIN, which tell us we've
+// identified to services, to close the channel returned by Ready if the
+// MOTD has been received.
+//   :NickServ!NickServ@services. NOTICE me :You are now identified for me.
+//   :server 900 me me!ident@host account :You are now logged in as account
+func (conn *Conn) h_IDENTIFIED(line *Line) {
+	re := conn.cfg.WaitForIdentify
+	if re == nil {
+		return
+	}
+	if line.Cmd == NOTICE && (len(line.Args) < 2 || line.Public() ||
+		conn.Casefold(line.Nick) != conn.Casefold(conn.identifyNick()) ||
+		!re.MatchString(line.Text())) {
+		return
+	}
+	conn.regMu.Lock()
+	conn.identified = true
+	motdDone := conn.motdDone
+	conn.regMu.Unlock()
+	if motdDone {
+		conn.setReady()
+	}
+}
+
+// identifyNick returns Config.IdentifyNick, or NickServ if it isn't set.
+func (conn *Conn) identifyNick() string {
+	if conn.cfg.IdentifyNick != "" {
+		return conn.cfg.IdentifyNick
+	}
+	return "NickServ"
+}
+
+// Handler for 302 USERHOST replies, to update our own hostname.
+//   :server 302 me :nick[*]=[+|-]ident@host ...
+func (conn *Conn) h_302(line *Line) {
+	me := conn.Me()
+	for _, reply := range strings.Fields(line.Text()) {
+		idx := strings.Index(reply, "=")
+		if idx == -1 || strings.TrimSuffix(reply[:idx], "*") != me.Nick {
+			continue
+		}
+		// skip the away status character, + or -
+		uh := strings.SplitN(strings.TrimLeft(reply[idx+1:], "+-"), "@", 2)
+		if len(uh) != 2 {
+			return
+		}
+		if conn.st != nil {
+			conn.st.NickInfo(me.Nick, uh[0], uh[1], me.Name)
+		} else {
+			conn.cfg.Me.Ident, conn.cfg.Me.Host = uh[0], uh[1]
+		}
+		return
+	}
+}
+
+// Handler for 305 RPL_UNAWAY, to mark ourselves as no longer away.
+// An AWAY_CLEARED event is dispatched once our state has been updated.
+//   :server 305 me :You are no longer marked as being away
+func (conn *Conn) h_305(line *Line) {
+	conn.setAway(line, false, "")
+}
+
+// Handler for 306 RPL_NOWAWAY, to mark ourselves as away with the
+// message we sent in our last AWAY. An AWAY_SET event is dispatched
+// with that message in Args[0] once our state has been updated.
+//   :server 306 me :You have been marked as being away
+func (conn *Conn) h_306(line *Line) {
+	conn.awayMu.Lock()
+	msg := conn.awayMsg
+	conn.awayMu.Unlock()
+	conn.setAway(line, true, msg)
+}
+
+// setAway records the away status the server confirmed in line, and
+// dispatches AWAY_SET or AWAY_CLEARED with line's Time, so handlers know
+// when the change took effect.
+func (conn *Conn) setAway(line *Line, away bool, msg string) {
+	if st := conn.st; st != nil {
+		st.NickAway(conn.Me().Nick, away, msg)
+	} else {
+		conn.cfg.Me.Away, conn.cfg.Me.AwayMessage = away, msg
+	}
+	l := line.Copy()
+	l.Cmd, l.Args = AWAY_CLEARED, []string{}
+	if away {
+		l.Cmd, l.Args = AWAY_SET, []string{msg}
+	}
+	l.Internal = true
+	conn.dispatch(l)
+}
+
+// Handler for 221 RPL_UMODEIS, the reply to a MODE query for our own nick.
+// If we're tracking state, our user modes are replaced with those in the
+// reply, then a UMODE_SYNC event is dispatched with the modes in Args.
+//   :server 221 me +iwx
+func (conn *Conn) h_221(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	modes := line.Args[1]
+	if !strings.HasPrefix(modes, "+") {
+		modes = "+" + modes
+	}
+	if st := conn.st; st != nil {
+		// unset every mode the tracker knows, then set those we have
+		var known []string
+		for _, m := range state.NickModeToString {
+			known = append(known, m)
+		}
+		sort.Strings(known)
+		st.NickModes(st.Me().Nick,
+			"-"+strings.Join(known, "")+conn.botModes(modes))
+	}
+	l := line.Copy()
+	l.Cmd, l.Args = UMODE_SYNC, []string{modes}
+	l.Internal = true
+	conn.dispatch(l)
+}
+
+// Handler for 328 RPL_CHANNEL_URL, which some servers send on join with
+// the channel's website. If we're tracking the channel its URL is updated,
+// then a CHANNEL_URL event is dispatched with the channel and URL in Args.
+//   :server 328 me #channel :http://example.com/
+func (conn *Conn) h_328(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	if st := conn.st; st != nil {
+		if ch := st.GetChannel(line.Args[1]); ch != nil {
+			st.ChannelURL(line.Args[1], line.Args[2])
+		} else {
+			logging.Warn("irc.328(): received URL for unknown channel %s",
+				line.Args[1])
+		}
+	}
+	l := line.Copy()
+	l.Cmd, l.Args = CHANNEL_URL, []string{line.Args[1], line.Args[2]}
+	l.Internal = true
+	conn.dispatch(l)
 }
 
-// XXX: do we need 005 protocol support message parsing here?
-// probably in the future, but I can't quite be arsed yet.
-/*
-	:irc.pl0rt.org 005 GoTest CMDS=KNOCK,MAP,DCCALLOW,USERIP UHNAMES NAMESX SAFELIST HCN MAXCHANNELS=20 CHANLIMIT=#:20 MAXLIST=b:60,e:60,I:60 NICKLEN=30 CHANNELLEN=32 TOPICLEN=307 KICKLEN=307 AWAYLEN=307 :are supported by this server
-	:irc.pl0rt.org 005 GoTest MAXTARGETS=20 WALLCHOPS WATCH=128 WATCHOPTS=A SILENCE=15 MODES=12 CHANTYPES=# PREFIX=(qaohv)~&@%+ CHANMODES=beI,kfL,lj,psmntirRcOAQKVCuzNSMT NETWORK=bb101.net CASEMAPPING=ascii EXTBAN=~,cqnr ELIST=MNUCT :are supported by this server
-	:irc.pl0rt.org 005 GoTest STATUSMSG=~&@%+ EXCEPTS INVEX :are supported by this server
-*/
+// Handler for 333 RPL_TOPICWHOTIME, sent after 332 with who set the topic
+// and when. Servers differ on whether the setter is a bare nick or a full
+// nick!ident@host, so only the nick is kept. If we're tracking the channel
+// its topic info is updated, then a TOPIC_INFO event is dispatched with the
+// channel, setter's nick and timestamp in Args.
+//   :server 333 me #channel nick!ident@host 1234567890
+func (conn *Conn) h_333(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	setBy := line.Args[2]
+	if i := strings.IndexAny(setBy, "!@"); i > 0 {
+		setBy = setBy[:i]
+	}
+	var ts string
+	var t time.Time
+	if len(line.Args) > 3 {
+		ts = strings.TrimSpace(line.Args[3])
+		if secs, err := strconv.ParseInt(ts, 10, 64); err == nil && secs > 0 {
+			t = time.Unix(secs, 0)
+		} else {
+			logging.Warn("irc.333(): bad topic time %s for channel %s",
+				line.Args[3], line.Args[1])
+		}
+	}
+	if st := conn.st; st != nil {
+		if ch := st.GetChannel(line.Args[1]); ch != nil {
+			st.TopicInfo(line.Args[1], setBy, t)
+			conn.synced(line.Args[1], syncTopicWho)
+		} else {
+			logging.Warn("irc.333(): received topic info for unknown channel %s",
+				line.Args[1])
+		}
+	}
+	l := line.Copy()
+	l.Cmd, l.Args = TOPIC_INFO, []string{line.Args[1], setBy, ts}
+	l.Internal = true
+	conn.dispatch(l)
+}
 
 // Handler to deal with "433 :Nickname already in use"
 func (conn *Conn) h_433(line *Line) {
+	if conn.recoverRefused(line) {
+		return
+	}
 	// Args[1] is the new nick we were attempting to acquire
 	me := conn.Me()
 	neu := conn.cfg.NewNick(line.Args[1])
@@ -88,18 +400,77 @@ func (conn *Conn) h_433(line *Line) {
 	}
 }
 
-// Handle VERSION requests and CTCP PING
+// Handle VERSION requests, CTCP PING and, if Config.TimeFormat is set, TIME
 func (conn *Conn) h_CTCP(line *Line) {
-	if line.Args[0] == VERSION {
+	switch line.Args[0] {
+	case VERSION, PING:
+	case TIME:
+		if conn.cfg.TimeFormat == "" {
+			return
+		}
+	default:
+		return
+	}
+	if !conn.ctcpReplyAllowed(line.Nick) {
+		return
+	}
+	switch {
+	case line.Args[0] == VERSION:
 		conn.CtcpReply(line.Nick, VERSION, conn.cfg.Version)
-	} else if line.Args[0] == PING && line.argslen(2) {
+	case line.Args[0] == PING && line.argslen(2):
 		conn.CtcpReply(line.Nick, PING, line.Args[2])
+	case line.Args[0] == TIME:
+		conn.CtcpReply(line.Nick, TIME, conn.LocalTime())
+	}
+}
+
+// LocalTime returns the current time formatted with Config.TimeFormat, as
+// sent in reply to CTCP TIME, or time.RFC1123 if that isn't set.
+func (conn *Conn) LocalTime() string {
+	layout := conn.cfg.TimeFormat
+	if layout == "" {
+		layout = time.RFC1123
+	}
+	return time.Now().Format(layout)
+}
+
+// Handle CTCP PING replies to PINGs sent by CtcpPing
+func (conn *Conn) h_CTCPREPLY(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	switch line.Args[0] {
+	case PING:
+		conn.ctcpPingDone(line.Args[2], line.Nick, line.Time)
+	case VERSION:
+		if st := conn.st; st != nil && st.GetNick(line.Nick) != nil {
+			st.NickVersion(line.Nick, line.Args[2])
+		}
 	}
 }
 
 // Handle updating our own NICK if we're not using the state tracker
 func (conn *Conn) h_NICK(line *Line) {
 	if conn.st == nil && line.Nick == conn.cfg.Me.Nick {
+		requested := conn.cfg.Me.RequestedNick
 		conn.cfg.Me.Nick = line.Args[0]
+		conn.recovered(line.Args[0])
+		conn.forcedNick(line, requested)
+	}
+}
+
+// forcedNick dispatches a FORCED_NICK event if line, which changed our
+// nick, changed it to something other than the nick we last asked for,
+// e.g. because services renamed us with SVSNICK. The event has our old
+// nick in Args[0] and our new one in Args[1].
+func (conn *Conn) forcedNick(line *Line, requested string) {
+	if !line.argslen(0) || conn.Casefold(line.Args[0]) == conn.Casefold(requested) {
+		return
 	}
+	logging.Warn("irc.NICK(): nick changed from %s to %s, but we asked for %s",
+		line.Nick, line.Args[0], requested)
+	l := line.Copy()
+	l.Cmd, l.Args = FORCED_NICK, []string{line.Nick, line.Args[0]}
+	l.Internal = true
+	conn.dispatch(l)
 }
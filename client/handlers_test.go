@@ -3,6 +3,9 @@ package client
 import (
 	"github.com/lfkeitel/goirc/state"
 	"github.com/golang/mock/gomock"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -12,10 +15,20 @@ import (
 // in this file will call their respective handlers synchronously, otherwise
 // testing becomes more difficult.
 func TestPING(t *testing.T) {
-	_, s := setUp(t)
+	c, s := setUp(t)
 	defer s.tearDown()
 	s.nc.Send("PING :1234567890")
 	s.nc.Expect("PONG :1234567890")
+
+	// PINGs must be answered before registration completes, even when
+	// other commands are being held back until then.
+	c.cfg.QueueUntilRegistered = true
+	s.nc.Send("PING 0xDEADBEEF")
+	s.nc.Expect("PONG :0xDEADBEEF")
+
+	// A PING without a cookie shouldn't crash us.
+	c.h_PING(ParseLine("PING"))
+	s.nc.ExpectNothing()
 }
 
 // Test the REGISTER handler matches section 3.1 of rfc2812
@@ -23,6 +36,7 @@ func TestREGISTER(t *testing.T) {
 	c, s := setUp(t)
 	defer s.tearDown()
 
+	s.st.EXPECT().RequestNick("test").Return(c.cfg.Me).Times(2)
 	c.h_REGISTER(&Line{Cmd: REGISTER})
 	s.nc.Expect("NICK test")
 	s.nc.Expect("USER test 12 * :Testing IRC")
@@ -48,6 +62,9 @@ func Test001(t *testing.T) {
 	hcon := false
 	c.HandleFunc("connected", func(conn *Conn, line *Line) {
 		hcon = true
+		if !line.Internal {
+			t.Errorf("Connected event not marked as internal.")
+		}
 	})
 
 	// Test state tracking first.
@@ -72,6 +89,135 @@ func Test001(t *testing.T) {
 	c.st = s.st
 }
 
+// Test that 001 sends a USERHOST when configured to resolve our own host
+func Test001ResolveOwnHost(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.st = nil
+	c.cfg.ResolveOwnHost = true
+	c.h_001(ParseLine(":irc.server.org 001 test :Welcome to IRC"))
+	s.nc.Expect("USERHOST test")
+
+	// No USERHOST should be sent if the host is in the welcome message.
+	c.h_001(ParseLine(":irc.server.org 001 test :Welcome to IRC test!test@somehost.com"))
+	s.nc.ExpectNothing()
+	c.st = s.st
+}
+
+// Test that 001 sends Config.OnConnect in order, skipping bad lines
+func Test001OnConnect(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.st = nil
+	c.cfg.AwayOnConnect = "I'm a bot"
+	c.cfg.OnConnect = []string{"MODE test +B", "", "JOIN #a\r\nQUIT",
+		"PRIVMSG NickServ :IDENTIFY secret", "JOIN #b\n"}
+	c.h_001(ParseLine(":irc.server.org 001 test :Welcome to IRC"))
+	s.nc.Expect("AWAY :I'm a bot")
+	s.nc.Expect("MODE test +B")
+	s.nc.Expect("PRIVMSG NickServ :IDENTIFY secret")
+	s.nc.ExpectNothing()
+	c.st = s.st
+}
+
+// Test that 001 marks us away when configured to
+func Test001AwayOnConnect(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.st = nil
+	c.cfg.AwayOnConnect = "I'm a bot"
+	c.h_001(ParseLine(":irc.server.org 001 test :Welcome to IRC"))
+	s.nc.Expect("AWAY :I'm a bot")
+
+	// The server confirming we're away should update our away status,
+	c.h_306(ParseLine(":irc.server.org 306 test :You have been marked as being away"))
+	if !c.cfg.Me.Away || c.cfg.Me.AwayMessage != "I'm a bot" {
+		t.Errorf("Not marked away after 306: %#v", c.cfg.Me)
+	}
+	// and coming back should clear it again.
+	c.Away()
+	s.nc.Expect("AWAY")
+	c.h_305(ParseLine(":irc.server.org 305 test :You are no longer marked as being away"))
+	if c.cfg.Me.Away || c.cfg.Me.AwayMessage != "" {
+		t.Errorf("Still marked away after 305: %#v", c.cfg.Me)
+	}
+	c.st = s.st
+
+	// With state tracking, the tracker is told instead.
+	c.Away("gone")
+	s.nc.Expect("AWAY :gone")
+	gomock.InOrder(
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickAway("test", true, "gone"),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickAway("test", false, ""),
+	)
+	c.h_306(ParseLine(":irc.server.org 306 test :You have been marked as being away"))
+	c.h_305(ParseLine(":irc.server.org 305 test :You are no longer marked as being away"))
+}
+
+// Test that 305 and 306 dispatch AWAY_CLEARED and AWAY_SET events
+func TestAwayEvents(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	var mu sync.Mutex
+	events := []*Line{}
+	record := func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, line)
+	}
+	c.HandleFunc(AWAY_SET, record)
+	c.HandleFunc(AWAY_CLEARED, record)
+
+	c.st = nil
+	c.Away("gone")
+	s.nc.Expect("AWAY :gone")
+	set := ParseLine(":irc.server.org 306 test :You have been marked as being away")
+	set.Time = time.Unix(1500000000, 0)
+	c.h_306(set)
+	c.h_305(ParseLine(":irc.server.org 305 test :You are no longer marked as being away"))
+	c.st = s.st
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 away events, got %d.", len(events))
+	}
+	if ev := events[0]; ev.Cmd != AWAY_SET || !ev.Internal ||
+		len(ev.Args) != 1 || ev.Args[0] != "gone" || !ev.Time.Equal(set.Time) {
+		t.Errorf("Incorrect AWAY_SET event: %#v", ev)
+	}
+	if ev := events[1]; ev.Cmd != AWAY_CLEARED || !ev.Internal || len(ev.Args) != 0 {
+		t.Errorf("Incorrect AWAY_CLEARED event: %#v", ev)
+	}
+}
+
+// Test the handler for 302 / RPL_USERHOST
+func Test302(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Ensure 302 reply calls NickInfo for us only
+	gomock.InOrder(
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickInfo("test", "ident", "somehost.com", "Testing IRC"),
+	)
+	c.h_302(ParseLine(":irc.server.org 302 test :other=+moo@cows.com test*=-ident@somehost.com"))
+
+	// Now without state tracking.
+	c.st = nil
+	c.h_302(ParseLine(":irc.server.org 302 test :test=+ident2@otherhost.com"))
+	if c.cfg.Me.Ident != "ident2" || c.cfg.Me.Host != "otherhost.com" {
+		t.Errorf("Host parsing failed, got '%s@%s'.", c.cfg.Me.Ident, c.cfg.Me.Host)
+	}
+	c.st = s.st
+}
+
 // Test the handler for 433 / ERR_NICKNAMEINUSE
 func Test433(t *testing.T) {
 	c, s := setUp(t)
@@ -79,6 +225,7 @@ func Test433(t *testing.T) {
 
 	// Call handler with a 433 line, not triggering c.cfg.Me.Renick()
 	s.st.EXPECT().Me().Return(c.cfg.Me)
+	s.st.EXPECT().RequestNick("new_").Return(c.cfg.Me)
 	c.h_433(ParseLine(":irc.server.org 433 test new :Nickname is already in use."))
 	s.nc.Expect("NICK new_")
 
@@ -88,6 +235,7 @@ func Test433(t *testing.T) {
 	// sent by the server to confirm nick change in this case.
 	gomock.InOrder(
 		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().RequestNick("test_").Return(c.cfg.Me),
 		s.st.EXPECT().ReNick("test", "test_").Return(c.cfg.Me),
 	)
 	c.h_433(ParseLine(":irc.server.org 433 test test :Nickname is already in use."))
@@ -101,6 +249,9 @@ func Test433(t *testing.T) {
 	if c.cfg.Me.Nick != "test_" {
 		t.Errorf("My nick not updated from '%s'.", c.cfg.Me.Nick)
 	}
+	if c.cfg.Me.RequestedNick != "test_" {
+		t.Errorf("Requested nick not updated to 'test_'.")
+	}
 	c.st = s.st
 }
 
@@ -138,6 +289,53 @@ func TestNICK(t *testing.T) {
 	}
 }
 
+// Test that nick changes we didn't ask for dispatch FORCED_NICK events
+func TestForcedNick(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	var mu sync.Mutex
+	events := []string{}
+	c.HandleFunc(FORCED_NICK, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !line.Internal {
+			t.Errorf("FORCED_NICK event not internal: %#v", line)
+		}
+		events = append(events, strings.Join(line.Args, " "))
+	})
+
+	// With state tracking, h_STNICK spots our nick changing.
+	me := &state.Nick{Nick: "test", RequestedNick: "test"}
+	gomock.InOrder(
+		s.st.EXPECT().Me().Return(me),
+		s.st.EXPECT().ReNick("test", "Guest123").Return(&state.Nick{Nick: "Guest123"}),
+		// asking for a nick the server changes the case of is fine
+		s.st.EXPECT().Me().Return(&state.Nick{Nick: "Guest123", RequestedNick: "new"}),
+		s.st.EXPECT().ReNick("Guest123", "NEW").Return(&state.Nick{Nick: "NEW"}),
+		// as is anyone else changing their nick
+		s.st.EXPECT().Me().Return(&state.Nick{Nick: "NEW", RequestedNick: "new"}),
+		s.st.EXPECT().ReNick("blah", "milk").Return(&state.Nick{Nick: "milk"}),
+	)
+	c.h_STNICK(ParseLine(":test!test@somehost.com NICK :Guest123"))
+	c.h_STNICK(ParseLine(":Guest123!test@somehost.com NICK :NEW"))
+	c.h_STNICK(ParseLine(":blah!moo@cows.com NICK :milk"))
+
+	// Without it, h_NICK does.
+	c.st = nil
+	c.cfg.Me = &state.Nick{Nick: "test", RequestedNick: "test"}
+	c.h_NICK(ParseLine(":test!test@somehost.com NICK :Guest456"))
+	c.h_NICK(ParseLine(":blah!moo@cows.com NICK :milk"))
+	c.st = s.st
+
+	mu.Lock()
+	defer mu.Unlock()
+	exp := []string{"test Guest123", "test Guest456"}
+	if !reflect.DeepEqual(events, exp) {
+		t.Errorf("Incorrect FORCED_NICK events: %q, want %q", events, exp)
+	}
+}
+
 // Test the handler for CTCP messages
 func TestCTCP(t *testing.T) {
 	c, s := setUp(t)
@@ -155,6 +353,13 @@ func TestCTCP(t *testing.T) {
 	// Expect a ping reply
 	s.nc.Expect("NOTICE blah :\001PING 1234567890\001")
 
+	// CTCP TIME isn't answered unless TimeFormat is set
+	c.h_CTCP(ParseLine(":blah!moo@cows.com PRIVMSG test :\001TIME\001"))
+	s.nc.ExpectNothing()
+	c.cfg.TimeFormat = "2006"
+	c.h_CTCP(ParseLine(":blah!moo@cows.com PRIVMSG test :\001TIME\001"))
+	s.nc.Expect("NOTICE blah :\001TIME " + time.Now().Format("2006") + "\001")
+
 	// Call handler with CTCP UNKNOWN
 	c.h_CTCP(ParseLine(":blah!moo@cows.com PRIVMSG test :\001UNKNOWN ctcp\001"))
 }
@@ -231,7 +436,24 @@ func TestPART(t *testing.T) {
 
 	// PART should dissociate a nick from a channel.
 	s.st.EXPECT().Dissociate("#test1", "user1")
+	s.st.EXPECT().Me().Return(c.cfg.Me)
 	c.h_PART(ParseLine(":user1!ident1@host1.com PART #test1 :Bye!"))
+
+	// Our own PART should also dispatch SELF_PART.
+	parted := callCheck(t)
+	c.HandleFunc(SELF_PART, func(conn *Conn, line *Line) {
+		if !line.Internal || len(line.Args) != 2 ||
+			line.Args[0] != "#test1" || line.Args[1] != "Bye!" {
+			t.Errorf("Bad SELF_PART event: %#v", line)
+		}
+		parted.call()
+	})
+	gomock.InOrder(
+		s.st.EXPECT().Dissociate("#test1", "test"),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+	)
+	go c.h_PART(ParseLine(":test!test@somehost.com PART #test1 :Bye!"))
+	parted.assertWasCalled("SELF_PART not dispatched on our PART.")
 }
 
 // Test the handler for KICK messages
@@ -243,6 +465,16 @@ func TestKICK(t *testing.T) {
 	// KICK should dissociate a nick from a channel.
 	s.st.EXPECT().Dissociate("#test1", "user1")
 	c.h_KICK(ParseLine(":test!test@somehost.com KICK #test1 user1 :Bye!"))
+
+	// With channel event history, the KICK should be recorded first.
+	c.cfg.ChannelEventHistory = 10
+	l := ParseLine(":test!test@somehost.com KICK #test1 user1 :Bye!")
+	gomock.InOrder(
+		s.st.EXPECT().RecordEvent("#test1", state.Event{Time: l.Time,
+			Cmd: "KICK", Nick: "test", Args: []string{"user1", "Bye!"}}),
+		s.st.EXPECT().Dissociate("#test1", "user1"),
+	)
+	c.h_KICK(l)
 }
 
 // Test the handler for QUIT messages
@@ -255,17 +487,86 @@ func TestQUIT(t *testing.T) {
 	c.h_QUIT(ParseLine(":user1!ident1@host1.com QUIT :Bye!"))
 }
 
+// Test the handler for channel activity
+func TestActivity(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Without TrackActivity nothing should be recorded.
+	c.h_ACTIVE(ParseLine(":user1!ident1@host1.com PRIVMSG #test1 :Hello!"))
+
+	c.cfg.TrackActivity = true
+	for _, raw := range []string{
+		":user1!ident1@host1.com PRIVMSG #test1 :Hello!",
+		":user1!ident1@host1.com NOTICE #test1 :Hello!",
+		":user1!ident1@host1.com PRIVMSG #test1 :\001ACTION waves\001",
+	} {
+		l := ParseLine(raw)
+		s.st.EXPECT().NickActive("#test1", "user1", l.Time)
+		c.h_ACTIVE(l)
+	}
+
+	// Private messages and server notices don't count.
+	c.h_ACTIVE(ParseLine(":user1!ident1@host1.com PRIVMSG test :Hello!"))
+	c.h_ACTIVE(ParseLine(":irc.server.org NOTICE #test1 :Hello!"))
+}
+
+// Test the handler for AWAY messages
+func TestAWAY(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	s.st.EXPECT().NickAway("user1", true, "Gone fishing")
+	c.h_AWAY(ParseLine(":user1!ident1@host1.com AWAY :Gone fishing"))
+
+	// AWAY without a message means the nick is back.
+	s.st.EXPECT().NickAway("user1", false, "")
+	c.h_AWAY(ParseLine(":user1!ident1@host1.com AWAY"))
+}
+
+// Test the handler for CHGHOST messages
+func TestCHGHOST(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	gomock.InOrder(
+		s.st.EXPECT().GetNick("user1").Return(&state.Nick{Nick: "user1", Name: "name"}),
+		s.st.EXPECT().NickInfo("user1", "ident2", "host2.com", "name"),
+	)
+	c.h_CHGHOST(ParseLine(":user1!ident1@host1.com CHGHOST ident2 host2.com"))
+
+	// Check error paths -- CHGHOST for an unknown nick
+	s.st.EXPECT().GetNick("user2").Return(nil)
+	c.h_CHGHOST(ParseLine(":user2!ident2@host2.com CHGHOST ident3 host3.com"))
+}
+
+// Test the handler for RENAME messages
+func TestRENAME(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// RENAME should be ignored without the capability.
+	c.h_RENAME(ParseLine(":irc.server.org RENAME #test1 #test2 :Moving"))
+
+	c.h_CAP(ParseLine(":irc.server.org CAP test ACK :draft/channel-rename"))
+	s.st.EXPECT().RenameChannel("#test1", "#test2")
+	c.h_RENAME(ParseLine(":irc.server.org RENAME #test1 #test2 :Moving"))
+}
+
 // Test the handler for MODE messages
 func TestMODE(t *testing.T) {
 	c, s := setUp(t)
 	defer s.tearDown()
 
-	// Channel modes
+	// Channel modes, and when they were changed
+	l := ParseLine(":user1!ident1@host1.com MODE #test1 +sk somekey")
+	l.Time = time.Unix(1234567890, 0)
 	gomock.InOrder(
 		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
 		s.st.EXPECT().ChannelModes("#test1", "+sk", "somekey"),
+		s.st.EXPECT().ModesChanged("#test1", l.Time),
 	)
-	c.h_MODE(ParseLine(":user1!ident1@host1.com MODE #test1 +sk somekey"))
+	c.h_MODE(l)
 
 	// Nick modes for Me.
 	gomock.InOrder(
@@ -290,17 +591,95 @@ func TestMODE(t *testing.T) {
 	c.h_MODE(ParseLine(":user1!ident1@host1.com MODE #test2 +is"))
 }
 
+// Test handling of nicks the tracker doesn't know are on a channel
+func TestUnknownNicks(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// With UnknownNickCreate, the op and the nick being voiced
+	// are added to the channel before the modes are applied.
+	c.cfg.UnknownNicks = UnknownNickCreate
+	l := ParseLine(":user1!ident1@host1.com MODE #test1 +kv somekey user2")
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().IsOn("#test1", "user1").Return(&state.ChanPrivs{Op: true}, true),
+		s.st.EXPECT().IsOn("#test1", "user2").Return(nil, false),
+		s.st.EXPECT().GetNick("user2").Return(nil),
+		s.st.EXPECT().NewNick("user2"),
+		s.st.EXPECT().Associate("#test1", "user2"),
+		s.st.EXPECT().ChannelModes("#test1", "+kv", "somekey", "user2"),
+		s.st.EXPECT().ModesChanged("#test1", l.Time),
+	)
+	c.h_MODE(l)
+
+	// With UnknownNickWho, a WHO is sent for the channel instead.
+	c.cfg.UnknownNicks = UnknownNickWho
+	gomock.InOrder(
+		s.st.EXPECT().IsOn("#test1", "user3").Return(nil, false),
+		s.st.EXPECT().Dissociate("#test1", "user4"),
+	)
+	c.h_KICK(ParseLine(":user3!ident3@host3.com KICK #test1 user4 :Bye!"))
+	s.nc.Expect("WHO #test1")
+
+	// ... and nicks in the replies are added to the channel.
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().GetNick("user3").Return(nil),
+		s.st.EXPECT().NewNick("user3").Return(&state.Nick{Nick: "user3"}),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickInfo("user3", "ident3", "host3.com", "name"),
+		s.st.EXPECT().IsOn("#test1", "user3").Return(nil, false),
+		s.st.EXPECT().Associate("#test1", "user3"),
+		s.st.EXPECT().ChannelModes("#test1", "+o", "user3"),
+		s.st.EXPECT().NickAway("user3", false, ""),
+		s.st.EXPECT().NickModes("user3", "+i"),
+	)
+	c.h_352(ParseLine(":irc.server.org 352 test #test1 ident3 host3.com irc.server.org user3 H@ :0 name"))
+
+	// Another unknown nick soon after doesn't send another WHO.
+	gomock.InOrder(
+		s.st.EXPECT().IsOn("#test1", "user5").Return(nil, false),
+		s.st.EXPECT().Dissociate("#test1", "user6"),
+	)
+	c.h_KICK(ParseLine(":user5!ident5@host5.com KICK #test1 user6 :Bye!"))
+	s.nc.ExpectNothing()
+
+	// Services aren't expected to be on the channel.
+	c.cfg.UnknownNicks = UnknownNickCreate
+	s.st.EXPECT().Dissociate("#test1", "user7")
+	c.h_KICK(ParseLine(":ChanServ!ChanServ@services. KICK #test1 user7 :Banned"))
+
+	// Server modes don't come from a nick.
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().ChannelModes("#test1", "+s"),
+		s.st.EXPECT().ModesChanged("#test1", gomock.Any()),
+	)
+	c.h_MODE(ParseLine(":irc.server.org MODE #test1 +s"))
+}
+
 // Test the handler for TOPIC messages
 func TestTOPIC(t *testing.T) {
 	c, s := setUp(t)
 	defer s.tearDown()
 
-	// Ensure TOPIC reply calls Topic
+	// Ensure TOPIC reply calls Topic and TopicInfo
+	l := ParseLine(":user1!ident1@host1.com TOPIC #test1 :something something")
 	gomock.InOrder(
 		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
 		s.st.EXPECT().Topic("#test1", "something something"),
+		s.st.EXPECT().TopicInfo("#test1", "user1", l.Time),
 	)
-	c.h_TOPIC(ParseLine(":user1!ident1@host1.com TOPIC #test1 :something something"))
+	c.h_TOPIC(l)
+
+	// Topics set by the server are attributed to it
+	l = ParseLine(":irc.server.org TOPIC #test1 :server topic")
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().Topic("#test1", "server topic"),
+		s.st.EXPECT().TopicInfo("#test1", "irc.server.org", l.Time),
+	)
+	c.h_TOPIC(l)
 
 	// Check error paths -- send a topic for an unknown channel
 	s.st.EXPECT().GetChannel("#test2").Return(nil)
@@ -325,6 +704,48 @@ func Test311(t *testing.T) {
 	c.h_311(ParseLine(":irc.server.org 311 test user2 ident2 host2.com * :dongs"))
 }
 
+// Test the handler for 319 / RPL_WHOISCHANNELS
+func Test319(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Ensure 319 reply for us creates and populates unknown channels
+	s.st.EXPECT().Me().Return(c.cfg.Me)
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().GetChannel("#test2").Return(nil),
+		s.st.EXPECT().NewChannel("#test2"),
+		s.st.EXPECT().Associate("#test2", "test"),
+	)
+	c.h_319(ParseLine(":irc.server.org 319 test test :#test1 @#test2"))
+	s.nc.Expect("MODE #test2")
+	s.nc.Expect("NAMES #test2")
+	s.nc.Expect("WHO #test2")
+
+	// & is both a channel type and a privilege prefix by default, so
+	// it must not be stripped from the start of the channel name
+	s.st.EXPECT().Me().Return(c.cfg.Me)
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("&test3").Return(nil),
+		s.st.EXPECT().NewChannel("&test3"),
+		s.st.EXPECT().Associate("&test3", "test"),
+		s.st.EXPECT().GetChannel("&test4").Return(nil),
+		s.st.EXPECT().NewChannel("&test4"),
+		s.st.EXPECT().Associate("&test4", "test"),
+	)
+	c.h_319(ParseLine(":irc.server.org 319 test test :&test3 @&test4"))
+	s.nc.Expect("MODE &test3")
+	s.nc.Expect("NAMES &test3")
+	s.nc.Expect("WHO &test3")
+	s.nc.Expect("MODE &test4")
+	s.nc.Expect("NAMES &test4")
+	s.nc.Expect("WHO &test4")
+
+	// 319 replies for other nicks should be ignored
+	s.st.EXPECT().Me().Return(c.cfg.Me)
+	c.h_319(ParseLine(":irc.server.org 319 test user1 :#test1 #test3"))
+}
+
 // Test the handler for 324 / RPL_CHANNELMODEIS
 func Test324(t *testing.T) {
 	c, s := setUp(t)
@@ -342,6 +763,168 @@ func Test324(t *testing.T) {
 	c.h_324(ParseLine(":irc.server.org 324 test #test2 +pmt"))
 }
 
+// Test the handler for 329 / RPL_CREATIONTIME
+func Test329(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Ensure 329 reply calls ChannelCreated
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().ChannelCreated("#test1", time.Unix(1234567890, 0)),
+	)
+	c.h_329(ParseLine(":irc.server.org 329 test #test1 1234567890"))
+
+	// Check error paths -- send 329 for an unknown channel or a bad time
+	s.st.EXPECT().GetChannel("#test2").Return(nil)
+	c.h_329(ParseLine(":irc.server.org 329 test #test2 1234567890"))
+	c.h_329(ParseLine(":irc.server.org 329 test #test1 yesterday"))
+}
+
+// Test the handler for 221 / RPL_UMODEIS
+func Test221(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	var mu sync.Mutex
+	events := []*Line{}
+	c.HandleFunc(UMODE_SYNC, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, line)
+	})
+
+	// Ensure 221 reply replaces our modes
+	gomock.InOrder(
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickModes("test", "-Biowxz+iwx"),
+	)
+	c.h_221(ParseLine(":irc.server.org 221 test +iwx"))
+
+	// Modes without a leading + are handled too
+	gomock.InOrder(
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickModes("test", "-Biowxz+z"),
+	)
+	c.h_221(ParseLine(":irc.server.org 221 test :z"))
+
+	// Without the state tracker, only the event is dispatched
+	c.st = nil
+	c.h_221(ParseLine(":irc.server.org 221 test +"))
+	c.h_221(ParseLine(":irc.server.org 221 test"))
+	c.st = s.st
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 UMODE_SYNC events, got %d.", len(events))
+	}
+	for i, exp := range []string{"+iwx", "+z", "+"} {
+		if ev := events[i]; !ev.Internal || strings.Join(ev.Args, " ") != exp {
+			t.Errorf("Incorrect UMODE_SYNC event: %#v", ev)
+		}
+	}
+}
+
+// Test the handler for 328 / RPL_CHANNEL_URL
+func Test328(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	var mu sync.Mutex
+	events := []*Line{}
+	c.HandleFunc(CHANNEL_URL, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, line)
+	})
+
+	// Ensure 328 reply calls ChannelURL
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().ChannelURL("#test1", "http://example.com/"),
+	)
+	c.h_328(ParseLine(":irc.server.org 328 test #test1 :http://example.com/"))
+
+	// Check error paths -- send 328 for an unknown channel, which still
+	// dispatches an event, and without a URL, which doesn't
+	s.st.EXPECT().GetChannel("#test2").Return(nil)
+	c.h_328(ParseLine(":irc.server.org 328 test #test2 :http://example.org/"))
+	c.h_328(ParseLine(":irc.server.org 328 test #test1"))
+
+	// Without the state tracker, only the event is dispatched
+	c.st = nil
+	c.h_328(ParseLine(":irc.server.org 328 test #test3 :http://example.net/"))
+	c.st = s.st
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 CHANNEL_URL events, got %d.", len(events))
+	}
+	for i, exp := range []string{"#test1 http://example.com/",
+		"#test2 http://example.org/", "#test3 http://example.net/"} {
+		if ev := events[i]; !ev.Internal || strings.Join(ev.Args, " ") != exp {
+			t.Errorf("Incorrect CHANNEL_URL event: %#v", ev)
+		}
+	}
+}
+
+// Test the handler for 333 / RPL_TOPICWHOTIME
+func Test333(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	var mu sync.Mutex
+	events := []*Line{}
+	c.HandleFunc(TOPIC_INFO, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, line)
+	})
+
+	// Ensure 333 reply calls TopicInfo with just the nick, whichever
+	// form the server sends the setter in
+	set := time.Unix(1234567890, 0)
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().TopicInfo("#test1", "user1", set),
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().TopicInfo("#test1", "user2", set),
+	)
+	c.h_333(ParseLine(":irc.server.org 333 test #test1 user1 1234567890"))
+	c.h_333(ParseLine(":irc.server.org 333 test #test1 user2!ident2@host2.com :1234567890"))
+
+	// A bad or missing timestamp still records the setter
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().TopicInfo("#test1", "user3", time.Time{}),
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().TopicInfo("#test1", "user4", time.Time{}),
+	)
+	c.h_333(ParseLine(":irc.server.org 333 test #test1 user3 yesterday"))
+	c.h_333(ParseLine(":irc.server.org 333 test #test1 user4"))
+
+	// Check error paths -- send 333 for an unknown channel, which still
+	// dispatches an event, and without a setter, which doesn't
+	s.st.EXPECT().GetChannel("#test2").Return(nil)
+	c.h_333(ParseLine(":irc.server.org 333 test #test2 user1 1234567890"))
+	c.h_333(ParseLine(":irc.server.org 333 test #test1"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 TOPIC_INFO events, got %d.", len(events))
+	}
+	for i, exp := range []string{"#test1 user1 1234567890",
+		"#test1 user2 1234567890", "#test1 user3 yesterday", "#test1 user4 ",
+		"#test2 user1 1234567890"} {
+		if ev := events[i]; !ev.Internal || strings.Join(ev.Args, " ") != exp {
+			t.Errorf("Incorrect TOPIC_INFO event: %#v", ev)
+		}
+	}
+}
+
 // Test the handler for 332 / RPL_TOPIC
 func Test332(t *testing.T) {
 	c, s := setUp(t)
@@ -369,6 +952,7 @@ func Test352(t *testing.T) {
 		s.st.EXPECT().GetNick("user1").Return(&state.Nick{Nick: "user1"}),
 		s.st.EXPECT().Me().Return(c.cfg.Me),
 		s.st.EXPECT().NickInfo("user1", "ident1", "host1.com", "name"),
+		s.st.EXPECT().NickAway("user1", true, ""),
 	)
 	c.h_352(ParseLine(":irc.server.org 352 test #test1 ident1 host1.com irc.server.org user1 G :0 name"))
 
@@ -377,6 +961,7 @@ func Test352(t *testing.T) {
 		s.st.EXPECT().GetNick("user1").Return(&state.Nick{Nick: "user1"}),
 		s.st.EXPECT().Me().Return(c.cfg.Me),
 		s.st.EXPECT().NickInfo("user1", "ident1", "host1.com", "name"),
+		s.st.EXPECT().NickAway("user1", false, ""),
 		s.st.EXPECT().NickModes("user1", "+o"),
 		s.st.EXPECT().NickModes("user1", "+i"),
 	)
@@ -385,6 +970,29 @@ func Test352(t *testing.T) {
 	// Check error paths -- send a 352 for an unknown nick
 	s.st.EXPECT().GetNick("user2").Return(nil)
 	c.h_352(ParseLine(":irc.server.org 352 test #test2 ident2 host2.com irc.server.org user2 G :0 fooo"))
+
+	// Without NAMES on join, unknown nicks are added to the channel
+	// with the privileges in their flags.
+	c.caps[noImplicitNames] = true
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#test1").Return(&state.Channel{Name: "#test1"}),
+		s.st.EXPECT().GetNick("user2").Return(nil),
+		s.st.EXPECT().NewNick("user2").Return(&state.Nick{Nick: "user2"}),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickInfo("user2", "ident2", "host2.com", "fooo"),
+		s.st.EXPECT().IsOn("#test1", "user2").Return(nil, false),
+		s.st.EXPECT().Associate("#test1", "user2"),
+		s.st.EXPECT().ChannelModes("#test1", "+o", "user2"),
+		s.st.EXPECT().ChannelModes("#test1", "+v", "user2"),
+		s.st.EXPECT().NickAway("user2", false, ""),
+		s.st.EXPECT().NickModes("user2", "+i"),
+	)
+	c.h_352(ParseLine(":irc.server.org 352 test #test1 ident2 host2.com irc.server.org user2 H@+ :0 fooo"))
+
+	// Replies for channels we're not on are only used for nick info.
+	s.st.EXPECT().GetChannel("*").Return(nil)
+	s.st.EXPECT().GetNick("user3").Return(nil)
+	c.h_352(ParseLine(":irc.server.org 352 test * ident3 host3.com irc.server.org user3 H :0 fooo"))
 }
 
 // Test the handler for 353 / RPL_NAMREPLY
@@ -433,6 +1041,76 @@ func Test353(t *testing.T) {
 	c.h_353(ParseLine(":irc.server.org 353 test = #test2 :test ~user3"))
 }
 
+// Test the handler for 366 / RPL_ENDOFNAMES
+func Test366(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.cfg.ChannelModeDefaults = map[string]string{"#New": "+nt"}
+	created := &state.Channel{Name: "#new",
+		Nicks: map[string]*state.ChanPrivs{"test": {Op: true}}}
+
+	// Joining a channel with defaults, where we're the only op, sets them.
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#new").Return(nil),
+		s.st.EXPECT().GetNick("test").Return(c.cfg.Me),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NewChannel("#new").Return(created),
+		s.st.EXPECT().Associate("#new", "test"),
+		s.st.EXPECT().GetChannel("#new").Return(created),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+	)
+	c.h_JOIN(ParseLine(":test!test@somehost.com JOIN :#new"))
+	s.nc.Expect("MODE #new")
+	s.nc.Expect("WHO #new")
+	c.h_366(ParseLine(":irc.server.org 366 test #new :End of /NAMES list."))
+	s.nc.Expect("MODE #new +nt")
+
+	// Later NAMES shouldn't set them again.
+	c.h_366(ParseLine(":irc.server.org 366 test #new :End of /NAMES list."))
+	s.nc.ExpectNothing()
+
+	// Nor should joining when there are other nicks on the channel.
+	created.Nicks["user1"] = &state.ChanPrivs{}
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("#new").Return(nil),
+		s.st.EXPECT().GetNick("test").Return(c.cfg.Me),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NewChannel("#new").Return(created),
+		s.st.EXPECT().Associate("#new", "test"),
+		s.st.EXPECT().GetChannel("#new").Return(created),
+	)
+	c.h_JOIN(ParseLine(":test!test@somehost.com JOIN :#new"))
+	s.nc.Expect("MODE #new")
+	s.nc.Expect("WHO #new")
+	c.h_366(ParseLine(":irc.server.org 366 test #new :End of /NAMES list."))
+	s.nc.ExpectNothing()
+}
+
+// Test the handler for 330 / RPL_WHOISACCOUNT
+func Test330(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Ensure 330 reply calls NickAccount
+	gomock.InOrder(
+		s.st.EXPECT().GetNick("user1").Return(&state.Nick{Nick: "user1"}),
+		s.st.EXPECT().NickAccount("user1", "acct1"),
+	)
+	c.h_330(ParseLine(":irc.server.org 330 test user1 acct1 :is logged in as"))
+
+	// Some servers leave out the account if it's the same as the nick.
+	gomock.InOrder(
+		s.st.EXPECT().GetNick("user1").Return(&state.Nick{Nick: "user1"}),
+		s.st.EXPECT().NickAccount("user1", "user1"),
+	)
+	c.h_330(ParseLine(":irc.server.org 330 test user1 :is a registered nick"))
+
+	// Check error paths -- send a 330 for an unknown nick
+	s.st.EXPECT().GetNick("user2").Return(nil)
+	c.h_330(ParseLine(":irc.server.org 330 test user2 acct2 :is logged in as"))
+}
+
 // Test the handler for 671 (unreal specific)
 func Test671(t *testing.T) {
 	c, s := setUp(t)
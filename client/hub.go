@@ -0,0 +1,101 @@
+package client
+
+import "sync"
+
+// A Hub lets handlers be added once for events from many Conns, e.g. a bot
+// connected to several networks. Handlers added to a Hub are added to every
+// Conn registered with it, now or later, and the *Conn passed to them says
+// which connection the event came from. It is safe for concurrent use.
+type Hub struct {
+	mu       sync.Mutex
+	conns    map[*Conn]bool
+	handlers map[*hubHandler]bool
+}
+
+// hubHandler is a handler added to a Hub, and the Removers
+// for its copies on each registered Conn.
+type hubHandler struct {
+	hub      *Hub
+	name     string
+	h        Handler
+	removers map[*Conn]Remover
+}
+
+// NewHub creates a Hub with no Conns or handlers.
+func NewHub() *Hub {
+	return &Hub{
+		conns:    make(map[*Conn]bool),
+		handlers: make(map[*hubHandler]bool),
+	}
+}
+
+// Add registers conn with the hub, adding all of the hub's handlers to it.
+func (hub *Hub) Add(conn *Conn) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.conns[conn] {
+		return
+	}
+	hub.conns[conn] = true
+	for hh := range hub.handlers {
+		hh.removers[conn] = conn.Handle(hh.name, hh.h)
+	}
+}
+
+// Remove unregisters conn from the hub, removing the hub's handlers from it.
+func (hub *Hub) Remove(conn *Conn) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if !hub.conns[conn] {
+		return
+	}
+	delete(hub.conns, conn)
+	for hh := range hub.handlers {
+		hh.removers[conn].Remove()
+		delete(hh.removers, conn)
+	}
+}
+
+// Conns returns the Conns registered with the hub, in no particular order.
+func (hub *Hub) Conns() []*Conn {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	conns := make([]*Conn, 0, len(hub.conns))
+	for conn := range hub.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Handle adds the provided handler to the foreground set for the named event
+// on every Conn registered with the hub. It will return a Remover that allows
+// that handler to be removed from all of them again.
+func (hub *Hub) Handle(name string, h Handler) Remover {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hh := &hubHandler{hub: hub, name: name, h: h,
+		removers: make(map[*Conn]Remover)}
+	hub.handlers[hh] = true
+	for conn := range hub.conns {
+		hh.removers[conn] = conn.Handle(name, h)
+	}
+	return hh
+}
+
+// HandleFunc adds the provided function as a handler in the foreground set
+// for the named event on every Conn registered with the hub.
+// It will return a Remover that allows that handler to be removed again.
+func (hub *Hub) HandleFunc(name string, hf HandlerFunc) Remover {
+	return hub.Handle(name, hf)
+}
+
+// Remove removes the handler from the hub and every Conn registered with it.
+func (hh *hubHandler) Remove() {
+	hh.hub.mu.Lock()
+	defer hh.hub.mu.Unlock()
+	delete(hh.hub.handlers, hh)
+	for conn, r := range hh.removers {
+		r.Remove()
+		delete(hh.removers, conn)
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	c1, c2 := Client(NewConfig("one")), Client(NewConfig("two"))
+	hub := NewHub()
+
+	var mu sync.Mutex
+	seen := []string{}
+	hub.Add(c1)
+	r := hub.HandleFunc(PRIVMSG, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, conn.Me().Nick+" "+line.Text())
+	})
+	// Conns added after the handler should get it too, but only once.
+	hub.Add(c2)
+	hub.Add(c2)
+	if n := len(hub.Conns()); n != 2 {
+		t.Errorf("Expected 2 conns in hub, got %d.", n)
+	}
+
+	c1.dispatch(ParseLine(":nick!ident@host PRIVMSG #chan :hello"))
+	c2.dispatch(ParseLine(":nick!ident@host PRIVMSG #chan :world"))
+	hub.Remove(c2)
+	c2.dispatch(ParseLine(":nick!ident@host PRIVMSG #chan :removed"))
+	if ev := c2.RegisteredEvents(); len(ev) != 0 {
+		t.Errorf("Hub handlers left on removed conn: %v", ev)
+	}
+	r.Remove()
+	c1.dispatch(ParseLine(":nick!ident@host PRIVMSG #chan :gone"))
+	if ev := c1.RegisteredEvents(); len(ev) != 0 {
+		t.Errorf("Hub handlers left after removal: %v", ev)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0] != "one hello" || seen[1] != "two world" {
+		t.Errorf("Hub handler saw wrong events: %q", seen)
+	}
+}
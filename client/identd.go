@@ -0,0 +1,104 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// How long the built-in ident server waits for a query once a connection
+// to it is accepted.
+var identTimeout = 10 * time.Second
+
+// IdentPorts returns the local and remote TCP ports of the connection to
+// the server, which is what the server asks an ident server about, so an
+// external ident server can be told how to answer. ok is false if we're
+// not connected. When connecting through a proxy, these are the ports of
+// the connection to the proxy.
+func (conn *Conn) IdentPorts() (local, remote int, ok bool) {
+	l, lok := conn.LocalAddr().(*net.TCPAddr)
+	r, rok := conn.RemoteAddr().(*net.TCPAddr)
+	if !lok || !rok {
+		return 0, 0, false
+	}
+	return l.Port, r.Port, true
+}
+
+// startIdentd starts the built-in ident server on Config.Identd, if it
+// isn't already running.
+func (conn *Conn) startIdentd() error {
+	conn.identMu.Lock()
+	defer conn.identMu.Unlock()
+	if conn.identLn != nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", conn.cfg.Identd)
+	if err != nil {
+		return err
+	}
+	conn.identLn = ln
+	go conn.identd(ln)
+	return nil
+}
+
+// stopIdentd stops the built-in ident server, if it's running.
+func (conn *Conn) stopIdentd() {
+	conn.identMu.Lock()
+	defer conn.identMu.Unlock()
+	if conn.identLn != nil {
+		conn.identLn.Close()
+		conn.identLn = nil
+	}
+}
+
+// identd accepts connections to the built-in ident server until ln is
+// closed by stopIdentd.
+func (conn *Conn) identd(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go conn.identReply(c)
+	}
+}
+
+// identReply answers a single ident query on c, then closes it.
+//   query: 6667, 12345
+//   reply: 6667, 12345 : USERID : UNIX : ident
+func (conn *Conn) identReply(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(identTimeout))
+	query, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil && query == "" {
+		return
+	}
+	fmt.Fprintf(c, "%s\r\n", conn.identAnswer(strings.TrimSpace(query)))
+}
+
+// identAnswer returns the reply to an ident query for "local, remote",
+// where local is the port on our side of the connection being asked about.
+func (conn *Conn) identAnswer(query string) string {
+	ports := strings.SplitN(query, ",", 2)
+	if len(ports) != 2 {
+		return query + " : ERROR : INVALID-PORT"
+	}
+	qlocal, lerr := strconv.Atoi(strings.TrimSpace(ports[0]))
+	qremote, rerr := strconv.Atoi(strings.TrimSpace(ports[1]))
+	if lerr != nil || rerr != nil {
+		return query + " : ERROR : INVALID-PORT"
+	}
+	reply := fmt.Sprintf("%d, %d", qlocal, qremote)
+	local, remote, ok := conn.IdentPorts()
+	if !ok || local != qlocal || remote != qremote {
+		return reply + " : ERROR : NO-USER"
+	}
+	ident := conn.Me().Ident
+	logging.Info("irc.identd(): Answered query for %s with %s", reply, ident)
+	return reply + " : USERID : UNIX : " + ident
+}
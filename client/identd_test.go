@@ -0,0 +1,63 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIdentPorts(t *testing.T) {
+	c, s := setUp(t)
+
+	if l, r, ok := c.IdentPorts(); !ok || l != 12345 || r != 6667 {
+		t.Errorf("Wrong ident ports: %d, %d, %t", l, r, ok)
+	}
+	s.tearDown()
+	if _, _, ok := c.IdentPorts(); ok {
+		t.Errorf("Ident ports returned after disconnect.")
+	}
+}
+
+func TestIdentd(t *testing.T) {
+	c, s := setUp(t)
+	c.st = nil
+
+	c.cfg.Identd = "127.0.0.1:0"
+	if err := c.startIdentd(); err != nil {
+		t.Fatalf("Couldn't start identd: %v", err)
+	}
+	addr := c.identLn.Addr().String()
+	query := func(q string) string {
+		nc, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Couldn't connect to identd: %v", err)
+		}
+		defer nc.Close()
+		fmt.Fprintf(nc, "%s\r\n", q)
+		reply, _ := bufio.NewReader(nc).ReadString('\n')
+		return reply
+	}
+
+	tests := []struct{ in, out string }{
+		{"12345, 6667", "12345, 6667 : USERID : UNIX : test\r\n"},
+		{"12345,6667", "12345, 6667 : USERID : UNIX : test\r\n"},
+		{"12345, 6668", "12345, 6668 : ERROR : NO-USER\r\n"},
+		{"foo", "foo : ERROR : INVALID-PORT\r\n"},
+	}
+	for i, test := range tests {
+		if out := query(test.in); out != test.out {
+			t.Errorf("test %d: expected %q, got %q", i, test.out, out)
+		}
+	}
+
+	// Disconnecting stops identd.
+	s.tearDown()
+	if c.identLn != nil {
+		t.Errorf("identd not stopped on disconnect.")
+	}
+	if nc, err := net.Dial("tcp", addr); err == nil {
+		nc.Close()
+		t.Errorf("identd still listening after disconnect.")
+	}
+}
@@ -0,0 +1,286 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Handler to store the tokens sent by the server in 005 RPL_ISUPPORT.
+//   :server 005 me TOKEN TOKEN=value -TOKEN :are supported by this server
+func (conn *Conn) h_005(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	casemapping := false
+	conn.supMu.Lock()
+	for _, tok := range line.Args[1 : len(line.Args)-1] {
+		if strings.HasPrefix(tok, "-") {
+			tok = tok[1:]
+			delete(conn.supports, strings.ToUpper(tok))
+		} else {
+			kv := strings.SplitN(tok, "=", 2)
+			if len(kv) == 1 {
+				kv = append(kv, "")
+			}
+			tok = kv[0]
+			conn.supports[strings.ToUpper(tok)] = unescapeISupport(kv[1])
+		}
+		casemapping = casemapping || strings.EqualFold(tok, "CASEMAPPING")
+	}
+	conn.supMu.Unlock()
+	// The tracker folds names with Casefold, so must re-key them if the
+	// server's CASEMAPPING isn't the rfc1459 we assumed.
+	if st := conn.st; st != nil && casemapping && conn.cfg.Normalizer == nil {
+		st.SetNormalizer(conn.Casefold)
+	}
+}
+
+// unescapeISupport replaces \xHH escapes in ISUPPORT values.
+func unescapeISupport(s string) string {
+	if !strings.Contains(s, "\\x") {
+		return s
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if b, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// Supports returns the value of an ISUPPORT token sent by the server in
+// 005 replies during registration, and whether the token was sent at all.
+// Tokens without a value return an empty string and true.
+func (conn *Conn) Supports(token string) (string, bool) {
+	conn.supMu.RLock()
+	defer conn.supMu.RUnlock()
+	v, ok := conn.supports[strings.ToUpper(token)]
+	return v, ok
+}
+
+// ISupport returns a copy of all the ISUPPORT tokens the server has sent,
+// keyed by upper-cased token, with the same values as Supports. Tokens the
+// client doesn't know about are included, so they can be used without
+// changes to the library.
+func (conn *Conn) ISupport() map[string]string {
+	conn.supMu.RLock()
+	defer conn.supMu.RUnlock()
+	toks := make(map[string]string, len(conn.supports))
+	for k, v := range conn.supports {
+		toks[k] = v
+	}
+	return toks
+}
+
+// supportInt returns the numeric value of an ISUPPORT token. ok is false
+// if the server didn't send the token or its value isn't a number.
+func (conn *Conn) supportInt(token string) (n int, ok bool) {
+	v, ok := conn.Supports(token)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil
+}
+
+// NickLen returns the maximum length of a nick, from the NICKLEN ISUPPORT
+// token. ok is false if the server didn't advertise it.
+func (conn *Conn) NickLen() (n int, ok bool) {
+	return conn.supportInt("NICKLEN")
+}
+
+// ChannelLen returns the maximum length of a channel name, from the
+// CHANNELLEN ISUPPORT token. ok is false if the server didn't advertise it.
+func (conn *Conn) ChannelLen() (n int, ok bool) {
+	return conn.supportInt("CHANNELLEN")
+}
+
+// TopicLen returns the maximum length of a channel topic, from the TOPICLEN
+// ISUPPORT token. ok is false if the server didn't advertise it.
+func (conn *Conn) TopicLen() (n int, ok bool) {
+	return conn.supportInt("TOPICLEN")
+}
+
+// Matches the network name in most servers' 001 welcome messages, e.g.
+//   Welcome to the FooNet IRC Network nick!ident@host
+//   Welcome to the BarNet Internet Relay Chat Network nick
+var welcomeNetwork = regexp.MustCompile(
+	`(?i)welcome to (?:the )?(\S+) (?:irc|internet relay chat) network`)
+
+// guessNetwork makes a best-effort attempt to find the network name
+// in the text of the 001 welcome message.
+func (conn *Conn) guessNetwork(text string) {
+	if m := welcomeNetwork.FindStringSubmatch(text); m != nil {
+		conn.supMu.Lock()
+		conn.network = m[1]
+		conn.supMu.Unlock()
+	}
+}
+
+// Network returns the name of the IRC network the client is connected to.
+// This is the NETWORK ISUPPORT token if the server has sent one. Otherwise,
+// if Config.GuessNetwork is set, it is the name found in the 001 welcome
+// message and provisional is true; consumers should prefer the value from
+// ISUPPORT once it arrives. If neither is known the name is empty.
+func (conn *Conn) Network() (name string, provisional bool) {
+	if n, ok := conn.Supports("NETWORK"); ok {
+		return n, false
+	}
+	conn.supMu.RLock()
+	defer conn.supMu.RUnlock()
+	return conn.network, conn.network != ""
+}
+
+// IsChannel returns true if name starts with one of the channel prefixes
+// advertised by the server in CHANTYPES, or one of "#&+!" if the server
+// hasn't advertised any.
+func (conn *Conn) IsChannel(name string) bool {
+	types, ok := conn.Supports("CHANTYPES")
+	if !ok {
+		types = "#&+!"
+	}
+	return name != "" && strings.IndexByte(types, name[0]) != -1
+}
+
+// ChanLimit returns the maximum number of channels starting with prefix that
+// we may be on, as advertised by the server in the CHANLIMIT ISUPPORT token,
+// along with the prefixes sharing that limit. For example CHANLIMIT=#&:20
+// allows 20 channels starting with # or & in total. If the server has told
+// us we're on too many channels with 405 ERR_TOOMANYCHANNELS, the number of
+// channels we were on is returned instead if it is lower. ok is false if no
+// limit is known for the prefix.
+func (conn *Conn) ChanLimit(prefix byte) (limit int, prefixes string, ok bool) {
+	limit, prefixes, ok = conn.supportLimit("CHANLIMIT", prefix)
+	conn.supMu.RLock()
+	defer conn.supMu.RUnlock()
+	if l, learned := conn.chanLimits[prefix]; learned && (!ok || l < limit) {
+		if !ok {
+			prefixes = string(prefix)
+		}
+		return l, prefixes, true
+	}
+	return limit, prefixes, ok
+}
+
+// MaxList returns the maximum number of entries the server allows in the
+// list for channel mode m, as advertised in the MAXLIST ISUPPORT token,
+// along with the list modes sharing that limit. For example MAXLIST=beI:100
+// allows 100 bans, exceptions and invite exceptions in total. ok is false
+// if the server advertised no limit for the mode.
+func (conn *Conn) MaxList(m byte) (limit int, modes string, ok bool) {
+	return conn.supportLimit("MAXLIST", m)
+}
+
+// TargMax returns the maximum number of targets the server allows in one
+// cmd, as advertised in the TARGMAX ISUPPORT token, e.g. TARGMAX=NOTICE:4.
+// Servers that predate TARGMAX may advertise MAXTARGETS instead, which is
+// used for PRIVMSG and NOTICE. ok is false if the server advertised no
+// limit for the command, and limit is 0 if the limit it advertised is
+// empty, i.e. there isn't one.
+func (conn *Conn) TargMax(cmd string) (limit int, ok bool) {
+	v, _ := conn.Supports("TARGMAX")
+	for _, l := range strings.Split(v, ",") {
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) < 2 || !strings.EqualFold(kv[0], cmd) {
+			continue
+		}
+		n, _ := strconv.Atoi(kv[1])
+		return n, true
+	}
+	if cmd = strings.ToUpper(cmd); cmd == PRIVMSG || cmd == NOTICE {
+		if v, ok := conn.Supports("MAXTARGETS"); ok {
+			n, _ := strconv.Atoi(v)
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// supportLimit parses ISUPPORT tokens of the form chars:limit,chars:limit
+// and returns the limit for the set of characters containing c.
+func (conn *Conn) supportLimit(token string, c byte) (int, string, bool) {
+	v, _ := conn.Supports(token)
+	for _, l := range strings.Split(v, ",") {
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) < 2 || strings.IndexByte(kv[0], c) == -1 {
+			continue
+		}
+		// An empty limit means there isn't one.
+		if n, err := strconv.Atoi(kv[1]); err == nil {
+			return n, kv[0], true
+		}
+		return 0, kv[0], false
+	}
+	return 0, "", false
+}
+
+// BotMode returns the user mode the server advertised for marking clients
+// as bots in the BOT ISUPPORT token. ok is false if there isn't one.
+func (conn *Conn) BotMode() (mode byte, ok bool) {
+	if v, ok := conn.Supports("BOT"); ok && v != "" {
+		return v[0], true
+	}
+	return 0, false
+}
+
+// SetBotMode marks us as a bot by setting the user mode the server
+// advertised in the BOT ISUPPORT token on ourselves. It returns an
+// error without sending anything if the server has no bot mode.
+func (conn *Conn) SetBotMode() error {
+	m, ok := conn.BotMode()
+	if !ok {
+		return fmt.Errorf("irc.SetBotMode(): server did not advertise BOT mode")
+	}
+	conn.Mode(conn.Me().Nick, "+"+string(m))
+	return nil
+}
+
+// botModes rewrites the server's BOT user mode in a mode string as the
+// B mode the state tracker understands as NickMode.Bot.
+func (conn *Conn) botModes(modes string) string {
+	if m, ok := conn.BotMode(); ok && m != 'B' {
+		return strings.Replace(modes, string(m), "B", -1)
+	}
+	return modes
+}
+
+// Casefold lowers the case of a nick or channel name according to the
+// CASEMAPPING advertised by the server, so that the result may be compared
+// with other folded names. Servers that don't advertise CASEMAPPING are
+// assumed to use rfc1459, as the RFC specifies. Config.Normalizer, if set,
+// is used instead.
+func (conn *Conn) Casefold(s string) string {
+	if f := conn.cfg.Normalizer; f != nil {
+		return f(s)
+	}
+	cm, _ := conn.Supports("CASEMAPPING")
+	return casefold(cm, s)
+}
+
+// casefold lowers the case of s according to the named casemapping.
+func casefold(casemapping, s string) string {
+	var upper byte
+	switch casemapping {
+	case "ascii":
+		upper = 'Z'
+	case "strict-rfc1459":
+		upper = ']'
+	default:
+		upper = '^'
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= upper {
+			b[i] = c + 32
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/lfkeitel/goirc/state"
+)
+
+// Test the handler for 005 / RPL_ISUPPORT
+func Test005(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.h_005(ParseLine(":irc.server.org 005 test CHANTYPES=# EXCEPTS " +
+		"PREFIX=(ov)@+ NETWORK=Some\\x20Net :are supported by this server"))
+
+	tests := []struct {
+		tok, val string
+		ok       bool
+	}{
+		{"CHANTYPES", "#", true},
+		{"excepts", "", true},
+		{"PREFIX", "(ov)@+", true},
+		{"NETWORK", "Some Net", true},
+		{"INVEX", "", false},
+	}
+	for i, test := range tests {
+		if val, ok := c.Supports(test.tok); val != test.val || ok != test.ok {
+			t.Errorf("test %d: expected %q, %t, got %q, %t",
+				i, test.val, test.ok, val, ok)
+		}
+	}
+
+	// Negated tokens should be removed.
+	c.h_005(ParseLine(":irc.server.org 005 test -EXCEPTS :are supported by this server"))
+	if _, ok := c.Supports("EXCEPTS"); ok {
+		t.Errorf("Negated ISUPPORT token not removed.")
+	}
+}
+
+func TestCasefold(t *testing.T) {
+	tests := []struct{ cm, in, out string }{
+		{"", "Nick[]\\~^", "nick{}|~~"},
+		{"rfc1459", "#Chan[^]", "#chan{~}"},
+		{"strict-rfc1459", "Nick[]\\^", "nick{}|^"},
+		{"ascii", "Nick[]\\^", "nick[]\\^"},
+	}
+	for i, test := range tests {
+		if out := casefold(test.cm, test.in); out != test.out {
+			t.Errorf("test %d: expected %q, got %q", i, test.out, out)
+		}
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// A CASEMAPPING token re-keys the tracker, which folds with Casefold.
+	s.st.EXPECT().SetNormalizer(gomock.Any())
+	c.h_005(ParseLine(":irc.server.org 005 test CASEMAPPING=ascii :are supported by this server"))
+	if f := c.Casefold("Nick[]"); f != "nick[]" {
+		t.Errorf("Casefold ignored CASEMAPPING: %q", f)
+	}
+
+	// A configured normalizer overrides CASEMAPPING entirely.
+	c.cfg.Normalizer = func(s string) string { return strings.TrimPrefix(s, "~") }
+	if f := c.Casefold("~Nick[]"); f != "Nick[]" {
+		t.Errorf("Casefold ignored Normalizer: %q", f)
+	}
+	c.h_005(ParseLine(":irc.server.org 005 test CASEMAPPING=rfc1459 :are supported by this server"))
+}
+
+func TestNetwork(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+	c.st = nil
+
+	if n, p := c.Network(); n != "" || p {
+		t.Errorf("Network known before connecting: %q, %t", n, p)
+	}
+
+	// Network shouldn't be guessed unless configured.
+	c.h_001(ParseLine(":irc.server.org 001 test :Welcome to the FooNet IRC Network test"))
+	if n, p := c.Network(); n != "" || p {
+		t.Errorf("Network guessed when not configured: %q, %t", n, p)
+	}
+
+	c.cfg.GuessNetwork = true
+	for _, welcome := range []string{
+		"Welcome to the FooNet IRC Network test!test@somehost.com",
+		"Welcome to the FooNet Internet Relay Chat Network test",
+		"Welcome to FooNet IRC network, test",
+	} {
+		c.network = ""
+		c.h_001(ParseLine(":irc.server.org 001 test :" + welcome))
+		if n, p := c.Network(); n != "FooNet" || !p {
+			t.Errorf("Network not guessed from %q: %q, %t", welcome, n, p)
+		}
+	}
+
+	// The NETWORK token supersedes the guess.
+	c.h_005(ParseLine(":irc.server.org 005 test NETWORK=BarNet :are supported by this server"))
+	if n, p := c.Network(); n != "BarNet" || p {
+		t.Errorf("Network not taken from ISUPPORT: %q, %t", n, p)
+	}
+	c.st = s.st
+}
+
+func TestSupportLimits(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if _, _, ok := c.ChanLimit('#'); ok {
+		t.Errorf("ChanLimit returned a limit before 005 received.")
+	}
+	c.h_005(ParseLine(":irc.server.org 005 test CHANLIMIT=#&:20,+: " +
+		"MAXLIST=beI:100,q:50 :are supported by this server"))
+
+	if l, p, ok := c.ChanLimit('&'); !ok || l != 20 || p != "#&" {
+		t.Errorf("Wrong CHANLIMIT for &: %d %q %t", l, p, ok)
+	}
+	if _, _, ok := c.ChanLimit('+'); ok {
+		t.Errorf("CHANLIMIT for + should be unlimited.")
+	}
+	if _, _, ok := c.ChanLimit('!'); ok {
+		t.Errorf("CHANLIMIT for ! should not be known.")
+	}
+	if l, m, ok := c.MaxList('I'); !ok || l != 100 || m != "beI" {
+		t.Errorf("Wrong MAXLIST for I: %d %q %t", l, m, ok)
+	}
+	if l, m, ok := c.MaxList('q'); !ok || l != 50 || m != "q" {
+		t.Errorf("Wrong MAXLIST for q: %d %q %t", l, m, ok)
+	}
+
+	if _, ok := c.TargMax(NOTICE); ok {
+		t.Errorf("TargMax returned a limit before 005 received.")
+	}
+	c.h_005(ParseLine(":irc.server.org 005 test MAXTARGETS=3 :are supported by this server"))
+	if l, ok := c.TargMax("notice"); !ok || l != 3 {
+		t.Errorf("Wrong MAXTARGETS for NOTICE: %d %t", l, ok)
+	}
+	c.h_005(ParseLine(":irc.server.org 005 test TARGMAX=NOTICE:4,JOIN:,KICK:1 :are supported by this server"))
+	if l, ok := c.TargMax(NOTICE); !ok || l != 4 {
+		t.Errorf("Wrong TARGMAX for NOTICE: %d %t", l, ok)
+	}
+	if l, ok := c.TargMax(JOIN); !ok || l != 0 {
+		t.Errorf("Wrong TARGMAX for JOIN: %d %t", l, ok)
+	}
+	if _, ok := c.TargMax(PART); ok {
+		t.Errorf("TARGMAX for PART should not be known.")
+	}
+}
+
+func TestISupport(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if _, ok := c.NickLen(); ok {
+		t.Errorf("NickLen returned a length before 005 received.")
+	}
+	if n := c.ModesPerLine(); n != 3 {
+		t.Errorf("Wrong default MODES: %d", n)
+	}
+	c.h_005(ParseLine(":irc.server.org 005 test NICKLEN=30 CHANNELLEN=50 " +
+		"TOPICLEN=bogus MODES=4 BOTPREFIX=! NETWORK=FooNet :are supported by this server"))
+
+	if n, ok := c.NickLen(); !ok || n != 30 {
+		t.Errorf("Wrong NICKLEN: %d %t", n, ok)
+	}
+	if n, ok := c.ChannelLen(); !ok || n != 50 {
+		t.Errorf("Wrong CHANNELLEN: %d %t", n, ok)
+	}
+	if _, ok := c.TopicLen(); ok {
+		t.Errorf("TOPICLEN with a bad value should not be known.")
+	}
+	if n := c.ModesPerLine(); n != 4 {
+		t.Errorf("Wrong MODES: %d", n)
+	}
+
+	// Unknown tokens can be queried too, and the map is a copy.
+	toks := c.ISupport()
+	if toks["BOTPREFIX"] != "!" || toks["NETWORK"] != "FooNet" || len(toks) != 6 {
+		t.Errorf("Wrong ISUPPORT tokens: %v", toks)
+	}
+	toks["NICKLEN"] = "1"
+	if n, _ := c.NickLen(); n != 30 {
+		t.Errorf("ISupport returned the tokens by reference.")
+	}
+}
+
+func TestBotMode(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if err := c.SetBotMode(); err == nil {
+		t.Errorf("SetBotMode succeeded without BOT ISUPPORT token.")
+	}
+	s.nc.ExpectNothing()
+
+	c.h_005(ParseLine(":irc.server.org 005 test BOT=b :are supported by this server"))
+	s.st.EXPECT().Me().Return(c.cfg.Me)
+	if err := c.SetBotMode(); err != nil {
+		t.Errorf("SetBotMode returned unexpected error: %v", err)
+	}
+	s.nc.Expect("MODE test +b")
+
+	// The advertised bot mode should be tracked as NickMode.Bot,
+	// both in our own user modes and in WHO replies.
+	gomock.InOrder(
+		s.st.EXPECT().GetChannel("test").Return(nil),
+		s.st.EXPECT().GetNick("test").Return(c.cfg.Me),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickModes("test", "+Bi"),
+	)
+	c.h_MODE(ParseLine(":test!test@somehost.com MODE test +bi"))
+
+	gomock.InOrder(
+		s.st.EXPECT().GetNick("user1").Return(&state.Nick{Nick: "user1"}),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().NickInfo("user1", "ident1", "host1.com", "name"),
+		s.st.EXPECT().NickAway("user1", true, ""),
+		s.st.EXPECT().NickModes("user1", "+B"),
+	)
+	c.h_352(ParseLine(":irc.server.org 352 test #test1 ident1 host1.com irc.server.org user1 Gb :0 name"))
+}
@@ -0,0 +1,594 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/goirc/logging"
+	"github.com/lfkeitel/goirc/state"
+)
+
+// How long JoinAll waits for the server to reply to a JOIN
+// before giving up on it and joining the next channel.
+var joinAllTimeout = 30 * time.Second
+
+// JoinFailure is the reason the server refused a JOIN.
+type JoinFailure string
+
+const (
+	JoinNoSuchChannel  JoinFailure = "no such channel"
+	JoinUnavailable    JoinFailure = "temporarily unavailable"
+	JoinChannelFull    JoinFailure = "channel is full"
+	JoinInviteOnly     JoinFailure = "invite only"
+	JoinBanned         JoinFailure = "banned"
+	JoinBadKey         JoinFailure = "bad key"
+	JoinBadMask        JoinFailure = "bad channel mask"
+	JoinNeedRegistered JoinFailure = "registered nick required"
+	JoinThrottled      JoinFailure = "throttled"
+)
+
+// Replies that tell us a JOIN has failed, and why. In all of them
+// the channel we tried to join is in Args[1].
+var joinFailures = map[string]JoinFailure{
+	"403": JoinNoSuchChannel,  // ERR_NOSUCHCHANNEL
+	"437": JoinUnavailable,    // ERR_UNAVAILRESOURCE
+	"471": JoinChannelFull,    // ERR_CHANNELISFULL
+	"473": JoinInviteOnly,     // ERR_INVITEONLYCHAN
+	"474": JoinBanned,         // ERR_BANNEDFROMCHAN
+	"475": JoinBadKey,         // ERR_BADCHANNELKEY
+	"476": JoinBadMask,        // ERR_BADCHANMASK
+	"477": JoinNeedRegistered, // ERR_NEEDREGGEDNICK
+	"480": JoinThrottled,      // ERR_THROTTLE
+}
+
+// JoinError is returned by JoinWait if the server refuses the JOIN.
+type JoinError struct {
+	Channel string
+	Reason  JoinFailure
+	// The text of the server's reply, e.g. "Cannot join channel (+k)".
+	Text string
+}
+
+func (e *JoinError) Error() string {
+	return fmt.Sprintf("irc.JoinWait(): cannot join %s: %s", e.Channel, e.Reason)
+}
+
+// Handler for replies refusing a JOIN, which dispatches a JOIN_FAILED event
+// with the channel in Args[0], the JoinFailure in Args[1] and the server's
+// text in Args[2]. Servers also send 403 and 476 for other commands naming
+// a channel, like PART or TOPIC, so those only count if we've sent a JOIN
+// for the channel.
+//   :server 475 me #channel :Cannot join channel (+k)
+func (conn *Conn) h_JOINFAILED(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	k := conn.Casefold(line.Args[1])
+	conn.joinsMu.Lock()
+	asked := conn.joinsSent[k]
+	delete(conn.joinsSent, k)
+	conn.joinsMu.Unlock()
+	if (line.Cmd == "403" || line.Cmd == "476") && !asked {
+		return
+	}
+	l := line.Copy()
+	l.Cmd = JOIN_FAILED
+	l.Args = []string{line.Args[1], string(joinFailures[line.Cmd]), line.Text()}
+	l.Internal = true
+	conn.dispatch(l)
+}
+
+// How many times a JOIN refused with 437 ERR_UNAVAILRESOURCE is retried
+// if Config.RetryUnavailable is set.
+const unavailRetries = 3
+
+// unavailJoin is a channel we've sent a JOIN for, with the key we used and
+// how many times it's been retried because the channel was unavailable.
+type unavailJoin struct {
+	key     string
+	retries int
+}
+
+// unavailTrack returns the retry state for the case-folded channel k,
+// creating it if needed. conn.unavailMu must be held.
+func (conn *Conn) unavailTrack(k string) *unavailJoin {
+	uj, ok := conn.unavail[k]
+	if !ok {
+		if len(conn.unavail) == 0 {
+			for _, n := range []string{JOIN, JOIN_FAILED} {
+				conn.unavailRemovers = append(conn.unavailRemovers,
+					conn.handle(n, HandlerFunc((*Conn).h_UNAVAILDONE)))
+			}
+		}
+		uj = &unavailJoin{}
+		conn.unavail[k] = uj
+	}
+	return uj
+}
+
+// unavailForget forgets the retry state for the case-folded channel k.
+// conn.unavailMu must be held.
+func (conn *Conn) unavailForget(k string) {
+	if _, ok := conn.unavail[k]; !ok {
+		return
+	}
+	delete(conn.unavail, k)
+	if len(conn.unavail) == 0 {
+		for _, r := range conn.unavailRemovers {
+			r.Remove()
+		}
+		conn.unavailRemovers = nil
+	}
+}
+
+// Handler for 437 ERR_UNAVAILRESOURCE, sent when the nick or channel we
+// asked for is temporarily unavailable, e.g. because of nick delay after a
+// netsplit. An UNAVAILABLE event is dispatched with the nick or channel in
+// Args[0] and the server's text in Args[1]. Nicks are then handled as with
+// 433, trying Config.NewNick. Channels are retried if
+// Config.RetryUnavailable is set, and JOIN_FAILED is dispatched otherwise.
+//   :server 437 me #channel :Nick/channel is temporarily unavailable
+func (conn *Conn) h_437(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	target := line.Args[1]
+	l := line.Copy()
+	l.Cmd, l.Args = UNAVAILABLE, []string{target, line.Text()}
+	l.Internal = true
+	conn.dispatch(l)
+	if !conn.IsChannel(target) {
+		conn.h_433(line)
+		return
+	}
+	if d := conn.cfg.RetryUnavailable; d > 0 {
+		k := conn.Casefold(target)
+		conn.unavailMu.Lock()
+		uj := conn.unavailTrack(k)
+		if uj.retries < unavailRetries {
+			uj.retries++
+			var keys []string
+			if uj.key != "" {
+				keys = append(keys, uj.key)
+			}
+			conn.unavailMu.Unlock()
+			logging.Info("irc.437(): %s unavailable, retrying in %s", target, d)
+			conn.After(d, func(conn *Conn) { conn.Join(target, keys...) })
+			return
+		}
+		conn.unavailForget(k)
+		conn.unavailMu.Unlock()
+	}
+	conn.h_JOINFAILED(line)
+}
+
+// Handler to forget the retry state for channels we've joined, or failed
+// to join. It is only registered while there's state to forget.
+//   :me!ident@host JOIN #channel
+func (conn *Conn) h_UNAVAILDONE(line *Line) {
+	if !line.argslen(0) ||
+		(line.Cmd == JOIN && conn.Casefold(line.Nick) != conn.Casefold(conn.Me().Nick)) {
+		return
+	}
+	conn.unavailMu.Lock()
+	conn.unavailForget(conn.Casefold(line.Args[0]))
+	conn.unavailMu.Unlock()
+}
+
+// Handler for 470 ERR_LINKCHANNEL, sent when the server forwards our JOIN
+// to another channel, e.g. because the one we asked for is full. We're
+// about to receive a JOIN for the channel we were forwarded to, so this
+// isn't a failure. A FORWARD event is dispatched with the channel we asked
+// for in Args[0], the one we were forwarded to in Args[1] and the server's
+// text in Args[2].
+//   :server 470 me #requested #forwarded :Forwarding to another channel
+func (conn *Conn) h_470(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	conn.joinsMu.Lock()
+	delete(conn.joinsSent, conn.Casefold(line.Args[1]))
+	conn.joinsSent[conn.Casefold(line.Args[2])] = true
+	conn.joinsMu.Unlock()
+	l := line.Copy()
+	l.Cmd = FORWARD
+	l.Args = []string{line.Args[1], line.Args[2], line.Text()}
+	l.Internal = true
+	conn.dispatch(l)
+}
+
+// joinSent records the channels in a JOIN we're sending to the server, so
+// that h_FORCEDJOIN knows we asked to join them. It's called before the line
+// is written, since the server's JOIN could otherwise be handled first.
+func (conn *Conn) joinSent(line string) {
+	f := strings.Fields(line)
+	if len(f) < 2 || !strings.EqualFold(f[0], JOIN) || f[1] == "0" {
+		return
+	}
+	var keys []string
+	for _, ch := range strings.Split(f[1], ",") {
+		keys = append(keys, conn.Casefold(ch))
+	}
+	conn.joinsMu.Lock()
+	defer conn.joinsMu.Unlock()
+	for _, k := range keys {
+		conn.joinsSent[k] = true
+	}
+}
+
+// joinQueued adds n to the number of JOINs waiting in the send queue if line
+// is a JOIN, so that joinsBusy knows about them before they're sent.
+func (conn *Conn) joinQueued(line string, n int) {
+	if !strings.EqualFold(strings.SplitN(line, " ", 2)[0], JOIN) {
+		return
+	}
+	conn.joinsMu.Lock()
+	defer conn.joinsMu.Unlock()
+	if conn.joinsQueued += n; conn.joinsQueued < 0 {
+		// written without being queued, e.g. by tests
+		conn.joinsQueued = 0
+	}
+}
+
+// Handler for our own JOINs to spot those we didn't ask for, e.g. because
+// an oper used SAJOIN, which dispatches a FORCED_JOIN event with the channel
+// in Args[0]. The state tracker handles them like any other JOIN. We can only
+// tell that we didn't send a JOIN for the channel on this connection since
+// the server last confirmed or refused one, so a forced JOIN into a channel
+// we're waiting to join isn't noticed.
+//   :me!ident@host JOIN #channel
+func (conn *Conn) h_FORCEDJOIN(line *Line) {
+	if !line.argslen(0) {
+		return
+	}
+	// Not conn.Me(), which updates conn.cfg.Me and so would race with the
+	// state tracker's JOIN handler running alongside this one.
+	var me *state.Nick
+	if st := conn.st; st != nil {
+		me = st.Me()
+	} else {
+		me = conn.cfg.Me
+	}
+	if conn.Casefold(line.Nick) != conn.Casefold(me.Nick) {
+		return
+	}
+	k := conn.Casefold(line.Args[0])
+	conn.joinsMu.Lock()
+	asked := conn.joinsSent[k]
+	delete(conn.joinsSent, k)
+	conn.joinsMu.Unlock()
+	if asked {
+		return
+	}
+	logging.Info("irc.JOIN(): joined %s without asking to", line.Args[0])
+	l := line.Copy()
+	l.Cmd, l.Args = FORCED_JOIN, []string{line.Args[0]}
+	l.Internal = true
+	conn.dispatch(l)
+}
+
+// JoinAll joins each of channels in turn, waiting for the server to confirm
+// or refuse each JOIN before sending the next. Each channel may be followed
+// by a space and its key, as with Join. If the server says we're on too many
+// channels with 405 ERR_TOOMANYCHANNELS, or joining would exceed CHANLIMIT,
+// the remaining channels are dropped and a TOO_MANY_CHANNELS event is
+// dispatched with the channel that failed in Args[0]. JoinAll returns a
+// *LimitError if the first channel can't be joined because of CHANLIMIT.
+func (conn *Conn) JoinAll(channels ...string) error {
+	conn.joinMu.Lock()
+	conn.joinQueue = append(conn.joinQueue, channels...)
+	if conn.joining != "" {
+		// we'll get to these after the current JOIN
+		conn.joinMu.Unlock()
+		return nil
+	}
+	conn.joinMu.Unlock()
+	return conn.joinNext()
+}
+
+// joinNext sends the next JOIN queued by JoinAll, if any.
+func (conn *Conn) joinNext() error {
+	conn.joinMu.Lock()
+	conn.stopJoining()
+	if len(conn.joinQueue) == 0 {
+		conn.joinMu.Unlock()
+		return nil
+	}
+	next := conn.joinQueue[0]
+	conn.joinQueue = conn.joinQueue[1:]
+	channel := next
+	if f := strings.Fields(next); len(f) > 0 {
+		channel = f[0]
+	}
+	conn.joining = channel
+	conn.joinRemovers = append(conn.joinRemovers,
+		conn.handle(JOIN, HandlerFunc((*Conn).h_JOINALL)))
+	for n := range joinFailures {
+		conn.joinRemovers = append(conn.joinRemovers,
+			conn.handle(n, HandlerFunc((*Conn).h_JOINALL)))
+	}
+	// a forwarded JOIN won't be followed by a JOIN for the channel we asked for
+	conn.joinRemovers = append(conn.joinRemovers,
+		conn.handle("470", HandlerFunc((*Conn).h_JOINALL)))
+	conn.joinTimer = time.AfterFunc(joinAllTimeout, func() {
+		conn.joinTimedOut(channel)
+	})
+	conn.joinMu.Unlock()
+	err := conn.Join(next)
+	if err != nil {
+		conn.tooManyChannels(channel, err.Error())
+	}
+	return err
+}
+
+// stopJoining stops waiting for a reply to the current JOIN sent by
+// JoinAll. conn.joinMu must be held.
+func (conn *Conn) stopJoining() {
+	conn.joining = ""
+	for _, r := range conn.joinRemovers {
+		r.Remove()
+	}
+	conn.joinRemovers = nil
+	if conn.joinTimer != nil {
+		conn.joinTimer.Stop()
+		conn.joinTimer = nil
+	}
+}
+
+// joinTimedOut moves JoinAll on to the next channel if the server
+// hasn't replied to our JOIN for channel.
+func (conn *Conn) joinTimedOut(channel string) {
+	conn.joinMu.Lock()
+	current := conn.joining == channel
+	conn.joinMu.Unlock()
+	if current {
+		logging.Warn("irc.JoinAll(): no reply to JOIN %s after %s",
+			channel, joinAllTimeout)
+		conn.joinNext()
+	}
+}
+
+// tooManyChannels drops any channels queued by JoinAll
+// and dispatches a TOO_MANY_CHANNELS event for channel.
+func (conn *Conn) tooManyChannels(channel, reason string) {
+	conn.joinMu.Lock()
+	dropped := conn.joinQueue
+	conn.joinQueue = nil
+	conn.stopJoining()
+	conn.joinMu.Unlock()
+	logging.Warn("irc.JoinAll(): not joining %s: %s", channel, reason)
+	if len(dropped) > 0 {
+		logging.Warn("irc.JoinAll(): also dropped %s",
+			strings.Join(dropped, ", "))
+	}
+	conn.dispatch(&Line{Cmd: TOO_MANY_CHANNELS, Internal: true,
+		Args: []string{channel, reason}, Time: time.Now()})
+}
+
+// Handler to send the next JOIN queued by JoinAll once the server has
+// confirmed or refused the current one. It is only registered while
+// JoinAll is waiting for a reply.
+//   :me!ident@host JOIN #channel
+//   :server 471 me #channel :Cannot join channel (+l)
+//   :server 470 me #channel #forwarded :Forwarding to another channel
+func (conn *Conn) h_JOINALL(line *Line) {
+	channel := ""
+	if line.Cmd == JOIN {
+		if len(line.Args) > 0 &&
+			conn.Casefold(line.Nick) == conn.Casefold(conn.Me().Nick) {
+			channel = line.Args[0]
+		}
+	} else if len(line.Args) > 1 {
+		channel = line.Args[1]
+	}
+	conn.joinMu.Lock()
+	current := channel != "" && conn.Casefold(channel) == conn.Casefold(conn.joining)
+	conn.joinMu.Unlock()
+	if current {
+		conn.joinNext()
+	}
+}
+
+// Handler for 405 ERR_TOOMANYCHANNELS. This stops JoinAll joining further
+// channels and, with state tracking enabled, limits the number of channels
+// Join allows from now on to the number we're on.
+//   :server 405 me #channel :You have joined too many channels
+func (conn *Conn) h_405(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	channel := line.Args[1]
+	if conn.st != nil && channel != "" {
+		_, prefixes, ok := conn.ChanLimit(channel[0])
+		if !ok {
+			prefixes = channel[:1]
+		}
+		n := 0
+		for c := range conn.Me().Channels {
+			if strings.IndexByte(prefixes, c[0]) != -1 {
+				n++
+			}
+		}
+		conn.supMu.Lock()
+		for i := range prefixes {
+			conn.chanLimits[prefixes[i]] = n
+		}
+		conn.supMu.Unlock()
+	}
+	conn.tooManyChannels(channel, line.Text())
+}
+
+// joinWait is a JOIN sent by JoinWait that's waiting for the server
+// to confirm or refuse it. channel changes if we're forwarded elsewhere.
+type joinWait struct {
+	channel string
+	joined  bool
+	waiters []chan error
+}
+
+// JoinWait joins channel with an optional key, as with Join, and waits until
+// the server has confirmed the JOIN and sent the channel's NAMES. It returns
+// the channel from the state tracker, or nil if state tracking is disabled.
+// If the server forwards us to another channel with 470 ERR_LINKCHANNEL,
+// JoinWait waits for that channel instead and returns it. A *JoinError is
+// returned if the server refuses the JOIN, e.g. with 471 ERR_CHANNELISFULL,
+// or ctx.Err() if ctx is done first. Concurrent calls for the same channel
+// share a single JOIN.
+//     JOIN channel [key]
+func (conn *Conn) JoinWait(ctx context.Context, channel, key string) (*state.Channel, error) {
+	if f := strings.Fields(channel); len(f) != 1 {
+		return nil, fmt.Errorf("irc.JoinWait(): bad channel %q", channel)
+	}
+	ch := make(chan error, 1)
+	k := conn.Casefold(channel)
+	conn.joinWaitMu.Lock()
+	jw, ok := conn.joinWaits[k]
+	if !ok {
+		if len(conn.joinWaits) == 0 {
+			for _, n := range []string{JOIN, "366", JOIN_FAILED, FORWARD} {
+				conn.joinWaitRemovers = append(conn.joinWaitRemovers,
+					conn.handle(n, HandlerFunc((*Conn).h_JOINWAIT)))
+			}
+		}
+		jw = &joinWait{channel: channel}
+		conn.joinWaits[k] = jw
+	}
+	jw.waiters = append(jw.waiters, ch)
+	conn.joinWaitMu.Unlock()
+	if !ok {
+		var keys []string
+		if key != "" {
+			keys = append(keys, key)
+		}
+		if err := conn.Join(channel, keys...); err != nil {
+			conn.joinWaitDone(k, err)
+		}
+	}
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			return nil, err
+		}
+		conn.joinWaitMu.Lock()
+		channel = jw.channel
+		conn.joinWaitMu.Unlock()
+		if st := conn.st; st != nil {
+			return st.GetChannel(channel), nil
+		}
+		return nil, nil
+	case <-ctx.Done():
+		conn.joinWaitMu.Lock()
+		k = conn.Casefold(jw.channel)
+		if jw, ok := conn.joinWaits[k]; ok {
+			for i, w := range jw.waiters {
+				if w == ch {
+					jw.waiters = append(jw.waiters[:i], jw.waiters[i+1:]...)
+					break
+				}
+			}
+			if len(jw.waiters) == 0 {
+				delete(conn.joinWaits, k)
+				conn.stopJoinWaits()
+			}
+		}
+		conn.joinWaitMu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// joinWaitDone tells everyone waiting for the JOIN of the case-folded
+// channel k how it went.
+func (conn *Conn) joinWaitDone(k string, err error) {
+	conn.joinWaitMu.Lock()
+	defer conn.joinWaitMu.Unlock()
+	jw, ok := conn.joinWaits[k]
+	if !ok {
+		return
+	}
+	delete(conn.joinWaits, k)
+	for _, ch := range jw.waiters {
+		ch <- err
+	}
+	conn.stopJoinWaits()
+}
+
+// joinWaitFail tells everyone waiting for a JOIN that it failed with err,
+// e.g. because we've been disconnected.
+func (conn *Conn) joinWaitFail(err error) {
+	conn.joinWaitMu.Lock()
+	keys := make([]string, 0, len(conn.joinWaits))
+	for k := range conn.joinWaits {
+		keys = append(keys, k)
+	}
+	conn.joinWaitMu.Unlock()
+	for _, k := range keys {
+		conn.joinWaitDone(k, err)
+	}
+}
+
+// stopJoinWaits removes the handlers following JOINs sent by JoinWait
+// if none are waiting for replies. conn.joinWaitMu must be held.
+func (conn *Conn) stopJoinWaits() {
+	if len(conn.joinWaits) > 0 {
+		return
+	}
+	for _, r := range conn.joinWaitRemovers {
+		r.Remove()
+	}
+	conn.joinWaitRemovers = nil
+}
+
+// Handler to follow the progress of JOINs sent by JoinWait. It is only
+// registered while they are waiting for replies.
+//   :me!ident@host JOIN #channel
+//   :server 366 me #channel :End of /NAMES list.
+//   :server 470 me #channel #forwarded :Forwarding to another channel
+func (conn *Conn) h_JOINWAIT(line *Line) {
+	switch line.Cmd {
+	case JOIN:
+		if len(line.Args) == 0 ||
+			conn.Casefold(line.Nick) != conn.Casefold(conn.Me().Nick) {
+			return
+		}
+		conn.joinWaitMu.Lock()
+		if jw, ok := conn.joinWaits[conn.Casefold(line.Args[0])]; ok {
+			jw.joined = true
+		}
+		conn.joinWaitMu.Unlock()
+	case "366":
+		if !line.argslen(1) {
+			return
+		}
+		k := conn.Casefold(line.Args[1])
+		conn.joinWaitMu.Lock()
+		jw, ok := conn.joinWaits[k]
+		joined := ok && jw.joined
+		conn.joinWaitMu.Unlock()
+		if joined {
+			conn.joinWaitDone(k, nil)
+		}
+	case FORWARD:
+		from, to := conn.Casefold(line.Args[0]), conn.Casefold(line.Args[1])
+		conn.joinWaitMu.Lock()
+		if jw, ok := conn.joinWaits[from]; ok && from != to {
+			delete(conn.joinWaits, from)
+			jw.channel = line.Args[1]
+			if other, ok := conn.joinWaits[to]; ok {
+				// someone is already waiting to join it, so share that JOIN
+				other.waiters = append(other.waiters, jw.waiters...)
+			} else {
+				conn.joinWaits[to] = jw
+			}
+		}
+		conn.joinWaitMu.Unlock()
+	case JOIN_FAILED:
+		conn.joinWaitDone(conn.Casefold(line.Args[0]), &JoinError{
+			Channel: line.Args[0],
+			Reason:  JoinFailure(line.Args[1]),
+			Text:    line.Args[2],
+		})
+	}
+}
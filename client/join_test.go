@@ -0,0 +1,374 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/lfkeitel/goirc/state"
+)
+
+func TestJoinAll(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.st = nil
+	c.JoinAll("#a", "#b key", "#c", "#d", "#e")
+	s.nc.Expect("JOIN #a")
+	s.nc.ExpectNothing()
+
+	// Replies about other channels, or other nicks joining,
+	// shouldn't advance the queue ...
+	c.h_JOINALL(ParseLine(":irc.server.org 475 test #other :Cannot join channel (+k)"))
+	c.h_JOINALL(ParseLine(":other!ident@host JOIN #a"))
+	s.nc.ExpectNothing()
+
+	// ... but our own JOIN or a failure to join should.
+	c.h_JOINALL(ParseLine(":test!ident@host JOIN #A"))
+	s.nc.Expect("JOIN #b key")
+	c.h_JOINALL(ParseLine(":irc.server.org 475 test #b :Cannot join channel (+k)"))
+	s.nc.Expect("JOIN #c")
+	c.h_JOINALL(ParseLine(":irc.server.org 470 test #c ##c :Forwarding to another channel"))
+	s.nc.Expect("JOIN #d")
+
+	// If the server doesn't reply at all, we should eventually move on.
+	joinAllTimeout = time.Millisecond
+	c.joinTimedOut("#d")
+	s.nc.Expect("JOIN #e")
+	joinAllTimeout = 30 * time.Second
+	c.h_JOINALL(ParseLine(":test!ident@host JOIN #e"))
+	s.nc.ExpectNothing()
+
+	// Too many channels should stop joining and dispatch an event.
+	c.JoinAll("#c", "#d")
+	s.nc.Expect("JOIN #c")
+	tooMany := callCheck(t)
+	c.HandleFunc(TOO_MANY_CHANNELS, func(conn *Conn, line *Line) {
+		if line.Args[0] != "#c" {
+			t.Errorf("TOO_MANY_CHANNELS for wrong channel: %q", line.Args[0])
+		}
+		tooMany.call()
+	})
+	go c.h_405(ParseLine(":irc.server.org 405 test #c :You have joined too many channels"))
+	tooMany.assertWasCalled("TOO_MANY_CHANNELS not dispatched on 405.")
+	s.nc.ExpectNothing()
+	c.st = s.st
+
+	// With state tracking, the number of channels we're on when we get a 405
+	// should limit joins from then on.
+	c.h_005(ParseLine(":irc.server.org 005 test CHANLIMIT=#&:10 " +
+		":are supported by this server"))
+	me := &state.Nick{Nick: "test",
+		Channels: map[string]*state.ChanPrivs{"#a": {}, "&b": {}, "+c": {}}}
+	s.st.EXPECT().Me().Return(me).Times(2)
+	go c.h_405(ParseLine(":irc.server.org 405 test #c :You have joined too many channels"))
+	tooMany.assertWasCalled("TOO_MANY_CHANNELS not dispatched on 405.")
+	if l, p, ok := c.ChanLimit('&'); !ok || l != 2 || p != "#&" {
+		t.Errorf("Limit not learned from 405: %d %q %t", l, p, ok)
+	}
+	errs := make(chan error)
+	go func() { errs <- c.JoinAll("#c", "#d") }()
+	tooMany.assertWasCalled("TOO_MANY_CHANNELS not dispatched over CHANLIMIT.")
+	if err := <-errs; err == nil {
+		t.Errorf("JoinAll over learned limit did not return an error.")
+	}
+	s.nc.ExpectNothing()
+}
+
+func TestJoinWait(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	type result struct {
+		ch  *state.Channel
+		err error
+	}
+	joinWait := func(ctx context.Context, channel, key string) chan result {
+		res := make(chan result, 1)
+		go func() {
+			ch, err := c.JoinWait(ctx, channel, key)
+			res <- result{ch, err}
+		}()
+		return res
+	}
+	expectNoResult := func(res chan result) {
+		select {
+		case r := <-res:
+			t.Errorf("JoinWait returned early: %#v", r)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	c.st = nil
+	res := joinWait(context.Background(), "#a", "")
+	s.nc.Expect("JOIN #a")
+	// NAMES before we've joined, or other nicks joining, aren't enough.
+	c.h_JOINWAIT(ParseLine(":irc.server.org 366 test #a :End of /NAMES list."))
+	c.h_JOINWAIT(ParseLine(":other!ident@host JOIN #a"))
+	c.h_JOINWAIT(ParseLine(":test!ident@host JOIN #A"))
+	expectNoResult(res)
+	c.h_JOINWAIT(ParseLine(":irc.server.org 366 test #a :End of /NAMES list."))
+	if r := <-res; r.ch != nil || r.err != nil {
+		t.Errorf("JoinWait without state tracking returned %#v", r)
+	}
+
+	// Failure to join should be returned as an error.
+	res = joinWait(context.Background(), "#b", "key")
+	s.nc.Expect("JOIN #b key")
+	c.h_JOINFAILED(ParseLine(":irc.server.org 475 test #b :Cannot join channel (+k)"))
+	if r := <-res; r.err == nil {
+		t.Errorf("JoinWait did not return an error on 475.")
+	} else if je, ok := r.err.(*JoinError); !ok || je.Channel != "#b" ||
+		je.Reason != JoinBadKey || je.Text != "Cannot join channel (+k)" {
+		t.Errorf("JoinWait returned wrong error on 475: %#v", r.err)
+	}
+
+	// Giving up should stop waiting for replies.
+	ctx, cancel := context.WithCancel(context.Background())
+	res = joinWait(ctx, "#c", "")
+	s.nc.Expect("JOIN #c")
+	cancel()
+	if r := <-res; r.err != context.Canceled {
+		t.Errorf("JoinWait did not return context error: %#v", r)
+	}
+	c.joinWaitMu.Lock()
+	if len(c.joinWaits) != 0 || len(c.joinWaitRemovers) != 0 {
+		t.Errorf("JoinWait still waiting after cancellation.")
+	}
+	c.joinWaitMu.Unlock()
+
+	// As should disconnecting.
+	res = joinWait(context.Background(), "#e", "")
+	s.nc.Expect("JOIN #e")
+	c.joinWaitFail(ErrDisconnected)
+	if r := <-res; r.err != ErrDisconnected {
+		t.Errorf("JoinWait did not fail on disconnect: %#v", r)
+	}
+	c.joinWaitMu.Lock()
+	if len(c.joinWaits) != 0 || len(c.joinWaitRemovers) != 0 {
+		t.Errorf("JoinWait still waiting after disconnect.")
+	}
+	c.joinWaitMu.Unlock()
+	c.st = s.st
+
+	// With state tracking, the tracked channel is returned.
+	chd := &state.Channel{Name: "#d"}
+	gomock.InOrder(
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().GetChannel("#d").Return(chd),
+	)
+	res = joinWait(context.Background(), "#d", "")
+	s.nc.Expect("JOIN #d")
+	c.h_JOINWAIT(ParseLine(":test!ident@host JOIN #d"))
+	c.h_JOINWAIT(ParseLine(":irc.server.org 366 test #d :End of /NAMES list."))
+	if r := <-res; r.ch != chd || r.err != nil {
+		t.Errorf("JoinWait with state tracking returned %#v", r)
+	}
+}
+
+func TestJoinFailed(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	failed := []string{}
+	c.HandleFunc(JOIN_FAILED, func(conn *Conn, line *Line) {
+		if !line.Internal || len(line.Args) != 3 {
+			t.Errorf("Bad JOIN_FAILED event: %#v", line)
+			return
+		}
+		failed = append(failed, strings.Join(line.Args, "|"))
+	})
+	c.h_JOINFAILED(ParseLine(":irc.server.org 471 test #a :Cannot join channel (+l)"))
+	c.h_JOINFAILED(ParseLine(":irc.server.org 473 test #b :Cannot join channel (+i)"))
+	c.h_JOINFAILED(ParseLine(":irc.server.org 474 test #c :Cannot join channel (+b)"))
+	c.h_JOINFAILED(ParseLine(":irc.server.org 477 test #d :You need a registered nick"))
+	c.h_JOINFAILED(ParseLine(":irc.server.org 480 test #e :Cannot join channel (+j)"))
+	c.h_JOINFAILED(ParseLine(":irc.server.org 475 test"))
+	// 403 is also sent for e.g. PART, so only counts after a JOIN.
+	c.h_JOINFAILED(ParseLine(":irc.server.org 403 test #f :No such channel"))
+	c.joinSent("JOIN #f,#g")
+	c.h_JOINFAILED(ParseLine(":irc.server.org 403 test #F :No such channel"))
+	c.h_JOINFAILED(ParseLine(":irc.server.org 476 test #g :Bad Channel Mask"))
+	exp := []string{
+		"#a|channel is full|Cannot join channel (+l)",
+		"#b|invite only|Cannot join channel (+i)",
+		"#c|banned|Cannot join channel (+b)",
+		"#d|registered nick required|You need a registered nick",
+		"#e|throttled|Cannot join channel (+j)",
+		"#F|no such channel|No such channel",
+		"#g|bad channel mask|Bad Channel Mask",
+	}
+	if !reflect.DeepEqual(failed, exp) {
+		t.Errorf("Incorrect JOIN_FAILED events:\n%q\nwant\n%q", failed, exp)
+	}
+}
+
+func TestForward(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	forwards := []string{}
+	c.HandleFunc(FORWARD, func(conn *Conn, line *Line) {
+		if !line.Internal || len(line.Args) != 3 {
+			t.Errorf("Bad FORWARD event: %#v", line)
+			return
+		}
+		forwards = append(forwards, strings.Join(line.Args, "|"))
+	})
+	c.h_470(ParseLine(":irc.server.org 470 test #a ##a :Forwarding to another channel"))
+	c.h_470(ParseLine(":irc.server.org 470 test #b"))
+	exp := []string{"#a|##a|Forwarding to another channel"}
+	if !reflect.DeepEqual(forwards, exp) {
+		t.Errorf("Incorrect FORWARD events:\n%q\nwant\n%q", forwards, exp)
+	}
+
+	// JoinWait follows the forward and returns the channel we ended up in.
+	chd := &state.Channel{Name: "##c"}
+	res := make(chan *state.Channel, 1)
+	go func() {
+		ch, err := c.JoinWait(context.Background(), "#c", "")
+		if err != nil {
+			t.Errorf("JoinWait returned error after forward: %v", err)
+		}
+		res <- ch
+	}()
+	s.nc.Expect("JOIN #c")
+	gomock.InOrder(
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+		s.st.EXPECT().GetChannel("##c").Return(chd),
+	)
+	c.h_470(ParseLine(":irc.server.org 470 test #c ##c :Forwarding to another channel"))
+	c.h_JOINWAIT(ParseLine(":test!ident@host JOIN ##c"))
+	c.h_JOINWAIT(ParseLine(":irc.server.org 366 test ##c :End of /NAMES list."))
+	if ch := <-res; ch != chd {
+		t.Errorf("JoinWait after forward returned %#v", ch)
+	}
+	c.joinWaitMu.Lock()
+	if len(c.joinWaits) != 0 || len(c.joinWaitRemovers) != 0 {
+		t.Errorf("JoinWait still waiting after forwarded JOIN.")
+	}
+	c.joinWaitMu.Unlock()
+}
+
+func TestUnavailable(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+	c.st = nil
+	defer func() { c.st = s.st }()
+
+	var mu sync.Mutex
+	events := []string{}
+	record := func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, line.Cmd+" "+strings.Join(line.Args, "|"))
+	}
+	c.HandleFunc(UNAVAILABLE, record)
+	c.HandleFunc(JOIN_FAILED, record)
+
+	// An unavailable nick is handled like 433.
+	c.h_437(ParseLine(":irc.server.org 437 test test :Nick/channel is temporarily unavailable"))
+	s.nc.Expect("NICK test_")
+	if c.cfg.Me.Nick != "test_" {
+		t.Errorf("My nick not updated from '%s'.", c.cfg.Me.Nick)
+	}
+
+	// By default, an unavailable channel fails straight away.
+	c.h_437(ParseLine(":irc.server.org 437 test_ #a :Nick/channel is temporarily unavailable"))
+	s.nc.ExpectNothing()
+
+	// With RetryUnavailable, the JOIN is retried with the same key.
+	c.cfg.RetryUnavailable = time.Millisecond
+	c.Join("#b", "key")
+	s.nc.Expect("JOIN #b key")
+	for i := 0; i < unavailRetries; i++ {
+		c.h_437(ParseLine(":irc.server.org 437 test_ #b :Nick/channel is temporarily unavailable"))
+		<-time.After(20 * time.Millisecond)
+		s.nc.Expect("JOIN #b key")
+	}
+	// ... until it's been retried too many times.
+	c.h_437(ParseLine(":irc.server.org 437 test_ #b :Nick/channel is temporarily unavailable"))
+	<-time.After(20 * time.Millisecond)
+	s.nc.ExpectNothing()
+
+	// Successful JOINs forget the retry state.
+	c.Join("#c")
+	s.nc.Expect("JOIN #c")
+	c.h_437(ParseLine(":irc.server.org 437 test_ #c :Nick/channel is temporarily unavailable"))
+	<-time.After(20 * time.Millisecond)
+	s.nc.Expect("JOIN #c")
+	c.dispatch(ParseLine(":test_!ident@host JOIN #c"))
+	c.unavailMu.Lock()
+	if len(c.unavail) != 0 || len(c.unavailRemovers) != 0 {
+		t.Errorf("Retry state not forgotten after JOIN: %v", c.unavail)
+	}
+	c.unavailMu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	text := "Nick/channel is temporarily unavailable"
+	exp := []string{
+		UNAVAILABLE + " test|" + text,
+		UNAVAILABLE + " #a|" + text,
+		JOIN_FAILED + " #a|temporarily unavailable|" + text,
+		UNAVAILABLE + " #b|" + text,
+		UNAVAILABLE + " #b|" + text,
+		UNAVAILABLE + " #b|" + text,
+		UNAVAILABLE + " #b|" + text,
+		JOIN_FAILED + " #b|temporarily unavailable|" + text,
+		UNAVAILABLE + " #c|" + text,
+	}
+	if !reflect.DeepEqual(events, exp) {
+		t.Errorf("Incorrect events:\n%q\nwant\n%q", events, exp)
+	}
+}
+
+func TestForcedJoin(t *testing.T) {
+	c, s := setUp(t, false)
+	defer s.tearDown()
+	c.st = nil
+
+	var forced []string
+	c.HandleFunc(FORCED_JOIN, func(conn *Conn, line *Line) {
+		if !line.Internal {
+			t.Errorf("FORCED_JOIN not internal: %#v", line)
+		}
+		forced = append(forced, line.Args[0])
+	})
+	for _, l := range []string{"JOIN #a,#B key", "JOIN #c", "JOIN #d", "JOIN 0"} {
+		c.write(l, time.Time{})
+		s.nc.Expect(l)
+	}
+
+	// Channels we asked to join, or were forwarded to, aren't forced.
+	c.h_470(ParseLine(":irc.server.org 470 test #c #c-overflow :Forwarding"))
+	c.h_JOINFAILED(ParseLine(":irc.server.org 473 test #d :Cannot join channel (+i)"))
+	for _, l := range []string{
+		":test!test@somehost.com JOIN #A",
+		":test!test@somehost.com JOIN #b",
+		":test!test@somehost.com JOIN #c-overflow",
+		":user1!user1@host JOIN #e",
+	} {
+		c.h_FORCEDJOIN(ParseLine(l))
+	}
+	if len(forced) != 0 {
+		t.Errorf("Requested JOINs seen as forced: %q", forced)
+	}
+
+	// Everything else is, including channels we've already been told about.
+	for _, l := range []string{
+		":test!test@somehost.com JOIN #a",
+		":test!test@somehost.com JOIN #c",
+		":test!test@somehost.com JOIN #d",
+		":test!test@somehost.com JOIN #e",
+	} {
+		c.h_FORCEDJOIN(ParseLine(l))
+	}
+	if exp := []string{"#a", "#c", "#d", "#e"}; !reflect.DeepEqual(forced, exp) {
+		t.Errorf("Forced JOINs were %q, expected %q", forced, exp)
+	}
+}
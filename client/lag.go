@@ -0,0 +1,55 @@
+package client
+
+import (
+	"strconv"
+	"time"
+)
+
+// pingPayload returns the payload for the next PING sent by the ping
+// goroutine or SelfTest, and remembers it and when it was sent so the PONG
+// can be matched, along with a channel that's closed when it is. Unless
+// Config.PingPayload is set the payload is a token unique to the PING, made
+// from a counter and the time it was sent.
+func (conn *Conn) pingPayload() (string, <-chan struct{}) {
+	conn.pingMu.Lock()
+	defer conn.pingMu.Unlock()
+	now := time.Now()
+	conn.pingSeq++
+	conn.pingToken = conn.cfg.PingPayload
+	if conn.pingToken == "" {
+		conn.pingToken = strconv.FormatUint(conn.pingSeq, 10) + "-" +
+			strconv.FormatInt(now.UnixNano(), 10)
+	}
+	conn.pingSent = now
+	conn.pingAnswered = make(chan struct{})
+	return conn.pingToken, conn.pingAnswered
+}
+
+// Handler for PONGs, which records the lag if it's a reply to our last PING.
+// Servers differ on where they echo the payload, so it's looked for in
+// each argument, e.g.
+//   :server PONG server :payload
+//   :server PONG :payload
+func (conn *Conn) h_PONG(line *Line) {
+	conn.pingMu.Lock()
+	defer conn.pingMu.Unlock()
+	if conn.pingToken == "" {
+		return
+	}
+	for _, arg := range line.Args {
+		if arg == conn.pingToken {
+			conn.lag = line.Time.Sub(conn.pingSent)
+			conn.pingToken = ""
+			close(conn.pingAnswered)
+			return
+		}
+	}
+}
+
+// Lag returns the round trip time of the last PING sent every
+// Config.PingFreq to be answered, or 0 if none have been yet.
+func (conn *Conn) Lag() time.Duration {
+	conn.pingMu.Lock()
+	defer conn.pingMu.Unlock()
+	return conn.lag
+}
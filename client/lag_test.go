@@ -0,0 +1,71 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLag(t *testing.T) {
+	c, s := setUp(t, false)
+	defer s.tearDown()
+
+	pong := func(raw string, after time.Duration) {
+		l := ParseLine(raw)
+		c.pingMu.Lock()
+		l.Time = c.pingSent.Add(after)
+		c.pingMu.Unlock()
+		c.h_PONG(l)
+	}
+
+	if lag := c.Lag(); lag != 0 {
+		t.Errorf("Lag before any PINGs was %s", lag)
+	}
+
+	// Each PING has a unique payload, echoed in either argument.
+	tok1, _ := c.pingPayload()
+	tok2, answered := c.pingPayload()
+	if tok1 == tok2 || tok1 == "" {
+		t.Errorf("PING payloads not unique: %q, %q", tok1, tok2)
+	}
+	pong(":irc.server.org PONG irc.server.org :"+tok1, time.Second)
+	if lag := c.Lag(); lag != 0 {
+		t.Errorf("PONG for an old PING changed lag to %s", lag)
+	}
+	select {
+	case <-answered:
+		t.Errorf("PING answered by PONG for an old PING.")
+	default:
+	}
+	pong(":irc.server.org PONG irc.server.org :"+tok2, 2*time.Second)
+	if lag := c.Lag(); lag != 2*time.Second {
+		t.Errorf("Lag was %s, expected 2s", lag)
+	}
+	select {
+	case <-answered:
+	default:
+		t.Errorf("PING not marked answered by its PONG.")
+	}
+	tok, _ := c.pingPayload()
+	pong(":irc.server.org PONG :"+tok, 3*time.Second)
+	if lag := c.Lag(); lag != 3*time.Second {
+		t.Errorf("Lag was %s, expected 3s", lag)
+	}
+
+	// Only the first PONG for a PING counts.
+	tok, _ = c.pingPayload()
+	pong(":irc.server.org PONG "+tok+" irc.server.org", time.Second)
+	pong(":irc.server.org PONG "+tok+" irc.server.org", 5*time.Second)
+	if lag := c.Lag(); lag != time.Second {
+		t.Errorf("Lag was %s, expected 1s", lag)
+	}
+
+	// A fixed payload is used if configured.
+	c.cfg.PingPayload = "keepalive"
+	if tok, _ := c.pingPayload(); tok != "keepalive" {
+		t.Errorf("PING payload was %q, expected keepalive", tok)
+	}
+	pong(":irc.server.org PONG irc.server.org :keepalive", 4*time.Second)
+	if lag := c.Lag(); lag != 4*time.Second {
+		t.Errorf("Lag was %s, expected 4s", lag)
+	}
+}
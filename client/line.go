@@ -8,7 +8,8 @@ import (
 	"github.com/lfkeitel/goirc/logging"
 )
 
-var tagsReplacer = strings.NewReplacer("\\:", ";", "\\s", " ", "\\r", "\r", "\\n", "\n")
+var tagsReplacer = strings.NewReplacer("\\:", ";", "\\s", " ", "\\r", "\r", "\\n", "\n",
+	"\\\\", "\\")
 
 // We parse an incoming line into this struct. Line.Cmd is used as the trigger
 // name for incoming event handlers and is the IRC verb, the first sequence
@@ -22,6 +23,13 @@ type Line struct {
 	Cmd, Raw               string
 	Args                   []string
 	Time                   time.Time
+	// Identified is set for PRIVMSGs and NOTICEs received with the
+	// identify-msg capability if the sender is identified to services.
+	Identified bool
+	// Internal is set for events synthesized by the client, such as
+	// CONNECTED, rather than parsed from a line sent by the server. Those
+	// derived from a server line, like CAP_ACK, keep it in Raw.
+	Internal bool
 }
 
 // Copy returns a deep copy of the Line.
@@ -98,21 +106,80 @@ func (line *Line) Public() bool {
 	return false
 }
 
+// Mentions returns true if the text of a PRIVMSG, NOTICE or ACTION contains
+// nick as a whole word, e.g. "nick: hi" or "hi nick," but not "nickname".
+// Nicks are compared case-insensitively using the rfc1459 casemapping; use
+// MentionsMe to respect the CASEMAPPING advertised by the server.
+func (line *Line) Mentions(nick string) bool {
+	return line.mentions(nick, func(s string) string {
+		return casefold("rfc1459", s)
+	})
+}
+
+// MentionsMe returns true if the line's text contains the client's current
+// nick as a whole word, using the server's CASEMAPPING to compare nicks.
+func (line *Line) MentionsMe(conn *Conn) bool {
+	return line.mentions(conn.Me().Nick, conn.Casefold)
+}
+
+func (line *Line) mentions(nick string, fold func(string) string) bool {
+	switch line.Cmd {
+	case PRIVMSG, NOTICE, ACTION:
+	default:
+		return false
+	}
+	if nick == "" {
+		return false
+	}
+	text, nick := fold(line.Text()), fold(nick)
+	for i := 0; i+len(nick) <= len(text); {
+		idx := strings.Index(text[i:], nick)
+		if idx == -1 {
+			return false
+		}
+		start, end := i+idx, i+idx+len(nick)
+		if (start == 0 || !isNickChar(text[start-1])) &&
+			(end == len(text) || !isNickChar(text[end])) {
+			return true
+		}
+		i = start + 1
+	}
+	return false
+}
+
+// isNickChar returns true if c may appear in an IRC nick.
+func isNickChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("[]\\`_^{|}-", c) != -1
+}
+
 // ParseLine creates a Line from an incoming message from the IRC server.
 //
 // It contains special casing for CTCP messages, most notably CTCP ACTION.
 // All CTCP messages have the \001 bytes stripped from the message and the
-// CTCP command separated from any subsequent text. Then, CTCP ACTIONs are
+// CTCP command separated from any subsequent text, which is empty if there
+// is none. The closing \001 is optional, as some clients leave it off. Then, CTCP ACTIONs are
 // rewritten such that Line.Cmd == ACTION. Other CTCP messages have Cmd
 // set to CTCP or CTCPREPLY, and the CTCP command prepended to line.Args.
 //
 // ParseLine also parses IRCv3 tags, if received. If a line does not have
 // the tags section, Line.Tags will be nil. Tags are optional, and will
-// only be included after the correct CAP command.
+// only be included after the correct CAP command. Every tag is kept, with
+// its value unescaped, whether or not the client knows what it means.
 //
 // http://ircv3.net/specs/core/capability-negotiation-3.1.html
 // http://ircv3.net/specs/core/message-tags-3.2.html
 func ParseLine(s string) *Line {
+	return parseLine(s, false)
+}
+
+// parseLine does the work for ParseLine. If identifyMsg is true, the +/-
+// identify-msg prefix is stripped from the text of PRIVMSGs and NOTICEs
+// into Line.Identified before looking for CTCP messages.
+func parseLine(s string, identifyMsg bool) *Line {
 	line := &Line{Raw: s}
 
 	if s == "" {
@@ -175,34 +242,44 @@ func ParseLine(s string) *Line {
 		line.Args = args[1:]
 	}
 
+	if line.Cmd == PRIVMSG || line.Cmd == NOTICE {
+		line.decodeMessage(identifyMsg)
+	}
+	return line
+}
+
+// decodeMessage classifies a PRIVMSG or NOTICE, so handlers never see the
+// raw \001 framing of CTCP messages. If identifyMsg is true, the +/-
+// identify-msg prefix is first stripped from the text into Line.Identified.
+func (line *Line) decodeMessage(identifyMsg bool) {
+	if len(line.Args) < 2 {
+		return
+	}
+	if t := line.Args[1]; identifyMsg && t != "" && (t[0] == '+' || t[0] == '-') {
+		line.Identified, line.Args[1] = t[0] == '+', t[1:]
+	}
 	// So, I think CTCP and (in particular) CTCP ACTION are better handled as
 	// separate events as opposed to forcing people to have gargantuan
 	// handlers to cope with the possibilities.
-	if (line.Cmd == PRIVMSG || line.Cmd == NOTICE) &&
-		len(line.Args[1]) > 2 &&
-		strings.HasPrefix(line.Args[1], "\001") &&
-		strings.HasSuffix(line.Args[1], "\001") {
-		// WOO, it's a CTCP message
-		t := strings.SplitN(strings.Trim(line.Args[1], "\001"), " ", 2)
-		if len(t) > 1 {
-			// Replace the line with the unwrapped CTCP
-			line.Args[1] = t[1]
-		}
-		if c := strings.ToUpper(t[0]); c == ACTION && line.Cmd == PRIVMSG {
-			// make a CTCP ACTION it's own event a-la PRIVMSG
-			line.Cmd = c
-		} else {
-			// otherwise, dispatch a generic CTCP/CTCPREPLY event that
-			// contains the type of CTCP in line.Args[0]
-			if line.Cmd == PRIVMSG {
-				line.Cmd = CTCP
-			} else {
-				line.Cmd = CTCPREPLY
-			}
-			line.Args = append([]string{c}, line.Args...)
-		}
+	c, args, ok := DecodeCTCP(line.Args[1])
+	if !ok {
+		return
 	}
-	return line
+	// WOO, it's a CTCP message; replace the text with the unwrapped CTCP
+	line.Args[1] = args
+	if c == ACTION && line.Cmd == PRIVMSG {
+		// make a CTCP ACTION it's own event a-la PRIVMSG
+		line.Cmd = c
+		return
+	}
+	// otherwise, dispatch a generic CTCP/CTCPREPLY event that
+	// contains the type of CTCP in line.Args[0]
+	if line.Cmd == PRIVMSG {
+		line.Cmd = CTCP
+	} else {
+		line.Cmd = CTCPREPLY
+	}
+	line.Args = append([]string{c}, line.Args...)
 }
 
 func (line *Line) argslen(minlen int) bool {
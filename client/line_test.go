@@ -184,3 +184,81 @@ func TestLineTags(t *testing.T) {
 		}
 	}
 }
+
+func TestLineIdentifyMsg(t *testing.T) {
+	tests := []struct {
+		in         string
+		cmd, text  string
+		identified bool
+	}{
+		{":nick!ident@host.com PRIVMSG me :+Hello", PRIVMSG, "Hello", true},
+		{":nick!ident@host.com NOTICE #chan :-Hello", NOTICE, "Hello", false},
+		{":nick!ident@host.com PRIVMSG me :+\001ACTION waves\001", ACTION, "waves", true},
+		{":nick!ident@host.com PRIVMSG me :-\001PING 1234\001", CTCP, "1234", false},
+		// Only the first character is a prefix.
+		{":nick!ident@host.com PRIVMSG me :++1", PRIVMSG, "+1", true},
+		{":nick!ident@host.com TOPIC #chan :+topic", TOPIC, "+topic", false},
+	}
+	for i, test := range tests {
+		l := parseLine(test.in, true)
+		if l.Cmd != test.cmd || l.Text() != test.text || l.Identified != test.identified {
+			t.Errorf("test %d: expected %s %q %t, got %s %q %t", i,
+				test.cmd, test.text, test.identified, l.Cmd, l.Text(), l.Identified)
+		}
+	}
+
+	// Without the capability the prefix is left alone.
+	if l := ParseLine(":nick!ident@host.com PRIVMSG me :+Hello"); l.Text() != "+Hello" || l.Identified {
+		t.Errorf("identify-msg prefix stripped without capability: %#v", l)
+	}
+}
+
+func TestLineCTCP(t *testing.T) {
+	tests := []struct {
+		in   string
+		cmd  string
+		args []string
+	}{
+		{":a!b@c PRIVMSG #foo :hello", PRIVMSG, []string{"#foo", "hello"}},
+		{":a!b@c PRIVMSG #foo :\001ACTION waves\001", ACTION, []string{"#foo", "waves"}},
+		{":a!b@c PRIVMSG #foo :\001ACTION waves", ACTION, []string{"#foo", "waves"}},
+		{":a!b@c PRIVMSG me :\001VERSION\001", CTCP, []string{"VERSION", "me", ""}},
+		{":a!b@c NOTICE me :\001PING 1234\001", CTCPREPLY, []string{"PING", "me", "1234"}},
+		{":a!b@c NOTICE #foo :\001ACTION waves\001", CTCPREPLY, []string{"ACTION", "#foo", "waves"}},
+	}
+	for i, test := range tests {
+		l := ParseLine(test.in)
+		if l.Cmd != test.cmd || !reflect.DeepEqual(l.Args, test.args) {
+			t.Errorf("test %d: expected %s %q, got %s %q", i,
+				test.cmd, test.args, l.Cmd, l.Args)
+		}
+	}
+}
+
+func TestLineMentions(t *testing.T) {
+	tests := []struct {
+		in  string
+		out bool
+	}{
+		{":a!b@c PRIVMSG #foo :mynick: hello", true},
+		{":a!b@c PRIVMSG #foo :hello MyNick, how are you?", true},
+		{":a!b@c PRIVMSG #foo :hello mynick", true},
+		{":a!b@c NOTICE #foo :(mynick)", true},
+		{":a!b@c PRIVMSG #foo :\001ACTION pokes mynick\001", true},
+		{":a!b@c PRIVMSG #foo :hello mynickname", false},
+		{":a!b@c PRIVMSG #foo :hello notmynick", false},
+		{":a!b@c PRIVMSG #foo :mynick_ mynick| mynick", true},
+		{":a!b@c PRIVMSG #foo :nothing to see here", false},
+		{":a!b@c TOPIC #foo :mynick", false},
+	}
+	for i, test := range tests {
+		if out := ParseLine(test.in).Mentions("mynick"); out != test.out {
+			t.Errorf("test %d: expected %t, got %t", i, test.out, out)
+		}
+	}
+
+	// Check that rfc1459 casemapping is used by default.
+	if !ParseLine(":a!b@c PRIVMSG #foo :hi {nick}").Mentions("[NICK]") {
+		t.Errorf("Mentions did not use rfc1459 casemapping.")
+	}
+}
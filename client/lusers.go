@@ -0,0 +1,161 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replies to a LUSERS collected by Lusers. Servers send a varying subset
+// of these, usually in this order.
+var lusersReplies = []string{
+	"251", // RPL_LUSERCLIENT
+	"252", // RPL_LUSEROP
+	"253", // RPL_LUSERUNKNOWN
+	"254", // RPL_LUSERCHANNELS
+	"255", // RPL_LUSERME
+	"265", // RPL_LOCALUSERS
+	"266", // RPL_GLOBALUSERS
+}
+
+// How long Lusers waits for another reply before deciding the server has
+// sent all it's going to, since not all servers send 266.
+var lusersTimeout = 5 * time.Second
+
+// LusersInfo is the result of a LUSERS sent by Lusers, parsed from the
+// server's replies. Counts the server didn't send are zero.
+type LusersInfo struct {
+	// From 251 RPL_LUSERCLIENT: users, invisible users and servers
+	// on the network.
+	Users, Invisible, Servers int
+
+	// From 252 RPL_LUSEROP, 253 RPL_LUSERUNKNOWN and 254 RPL_LUSERCHANNELS:
+	// opers online, connections that haven't registered yet, and channels.
+	Operators, Unknown, Channels int
+
+	// From 255 RPL_LUSERME: clients and servers connected to this server.
+	LocalClients, LocalServers int
+
+	// From 265 RPL_LOCALUSERS and 266 RPL_GLOBALUSERS: current and maximum
+	// users on this server and on the network.
+	LocalUsers, MaxLocalUsers, GlobalUsers, MaxGlobalUsers int
+}
+
+// lusersReq is a LUSERS sent by Lusers that's waiting for replies.
+type lusersReq struct {
+	info     LusersInfo
+	waiters  []chan LusersInfo
+	timer    *time.Timer
+	removers []Remover
+}
+
+// Lusers sends a LUSERS and returns a channel that receives the parsed
+// replies once the server has sent 266 RPL_GLOBALUSERS, or hasn't sent
+// another reply for a few seconds. The channel is closed after the result
+// is sent. The replies are dispatched as usual too. Concurrent calls share
+// a single LUSERS. It returns an error if we're not connected.
+//     LUSERS
+func (conn *Conn) Lusers() (<-chan LusersInfo, error) {
+	if !conn.Connected() {
+		return nil, errors.New("irc.Lusers(): not connected")
+	}
+	ch := make(chan LusersInfo, 1)
+	conn.lusersMu.Lock()
+	defer conn.lusersMu.Unlock()
+	if req := conn.lusersPending; req != nil {
+		req.waiters = append(req.waiters, ch)
+		return ch, nil
+	}
+	req := &lusersReq{waiters: []chan LusersInfo{ch}}
+	for _, n := range lusersReplies {
+		req.removers = append(req.removers,
+			conn.handle(n, HandlerFunc((*Conn).h_LUSERSREPLY)))
+	}
+	req.timer = time.AfterFunc(lusersTimeout, func() {
+		conn.lusersMu.Lock()
+		defer conn.lusersMu.Unlock()
+		conn.lusersDone(req)
+	})
+	conn.lusersPending = req
+	conn.Raw(LUSERS)
+	return ch, nil
+}
+
+// lusersDone sends the result of req to everyone waiting for it and removes
+// the handlers collecting replies, if it hasn't already finished.
+// conn.lusersMu must be held.
+func (conn *Conn) lusersDone(req *lusersReq) {
+	if conn.lusersPending != req {
+		return
+	}
+	conn.lusersPending = nil
+	req.timer.Stop()
+	for _, r := range req.removers {
+		r.Remove()
+	}
+	for _, ch := range req.waiters {
+		ch <- req.info
+		close(ch)
+	}
+}
+
+// numbers returns the integers in s, ignoring everything else.
+func numbers(s string) []int {
+	var nums []int
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool {
+		return r < '0' || r > '9'
+	}) {
+		if n, err := strconv.Atoi(f); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	return nums
+}
+
+// Handler to collect replies to a LUSERS sent by Lusers. It is only
+// registered while one is waiting for replies. Most counts are only in
+// the text, whose wording varies between servers.
+//   :server 251 me :There are 5 users and 10 invisible on 2 servers
+//   :server 252 me 3 :IRC Operators online
+//   :server 255 me :I have 7 clients and 1 servers
+//   :server 266 me 15 20 :Current global users 15, max 20
+func (conn *Conn) h_LUSERSREPLY(line *Line) {
+	conn.lusersMu.Lock()
+	defer conn.lusersMu.Unlock()
+	req := conn.lusersPending
+	if req == nil {
+		return
+	}
+	req.timer.Reset(lusersTimeout)
+	info := &req.info
+	nums := numbers(line.Text())
+	if len(line.Args) > 2 {
+		// counts may be args before the text too
+		nums = numbers(strings.Join(line.Args[1:len(line.Args)-1], " "))
+	}
+	get := func(ptrs ...*int) {
+		for i, p := range ptrs {
+			if i < len(nums) {
+				*p = nums[i]
+			}
+		}
+	}
+	switch line.Cmd {
+	case "251":
+		get(&info.Users, &info.Invisible, &info.Servers)
+	case "252":
+		get(&info.Operators)
+	case "253":
+		get(&info.Unknown)
+	case "254":
+		get(&info.Channels)
+	case "255":
+		get(&info.LocalClients, &info.LocalServers)
+	case "265":
+		get(&info.LocalUsers, &info.MaxLocalUsers)
+	case "266":
+		get(&info.GlobalUsers, &info.MaxGlobalUsers)
+		conn.lusersDone(req)
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLusers(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	res1, err := c.Lusers()
+	if err != nil {
+		t.Fatalf("Unexpected error from Lusers: %v", err)
+	}
+	s.nc.Expect("LUSERS")
+	// Concurrent calls share the LUSERS.
+	res2, _ := c.Lusers()
+	s.nc.ExpectNothing()
+
+	for _, l := range []string{
+		":irc.server.org 251 test :There are 5 users and 10 invisible on 2 servers",
+		":irc.server.org 252 test 3 :IRC Operators online",
+		":irc.server.org 253 test 1 :unknown connection(s)",
+		":irc.server.org 254 test 42 :channels formed",
+		":irc.server.org 255 test :I have 7 clients and 1 servers",
+		":irc.server.org 265 test :Current local users: 7 Max: 9",
+	} {
+		c.dispatch(ParseLine(l))
+	}
+	select {
+	case r := <-res1:
+		t.Fatalf("LUSERS result sent before 266: %#v", r)
+	default:
+	}
+	c.dispatch(ParseLine(":irc.server.org 266 test 15 20 :Current global users 15, max 20"))
+
+	exp := LusersInfo{Users: 5, Invisible: 10, Servers: 2, Operators: 3,
+		Unknown: 1, Channels: 42, LocalClients: 7, LocalServers: 1,
+		LocalUsers: 7, MaxLocalUsers: 9, GlobalUsers: 15, MaxGlobalUsers: 20}
+	for _, res := range []<-chan LusersInfo{res1, res2} {
+		if r := <-res; r != exp {
+			t.Errorf("Expected %#v, got %#v", exp, r)
+		}
+		if _, ok := <-res; ok {
+			t.Errorf("Channel not closed after result.")
+		}
+	}
+
+	// The handlers collecting replies are removed afterwards.
+	c.dispatch(ParseLine(":irc.server.org 252 test 4 :IRC Operators online"))
+	if c.lusersPending != nil {
+		t.Errorf("LUSERS still pending after 266.")
+	}
+}
+
+func TestLusersTimeout(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+	defer func(d time.Duration) { lusersTimeout = d }(lusersTimeout)
+	lusersTimeout = 10 * time.Millisecond
+
+	res, _ := c.Lusers()
+	s.nc.Expect("LUSERS")
+	c.dispatch(ParseLine(":irc.server.org 251 test :There are 5 users and 0 services on 2 servers"))
+	select {
+	case r := <-res:
+		if exp := (LusersInfo{Users: 5, Servers: 2}); r != exp {
+			t.Errorf("Expected %#v, got %#v", exp, r)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("LUSERS didn't time out.")
+	}
+
+	c.Close()
+	if _, err := c.Lusers(); err == nil {
+		t.Errorf("No error sending LUSERS while disconnected.")
+	}
+}
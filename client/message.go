@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Escapes IRCv3 tag values, the reverse of tagsReplacer in line.go.
+var tagsEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\:", " ", "\\s",
+	"\r", "\\r", "\n", "\\n")
+
+// Message builds an outgoing IRC message, complementing Line for incoming
+// ones. It takes care of escaping tag values and prefixing the final
+// parameter with ":" where necessary, e.g.
+//   NewMessage("PRIVMSG").Tag("+draft/react", "👍").Params("#chan").Trailing("hi")
+// produces
+//   @+draft/react=👍 PRIVMSG #chan :hi
+// Send it to the server with conn.Raw(msg.String()).
+type Message struct {
+	tags     [][2]string
+	cmd      string
+	params   []string
+	trailing *string
+}
+
+// NewMessage starts building a message with the given command.
+func NewMessage(cmd string) *Message {
+	return &Message{cmd: strings.ToUpper(cmd)}
+}
+
+// Tag adds an IRCv3 message tag. Tags are sent in the order they are added,
+// and an empty value sends the tag without one.
+func (m *Message) Tag(key, value string) *Message {
+	m.tags = append(m.tags, [2]string{key, value})
+	return m
+}
+
+// Params appends parameters to the message. Only the last parameter of a
+// message may contain spaces or start with ":"; see also Trailing.
+func (m *Message) Params(params ...string) *Message {
+	m.params = append(m.params, params...)
+	return m
+}
+
+// Trailing sets the final parameter of the message, which is always
+// prefixed with ":" and may contain spaces.
+func (m *Message) Trailing(t string) *Message {
+	m.trailing = &t
+	return m
+}
+
+// String returns the message as it should be sent to the server,
+// without the trailing "\r\n".
+func (m *Message) String() string {
+	var sb bytes.Buffer
+	if len(m.tags) > 0 {
+		sb.WriteByte('@')
+		for i, t := range m.tags {
+			if i > 0 {
+				sb.WriteByte(';')
+			}
+			sb.WriteString(t[0])
+			if t[1] != "" {
+				sb.WriteByte('=')
+				sb.WriteString(tagsEscaper.Replace(t[1]))
+			}
+		}
+		sb.WriteByte(' ')
+	}
+	sb.WriteString(m.cmd)
+	params, trailing := m.params, m.trailing
+	if trailing == nil && len(params) > 0 {
+		// The last parameter needs a ":" if it would otherwise be misparsed.
+		if last := params[len(params)-1]; last == "" ||
+			last[0] == ':' || strings.Contains(last, " ") {
+			params, trailing = params[:len(params)-1], &last
+		}
+	}
+	for _, p := range params {
+		sb.WriteByte(' ')
+		sb.WriteString(p)
+	}
+	if trailing != nil {
+		sb.WriteString(" :")
+		sb.WriteString(*trailing)
+	}
+	return cutNewLines(sb.String())
+}
+
+// Message returns a Message that rebuilds the line, e.g. to relay it to
+// another server. CTCP and ACTION lines are encoded back into the text of
+// a PRIVMSG or NOTICE. The source is dropped, since the server we send to
+// fills in our own. If tags is true the line's tags are kept, sorted by
+// key; otherwise they are stripped.
+func (line *Line) Message(tags bool) *Message {
+	cmd, args := line.Cmd, line.Args
+	switch {
+	case cmd == ACTION && len(args) > 1:
+		cmd, args = PRIVMSG, []string{args[0], EncodeCTCP(ACTION, args[1])}
+	case (cmd == CTCP || cmd == CTCPREPLY) && len(args) > 1:
+		text := ""
+		if len(args) > 2 {
+			text = args[2]
+		}
+		cmd, args = PRIVMSG, []string{args[1], EncodeCTCP(args[0], text)}
+		if line.Cmd == CTCPREPLY {
+			cmd = NOTICE
+		}
+	}
+	m := NewMessage(cmd)
+	if (cmd == PRIVMSG || cmd == NOTICE) && len(args) > 1 {
+		// the text is always sent as the trailing parameter
+		m.Params(args[:len(args)-1]...).Trailing(args[len(args)-1])
+	} else {
+		m.Params(args...)
+	}
+	if tags {
+		keys := make([]string, 0, len(line.Tags))
+		for k := range line.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			m.Tag(k, line.Tags[k])
+		}
+	}
+	return m
+}
+
+// Rewrite returns the line as it should be sent to the server with its
+// target replaced, e.g. to relay a PRIVMSG from one channel to another,
+// keeping or stripping its tags as for Message.
+//   ParseLine(":nick!u@h PRIVMSG #a :hi").Rewrite("#b", false) == "PRIVMSG #b :hi"
+func (line *Line) Rewrite(target string, tags bool) string {
+	l := line.Copy()
+	i := 0
+	if l.Cmd == CTCP || l.Cmd == CTCPREPLY {
+		i = 1
+	}
+	if len(l.Args) > i {
+		l.Args[i] = target
+	}
+	return l.Message(tags).String()
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	tests := []struct {
+		in  *Message
+		out string
+	}{
+		{NewMessage("privmsg").Params("#chan").Trailing("hi"),
+			"PRIVMSG #chan :hi"},
+		{NewMessage("PRIVMSG").Tag("+draft/react", "👍").Params("#chan").Trailing("hi"),
+			"@+draft/react=👍 PRIVMSG #chan :hi"},
+		{NewMessage("TAGMSG").Tag("+a", "b; c\\d").Tag("+flag", "").Params("nick"),
+			"@+a=b\\:\\sc\\\\d;+flag TAGMSG nick"},
+		{NewMessage("JOIN").Params("#chan", "key"), "JOIN #chan key"},
+		{NewMessage("TOPIC").Params("#chan", "a new topic"), "TOPIC #chan :a new topic"},
+		{NewMessage("TOPIC").Params("#chan", ""), "TOPIC #chan :"},
+		{NewMessage("PRIVMSG").Params("#chan", ":)"), "PRIVMSG #chan ::)"},
+		{NewMessage("PRIVMSG").Params("#chan").Trailing("hi\r\nQUIT"), "PRIVMSG #chan :hi"},
+		{NewMessage("AWAY"), "AWAY"},
+	}
+	for i, test := range tests {
+		if out := test.in.String(); out != test.out {
+			t.Errorf("test %d: expected %q, got %q", i, test.out, out)
+		}
+	}
+
+	// Messages should round-trip through ParseLine.
+	l := ParseLine(NewMessage("PRIVMSG").Tag("+a", "b; c").
+		Params("#chan").Trailing("hello there").String())
+	if l.Tags["+a"] != "b; c" || l.Cmd != PRIVMSG ||
+		l.Args[0] != "#chan" || l.Args[1] != "hello there" {
+		t.Errorf("Message did not round-trip: %#v", l)
+	}
+}
+
+func TestLineRewrite(t *testing.T) {
+	tests := []struct {
+		in, target string
+		tags       bool
+		out        string
+	}{
+		{":nick!u@h PRIVMSG #a :hello there", "#b", false,
+			"PRIVMSG #b :hello there"},
+		{"@time=2017-01-01T00:00:00.000Z;+draft/reply=123 :nick!u@h PRIVMSG #a :hi",
+			"#b", true, "@+draft/reply=123;time=2017-01-01T00:00:00.000Z PRIVMSG #b :hi"},
+		{"@+draft/reply=123 :nick!u@h PRIVMSG #a :hi", "#b", false,
+			"PRIVMSG #b :hi"},
+		{":nick!u@h PRIVMSG #a :\001ACTION waves\001", "#b", false,
+			"PRIVMSG #b :\001ACTION waves\001"},
+		{":nick!u@h PRIVMSG me :\001VERSION\001", "other", false,
+			"PRIVMSG other :\001VERSION\001"},
+		{":nick!u@h NOTICE me :\001PING 1234\001", "other", false,
+			"NOTICE other :\001PING 1234\001"},
+		{":nick!u@h NOTICE #a ::)", "#b", false, "NOTICE #b ::)"},
+		{":nick!u@h TOPIC #a :new topic", "#b", false, "TOPIC #b :new topic"},
+	}
+	for i, test := range tests {
+		l := ParseLine(test.in)
+		if out := l.Rewrite(test.target, test.tags); out != test.out {
+			t.Errorf("test %d: expected %q, got %q", i, test.out, out)
+		}
+	}
+
+	// The original line is untouched.
+	l := ParseLine(":nick!u@h PRIVMSG #a :hi")
+	l.Rewrite("#b", false)
+	if l.Args[0] != "#a" {
+		t.Errorf("Rewrite modified line: %#v", l)
+	}
+	if out := l.Message(false).String(); out != "PRIVMSG #a :hi" {
+		t.Errorf("Message returned %q", out)
+	}
+}
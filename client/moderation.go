@@ -0,0 +1,139 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/lfkeitel/goirc/logging"
+	"github.com/lfkeitel/goirc/state"
+)
+
+// NotOpError is returned by commands that need channel operator privileges
+// if the state tracker says we don't have them. The command is not sent to
+// the server.
+type NotOpError struct {
+	Cmd, Channel string
+}
+
+func (e *NotOpError) Error() string {
+	return fmt.Sprintf("irc.%s(): not an operator on %s", e.Cmd, e.Channel)
+}
+
+// GlobalBan bans nick by host from every channel we share with it, and
+// kicks it with reason. The ban mask is *!*@host, using the host from the
+// state tracker. Any channel privileges nick has are removed in the same
+// MODE commands as the ban, sending as few as the server's MODES limit
+// allows. Channels where we aren't an operator are skipped with a warning.
+//
+// It returns the result for each shared channel, which is nil if the
+// commands were sent or a *NotOpError if the channel was skipped, or an
+// error if state tracking is disabled or nick's host isn't known.
+//     MODE channel -o+b nick *!*@host
+//     KICK channel nick :reason
+func (conn *Conn) GlobalBan(nick, reason string) (map[string]error, error) {
+	st := conn.st
+	if st == nil {
+		return nil, errors.New("irc.GlobalBan(): state tracking disabled")
+	}
+	nk := st.GetNick(nick)
+	if nk == nil || nk.Host == "" {
+		return nil, fmt.Errorf("irc.GlobalBan(): host of %s not known", nick)
+	}
+	mask := "*!*@" + nk.Host
+	me := st.Me()
+
+	channels := make([]string, 0, len(nk.Channels))
+	for ch := range nk.Channels {
+		channels = append(channels, ch)
+	}
+	sort.Strings(channels)
+	results := make(map[string]error, len(channels))
+	for _, ch := range channels {
+		if !me.Channels[ch].HasAny("qao") {
+			logging.Warn("irc.GlobalBan(): not banning %s from %s, "+
+				"not an operator", nick, ch)
+			results[ch] = &NotOpError{Cmd: "GlobalBan", Channel: ch}
+			continue
+		}
+		var ops []state.ModeOp
+		cp := nk.Channels[ch]
+		for _, m := range []byte("qaohv") {
+			if cp.HasAny(string(m)) {
+				ops = append(ops, state.ModeOp{Mode: m, Arg: nick})
+			}
+		}
+		ops = append(ops, state.ModeOp{Add: true, Mode: 'b', Arg: mask})
+		conn.sendModes(ch, ops)
+		conn.Kick(ch, nick, reason)
+		results[ch] = nil
+	}
+	return results, nil
+}
+
+// privs returns our privileges on channel and the channel itself according
+// to the state tracker, and false if state tracking is disabled or we aren't
+// on channel.
+func (conn *Conn) privs(channel string) (*state.ChanPrivs, *state.Channel, bool) {
+	st := conn.st
+	if st == nil {
+		return nil, nil, false
+	}
+	ch := st.GetChannel(channel)
+	if ch == nil {
+		return nil, nil, false
+	}
+	// Not conn.Me(), which updates conn.cfg.Me and so would race with
+	// handlers reading it.
+	cp, ok := ch.Nicks[st.Me().Nick]
+	if !ok {
+		return nil, nil, false
+	}
+	if cp == nil {
+		cp = &state.ChanPrivs{}
+	}
+	return cp, ch, true
+}
+
+// CanKick returns true if the state tracker says we have the half-op or
+// higher privileges needed to KICK from channel. Like the other Can
+// functions, it returns false if state tracking is disabled or we aren't
+// on channel, so it can be used to tell users why a command would fail
+// before sending it.
+func (conn *Conn) CanKick(channel string) bool {
+	cp, _, ok := conn.privs(channel)
+	return ok && cp.HasAny("qaoh")
+}
+
+// CanBan returns true if we have the privileges to set bans on channel,
+// which are the same as those needed to kick.
+func (conn *Conn) CanBan(channel string) bool {
+	return conn.CanKick(channel)
+}
+
+// CanSetModes returns true if we're an operator on channel, and so can
+// change its modes and other nicks' privileges.
+func (conn *Conn) CanSetModes(channel string) bool {
+	cp, _, ok := conn.privs(channel)
+	return ok && cp.HasAny("qao")
+}
+
+// CanSetTopic returns true if we can change channel's topic, which anyone
+// on it can do unless it's +t, when half-op or higher privileges are needed.
+func (conn *Conn) CanSetTopic(channel string) bool {
+	cp, ch, ok := conn.privs(channel)
+	if !ok {
+		return false
+	}
+	return ch.Modes == nil || !ch.Modes.ProtectedTopic || cp.HasAny("qaoh")
+}
+
+// CanSpeak returns true if we can send messages to channel, which anyone
+// on it can do unless it's +m, when voice or higher privileges are needed.
+func (conn *Conn) CanSpeak(channel string) bool {
+	cp, ch, ok := conn.privs(channel)
+	if !ok {
+		return false
+	}
+	return ch.Modes == nil || !ch.Modes.Moderated || cp.HasAny("qaohv")
+}
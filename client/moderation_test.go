@@ -0,0 +1,109 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/lfkeitel/goirc/state"
+)
+
+func TestGlobalBan(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.h_005(ParseLine(":irc.server.org 005 test MODES=2 :are supported by this server"))
+	s.st.EXPECT().GetNick("spammer").Return(&state.Nick{Nick: "spammer",
+		Host: "spam.example.com", Channels: map[string]*state.ChanPrivs{
+			"#a": {Op: true, Voice: true}, "#b": {}, "#c": {}}})
+	s.st.EXPECT().Me().Return(&state.Nick{Nick: "test",
+		Channels: map[string]*state.ChanPrivs{
+			"#a": {Op: true}, "#b": {Voice: true}, "#c": {Admin: true}}})
+	res, err := c.GlobalBan("spammer", "Go away")
+	if err != nil {
+		t.Fatalf("GlobalBan returned error: %v", err)
+	}
+	s.nc.Expect("MODE #a -ov spammer spammer")
+	s.nc.Expect("MODE #a +b *!*@spam.example.com")
+	s.nc.Expect("KICK #a spammer :Go away")
+	s.nc.Expect("MODE #c +b *!*@spam.example.com")
+	s.nc.Expect("KICK #c spammer :Go away")
+	s.nc.ExpectNothing()
+	if len(res) != 3 || res["#a"] != nil || res["#c"] != nil {
+		t.Errorf("Wrong GlobalBan results: %v", res)
+	}
+	if e, ok := res["#b"].(*NotOpError); !ok || e.Channel != "#b" {
+		t.Errorf("GlobalBan without op returned wrong result: %v", res["#b"])
+	}
+
+	// We can't ban without knowing the nick's host, or without tracking.
+	s.st.EXPECT().GetNick("nobody").Return(nil)
+	if _, err := c.GlobalBan("nobody", "Go away"); err == nil {
+		t.Errorf("GlobalBan of unknown nick did not return error.")
+	}
+	c.st = nil
+	if _, err := c.GlobalBan("spammer", "Go away"); err == nil {
+		t.Errorf("GlobalBan without state tracking did not return error.")
+	}
+	c.st = s.st
+	s.nc.ExpectNothing()
+}
+
+func TestCanDo(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	me := c.cfg.Me
+	chanWith := func(modes *state.ChanMode, cp *state.ChanPrivs) *state.Channel {
+		return &state.Channel{Name: "#test", Modes: modes,
+			Nicks: map[string]*state.ChanPrivs{"test": cp, "other": {Op: true}}}
+	}
+	can := map[string]func(string) bool{
+		"CanKick":     c.CanKick,
+		"CanBan":      c.CanBan,
+		"CanSetModes": c.CanSetModes,
+		"CanSetTopic": c.CanSetTopic,
+		"CanSpeak":    c.CanSpeak,
+	}
+	tests := []struct {
+		ch  *state.Channel
+		exp map[string]bool
+	}{
+		// Anyone can set the topic and speak without +t and +m.
+		{chanWith(&state.ChanMode{}, &state.ChanPrivs{}),
+			map[string]bool{"CanSetTopic": true, "CanSpeak": true}},
+		{chanWith(&state.ChanMode{ProtectedTopic: true, Moderated: true}, &state.ChanPrivs{}),
+			map[string]bool{}},
+		{chanWith(&state.ChanMode{ProtectedTopic: true, Moderated: true}, &state.ChanPrivs{Voice: true}),
+			map[string]bool{"CanSpeak": true}},
+		// Half-ops can kick and set the topic, but not change modes.
+		{chanWith(&state.ChanMode{ProtectedTopic: true, Moderated: true}, &state.ChanPrivs{HalfOp: true}),
+			map[string]bool{"CanKick": true, "CanBan": true, "CanSetTopic": true, "CanSpeak": true}},
+		{chanWith(&state.ChanMode{ProtectedTopic: true, Moderated: true}, &state.ChanPrivs{Op: true}),
+			map[string]bool{"CanKick": true, "CanBan": true, "CanSetModes": true,
+				"CanSetTopic": true, "CanSpeak": true}},
+		{chanWith(nil, &state.ChanPrivs{Owner: true}),
+			map[string]bool{"CanKick": true, "CanBan": true, "CanSetModes": true,
+				"CanSetTopic": true, "CanSpeak": true}},
+		// We can do nothing on channels we aren't on.
+		{&state.Channel{Name: "#test", Nicks: map[string]*state.ChanPrivs{"other": {Op: true}}},
+			map[string]bool{}},
+	}
+	for i, test := range tests {
+		for name, f := range can {
+			s.st.EXPECT().GetChannel("#test").Return(test.ch)
+			s.st.EXPECT().Me().Return(me)
+			if got := f("#test"); got != test.exp[name] {
+				t.Errorf("%d: %s returned %t, expected %t", i, name, got, test.exp[name])
+			}
+		}
+	}
+
+	s.st.EXPECT().GetChannel("#unknown").Return(nil)
+	if c.CanSpeak("#unknown") {
+		t.Errorf("CanSpeak returned true for unknown channel.")
+	}
+	c.st = nil
+	if c.CanSpeak("#test") {
+		t.Errorf("CanSpeak returned true without state tracking.")
+	}
+	c.st = s.st
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lfkeitel/goirc/state"
+)
+
+// ModeTypes and ModeOp are the state tracker's, so that the client and the
+// tracker agree on how mode changes are parsed.
+type (
+	ModeTypes = state.ModeTypes
+	ModeOp    = state.ModeOp
+)
+
+// DefaultModeTypes are used when the server does not advertise CHANMODES
+// or PREFIX. It's a copy of state.DefaultModeTypes, which is what's used.
+var DefaultModeTypes = state.DefaultModeTypes
+
+// ParseModeChange parses a mode string like "+ov-k" and its arguments into
+// a list of ModeOps, as state.ParseModeChange does.
+func ParseModeChange(spec string, args []string, modes *ModeTypes) []ModeOp {
+	return state.ParseModeChange(spec, args, modes)
+}
+
+// ModeTypes returns the channel mode types advertised by the server
+// in ISUPPORT, falling back to state.DefaultModeTypes for any not advertised.
+// If the server doesn't advertise CHANMODES, any channel modes listed in
+// 004 RPL_MYINFO that the defaults don't know about are added to them.
+func (conn *Conn) ModeTypes() *ModeTypes {
+	mt := state.DefaultModeTypes
+	if p, ok := conn.Supports("PREFIX"); ok {
+		mt.Prefix, mt.Symbols = parsePrefix(p)
+	}
+	if cm, ok := conn.Supports("CHANMODES"); ok {
+		t := strings.SplitN(cm, ",", 4)
+		for len(t) < 4 {
+			t = append(t, "")
+		}
+		mt.List, mt.Always, mt.OnSet, mt.Never = t[0], t[1], t[2], t[3]
+	} else {
+		si := conn.ServerInfo()
+		known := mt.List + mt.Always + mt.OnSet + mt.Never + mt.Prefix
+		for _, m := range si.ChannelModes {
+			switch {
+			case strings.ContainsRune(known, m):
+			case strings.ContainsRune(si.ParamModes, m):
+				// we can't tell if it's only needed when set
+				mt.Always += string(m)
+			default:
+				mt.Never += string(m)
+			}
+		}
+	}
+	return &mt
+}
+
+// The RFC 1459 prefix modes, used when a server's PREFIX token is
+// empty or can't be made sense of.
+const (
+	fallbackPrefix  = "ov"
+	fallbackSymbols = "@+"
+)
+
+// parsePrefix splits a PREFIX token like "(ov)@+" into modes and symbols.
+// Some servers leave out the parenthesized list of modes, in which case
+// they are inferred from the symbols state.DefaultModeTypes knows about.
+// If the token is empty or malformed, or the modes and symbols don't line
+// up one-to-one, the RFC 1459 "(ov)@+" is returned instead.
+func parsePrefix(p string) (modes, symbols string) {
+	if strings.HasPrefix(p, "(") {
+		idx := strings.Index(p, ")")
+		if idx == -1 {
+			return fallbackPrefix, fallbackSymbols
+		}
+		modes, symbols = p[1:idx], p[idx+1:]
+	} else {
+		symbols = p
+		for i := 0; i < len(symbols); i++ {
+			j := strings.IndexByte(state.DefaultModeTypes.Symbols, symbols[i])
+			if j == -1 {
+				return fallbackPrefix, fallbackSymbols
+			}
+			modes += string(state.DefaultModeTypes.Prefix[j])
+		}
+	}
+	if modes == "" || len(modes) != len(symbols) {
+		return fallbackPrefix, fallbackSymbols
+	}
+	return modes, symbols
+}
+
+// ModesPerLine returns the maximum number of mode changes with arguments
+// the server accepts in one MODE command, from the MODES ISUPPORT token.
+// The RFC default of 3 is assumed if it's not advertised, and 0 means
+// there is no limit.
+func (conn *Conn) ModesPerLine() int {
+	v, ok := conn.Supports("MODES")
+	if !ok {
+		return 3
+	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+// sendModes sends ops for channel t in as few MODE commands as the server's
+// MODES limit allows.
+func (conn *Conn) sendModes(t string, ops []state.ModeOp) {
+	max := conn.ModesPerLine()
+	for len(ops) > 0 {
+		spec, args, sign := "", []string{}, byte(0)
+		i := 0
+		for ; i < len(ops); i++ {
+			op := ops[i]
+			if op.Arg != "" {
+				if max > 0 && len(args) == max {
+					break
+				}
+				args = append(args, op.Arg)
+			}
+			s := byte('-')
+			if op.Add {
+				s = '+'
+			}
+			if s != sign {
+				spec += string(s)
+				sign = s
+			}
+			spec += string(op.Mode)
+		}
+		ops = ops[i:]
+		conn.Raw(strings.Join(append([]string{MODE, t, spec}, args...), " "))
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lfkeitel/goirc/state"
+)
+
+func TestConnModeTypes(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if mt := c.ModeTypes(); !reflect.DeepEqual(*mt, state.DefaultModeTypes) {
+		t.Errorf("Default mode types not used without ISUPPORT: %#v", mt)
+	}
+	// Without CHANMODES, unknown modes from 004 are added to the defaults.
+	c.h_004(ParseLine(":irc.server.org 004 test irc.server.org ircd-1.0 iow beiklmnostvxX klX"))
+	exp := state.DefaultModeTypes
+	exp.Always += "X"
+	exp.Never += "x"
+	if mt := c.ModeTypes(); !reflect.DeepEqual(*mt, exp) {
+		t.Errorf("Mode types not extended from 004: %#v", mt)
+	}
+	c.h_005(ParseLine(":irc.server.org 005 test CHANMODES=beI,kfL,lj,psmntirRcOAQKVCuzNSMT " +
+		"PREFIX=(qaohv)~&@%+ :are supported by this server"))
+	exp = state.ModeTypes{List: "beI", Always: "kfL", OnSet: "lj",
+		Never: "psmntirRcOAQKVCuzNSMT", Prefix: "qaohv", Symbols: "~&@%+"}
+	if mt := c.ModeTypes(); !reflect.DeepEqual(*mt, exp) {
+		t.Errorf("Mode types not parsed from ISUPPORT: %#v", mt)
+	}
+}
+
+func TestParseModeChange(t *testing.T) {
+	// The client's exports are the state tracker's parser and types.
+	ops := ParseModeChange("+ov-k", []string{"nick1", "nick2", "key"}, nil)
+	exp := []ModeOp{{Add: true, Mode: 'o', Arg: "nick1"},
+		{Add: true, Mode: 'v', Arg: "nick2"}, {Mode: 'k', Arg: "key"}}
+	if !reflect.DeepEqual(ops, exp) {
+		t.Errorf("Expected %v, got %v", exp, ops)
+	}
+	if !reflect.DeepEqual(DefaultModeTypes, state.DefaultModeTypes) {
+		t.Errorf("DefaultModeTypes differ from the state tracker's.")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in, modes, symbols string
+	}{
+		{"(ov)@+", "ov", "@+"},
+		{"(qaohv)~&@%+", "qaohv", "~&@%+"},
+		{"~&@%+", "qaohv", "~&@%+"},
+		{"@+", "ov", "@+"},
+		// Malformed or empty tokens fall back to (ov)@+.
+		{"", "ov", "@+"},
+		{"()", "ov", "@+"},
+		{"(ov@+", "ov", "@+"},
+		{"(ohv)@+", "ov", "@+"},
+		{"(ov)@%+", "ov", "@+"},
+		{"@!+", "ov", "@+"},
+	}
+	for _, test := range tests {
+		modes, symbols := parsePrefix(test.in)
+		if modes != test.modes || symbols != test.symbols {
+			t.Errorf("parsePrefix(%q) = %q, %q; want %q, %q",
+				test.in, modes, symbols, test.modes, test.symbols)
+		}
+	}
+}
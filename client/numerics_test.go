@@ -0,0 +1,44 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestNumericName(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{":irc.server.org 001 test :Welcome to IRC test", "RPL_WELCOME"},
+		{":irc.server.org 396 test some.host :is now your displayed host", "RPL_HOSTHIDDEN"},
+		{":irc.server.org 999 test :What's this?", ""},
+		{":nick!ident@host PRIVMSG #chan :Hello", ""},
+	}
+	for i, test := range tests {
+		if out := ParseLine(test.in).NumericName(); out != test.out {
+			t.Errorf("test %d: expected %q, got %q", i, test.out, out)
+		}
+	}
+}
+
+func TestHandleNumericName(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Handlers registered by symbolic name run for the numeric.
+	got := make(chan string, 2)
+	c.HandleFunc("RPL_HOSTHIDDEN", func(conn *Conn, line *Line) {
+		got <- "name " + line.Cmd + " " + line.NumericName()
+	})
+	c.HandleFunc("396", func(conn *Conn, line *Line) {
+		got <- "numeric " + line.Cmd
+	})
+	if ev := c.RegisteredEvents(); ev["396"] != 2 {
+		t.Errorf("Handlers not registered for numeric: %v", ev)
+	}
+	c.dispatch(ParseLine(":irc.server.org 396 test some.host :is now your displayed host"))
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		seen[<-got] = true
+	}
+	if !seen["name 396 RPL_HOSTHIDDEN"] || !seen["numeric 396"] {
+		t.Errorf("Handlers not run for numeric: %v", seen)
+	}
+}
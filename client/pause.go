@@ -0,0 +1,80 @@
+package client
+
+import (
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// PauseDispatch stops events being delivered to handlers added with Handle,
+// HandleBG and HandleFunc, e.g. while a bot reloads its configuration.
+// Lines are still read from the server and the internal handlers, including
+// state tracking and answering PINGs, still run, so the connection stays
+// up and the tracker stays accurate. Up to Config.PauseBuffer events are
+// buffered for delivery by ResumeDispatch and any more are dropped.
+// Pausing lasts until ResumeDispatch is called, across reconnects.
+func (conn *Conn) PauseDispatch() {
+	conn.pauseMu.Lock()
+	defer conn.pauseMu.Unlock()
+	conn.paused = true
+}
+
+// ResumeDispatch undoes PauseDispatch. Any events buffered while paused are
+// delivered in the order they were received, in a separate goroutine, before
+// any received since; ResumeDispatch doesn't wait for them to be handled.
+func (conn *Conn) ResumeDispatch() {
+	conn.pauseMu.Lock()
+	defer conn.pauseMu.Unlock()
+	conn.paused = false
+	if !conn.replaying && len(conn.pauseBuf) > 0 {
+		conn.replaying = true
+		go conn.replay()
+	}
+}
+
+// DispatchPaused returns true between calls to PauseDispatch and
+// ResumeDispatch.
+func (conn *Conn) DispatchPaused() bool {
+	conn.pauseMu.Lock()
+	defer conn.pauseMu.Unlock()
+	return conn.paused
+}
+
+// held is called by dispatch after the internal handlers have run. It
+// returns true if the line shouldn't be delivered to other handlers now,
+// because dispatch is paused or buffered events are still being delivered,
+// buffering it if there's room.
+func (conn *Conn) held(line *Line) bool {
+	conn.pauseMu.Lock()
+	defer conn.pauseMu.Unlock()
+	if !conn.paused && !conn.replaying {
+		return false
+	}
+	if len(conn.pauseBuf) < conn.cfg.PauseBuffer {
+		conn.pauseBuf = append(conn.pauseBuf, line)
+	} else {
+		logging.Debug("irc.dispatch(): paused, dropping %s event", line.Cmd)
+	}
+	return true
+}
+
+// replay is started as a goroutine by ResumeDispatch to deliver the events
+// buffered while dispatch was paused. Events received meanwhile are buffered
+// behind them, so that handlers still see events in order. Foreground
+// handlers are run here one event at a time rather than by any dispatch
+// workers, which keeps them in order too. It stops early if dispatch is
+// paused again, leaving the rest in the buffer.
+func (conn *Conn) replay() {
+	for {
+		conn.pauseMu.Lock()
+		if conn.paused || len(conn.pauseBuf) == 0 {
+			conn.replaying = false
+			conn.pauseMu.Unlock()
+			return
+		}
+		line := conn.pauseBuf[0]
+		conn.pauseBuf[0] = nil
+		conn.pauseBuf = conn.pauseBuf[1:]
+		conn.pauseMu.Unlock()
+		go conn.bgHandlers.dispatch(conn, line)
+		conn.fgHandlers.dispatch(conn, line)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPauseDispatch(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+	c.st = nil
+	defer func() { c.st = s.st }()
+
+	var mu sync.Mutex
+	seen := []string{}
+	done := make(chan struct{}, 10)
+	c.HandleFunc(PRIVMSG, func(conn *Conn, line *Line) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, line.Text())
+		done <- struct{}{}
+	})
+	check := func(exp ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seen) != len(exp) {
+			t.Fatalf("Expected %d events handled, got %d: %v", len(exp), len(seen), seen)
+		}
+		for i := range exp {
+			if seen[i] != exp[i] {
+				t.Errorf("Event %d was %q, expected %q", i, seen[i], exp[i])
+			}
+		}
+	}
+	wait := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for buffered events.")
+			}
+		}
+	}
+
+	// With no buffer, events are dropped while paused.
+	c.PauseDispatch()
+	if !c.DispatchPaused() {
+		t.Errorf("DispatchPaused false after PauseDispatch.")
+	}
+	c.dispatch(ParseLine(":nick!user@host PRIVMSG #chan :dropped"))
+	c.ResumeDispatch()
+	if c.DispatchPaused() {
+		t.Errorf("DispatchPaused true after ResumeDispatch.")
+	}
+	c.dispatch(ParseLine(":nick!user@host PRIVMSG #chan :one"))
+	wait(1)
+	check("one")
+
+	// Internal handlers keep running, so PINGs are still answered. The
+	// PING takes up one of the buffered events.
+	c.cfg.PauseBuffer = 3
+	c.PauseDispatch()
+	c.dispatch(ParseLine("PING :1234"))
+	s.nc.Expect("PONG :1234")
+	for _, text := range []string{"two", "three", "four"} {
+		c.dispatch(ParseLine(":nick!user@host PRIVMSG #chan :" + text))
+	}
+	check("one")
+
+	// Buffered events are delivered in order on resume, and events beyond
+	// the buffer limit are dropped.
+	c.ResumeDispatch()
+	wait(2)
+	c.dispatch(ParseLine(":nick!user@host PRIVMSG #chan :five"))
+	wait(1)
+	check("one", "two", "three", "five")
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy is what a client has learned to trust about a server host that
+// should outlive the connection: an IRCv3 STS upgrade policy, and the
+// fingerprints of any self-signed certificates that have been accepted.
+type Policy struct {
+	// The port to connect to with TLS, and when the STS policy expires.
+	// A zero Expires means there is no STS policy for the host.
+	Port    int `json:",omitempty"`
+	Expires time.Time
+
+	// Hex-encoded SHA-256 fingerprints of certificates accepted for the
+	// host, for pinning.
+	Fingerprints []string `json:",omitempty"`
+}
+
+// Active returns true if the policy has an STS policy that hasn't expired.
+func (p *Policy) Active() bool {
+	return p != nil && !p.Expires.IsZero() && time.Now().Before(p.Expires)
+}
+
+// PolicyStore persists Policies by host, so they survive client restarts.
+// Hosts are compared case-insensitively. Implementations must be safe for
+// concurrent use. NewMemoryPolicyStore and NewFilePolicyStore provide simple
+// implementations, or users may supply their own.
+type PolicyStore interface {
+	// Get returns the policy for host, or nil if there isn't one.
+	Get(host string) (*Policy, error)
+	// Set stores p as the policy for host, replacing any existing one.
+	// A nil p removes any policy for host, as Delete does.
+	Set(host string, p *Policy) error
+	// Delete removes any policy for host.
+	Delete(host string) error
+}
+
+// memoryPolicyStore keeps policies in memory only.
+type memoryPolicyStore struct {
+	mu       sync.Mutex
+	policies map[string]Policy
+}
+
+// NewMemoryPolicyStore returns a PolicyStore that keeps policies in memory,
+// and so only for the lifetime of the process.
+func NewMemoryPolicyStore() PolicyStore {
+	return &memoryPolicyStore{policies: make(map[string]Policy)}
+}
+
+func (s *memoryPolicyStore) Get(host string) (*Policy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.policies[strings.ToLower(host)]
+	if !ok {
+		return nil, nil
+	}
+	return p.copy(), nil
+}
+
+func (s *memoryPolicyStore) Set(host string, p *Policy) error {
+	if p == nil {
+		return s.Delete(host)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[strings.ToLower(host)] = *p.copy()
+	return nil
+}
+
+func (s *memoryPolicyStore) Delete(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.policies, strings.ToLower(host))
+	return nil
+}
+
+// copy returns a copy of p that shares no memory with it.
+func (p *Policy) copy() *Policy {
+	c := *p
+	c.Fingerprints = append([]string(nil), p.Fingerprints...)
+	return &c
+}
+
+// filePolicyStore keeps policies in memory, writing them
+// to a JSON file whenever they change.
+type filePolicyStore struct {
+	memoryPolicyStore
+	path string
+}
+
+// NewFilePolicyStore returns a PolicyStore that persists policies as JSON in
+// the file at path, loading any policies already stored there. The file is
+// replaced atomically each time a policy is set or deleted.
+func NewFilePolicyStore(path string) (PolicyStore, error) {
+	s := &filePolicyStore{path: path}
+	s.policies = make(map[string]Policy)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.policies); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *filePolicyStore) Set(host string, p *Policy) error {
+	if p == nil {
+		return s.Delete(host)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[strings.ToLower(host)] = *p.copy()
+	return s.save()
+}
+
+func (s *filePolicyStore) Delete(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.policies, strings.ToLower(host))
+	return s.save()
+}
+
+// save writes the policies to a temporary file and renames it over the
+// store's file, so it's never left half-written. s.mu must be held.
+func (s *filePolicyStore) save() error {
+	data, err := json.MarshalIndent(s.policies, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testPolicyStore(t *testing.T, s PolicyStore) {
+	if p, err := s.Get("irc.example.org"); p != nil || err != nil {
+		t.Errorf("Get for unknown host returned %#v, %v", p, err)
+	}
+	exp := &Policy{Port: 6697, Expires: time.Now().Add(time.Hour),
+		Fingerprints: []string{"abcdef"}}
+	if err := s.Set("IRC.example.org", exp); err != nil {
+		t.Errorf("Set returned error: %v", err)
+	}
+	// Changes to the stored policy shouldn't affect the store.
+	exp.Fingerprints[0] = "123456"
+	p, err := s.Get("irc.Example.org")
+	if err != nil || p == nil || p.Port != 6697 || !p.Active() ||
+		!reflect.DeepEqual(p.Fingerprints, []string{"abcdef"}) {
+		t.Errorf("Get returned %#v, %v", p, err)
+	}
+	if err := s.Delete("irc.example.org"); err != nil {
+		t.Errorf("Delete returned error: %v", err)
+	}
+	if p, err := s.Get("irc.example.org"); p != nil || err != nil {
+		t.Errorf("Get after Delete returned %#v, %v", p, err)
+	}
+	// Setting a nil policy deletes it too.
+	s.Set("irc.example.org", exp)
+	if err := s.Set("irc.example.org", nil); err != nil {
+		t.Errorf("Set nil returned error: %v", err)
+	}
+	if p, err := s.Get("irc.example.org"); p != nil || err != nil {
+		t.Errorf("Get after Set nil returned %#v, %v", p, err)
+	}
+}
+
+func TestMemoryPolicyStore(t *testing.T) {
+	testPolicyStore(t, NewMemoryPolicyStore())
+}
+
+func TestFilePolicyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goirc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policies.json")
+
+	s, err := NewFilePolicyStore(path)
+	if err != nil {
+		t.Fatalf("NewFilePolicyStore returned error: %v", err)
+	}
+	testPolicyStore(t, s)
+
+	// Policies should be loaded again by a new store.
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	s.Set("irc.example.org", &Policy{Port: 6697, Expires: expires})
+	s, err = NewFilePolicyStore(path)
+	if err != nil {
+		t.Fatalf("NewFilePolicyStore returned error: %v", err)
+	}
+	if p, _ := s.Get("irc.example.org"); p == nil || p.Port != 6697 ||
+		!p.Expires.Equal(expires) {
+		t.Errorf("Policy not persisted: %#v", p)
+	}
+
+	if (&Policy{Port: 6697}).Active() {
+		t.Errorf("Policy without expiry is active.")
+	}
+	ioutil.WriteFile(path, []byte("not json"), 0600)
+	if _, err := NewFilePolicyStore(path); err == nil {
+		t.Errorf("NewFilePolicyStore did not fail on a corrupt file.")
+	}
+}
+
+func TestSTS(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	ps := NewMemoryPolicyStore()
+	c.cfg.PolicyStore = ps
+	c.cfg.Server = "irc.example.org:6667"
+
+	// Over an insecure connection, we're told which port to use TLS on.
+	c.stsPolicy("port=6697", false)
+	if !c.cfg.SSL || c.cfg.Server != "irc.example.org:6697" ||
+		c.cfg.SSLConfig == nil || c.cfg.SSLConfig.ServerName != "irc.example.org" {
+		t.Errorf("Not upgraded to TLS: %t, %s, %#v", c.cfg.SSL, c.cfg.Server, c.cfg.SSLConfig)
+	}
+	if p, _ := ps.Get("irc.example.org"); p != nil {
+		t.Errorf("Policy stored from an insecure connection: %#v", p)
+	}
+
+	// Over a secure one, the policy is stored for its duration.
+	c.stsPolicy("duration=3600,port=6697", true)
+	p, _ := ps.Get("irc.example.org")
+	if !p.Active() || p.Port != 6697 || p.Expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Bad stored policy: %#v", p)
+	}
+
+	// The stored policy is applied when we next connect.
+	c.cfg.SSL, c.cfg.SSLConfig = false, nil
+	c.cfg.Server = "irc.example.org:6667"
+	c.applySTS()
+	if !c.cfg.SSL || c.cfg.Server != "irc.example.org:6697" {
+		t.Errorf("Stored policy not applied: %t, %s", c.cfg.SSL, c.cfg.Server)
+	}
+
+	// A duration of 0 removes the policy, but not accepted fingerprints.
+	ps.Set("irc.example.org", &Policy{Port: 6697,
+		Expires: time.Now().Add(time.Hour), Fingerprints: []string{"abcdef"}})
+	c.stsPolicy("duration=0", true)
+	if p, _ := ps.Get("irc.example.org"); p == nil || p.Active() ||
+		!reflect.DeepEqual(p.Fingerprints, []string{"abcdef"}) {
+		t.Errorf("Bad policy after duration=0: %#v", p)
+	}
+	ps.Set("irc.example.org", &Policy{Port: 6697, Expires: time.Now().Add(time.Hour)})
+	c.stsPolicy("duration=0", true)
+	if p, _ := ps.Get("irc.example.org"); p != nil {
+		t.Errorf("Policy not removed after duration=0: %#v", p)
+	}
+	c.cfg.SSL, c.cfg.Server = false, "irc.example.org:6667"
+	c.applySTS()
+	if c.cfg.SSL || c.cfg.Server != "irc.example.org:6667" {
+		t.Errorf("Expired policy applied: %t, %s", c.cfg.SSL, c.cfg.Server)
+	}
+}
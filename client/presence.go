@@ -0,0 +1,50 @@
+package client
+
+// Presence is what the state tracker knows about whether a nick is around,
+// as returned by Conn.Presence. It's assembled from the WHO replies sent
+// when we join channels, kept up to date by AWAY, ACCOUNT and extended
+// JOINs when the away-notify, account-notify and extended-join
+// capabilities are enabled.
+type Presence struct {
+	Nick string
+	// Online is true while the nick shares a channel with us, or is us.
+	// The tracker may still know about nicks that don't, e.g. ones created
+	// with UnknownNickCreate or left over after parting a channel, but it
+	// can't tell whether they're still connected.
+	Online      bool
+	Away        bool
+	AwayMessage string
+	// The services account the nick is logged in to, or "" if none or
+	// unknown.
+	Account string
+	// Bot is true if the nick is marked as a bot with the BOT user mode.
+	Bot bool
+}
+
+// Presence returns a consolidated view of whether nick is online, away, and
+// logged in, and whether it's a bot, according to the state tracker. The
+// second return value is false if state tracking is disabled or the tracker
+// doesn't know about nick.
+func (conn *Conn) Presence(nick string) (Presence, bool) {
+	st := conn.st
+	if st == nil {
+		return Presence{}, false
+	}
+	nk := st.GetNick(nick)
+	if nk == nil {
+		return Presence{}, false
+	}
+	online := len(nk.Channels) > 0 ||
+		conn.Casefold(nk.Nick) == conn.Casefold(st.Me().Nick)
+	p := Presence{
+		Nick:        nk.Nick,
+		Online:      online,
+		Away:        nk.Away,
+		AwayMessage: nk.AwayMessage,
+		Account:     nk.Account,
+	}
+	if nk.Modes != nil {
+		p.Bot = nk.Modes.Bot
+	}
+	return p, true
+}
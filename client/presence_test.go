@@ -0,0 +1,53 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/lfkeitel/goirc/state"
+)
+
+func TestPresence(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	s.st.EXPECT().GetNick("user1").Return(&state.Nick{Nick: "User1",
+		Away: true, AwayMessage: "gone fishing", Account: "acct1",
+		Modes:    &state.NickMode{Bot: true},
+		Channels: map[string]*state.ChanPrivs{"#test1": {}}})
+	exp := Presence{Nick: "User1", Online: true, Away: true,
+		AwayMessage: "gone fishing", Account: "acct1", Bot: true}
+	if p, ok := c.Presence("user1"); !ok || p != exp {
+		t.Errorf("Wrong presence: %#v, %t", p, ok)
+	}
+
+	// A nick without modes isn't a bot, and one that shares no channels
+	// with us may not be online.
+	gomock.InOrder(
+		s.st.EXPECT().GetNick("user2").Return(&state.Nick{Nick: "user2"}),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+	)
+	if p, ok := c.Presence("user2"); !ok || p != (Presence{Nick: "user2"}) {
+		t.Errorf("Wrong presence: %#v, %t", p, ok)
+	}
+
+	// We're always online.
+	gomock.InOrder(
+		s.st.EXPECT().GetNick("test").Return(&state.Nick{Nick: "test"}),
+		s.st.EXPECT().Me().Return(c.cfg.Me),
+	)
+	if p, ok := c.Presence("test"); !ok || p != (Presence{Nick: "test", Online: true}) {
+		t.Errorf("Wrong presence: %#v, %t", p, ok)
+	}
+
+	s.st.EXPECT().GetNick("user3").Return(nil)
+	if _, ok := c.Presence("user3"); ok {
+		t.Errorf("Presence returned ok for unknown nick.")
+	}
+
+	c.st = nil
+	if _, ok := c.Presence("user1"); ok {
+		t.Errorf("Presence returned ok without state tracking.")
+	}
+	c.st = s.st
+}
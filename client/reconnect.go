@@ -0,0 +1,162 @@
+package client
+
+import (
+	"time"
+
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// DisconnectReason says why the connection to the server was lost,
+// for Config.ShouldReconnect.
+type DisconnectReason int
+
+const (
+	// We closed the connection ourselves, with Close or Quit.
+	DisconnectClosed DisconnectReason = iota
+	// Reading from or writing to the server failed, or we couldn't
+	// connect to it when trying to reconnect.
+	DisconnectNetwork
+	// The server closed the connection with an ERROR, e.g. for a K-line.
+	DisconnectServerError
+	// The server closed the connection after announcing it was shutting
+	// down or restarting, as recognised by Config.ShutdownPattern.
+	DisconnectServerShutdown
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClosed:
+		return "closed"
+	case DisconnectNetwork:
+		return "network error"
+	case DisconnectServerError:
+		return "server error"
+	case DisconnectServerShutdown:
+		return "server shutdown"
+	}
+	return "unknown"
+}
+
+// clock schedules functions to run later. Reconnection and STATE_READY use
+// it rather than the time package directly, so that tests can control the
+// passage of time.
+type clock interface {
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a function scheduled by a clock.
+type timer interface {
+	Stop() bool
+}
+
+// realClock is the clock used outside tests.
+type realClock struct{}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+// clock returns the clock to schedule functions with, Config.clock if it's
+// set.
+func (conn *Conn) clock() clock {
+	if c := conn.cfg.clock; c != nil {
+		return c
+	}
+	return realClock{}
+}
+
+// setDisconnectReason records why we're about to be disconnected. A reason
+// of DisconnectClosed sticks, since the server's ERROR reply to our QUIT
+// shouldn't count as it disconnecting us, as does DisconnectServerShutdown
+// over the ERROR the server sends as it goes down.
+func (conn *Conn) setDisconnectReason(r DisconnectReason) {
+	conn.reconnMu.Lock()
+	defer conn.reconnMu.Unlock()
+	switch {
+	case conn.discReason == DisconnectClosed:
+	case conn.discReason == DisconnectServerShutdown && r == DisconnectServerError:
+	default:
+		conn.discReason = r
+	}
+}
+
+// Handler for ERROR, which the server sends before closing the connection.
+//   ERROR :Closing Link: host (K-Lined)
+func (conn *Conn) h_ERROR(line *Line) {
+	logging.Warn("irc.ERROR(): %s", line.Text())
+	if !conn.shutdown(line) {
+		conn.setDisconnectReason(DisconnectServerError)
+	}
+}
+
+// Handler for NOTICEs from the server, rather than a nick, matching
+// Config.ShutdownPattern.
+//   :server NOTICE * :*** Server is restarting in 60 seconds
+func (conn *Conn) h_SHUTDOWN(line *Line) {
+	if line.Nick == "" {
+		conn.shutdown(line)
+	}
+}
+
+// shutdown checks whether the text of an ERROR or server NOTICE matches
+// Config.ShutdownPattern. If it does, the disconnection that follows is
+// recorded as DisconnectServerShutdown and a SERVER_SHUTDOWN event is
+// dispatched with the text in Args[0].
+func (conn *Conn) shutdown(line *Line) bool {
+	re := conn.cfg.ShutdownPattern
+	if re == nil || len(line.Args) == 0 || !re.MatchString(line.Text()) {
+		return false
+	}
+	logging.Warn("irc.SERVER_SHUTDOWN(): %s is going down: %s",
+		conn.cfg.Server, line.Text())
+	conn.setDisconnectReason(DisconnectServerShutdown)
+	l := line.Copy()
+	l.Cmd, l.Args = SERVER_SHUTDOWN, []string{line.Text()}
+	l.Internal = true
+	conn.dispatch(l)
+	return true
+}
+
+// maybeReconnect asks Config.ShouldReconnect whether to reconnect after
+// being disconnected for reason, and schedules the reconnection if so.
+func (conn *Conn) maybeReconnect(reason DisconnectReason) {
+	should := conn.cfg.ShouldReconnect
+	if should == nil {
+		return
+	}
+	conn.reconnMu.Lock()
+	conn.reconnAttempts++
+	attempt := conn.reconnAttempts
+	conn.reconnMu.Unlock()
+	ok, delay := should(reason, attempt)
+	if !ok {
+		return
+	}
+	logging.Info("irc.Reconnect(): disconnected (%s), reconnecting to %s "+
+		"in %s, attempt %d", reason, conn.cfg.Server, delay, attempt)
+	conn.reconnMu.Lock()
+	conn.reconnTimer = conn.clock().AfterFunc(delay, conn.reconnect)
+	conn.reconnMu.Unlock()
+}
+
+// reconnect reconnects to the server, trying again if
+// Config.ShouldReconnect says so when that fails.
+func (conn *Conn) reconnect() {
+	if conn.Connected() {
+		return
+	}
+	if err := conn.Connect(); err != nil {
+		logging.Error("irc.Reconnect(): %s", err)
+		conn.maybeReconnect(DisconnectNetwork)
+	}
+}
+
+// stopReconnecting cancels any pending reconnection.
+func (conn *Conn) stopReconnecting() {
+	conn.reconnMu.Lock()
+	defer conn.reconnMu.Unlock()
+	if conn.reconnTimer != nil {
+		conn.reconnTimer.Stop()
+		conn.reconnTimer = nil
+	}
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for tests whose time only passes when Advance is
+// called. Create one with newFakeClock.
+type fakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c    *fakeClock
+	when time.Duration
+	f    func()
+}
+
+func newFakeClock() *fakeClock {
+	fc := &fakeClock{}
+	fc.cond = sync.NewCond(&fc.mu)
+	return fc
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	t := &fakeTimer{c: fc, when: fc.now + d, f: f}
+	fc.timers = append(fc.timers, t)
+	fc.cond.Broadcast()
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, ft := range t.c.timers {
+		if ft == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, calling the functions of any timers
+// that expire in the meantime, in order.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	end := fc.now + d
+	for {
+		var next *fakeTimer
+		idx := -1
+		for i, t := range fc.timers {
+			if t.when <= end && (next == nil || t.when < next.when) {
+				next, idx = t, i
+			}
+		}
+		if next == nil {
+			break
+		}
+		fc.timers = append(fc.timers[:idx], fc.timers[idx+1:]...)
+		fc.now = next.when
+		fc.mu.Unlock()
+		next.f()
+		fc.mu.Lock()
+	}
+	fc.now = end
+	fc.mu.Unlock()
+}
+
+// BlockUntil waits until n timers are pending, failing the test if that
+// takes more than a second of real time.
+func (fc *fakeClock) BlockUntil(t *testing.T, n int) {
+	done := make(chan struct{})
+	go func() {
+		fc.mu.Lock()
+		for len(fc.timers) < n {
+			fc.cond.Wait()
+		}
+		fc.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for %d timers.", n)
+	}
+}
+
+// Pending returns the number of timers that haven't fired or been stopped.
+func (fc *fakeClock) Pending() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return len(fc.timers)
+}
+
+type reconnectCall struct {
+	reason  DisconnectReason
+	attempt int
+}
+
+// reconnectRecorder sets Config.ShouldReconnect to record its calls,
+// reconnecting immediately while retry is true.
+func reconnectRecorder(c *Conn, retry bool) chan reconnectCall {
+	calls := make(chan reconnectCall, 10)
+	c.cfg.ShouldReconnect = func(reason DisconnectReason, attempt int) (bool, time.Duration) {
+		calls <- reconnectCall{reason, attempt}
+		return retry && attempt < 2, 0
+	}
+	return calls
+}
+
+func expectReconnectCall(t *testing.T, calls chan reconnectCall, exp reconnectCall) {
+	select {
+	case call := <-calls:
+		if call != exp {
+			t.Errorf("ShouldReconnect called with %s, %d; expected %s, %d",
+				call.reason, call.attempt, exp.reason, exp.attempt)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("ShouldReconnect not called, expected %s, %d",
+			exp.reason, exp.attempt)
+	}
+}
+
+func TestShouldReconnect(t *testing.T) {
+	// Losing the connection is a network error.
+	c, s := setUp(t)
+	calls := reconnectRecorder(c, false)
+	s.nc.Close()
+	expectReconnectCall(t, calls, reconnectCall{DisconnectNetwork, 1})
+	s.ctrl.Finish()
+
+	// The server sending ERROR first is a server error.
+	c, s = setUp(t)
+	calls = reconnectRecorder(c, false)
+	c.h_ERROR(ParseLine("ERROR :Closing Link: somehost.com (K-Lined)"))
+	s.nc.Close()
+	expectReconnectCall(t, calls, reconnectCall{DisconnectServerError, 1})
+	s.ctrl.Finish()
+
+	// A server NOTICE or ERROR matching ShutdownPattern is a shutdown, and
+	// dispatches SERVER_SHUTDOWN.
+	for _, l := range []string{
+		":irc.server.org NOTICE * :*** Server is restarting in 60 seconds",
+		"ERROR :Closing Link: somehost.com (Server is restarting)",
+	} {
+		line := ParseLine(l)
+		c, s = setUp(t)
+		calls = reconnectRecorder(c, false)
+		c.cfg.ShutdownPattern = regexp.MustCompile("(?i)server is restarting")
+		shutdown := make(chan *Line, 2)
+		c.HandleFunc(SERVER_SHUTDOWN, func(conn *Conn, line *Line) {
+			shutdown <- line
+		})
+		// Nicks can't fake it.
+		c.h_NOTICE(ParseLine(":nick!user@host NOTICE test :Server is restarting"))
+		if line.Cmd == ERROR {
+			c.h_ERROR(line)
+		} else {
+			c.h_NOTICE(line)
+		}
+		if len(shutdown) != 1 {
+			t.Fatalf("Expected 1 SERVER_SHUTDOWN event, got %d.", len(shutdown))
+		}
+		if ev := <-shutdown; !ev.Internal || !strings.Contains(ev.Args[0], "restarting") {
+			t.Errorf("Incorrect SERVER_SHUTDOWN event: %#v", ev)
+		}
+		c.h_ERROR(ParseLine("ERROR :Closing Link: somehost.com (Server is going away)"))
+		s.nc.Close()
+		expectReconnectCall(t, calls, reconnectCall{DisconnectServerShutdown, 1})
+		s.ctrl.Finish()
+	}
+
+	// Unless we sent a QUIT, or closed the connection ourselves.
+	c, s = setUp(t)
+	calls = reconnectRecorder(c, false)
+	c.Quit()
+	s.nc.Expect("QUIT :GoBye!")
+	c.h_ERROR(ParseLine("ERROR :Closing Link: somehost.com (Quit: GoBye!)"))
+	s.nc.Close()
+	expectReconnectCall(t, calls, reconnectCall{DisconnectClosed, 1})
+	s.ctrl.Finish()
+
+	c, s = setUp(t)
+	calls = reconnectRecorder(c, false)
+	c.Close()
+	expectReconnectCall(t, calls, reconnectCall{DisconnectClosed, 1})
+	s.ctrl.Finish()
+
+	// Failing to reconnect is a network error, and counts as another attempt
+	// until we've registered successfully.
+	c, s = setUp(t)
+	calls = reconnectRecorder(c, true)
+	c.st = nil
+	c.cfg.Server = ""
+	s.nc.Close()
+	expectReconnectCall(t, calls, reconnectCall{DisconnectNetwork, 1})
+	expectReconnectCall(t, calls, reconnectCall{DisconnectNetwork, 2})
+	c.h_001(ParseLine(":irc.server.org 001 test :Welcome to IRC"))
+	c.reconnMu.Lock()
+	if c.reconnAttempts != 0 {
+		t.Errorf("Reconnection attempts not reset by 001: %d", c.reconnAttempts)
+	}
+	c.reconnMu.Unlock()
+	s.ctrl.Finish()
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	c, s := setUp(t)
+	defer s.ctrl.Finish()
+	c.st = nil
+	c.cfg.Server = "" // so reconnecting fails straight away
+	clk := newFakeClock()
+	c.cfg.clock = clk
+	calls := make(chan reconnectCall, 10)
+	c.cfg.ShouldReconnect = func(reason DisconnectReason, attempt int) (bool, time.Duration) {
+		calls <- reconnectCall{reason, attempt}
+		return attempt < 3, time.Duration(attempt) * time.Second
+	}
+
+	// The first attempt waits a second.
+	s.nc.Close()
+	expectReconnectCall(t, calls, reconnectCall{DisconnectNetwork, 1})
+	clk.BlockUntil(t, 1)
+	clk.Advance(999 * time.Millisecond)
+	select {
+	case call := <-calls:
+		t.Errorf("Reconnected too soon: %v", call)
+	default:
+	}
+	clk.Advance(time.Millisecond)
+	expectReconnectCall(t, calls, reconnectCall{DisconnectNetwork, 2})
+
+	// The second waits two seconds.
+	clk.Advance(1999 * time.Millisecond)
+	select {
+	case call := <-calls:
+		t.Errorf("Reconnected too soon: %v", call)
+	default:
+	}
+	clk.Advance(time.Millisecond)
+	expectReconnectCall(t, calls, reconnectCall{DisconnectNetwork, 3})
+	if n := clk.Pending(); n != 0 {
+		t.Errorf("Reconnection scheduled after giving up: %d pending", n)
+	}
+
+	// Closing the connection cancels a pending reconnection.
+	c.reconnMu.Lock()
+	c.reconnAttempts = 0
+	c.reconnMu.Unlock()
+	c.maybeReconnect(DisconnectNetwork)
+	expectReconnectCall(t, calls, reconnectCall{DisconnectNetwork, 1})
+	c.Close()
+	if n := clk.Pending(); n != 0 {
+		t.Errorf("Reconnection still pending after Close: %d", n)
+	}
+}
+
+func TestReconnectKeepsHandlers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	defer l.Close()
+
+	c, s := setUp(t)
+	defer s.ctrl.Finish()
+	c.st = nil
+	c.EnableStateTracking()
+	s.nc.Expect("WHOIS test")
+	st := c.StateTracker()
+	st.NewChannel("#test1")
+	st.Associate("#test1", "test")
+	st.NewNick("user1")
+	st.Associate("#test1", "user1")
+	st.NewNick("user2")
+
+	connected := make(chan struct{}, 1)
+	c.HandleFunc(CONNECTED, func(conn *Conn, line *Line) {
+		connected <- struct{}{}
+	})
+	c.h_READY(ParseLine(":irc.server.org 376 test :End of /MOTD command."))
+	oldReady := c.Ready()
+	c.cfg.Server = l.Addr().String()
+	c.cfg.ShouldReconnect = func(reason DisconnectReason, attempt int) (bool, time.Duration) {
+		return attempt == 1, 0
+	}
+	s.nc.Close()
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	srv, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Client did not reconnect: %v", err)
+	}
+	defer srv.Close()
+	srv.SetDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(srv)
+	for _, exp := range []string{"NICK test", "USER test"} {
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, exp) {
+			t.Errorf("Expected %q on reconnection, got %q", exp, line)
+		}
+	}
+
+	// State from the old connection is gone, but we're still tracking.
+	if c.StateTracker() != st {
+		t.Errorf("State tracker replaced on reconnection.")
+	}
+	if st.GetChannel("#test1") != nil || st.GetNick("user1") != nil ||
+		st.GetNick("user2") != nil {
+		t.Errorf("Stale state kept across reconnection.")
+	}
+
+	// Handlers registered before the disconnection still work.
+	srv.Write([]byte(":irc.server.org 001 test :Welcome to IRC\r\n"))
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Errorf("CONNECTED handler not called after reconnection.")
+	}
+
+	// The new connection isn't ready until the server says so.
+	ready := c.Ready()
+	if ready == oldReady {
+		t.Errorf("Ready channel not replaced on reconnection.")
+	}
+	select {
+	case <-ready:
+		t.Errorf("Ready before end of MOTD after reconnection.")
+	default:
+	}
+	srv.Write([]byte(":irc.server.org 422 test :MOTD File is missing\r\n"))
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Errorf("Not ready after 422 following reconnection.")
+	}
+	srv.Write([]byte(":test!test@somehost.com JOIN #test2\r\n"))
+	r.ReadString('\n') // MODE #test2
+	c.Close()
+	if st.GetChannel("#test2") == nil {
+		t.Errorf("State tracking handlers not called after reconnection.")
+	}
+}
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// SASL mechanisms the client can authenticate with.
+var saslMechs = map[string]bool{
+	"PLAIN":    true,
+	"EXTERNAL": true,
+}
+
+// The most base64-encoded bytes sent in one AUTHENTICATE line.
+const saslChunk = 400
+
+// saslNext picks the next mechanism in Config.SASLMechs to try that we
+// support and, if we know which ones the server supports, it does too.
+// It returns "" once there are none left. conn.capMu must be held.
+func (conn *Conn) saslNext() string {
+	var avail []string
+	if v := conn.capsAvail["sasl"]; v != "" {
+		avail = strings.Split(v, ",")
+	}
+	if conn.saslAvail != nil {
+		avail = conn.saslAvail
+	}
+	for len(conn.saslQueue) > 0 {
+		mech := strings.ToUpper(conn.saslQueue[0])
+		conn.saslQueue = conn.saslQueue[1:]
+		if !saslMechs[mech] {
+			logging.Warn("irc.SASL(): unsupported mechanism %s", mech)
+			continue
+		}
+		if avail != nil && !containsFold(avail, mech) {
+			continue
+		}
+		conn.saslMech = mech
+		return mech
+	}
+	conn.saslMech = ""
+	return ""
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// saslStart begins SASL authentication during capability negotiation if
+// Config.SASLMechs is set and the server acknowledged the sasl capability,
+// returning the mechanism to try first or "" if we shouldn't authenticate.
+// conn.capMu must be held.
+func (conn *Conn) saslStart() string {
+	if len(conn.cfg.SASLMechs) == 0 || !conn.caps["sasl"] {
+		return ""
+	}
+	conn.saslQueue = append([]string(nil), conn.cfg.SASLMechs...)
+	conn.saslAvail = nil
+	return conn.saslNext()
+}
+
+// saslEnd sends the next AUTHENTICATE if there's another mechanism to try,
+// or ends capability negotiation otherwise.
+func (conn *Conn) saslEnd(retry bool) {
+	conn.capMu.Lock()
+	mech := ""
+	if retry {
+		mech = conn.saslNext()
+	} else {
+		conn.saslMech = ""
+	}
+	end := mech == "" && conn.capNeg
+	if end {
+		conn.capNeg = false
+	}
+	conn.capMu.Unlock()
+	if mech != "" {
+		conn.Raw(AUTHENTICATE + " " + mech)
+	} else if end {
+		conn.Cap("END")
+	}
+}
+
+// saslResponse returns the response to the server's challenge for mech.
+func (conn *Conn) saslResponse(mech string) []byte {
+	switch mech {
+	case "PLAIN":
+		return []byte(conn.cfg.SASLLogin + "\x00" + conn.cfg.SASLLogin +
+			"\x00" + conn.cfg.SASLPassword)
+	}
+	// EXTERNAL uses the TLS client certificate, so sends nothing.
+	return nil
+}
+
+// Handler for AUTHENTICATE challenges from the server. The mechanisms we
+// support only have one step, so the challenge itself is ignored.
+//   AUTHENTICATE +
+func (conn *Conn) h_AUTHENTICATE(line *Line) {
+	conn.capMu.RLock()
+	mech := conn.saslMech
+	conn.capMu.RUnlock()
+	if mech == "" {
+		return
+	}
+	resp := base64.StdEncoding.EncodeToString(conn.saslResponse(mech))
+	for len(resp) >= saslChunk {
+		conn.Raw(AUTHENTICATE + " " + resp[:saslChunk])
+		resp = resp[saslChunk:]
+	}
+	if resp == "" {
+		// an empty or exactly chunk-sized response ends with "+"
+		resp = "+"
+	}
+	conn.Raw(AUTHENTICATE + " " + resp)
+}
+
+// Handler for the replies that end a SASL attempt. If it failed, the next
+// mechanism in Config.SASLMechs is tried, and once they're exhausted
+// registration continues without authenticating.
+//   :server 903 me :SASL authentication successful
+//   :server 904 me :SASL authentication failed
+func (conn *Conn) h_SASLDONE(line *Line) {
+	switch line.Cmd {
+	case "903", "907":
+		// successful, or we were already authenticated
+		conn.capMu.Lock()
+		conn.saslDone = true
+		conn.capMu.Unlock()
+		conn.saslEnd(false)
+	case "906":
+		logging.Warn("irc.SASL(): authentication aborted")
+		conn.saslEnd(false)
+	default:
+		logging.Warn("irc.SASL(): authentication failed: %s", line.Text())
+		conn.saslEnd(true)
+	}
+}
+
+// Handler for 908 RPL_SASLMECHS, which the server sends before failing if
+// it doesn't support the mechanism we tried. A SASL_MECHS event is
+// dispatched with the mechanisms it does support in Args.
+//   :server 908 me PLAIN,EXTERNAL :are available SASL mechanisms
+func (conn *Conn) h_908(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	mechs := strings.Split(line.Args[1], ",")
+	conn.capMu.Lock()
+	conn.saslAvail = mechs
+	conn.capMu.Unlock()
+	l := line.Copy()
+	l.Cmd, l.Args = SASL_MECHS, mechs
+	l.Internal = true
+	conn.dispatch(l)
+}
+
+// recoverNick sends a NICK for the nick we first registered with, if
+// Config.RecoverNickAfterSASL is set, we authenticated with SASL, and we
+// ended up with a different nick. It's called once registration completes.
+func (conn *Conn) recoverNick() {
+	if !conn.cfg.RecoverNickAfterSASL {
+		return
+	}
+	conn.capMu.RLock()
+	authed := conn.saslDone
+	conn.capMu.RUnlock()
+	conn.recoverMu.Lock()
+	want := conn.preferredNick
+	conn.recoverMu.Unlock()
+	if !authed || want == "" || conn.Casefold(conn.Me().Nick) == conn.Casefold(want) {
+		return
+	}
+	logging.Info("irc.SASL(): authenticated, trying to recover nick %s", want)
+	conn.recoverMu.Lock()
+	conn.recovering = want
+	conn.recoverMu.Unlock()
+	conn.Nick(want)
+}
+
+// recoverRefused returns true if line, a 433 or 437 reply, refuses the
+// NICK sent by recoverNick, in which case we keep our current nick.
+//   :server 433 me nick :Nickname is already in use.
+func (conn *Conn) recoverRefused(line *Line) bool {
+	if !line.argslen(1) {
+		return false
+	}
+	conn.recoverMu.Lock()
+	defer conn.recoverMu.Unlock()
+	if conn.recovering == "" || conn.Casefold(line.Args[1]) != conn.Casefold(conn.recovering) {
+		return false
+	}
+	logging.Info("irc.SASL(): could not recover nick %s: %s",
+		conn.recovering, line.Text())
+	conn.recovering = ""
+	return true
+}
+
+// recovered stops waiting for a reply to the NICK sent by recoverNick if our
+// nick has changed to nick, so that later 433s are handled as usual.
+func (conn *Conn) recovered(nick string) {
+	conn.recoverMu.Lock()
+	defer conn.recoverMu.Unlock()
+	if conn.recovering != "" && conn.Casefold(nick) == conn.Casefold(conn.recovering) {
+		logging.Info("irc.SASL(): recovered nick %s", nick)
+		conn.recovering = ""
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSASL(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	var mechs []string
+	c.HandleFunc(SASL_MECHS, func(conn *Conn, line *Line) {
+		mechs = line.Args
+	})
+
+	s.st.EXPECT().RequestNick("test").Return(c.cfg.Me).Times(2)
+	c.cfg.SASLMechs = []string{"EXTERNAL", "SCRAM-SHA-256", "PLAIN"}
+	c.cfg.SASLLogin, c.cfg.SASLPassword = "acct", "secret"
+	c.h_REGISTER(&Line{Cmd: REGISTER})
+	s.nc.Expect("CAP LS 302")
+	s.nc.Expect("NICK test")
+	s.nc.Expect("USER test 12 * :Testing IRC")
+	c.h_CAP(ParseLine(":irc.server.org CAP * LS :sasl"))
+	s.nc.Expect("CAP REQ :sasl")
+	c.h_CAP(ParseLine(":irc.server.org CAP * ACK :sasl"))
+	s.nc.Expect("AUTHENTICATE EXTERNAL")
+	s.nc.ExpectNothing()
+
+	// The server doesn't support EXTERNAL, so we fall back to PLAIN,
+	// skipping the mechanism we don't support.
+	c.h_908(ParseLine(":irc.server.org 908 test PLAIN,SCRAM-SHA-256 :are available SASL mechanisms"))
+	if !reflect.DeepEqual(mechs, []string{"PLAIN", "SCRAM-SHA-256"}) {
+		t.Errorf("Bad SASL_MECHS event: %v", mechs)
+	}
+	c.h_SASLDONE(ParseLine(":irc.server.org 904 test :SASL authentication failed"))
+	s.nc.Expect("AUTHENTICATE PLAIN")
+	c.h_AUTHENTICATE(ParseLine("AUTHENTICATE +"))
+	s.nc.Expect("AUTHENTICATE YWNjdABhY2N0AHNlY3JldA==")
+	s.nc.ExpectNothing()
+	c.h_SASLDONE(ParseLine(":irc.server.org 903 test :SASL authentication successful"))
+	s.nc.Expect("CAP END")
+
+	// Registration continues if every mechanism fails.
+	c.caps, c.capsAvail = map[string]bool{}, map[string]string{}
+	c.cfg.SASLMechs = []string{"PLAIN"}
+	c.h_REGISTER(&Line{Cmd: REGISTER})
+	s.nc.Expect("CAP LS 302")
+	s.nc.Expect("NICK test")
+	s.nc.Expect("USER test 12 * :Testing IRC")
+	c.h_CAP(ParseLine(":irc.server.org CAP * LS :sasl=EXTERNAL"))
+	s.nc.Expect("CAP REQ :sasl")
+	// The advertised mechanisms don't include PLAIN, so we don't try it.
+	c.h_CAP(ParseLine(":irc.server.org CAP * ACK :sasl"))
+	s.nc.Expect("CAP END")
+}
+
+func TestSASLChunks(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Responses are split into 400 byte chunks, ending with "+"
+	// if the last chunk is full.
+	c.saslMech = "PLAIN"
+	c.cfg.SASLLogin = strings.Repeat("a", 149)
+	c.cfg.SASLPassword = ""
+	c.h_AUTHENTICATE(ParseLine("AUTHENTICATE +"))
+	resp := base64.StdEncoding.EncodeToString([]byte(c.cfg.SASLLogin +
+		"\x00" + c.cfg.SASLLogin + "\x00"))
+	if len(resp) != 400 {
+		t.Fatalf("Test response is %d bytes, not 400", len(resp))
+	}
+	s.nc.Expect("AUTHENTICATE " + resp)
+	s.nc.Expect("AUTHENTICATE +")
+	s.nc.ExpectNothing()
+}
+
+func TestRecoverNickAfterSASL(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Test the code path that doesn't involve state tracking.
+	c.st = nil
+	c.cfg.RecoverNickAfterSASL = true
+	c.h_REGISTER(&Line{Cmd: REGISTER})
+	s.nc.Expect("NICK test")
+	s.nc.Expect("USER test 12 * :Testing IRC")
+
+	// Our nick is held by a ghost, so we register with another.
+	c.h_433(ParseLine(":irc.server.org 433 * test :Nickname is already in use."))
+	s.nc.Expect("NICK test_")
+
+	// Without SASL, we don't try to get it back.
+	c.recoverNick()
+	s.nc.ExpectNothing()
+
+	// Once authenticated, we ask for it after registering.
+	c.saslMech = "PLAIN"
+	c.h_SASLDONE(ParseLine(":irc.server.org 903 test_ :SASL authentication successful"))
+	c.h_001(ParseLine(":irc.server.org 001 test_ :Welcome to IRC test_!ident@somehost.com"))
+	s.nc.Expect("NICK test")
+
+	// If services haven't released it, we keep the nick we have.
+	c.h_433(ParseLine(":irc.server.org 433 test_ test :Nickname is already in use."))
+	s.nc.ExpectNothing()
+	if c.cfg.Me.Nick != "test_" {
+		t.Errorf("Nick changed after recovery was refused: %s", c.cfg.Me.Nick)
+	}
+
+	// Later refusals are handled as usual.
+	c.h_433(ParseLine(":irc.server.org 433 test_ test :Nickname is already in use."))
+	s.nc.Expect("NICK test_")
+
+	// As are those after we've recovered the nick.
+	c.cfg.Me.Nick = "test_"
+	c.recoverNick()
+	s.nc.Expect("NICK test")
+	c.h_NICK(ParseLine(":test_!ident@somehost.com NICK :test"))
+	if c.cfg.Me.Nick != "test" {
+		t.Errorf("Nick not recovered: %s", c.cfg.Me.Nick)
+	}
+	c.h_433(ParseLine(":irc.server.org 433 test test :Nickname is already in use."))
+	s.nc.Expect("NICK test_")
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// After calls fn once, after d has passed, unless the connection is closed
+// first or the returned cancel func is called. It should be called while
+// connected, e.g. from a CONNECTED handler; if the client isn't connected
+// fn is never called. Functions scheduled on one connection are not carried
+// over to the next if the client reconnects.
+func (conn *Conn) After(d time.Duration, fn func(*Conn)) (cancel func()) {
+	return conn.schedule(d, fn, false)
+}
+
+// Every calls fn every d until the connection is closed or the returned
+// cancel func is called. As with After, it should be called while connected,
+// and fn is not called again after the client reconnects.
+func (conn *Conn) Every(d time.Duration, fn func(*Conn)) (cancel func()) {
+	return conn.schedule(d, fn, true)
+}
+
+func (conn *Conn) schedule(d time.Duration, fn func(*Conn), repeat bool) func() {
+	conn.mu.RLock()
+	die, connected := conn.die, conn.connected
+	conn.mu.RUnlock()
+	stop := make(chan struct{})
+	var once sync.Once
+	cancel := func() { once.Do(func() { close(stop) }) }
+	if !connected {
+		return cancel
+	}
+	go func() {
+		tick := time.NewTicker(d)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-die:
+				return
+			case <-stop:
+				return
+			}
+			// don't fire if we were closed or cancelled at the same time
+			select {
+			case <-die:
+				return
+			case <-stop:
+				return
+			default:
+			}
+			fn(conn)
+			if !repeat {
+				return
+			}
+		}
+	}()
+	return cancel
+}
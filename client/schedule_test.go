@@ -0,0 +1,55 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	later := make(chan *Conn, 1)
+	c.After(time.Millisecond, func(conn *Conn) { later <- conn })
+	select {
+	case conn := <-later:
+		if conn != c {
+			t.Errorf("After called with the wrong Conn.")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("After did not call func.")
+	}
+
+	ticks := make(chan struct{}, 10)
+	cancel := c.Every(time.Millisecond, func(conn *Conn) {
+		select {
+		case ticks <- struct{}{}:
+		default:
+		}
+	})
+	<-ticks
+	<-ticks
+	cancel()
+	cancel()
+	// One more tick may already have been in progress when cancelled.
+	<-time.After(5 * time.Millisecond)
+	for len(ticks) > 0 {
+		<-ticks
+	}
+	<-time.After(5 * time.Millisecond)
+	if len(ticks) != 0 {
+		t.Errorf("Every still firing after cancellation.")
+	}
+
+	// Nothing fires once the connection has been closed.
+	fired := make(chan struct{}, 1)
+	c.After(5*time.Millisecond, func(conn *Conn) { fired <- struct{}{} })
+	c.Every(5*time.Millisecond, func(conn *Conn) { fired <- struct{}{} })
+	c.Close()
+	c.After(time.Millisecond, func(conn *Conn) { fired <- struct{}{} })
+	select {
+	case <-fired:
+		t.Errorf("Scheduled func called after the connection was closed.")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
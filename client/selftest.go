@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long SelfTest waits for the server's replies at most.
+var selfTestTimeout = 30 * time.Second
+
+// ISUPPORT tokens included in a SelfTestReport, if the server sent them.
+var selfTestSupports = []string{
+	"NETWORK", "CASEMAPPING", "CHANTYPES", "PREFIX", "CHANMODES",
+	"MODES", "NICKLEN", "CHANNELLEN", "TOPICLEN", "TARGMAX",
+}
+
+// SelfTestReport is the result of a SelfTest.
+type SelfTestReport struct {
+	// Our nick and what the server has told us about itself.
+	Nick   string
+	Server ServerInfo
+
+	// The round trip time of a PING sent by SelfTest, as returned by Lag
+	// once the server has answered it.
+	Lag time.Duration
+
+	// The result of a WHOIS of ourselves, which shows that we can send to
+	// and receive from the server. Whois.Err is set if it failed.
+	Whois *WhoisInfo
+
+	// The IRCv3 capabilities negotiated with the server, as returned by
+	// Caps.
+	Caps map[string]string
+
+	// Details of the TLS connection, or nil if we're not using TLS.
+	TLS *tls.ConnectionState
+
+	// The ISUPPORT tokens that matter most when troubleshooting, such as
+	// NETWORK, CASEMAPPING and PREFIX, that the server sent.
+	ISupport map[string]string
+}
+
+// String summarises the report on one line, for logging.
+func (r SelfTestReport) String() string {
+	var caps, toks []string
+	for c := range r.Caps {
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+	for _, t := range selfTestSupports {
+		if v, ok := r.ISupport[t]; ok {
+			toks = append(toks, t+"="+v)
+		}
+	}
+	whois := "ok"
+	if r.Whois == nil {
+		whois = "none"
+	} else if r.Whois.Err != nil {
+		whois = r.Whois.Err.Error()
+	}
+	tlsVer := "none"
+	if r.TLS != nil {
+		tlsVer = "0x" + strconv.FormatUint(uint64(r.TLS.Version), 16)
+	}
+	return fmt.Sprintf("nick=%s server=%s lag=%s whois=%q tls=%s caps=[%s] isupport=[%s]",
+		r.Nick, r.Server.Name, r.Lag, whois, tlsVer,
+		strings.Join(caps, " "), strings.Join(toks, " "))
+}
+
+// SelfTest checks the health of the connection to the server, as a single
+// call for troubleshooting. It measures the lag with a PING, and checks
+// that we can send and receive with a WHOIS of ourselves, waiting for the
+// server to answer both, for ctx to be done, or 30 seconds. The report
+// also includes the capabilities negotiated, the TLS connection state and
+// the most useful ISUPPORT tokens. An error is returned with the report if
+// either check failed or ctx was done first, and with an empty one if
+// we're not connected. Like RequestWhois, it must not be called from a
+// handler, since the replies it waits for are dispatched on the same
+// goroutine.
+//     PING :payload
+//     WHOIS me
+func (conn *Conn) SelfTest(ctx context.Context) (SelfTestReport, error) {
+	if !conn.Connected() {
+		return SelfTestReport{}, errors.New("irc.SelfTest(): not connected")
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	r := SelfTestReport{
+		Nick:     conn.Me().Nick,
+		Server:   conn.ServerInfo(),
+		Caps:     conn.Caps(),
+		ISupport: make(map[string]string),
+	}
+	if cs, ok := conn.TLSConnectionState(); ok {
+		r.TLS = &cs
+	}
+	for _, t := range selfTestSupports {
+		if v, ok := conn.Supports(t); ok {
+			r.ISupport[t] = v
+		}
+	}
+
+	payload, pong := conn.pingPayload()
+	conn.Ping(payload)
+	whois, err := conn.RequestWhois(ctx, r.Nick)
+	if err != nil {
+		return r, err
+	}
+
+	for pong != nil || whois != nil {
+		select {
+		case <-pong:
+			r.Lag, pong = conn.Lag(), nil
+		case r.Whois = <-whois:
+			whois = nil
+		case <-ctx.Done():
+			return r, ctx.Err()
+		}
+	}
+	if r.Whois.Err != nil {
+		return r, fmt.Errorf("irc.SelfTest(): WHOIS failed: %v", r.Whois.Err)
+	}
+	return r, nil
+}
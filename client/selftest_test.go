@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.capMu.Lock()
+	c.caps["sasl"], c.capsAvail["sasl"] = true, "PLAIN"
+	c.capMu.Unlock()
+	c.supMu.Lock()
+	c.supports["NETWORK"], c.supports["AWAYLEN"] = "TestNet", "200"
+	c.supMu.Unlock()
+
+	type result struct {
+		r   SelfTestReport
+		err error
+	}
+	run := func(ctx context.Context) (<-chan result, string) {
+		s.st.EXPECT().Me().Return(c.cfg.Me)
+		done := make(chan result, 1)
+		go func() {
+			r, err := c.SelfTest(ctx)
+			done <- result{r, err}
+		}()
+		var sent []string
+		for len(sent) < 2 {
+			select {
+			case l := <-s.nc.Out:
+				sent = append(sent, strings.Trim(l, "\r\n"))
+			case <-time.After(time.Second):
+				t.Fatalf("SelfTest sent only %q", sent)
+			}
+		}
+		if !strings.HasPrefix(sent[0], "PING :") || sent[1] != "WHOIS test" {
+			t.Fatalf("SelfTest sent %q", sent)
+		}
+		return done, strings.TrimPrefix(sent[0], "PING :")
+	}
+
+	done, token := run(context.Background())
+	s.nc.Send(":irc.server.org PONG irc.server.org :" + token)
+	s.nc.Send(":irc.server.org 318 test test :End of /WHOIS list.")
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("Unexpected error from SelfTest: %v", res.err)
+	}
+	r := res.r
+	if r.Nick != "test" || r.Lag <= 0 || r.Lag != c.Lag() || r.Whois == nil || r.Whois.Nick != "test" ||
+		r.TLS != nil || r.Caps["sasl"] != "PLAIN" || len(r.ISupport) != 1 ||
+		r.ISupport["NETWORK"] != "TestNet" {
+		t.Errorf("Bad report: %#v", r)
+	}
+	if str := r.String(); !strings.Contains(str, "caps=[sasl]") ||
+		!strings.Contains(str, "isupport=[NETWORK=TestNet]") {
+		t.Errorf("Bad report summary: %s", str)
+	}
+
+	// A failed WHOIS or no PONG before ctx is done gives an error.
+	fail := func(done <-chan result) {
+		select {
+		case res := <-done:
+			if res.err == nil {
+				t.Errorf("No error from SelfTest: %#v", res.r)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("SelfTest didn't give up.")
+		}
+	}
+	done, token = run(context.Background())
+	s.nc.Send(":irc.server.org PONG irc.server.org :" + token)
+	s.nc.Send(":irc.server.org 401 test test :No such nick/channel")
+	fail(done)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done, _ = run(ctx)
+	s.nc.Send(":irc.server.org 318 test test :End of /WHOIS list.")
+	fail(done)
+}
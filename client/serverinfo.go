@@ -0,0 +1,62 @@
+package client
+
+import "strings"
+
+// ServerInfo describes the server the client is connected to, from the
+// 004 RPL_MYINFO reply sent during registration and any 351 RPL_VERSION
+// reply to a VERSION command sent to the server.
+type ServerInfo struct {
+	// The server's name and software version, e.g. "irc.example.org" and
+	// "solanum-1.0". The version from 351 replaces the one from 004.
+	Name, Version string
+
+	// The user and channel modes the server supports, and those channel
+	// modes that take a parameter, if the server lists them.
+	UserModes, ChannelModes, ParamModes string
+
+	// The comments from 351, which often describe the server's build.
+	Comments string
+}
+
+// ServerInfo returns what the server has told us about itself. Fields
+// are empty until the corresponding replies have been received.
+func (conn *Conn) ServerInfo() ServerInfo {
+	conn.supMu.RLock()
+	defer conn.supMu.RUnlock()
+	return conn.server
+}
+
+// Handler for 004 RPL_MYINFO.
+//   :server 004 me server.name version umodes chanmodes [parammodes]
+func (conn *Conn) h_004(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	conn.supMu.Lock()
+	defer conn.supMu.Unlock()
+	si := &conn.server
+	si.Name, si.Version = line.Args[1], line.Args[2]
+	if line.argslen(4) {
+		si.UserModes, si.ChannelModes = line.Args[3], line.Args[4]
+	}
+	if line.argslen(5) {
+		si.ParamModes = line.Args[5]
+	}
+}
+
+// Handler for 351 RPL_VERSION.
+//   :server 351 me version.debuglevel server.name :comments
+func (conn *Conn) h_351(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	conn.supMu.Lock()
+	defer conn.supMu.Unlock()
+	si := &conn.server
+	// the debug level after the last "." is usually empty
+	si.Version = strings.TrimSuffix(line.Args[1], ".")
+	si.Name = line.Args[2]
+	if line.argslen(3) {
+		si.Comments = line.Text()
+	}
+}
@@ -0,0 +1,25 @@
+package client
+
+import "testing"
+
+func TestServerInfo(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if si := c.ServerInfo(); si != (ServerInfo{}) {
+		t.Errorf("Server info set before 004: %#v", si)
+	}
+	c.h_004(ParseLine(":irc.server.org 004 test irc.server.org ircd-1.0 iow beiklmnostv klov"))
+	exp := ServerInfo{Name: "irc.server.org", Version: "ircd-1.0",
+		UserModes: "iow", ChannelModes: "beiklmnostv", ParamModes: "klov"}
+	if si := c.ServerInfo(); si != exp {
+		t.Errorf("Server info not parsed from 004: %#v", si)
+	}
+
+	c.h_351(ParseLine(":irc.server.org 351 test ircd-1.0.5. irc.server.org :TS6ow"))
+	exp.Version, exp.Comments = "ircd-1.0.5", "TS6ow"
+	if si := c.ServerInfo(); si != exp {
+		t.Errorf("Server info not updated from 351: %#v", si)
+	}
+
+}
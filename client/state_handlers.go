@@ -4,25 +4,39 @@ package client
 // to manage tracking state for an IRC connection
 
 import (
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lfkeitel/goirc/logging"
+	"github.com/lfkeitel/goirc/state"
 )
 
 var stHandlers = map[string]HandlerFunc{
-	"JOIN":  (*Conn).h_JOIN,
-	"KICK":  (*Conn).h_KICK,
-	"MODE":  (*Conn).h_MODE,
-	"NICK":  (*Conn).h_STNICK,
-	"PART":  (*Conn).h_PART,
-	"QUIT":  (*Conn).h_QUIT,
-	"TOPIC": (*Conn).h_TOPIC,
-	"311":   (*Conn).h_311,
-	"324":   (*Conn).h_324,
-	"332":   (*Conn).h_332,
-	"352":   (*Conn).h_352,
-	"353":   (*Conn).h_353,
-	"671":   (*Conn).h_671,
+	"ACTION":  (*Conn).h_ACTIVE,
+	"AWAY":    (*Conn).h_AWAY,
+	"CHGHOST": (*Conn).h_CHGHOST,
+	"JOIN":    (*Conn).h_JOIN,
+	"KICK":    (*Conn).h_KICK,
+	"MODE":    (*Conn).h_MODE,
+	"NICK":    (*Conn).h_STNICK,
+	"NOTICE":  (*Conn).h_ACTIVE,
+	"PART":    (*Conn).h_PART,
+	"PRIVMSG": (*Conn).h_ACTIVE,
+	"QUIT":    (*Conn).h_QUIT,
+	"RENAME":  (*Conn).h_RENAME,
+	"TOPIC":   (*Conn).h_TOPIC,
+	"311":     (*Conn).h_311,
+	"315":     (*Conn).h_ST315,
+	"324":     (*Conn).h_324,
+	"329":     (*Conn).h_329,
+	"319":     (*Conn).h_319,
+	"330":     (*Conn).h_330,
+	"332":     (*Conn).h_332,
+	"352":     (*Conn).h_352,
+	"353":     (*Conn).h_353,
+	"366":     (*Conn).h_366,
+	"671":     (*Conn).h_671,
 }
 
 func (conn *Conn) addSTHandlers() {
@@ -38,10 +52,30 @@ func (conn *Conn) delSTHandlers() {
 	conn.stRemovers = conn.stRemovers[:0]
 }
 
+// Records an event for a channel with the state tracker, if
+// Config.ChannelEventHistory says we should keep them.
+func (conn *Conn) recordEvent(channel string, line *Line, args ...string) {
+	if conn.cfg.ChannelEventHistory <= 0 {
+		return
+	}
+	conn.st.RecordEvent(channel, state.Event{
+		Time: line.Time, Cmd: line.Cmd, Nick: line.Nick, Args: args})
+}
+
 // Handle NICK messages that need to update the state tracker
 func (conn *Conn) h_STNICK(line *Line) {
 	// all nicks should be handled the same way, our own included
-	conn.st.ReNick(line.Nick, line.Args[0])
+	me := conn.Me()
+	nk := conn.st.ReNick(line.Nick, line.Args[0])
+	if nk != nil && conn.Casefold(line.Nick) == conn.Casefold(me.Nick) {
+		conn.recovered(line.Args[0])
+		conn.forcedNick(line, me.RequestedNick)
+	}
+	if nk != nil && conn.cfg.ChannelEventHistory > 0 {
+		for ch := range nk.Channels {
+			conn.recordEvent(ch, line, line.Args[0])
+		}
+	}
 }
 
 // Handle JOINs to channels to maintain state
@@ -57,28 +91,86 @@ func (conn *Conn) h_JOIN(line *Line) {
 			return
 		}
 		conn.st.NewChannel(line.Args[0])
+		conn.startSync(line.Args[0])
+		if conn.channelModeDefaults(line.Args[0]) != "" {
+			// we might be creating it, which we'll know after NAMES
+			conn.joinedMu.Lock()
+			conn.joined[conn.Casefold(line.Args[0])] = true
+			conn.joinedMu.Unlock()
+		}
 		// since we don't know much about this channel, ask server for info
 		// we get the channel users automatically in 353 and the channel
 		// topic in 332 on join, so we just need to get the modes
 		conn.Mode(line.Args[0])
 		// sending a WHO for the channel is MUCH more efficient than
 		// triggering a WHOIS on every nick from the 353 handler
-		conn.Who(line.Args[0])
+		conn.query(WHO, line.Args[0])
 	}
 	if nk == nil {
 		// this is the first we've seen of this nick
 		conn.st.NewNick(line.Nick)
 		conn.st.NickInfo(line.Nick, line.Ident, line.Host, "")
 		// since we don't know much about this nick, ask server for info
-		conn.Who(line.Nick)
+		conn.query(WHO, line.Nick)
 	}
 	// this takes care of both nick and channel linking \o/
 	conn.st.Associate(line.Args[0], line.Nick)
+	conn.recordEvent(line.Args[0], line)
+	conn.versionOnJoin(line.Args[0], line.Nick)
 }
 
-// Handle PARTs from channels to maintain state
+// Handle AWAY notifications sent with the away-notify capability
+//   :nick!user@host AWAY :message
+//   :nick!user@host AWAY
+func (conn *Conn) h_AWAY(line *Line) {
+	msg := line.Text()
+	conn.st.NickAway(line.Nick, msg != "", msg)
+}
+
+// Handle ident/host changes sent with the chghost capability
+//   :nick!olduser@oldhost CHGHOST newuser newhost
+func (conn *Conn) h_CHGHOST(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	if nk := conn.st.GetNick(line.Nick); nk != nil {
+		conn.st.NickInfo(line.Nick, line.Args[0], line.Args[1], nk.Name)
+	} else {
+		logging.Warn("irc.CHGHOST(): received CHGHOST for unknown nick %s",
+			line.Nick)
+	}
+}
+
+// Handle channel messages, recording when their sender was last active
+// if Config.TrackActivity is set.
+//   :nick!user@host PRIVMSG #channel :text
+func (conn *Conn) h_ACTIVE(line *Line) {
+	if !conn.cfg.TrackActivity || line.Nick == "" || len(line.Args) == 0 ||
+		!conn.IsChannel(line.Args[0]) {
+		return
+	}
+	conn.st.NickActive(line.Args[0], line.Nick, line.Time)
+}
+
+// Handle PARTs from channels to maintain state. When we part a channel the
+// tracker forgets it and its members, and a SELF_PART event is dispatched
+// with the channel in Args[0] and any part message in Args[1]. With
+// Config.SuppressSelfEvents set, the PART itself is dispatched as SELF_PART.
+//   :nick!user@host PART #channel :reason
 func (conn *Conn) h_PART(line *Line) {
+	conn.recordEvent(line.Args[0], line, line.Args[1:]...)
 	conn.st.Dissociate(line.Args[0], line.Nick)
+	if conn.cfg.SuppressSelfEvents ||
+		conn.Casefold(line.Nick) != conn.Casefold(conn.Me().Nick) {
+		return
+	}
+	l := line.Copy()
+	l.Cmd, l.Args = SELF_PART, []string{line.Args[0], ""}
+	if len(line.Args) > 1 {
+		l.Args[1] = line.Args[1]
+	}
+	l.Internal = true
+	conn.dispatch(l)
 }
 
 // Handle KICKs from channels to maintain state
@@ -88,6 +180,9 @@ func (conn *Conn) h_KICK(line *Line) {
 	}
 	// XXX: this won't handle autorejoining channels on KICK
 	// it's trivial to do this in a seperate handler...
+	// the nick being kicked is leaving anyway, so only the kicker matters
+	conn.unknownNicks(line.Args[0], line.Nick)
+	conn.recordEvent(line.Args[0], line, line.Args[1:]...)
 	conn.st.Dissociate(line.Args[0], line.Args[1])
 }
 
@@ -96,6 +191,20 @@ func (conn *Conn) h_QUIT(line *Line) {
 	conn.st.DelNick(line.Nick)
 }
 
+// Handle channels being renamed by the server with draft/channel-rename
+//   :nick!user@host RENAME #old #new :reason
+func (conn *Conn) h_RENAME(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	if !conn.HasCapability("draft/channel-rename") {
+		logging.Warn("irc.RENAME(): received RENAME %s without "+
+			"draft/channel-rename capability", strings.Join(line.Args, " "))
+		return
+	}
+	conn.st.RenameChannel(line.Args[0], line.Args[1])
+}
+
 // Handle MODE changes for channels we know about (and our nick personally)
 func (conn *Conn) h_MODE(line *Line) {
 	if !line.argslen(1) {
@@ -103,7 +212,11 @@ func (conn *Conn) h_MODE(line *Line) {
 	}
 	if ch := conn.st.GetChannel(line.Args[0]); ch != nil {
 		// channel modes first
+		conn.unknownNicks(line.Args[0], append([]string{line.Nick},
+			conn.modeNicks(line.Args[1], line.Args[2:])...)...)
 		conn.st.ChannelModes(line.Args[0], line.Args[1], line.Args[2:]...)
+		conn.st.ModesChanged(line.Args[0], line.Time)
+		conn.recordEvent(line.Args[0], line, line.Args[1:]...)
 	} else if nk := conn.st.GetNick(line.Args[0]); nk != nil {
 		// nick mode change, should be us
 		if !conn.Me().Equals(nk) {
@@ -111,13 +224,111 @@ func (conn *Conn) h_MODE(line *Line) {
 				line.Args[1], line.Args[0])
 			return
 		}
-		conn.st.NickModes(line.Args[0], line.Args[1])
+		conn.st.NickModes(line.Args[0], conn.botModes(line.Args[1]))
 	} else {
 		logging.Warn("irc.MODE(): not sure what to do with MODE %s",
 			strings.Join(line.Args, " "))
 	}
 }
 
+// UnknownNickPolicy says what to do with nicks the state tracker doesn't
+// know are on a channel when they turn up in a MODE or KICK there.
+type UnknownNickPolicy int
+
+const (
+	// Ignore the nick; any privileges given to it aren't tracked.
+	UnknownNickIgnore UnknownNickPolicy = iota
+	// Track the nick as being on the channel with what little we know
+	// about it, i.e. just its nick and any privileges.
+	UnknownNickCreate
+	// Send a WHO for the channel, and add any nicks in the replies that
+	// aren't being tracked as members of it. Until the replies arrive the
+	// nick is ignored, as with UnknownNickIgnore.
+	UnknownNickWho
+)
+
+// How often unknownNicks sends a WHO for the same channel.
+var unknownNickWhoInterval = time.Minute
+
+var defaultServiceNicks = []string{"ChanServ", "NickServ", "OperServ", "BotServ"}
+
+// unknownNicks applies Config.UnknownNicks to any of nicks that the state
+// tracker doesn't know are on channel.
+func (conn *Conn) unknownNicks(channel string, nicks ...string) {
+	policy := conn.cfg.UnknownNicks
+	if policy == UnknownNickIgnore {
+		return
+	}
+	who := false
+	for _, n := range nicks {
+		if n == "" || conn.isService(n) {
+			continue
+		}
+		if _, ok := conn.st.IsOn(channel, n); ok {
+			continue
+		}
+		logging.Warn("irc.unknownNicks(): %s not known to be on %s", n, channel)
+		switch policy {
+		case UnknownNickCreate:
+			if conn.st.GetNick(n) == nil {
+				conn.st.NewNick(n)
+			}
+			conn.st.Associate(channel, n)
+		case UnknownNickWho:
+			who = true
+		}
+	}
+	if who && conn.unknownWhoDue(channel) {
+		conn.query(WHO, channel)
+	}
+}
+
+// isService returns true if nick is one of Config.ServiceNicks, or is
+// really the name of a server.
+func (conn *Conn) isService(nick string) bool {
+	if strings.IndexByte(nick, '.') != -1 {
+		return true
+	}
+	services := conn.cfg.ServiceNicks
+	if services == nil {
+		services = defaultServiceNicks
+	}
+	for _, s := range services {
+		if conn.Casefold(s) == conn.Casefold(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownWhoDue returns true, and records that one is being sent, if
+// unknownNicks hasn't sent a WHO for channel in unknownNickWhoInterval.
+func (conn *Conn) unknownWhoDue(channel string) bool {
+	conn.unknownMu.Lock()
+	defer conn.unknownMu.Unlock()
+	k, now := conn.Casefold(channel), time.Now()
+	if t, ok := conn.unknownWho[k]; ok && now.Sub(t) < unknownNickWhoInterval {
+		return false
+	}
+	if conn.unknownWho == nil {
+		conn.unknownWho = make(map[string]time.Time)
+	}
+	conn.unknownWho[k] = now
+	return true
+}
+
+// modeNicks returns the nicks given or losing channel privileges by a MODE.
+func (conn *Conn) modeNicks(modes string, args []string) []string {
+	mt := conn.ModeTypes()
+	var nicks []string
+	for _, op := range state.ParseModeChange(modes, args, mt) {
+		if strings.IndexByte(mt.Prefix, op.Mode) != -1 {
+			nicks = append(nicks, op.Arg)
+		}
+	}
+	return nicks
+}
+
 // Handle TOPIC changes for channels
 func (conn *Conn) h_TOPIC(line *Line) {
 	if !line.argslen(1) {
@@ -125,6 +336,12 @@ func (conn *Conn) h_TOPIC(line *Line) {
 	}
 	if ch := conn.st.GetChannel(line.Args[0]); ch != nil {
 		conn.st.Topic(line.Args[0], line.Args[1])
+		setBy := line.Nick
+		if setBy == "" {
+			// topic set by the server
+			setBy = line.Src
+		}
+		conn.st.TopicInfo(line.Args[0], setBy, line.Time)
 	} else {
 		logging.Warn("irc.TOPIC(): topic change on unknown channel %s",
 			line.Args[0])
@@ -144,6 +361,36 @@ func (conn *Conn) h_311(line *Line) {
 	}
 }
 
+// Handle 319 whois channels reply. We only care about our own channels,
+// which are requested when state tracking is enabled after connecting.
+func (conn *Conn) h_319(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	me := conn.Me()
+	if line.Args[1] != me.Nick {
+		return
+	}
+	symbols := conn.ModeTypes().Symbols
+	for _, name := range strings.Fields(line.Args[2]) {
+		// strip any privilege prefixes, e.g. @#channel, taking care
+		// not to eat channel types that are also prefixes, e.g. @&channel
+		for name != "" && !conn.IsChannel(name) &&
+			strings.IndexByte(symbols, name[0]) != -1 {
+			name = name[1:]
+		}
+		if name == "" || conn.st.GetChannel(name) != nil {
+			continue
+		}
+		conn.st.NewChannel(name)
+		conn.st.Associate(name, me.Nick)
+		// the 353 NAMES reply will fill in everyone else, and our privileges
+		conn.Mode(name)
+		conn.Names(name)
+		conn.query(WHO, name)
+	}
+}
+
 // Handle 324 mode reply
 func (conn *Conn) h_324(line *Line) {
 	if !line.argslen(2) {
@@ -151,12 +398,97 @@ func (conn *Conn) h_324(line *Line) {
 	}
 	if ch := conn.st.GetChannel(line.Args[1]); ch != nil {
 		conn.st.ChannelModes(line.Args[1], line.Args[2], line.Args[3:]...)
+		conn.synced(line.Args[1], syncModes)
 	} else {
 		logging.Warn("irc.324(): received MODE settings for unknown channel %s",
 			line.Args[1])
 	}
 }
 
+// Handle 329 channel creation time reply, sent after 324
+//   :server 329 me #channel 1234567890
+func (conn *Conn) h_329(line *Line) {
+	if !line.argslen(2) {
+		return
+	}
+	ts, err := strconv.ParseInt(line.Args[2], 10, 64)
+	if err != nil {
+		logging.Warn("irc.329(): bad creation time %s for channel %s",
+			line.Args[2], line.Args[1])
+		return
+	}
+	if ch := conn.st.GetChannel(line.Args[1]); ch != nil {
+		conn.st.ChannelCreated(line.Args[1], time.Unix(ts, 0))
+		conn.synced(line.Args[1], syncCreated)
+	} else {
+		logging.Warn("irc.329(): received creation time for unknown channel %s",
+			line.Args[1])
+	}
+}
+
+// Handle 315 end of WHO. Without NAMES on join, the WHO sent for a channel
+// we've just joined is how we learn its members, so its end stands in for
+// 366 for CHANNEL_SYNCED.
+//   :server 315 me #channel :End of /WHO list.
+func (conn *Conn) h_ST315(line *Line) {
+	if !line.argslen(1) || !conn.HasCapability(noImplicitNames) {
+		return
+	}
+	conn.synced(line.Args[1], syncNames)
+}
+
+// Handle 366 end of NAMES, to set Config.ChannelModeDefaults on a channel
+// we've just joined if it looks like we created it, and to record that we
+// have its members for CHANNEL_SYNCED.
+//   :server 366 me #channel :End of /NAMES list.
+func (conn *Conn) h_366(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	name, k := line.Args[1], conn.Casefold(line.Args[1])
+	defer conn.synced(name, syncNames)
+	conn.joinedMu.Lock()
+	joined := conn.joined[k]
+	delete(conn.joined, k)
+	conn.joinedMu.Unlock()
+	if !joined {
+		return
+	}
+	ch := conn.st.GetChannel(name)
+	if ch == nil || len(ch.Nicks) != 1 || !ch.Nicks[conn.Me().Nick].HasAny("qao") {
+		return
+	}
+	conn.Mode(name, conn.channelModeDefaults(name))
+}
+
+// channelModeDefaults returns the modes from Config.ChannelModeDefaults
+// for channel, if any.
+func (conn *Conn) channelModeDefaults(channel string) string {
+	if m, ok := conn.cfg.ChannelModeDefaults[channel]; ok {
+		return m
+	}
+	k := conn.Casefold(channel)
+	for c, m := range conn.cfg.ChannelModeDefaults {
+		if conn.Casefold(c) == k {
+			return m
+		}
+	}
+	return ""
+}
+
+// Handle 330 whois reply (nick logged in to a services account)
+func (conn *Conn) h_330(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	if nk := conn.st.GetNick(line.Args[1]); nk != nil {
+		conn.st.NickAccount(nk.Nick, whoisAccount(line))
+	} else {
+		logging.Warn("irc.330(): received WHOIS account info for unknown nick %s",
+			line.Args[1])
+	}
+}
+
 // Handle 332 topic reply on join to channel
 func (conn *Conn) h_332(line *Line) {
 	if !line.argslen(2) {
@@ -164,6 +496,7 @@ func (conn *Conn) h_332(line *Line) {
 	}
 	if ch := conn.st.GetChannel(line.Args[1]); ch != nil {
 		conn.st.Topic(line.Args[1], line.Args[2])
+		conn.awaitSync(line.Args[1], syncTopicWho)
 	} else {
 		logging.Warn("irc.332(): received TOPIC value for unknown channel %s",
 			line.Args[1])
@@ -175,7 +508,15 @@ func (conn *Conn) h_352(line *Line) {
 	if !line.argslen(5) {
 		return
 	}
+	// without NAMES on join, or to recover from missing a JOIN, channel
+	// membership comes from WHO replies
+	names := (conn.HasCapability(noImplicitNames) ||
+		conn.cfg.UnknownNicks == UnknownNickWho) &&
+		conn.st.GetChannel(line.Args[1]) != nil
 	nk := conn.st.GetNick(line.Args[5])
+	if nk == nil && names {
+		nk = conn.st.NewNick(line.Args[5])
+	}
 	if nk == nil {
 		logging.Warn("irc.352(): received WHO reply for unknown nick %s",
 			line.Args[5])
@@ -189,13 +530,35 @@ func (conn *Conn) h_352(line *Line) {
 	// last arg contains "<hop count> <real name>"
 	a := strings.SplitN(line.Args[len(line.Args)-1], " ", 2)
 	conn.st.NickInfo(nk.Nick, line.Args[2], line.Args[3], a[1])
+	if names {
+		if _, ok := conn.st.IsOn(line.Args[1], nk.Nick); !ok {
+			conn.st.Associate(line.Args[1], nk.Nick)
+		}
+	}
 	if !line.argslen(6) {
 		return
 	}
+	if names {
+		// flags include the nick's prefix symbols, e.g. "H@+"
+		mt := conn.ModeTypes()
+		for i, sym := range mt.Symbols {
+			if strings.ContainsRune(line.Args[6], sym) {
+				conn.st.ChannelModes(line.Args[1],
+					"+"+string(mt.Prefix[i]), nk.Nick)
+			}
+		}
+	}
+	// flags start with H for here, or G for gone (away)
+	conn.st.NickAway(nk.Nick, strings.HasPrefix(line.Args[6], "G"), "")
 	if idx := strings.Index(line.Args[6], "*"); idx != -1 {
 		conn.st.NickModes(nk.Nick, "+o")
 	}
-	if idx := strings.Index(line.Args[6], "B"); idx != -1 {
+	// bots are flagged with the BOT ISUPPORT mode, or B if not advertised
+	bot := "B"
+	if m, ok := conn.BotMode(); ok {
+		bot = string(m)
+	}
+	if idx := strings.Index(line.Args[6], bot); idx != -1 {
 		conn.st.NickModes(nk.Nick, "+B")
 	}
 	if idx := strings.Index(line.Args[6], "H"); idx != -1 {
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"time"
+
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// How often awaitStateReady checks whether we've finished joining channels.
+var stateReadyPoll = 250 * time.Millisecond
+
+// awaitStateReady is called once we're ready to join channels after
+// connecting, and dispatches STATE_READY once every channel we've asked to
+// join has been joined or refused and synced, or after
+// Config.StateReadyTimeout if that takes too long.
+func (conn *Conn) awaitStateReady() {
+	if conn.st == nil {
+		return
+	}
+	d := conn.cfg.StateReadyTimeout
+	if d <= 0 {
+		d = 30 * time.Second
+	}
+	conn.mu.RLock()
+	die := conn.die
+	conn.mu.RUnlock()
+	clk := conn.clock()
+	var waited time.Duration
+	var check func()
+	check = func() {
+		select {
+		case <-die:
+			// disconnected; the next connection waits afresh
+			return
+		default:
+		}
+		busy := conn.joinsBusy()
+		if busy && waited < d {
+			waited += stateReadyPoll
+			clk.AfterFunc(stateReadyPoll, check)
+			return
+		}
+		if busy {
+			logging.Debug("irc.STATE_READY(): gave up waiting for "+
+				"channels after %s", d)
+		}
+		if conn.st != nil {
+			conn.dispatch(&Line{Cmd: STATE_READY, Internal: true, Time: time.Now()})
+		}
+	}
+	clk.AfterFunc(stateReadyPoll, check)
+}
+
+// joinsBusy returns true if JoinAll has channels left to join, a JOIN is
+// queued to be sent or still waiting for the server's reply, or a channel
+// we've joined hasn't been synced yet.
+func (conn *Conn) joinsBusy() bool {
+	conn.joinMu.Lock()
+	busy := len(conn.joinQueue) > 0 || conn.joining != ""
+	conn.joinMu.Unlock()
+	conn.joinsMu.Lock()
+	busy = busy || len(conn.joinsSent) > 0 || conn.joinsQueued > 0
+	conn.joinsMu.Unlock()
+	conn.chanSyncMu.Lock()
+	busy = busy || len(conn.chanSyncs) > 0
+	conn.chanSyncMu.Unlock()
+	return busy
+}
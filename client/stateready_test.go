@@ -0,0 +1,97 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateReady(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+	clk := newFakeClock()
+	c.cfg.clock = clk
+
+	ready := make(chan struct{}, 1)
+	c.HandleFunc(STATE_READY, func(conn *Conn, line *Line) {
+		ready <- struct{}{}
+	})
+	isReady := func() bool {
+		select {
+		case <-ready:
+			return true
+		default:
+			return false
+		}
+	}
+	busy := func(sent, syncing bool) {
+		c.joinsMu.Lock()
+		delete(c.joinsSent, "#test1")
+		if sent {
+			c.joinsSent["#test1"] = true
+		}
+		c.joinsMu.Unlock()
+		c.chanSyncMu.Lock()
+		delete(c.chanSyncs, "#test1")
+		if syncing {
+			c.chanSyncs["#test1"] = &chanSync{need: syncNames, cancel: func() {}}
+		}
+		c.chanSyncMu.Unlock()
+	}
+
+	// The event waits for JOINs to be sent and answered, and channels to
+	// be synced.
+	c.joinQueued("JOIN #test1", 1)
+	c.setReady()
+	clk.Advance(stateReadyPoll)
+	c.joinQueued("JOIN #test1", -1)
+	busy(true, false)
+	clk.Advance(stateReadyPoll)
+	busy(false, true)
+	clk.Advance(stateReadyPoll)
+	if isReady() {
+		t.Fatalf("STATE_READY dispatched while joining channels.")
+	}
+	busy(false, false)
+	clk.Advance(stateReadyPoll)
+	if !isReady() {
+		t.Fatalf("STATE_READY not dispatched once channels were synced.")
+	}
+
+	// It's only sent once per connection.
+	c.setReady()
+	clk.Advance(stateReadyPoll)
+	if isReady() {
+		t.Errorf("STATE_READY dispatched twice.")
+	}
+
+	// If channels never finish syncing, it's sent after the timeout.
+	c.regMu.Lock()
+	c.ready = make(chan struct{})
+	c.regMu.Unlock()
+	c.cfg.StateReadyTimeout = 2 * stateReadyPoll
+	busy(false, true)
+	c.setReady()
+	clk.Advance(2 * stateReadyPoll)
+	if isReady() {
+		t.Fatalf("STATE_READY dispatched before timeout.")
+	}
+	clk.Advance(stateReadyPoll)
+	if !isReady() {
+		t.Fatalf("STATE_READY not dispatched after timeout.")
+	}
+	busy(false, false)
+
+	// Lines queued to be sent count until they're written.
+	c.joinQueued("JOIN #test1", 1)
+	if !c.joinsBusy() {
+		t.Errorf("Queued JOIN not counted as busy.")
+	}
+	c.write("JOIN #test1", time.Time{})
+	s.nc.Expect("JOIN #test1")
+	c.joinsMu.Lock()
+	if c.joinsQueued != 0 || !c.joinsSent["#test1"] {
+		t.Errorf("Written JOIN still queued, or not recorded as sent.")
+	}
+	c.joinsMu.Unlock()
+	busy(false, false)
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lfkeitel/goirc/logging"
+)
+
+// applySTS makes us connect with TLS, on the port from the server's STS
+// policy in Config.PolicyStore, if there's a policy that hasn't expired for
+// the host in Config.Server. It's called with conn.mu held while connecting.
+func (conn *Conn) applySTS() {
+	ps := conn.cfg.PolicyStore
+	if ps == nil || conn.cfg.SSL {
+		return
+	}
+	host, _, err := net.SplitHostPort(conn.cfg.Server)
+	if err != nil {
+		return
+	}
+	p, err := ps.Get(host)
+	if err != nil {
+		logging.Warn("irc.STS(): getting policy for %s: %v", host, err)
+		return
+	}
+	if !p.Active() || p.Port <= 0 {
+		return
+	}
+	logging.Info("irc.STS(): %s has an STS policy, using TLS on port %d",
+		host, p.Port)
+	conn.stsUpgrade(host, p.Port)
+}
+
+// stsUpgrade sets Config.SSL and the port in Config.Server to connect to
+// host with TLS, checking the server's certificate against host if no
+// SSLConfig has been given.
+func (conn *Conn) stsUpgrade(host string, port int) {
+	conn.cfg.SSL = true
+	conn.cfg.Server = net.JoinHostPort(host, strconv.Itoa(port))
+	if conn.cfg.SSLConfig == nil {
+		conn.cfg.SSLConfig = &tls.Config{ServerName: host}
+	}
+}
+
+// stsPolicy handles the value of the sts capability advertised in CAP LS or
+// CAP NEW, if Config.PolicyStore is set. Over an insecure connection the
+// server says which port to use TLS on, which we do from the next time we
+// connect. Over a secure one it says how long to keep using TLS, which is
+// stored, or that we needn't any more if the duration is 0.
+//   :server CAP * LS :sts=port=6697
+//   :server CAP * LS :sts=duration=2592000,port=6697
+func (conn *Conn) stsPolicy(value string, secure bool) {
+	ps := conn.cfg.PolicyStore
+	if ps == nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(conn.cfg.Server)
+	if err != nil {
+		return
+	}
+	params := make(map[string]string)
+	for _, kv := range strings.Split(value, ",") {
+		if p := strings.SplitN(kv, "=", 2); len(p) == 2 {
+			params[p[0]] = p[1]
+		}
+	}
+	if !secure {
+		p, err := strconv.Atoi(params["port"])
+		if err != nil || p <= 0 || p > 65535 {
+			return
+		}
+		logging.Warn("irc.STS(): %s requires TLS on port %d, "+
+			"which will be used when we next connect", host, p)
+		conn.stsUpgrade(host, p)
+		return
+	}
+	d, err := strconv.ParseInt(params["duration"], 10, 64)
+	if err != nil || d < 0 {
+		return
+	}
+	p, err := ps.Get(host)
+	if err != nil {
+		logging.Warn("irc.STS(): getting policy for %s: %v", host, err)
+		return
+	}
+	if p == nil {
+		p = &Policy{}
+	}
+	p.Port, p.Expires = 0, time.Time{}
+	if d > 0 {
+		p.Port, _ = strconv.Atoi(port)
+		p.Expires = time.Now().Add(time.Duration(d) * time.Second)
+	}
+	// keep any accepted certificate fingerprints without the STS policy
+	if p.Expires.IsZero() && len(p.Fingerprints) == 0 {
+		err = ps.Delete(host)
+	} else {
+		err = ps.Set(host, p)
+	}
+	if err != nil {
+		logging.Warn("irc.STS(): storing policy for %s: %v", host, err)
+	}
+}
@@ -0,0 +1,59 @@
+package client
+
+import "time"
+
+// The layout of server-time tag values.
+const serverTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// Tag returns the value of the IRCv3 message tag key and whether the line
+// had it. Every tag the server sends is kept in Line.Tags, including vendor
+// and draft tags the client knows nothing about, e.g.
+//   line.Tag("+draft/channel-context")
+// Accessors are provided for the stable tags in common use.
+func (line *Line) Tag(key string) (string, bool) {
+	v, ok := line.Tags[key]
+	return v, ok
+}
+
+// ServerTime returns when the server says the line was sent, from the time
+// tag added with the server-time capability. ok is false if the line has
+// no time tag or it can't be parsed.
+func (line *Line) ServerTime() (t time.Time, ok bool) {
+	v, ok := line.Tags["time"]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(serverTimeLayout, v)
+	if err != nil {
+		// some servers leave out the milliseconds
+		if t, err = time.Parse(time.RFC3339, v); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return t, true
+}
+
+// MsgID returns the line's msgid tag, which uniquely identifies the message,
+// or "" if it has none.
+func (line *Line) MsgID() string {
+	return line.Tags["msgid"]
+}
+
+// Account returns the services account of the line's sender, from the
+// account tag added with the account-tag capability, or "" if it has none.
+func (line *Line) Account() string {
+	return line.Tags["account"]
+}
+
+// Label returns the line's label tag, which the server copies from the
+// command it is replying to with the labeled-response capability, or ""
+// if it has none.
+func (line *Line) Label() string {
+	return line.Tags["label"]
+}
+
+// Batch returns the reference of the batch the line is part of, from the
+// batch tag, or "" if it isn't part of one.
+func (line *Line) Batch() string {
+	return line.Tags["batch"]
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLineTagAccessors(t *testing.T) {
+	l := ParseLine("@time=2017-01-02T03:04:05.678Z;msgid=abc;account=bob;label=l1;" +
+		"batch=b1;+draft/channel-context=#chan;example.com/foo=a\\\\sb\\s " +
+		":nick!ident@host.com PRIVMSG me :Hello")
+
+	// Unknown tags are kept, with escapes undone.
+	if v, ok := l.Tag("+draft/channel-context"); !ok || v != "#chan" {
+		t.Errorf("Draft tag not kept: %q %t", v, ok)
+	}
+	if v, ok := l.Tag("example.com/foo"); !ok || v != "a\\sb " {
+		t.Errorf("Vendor tag not unescaped correctly: %q %t", v, ok)
+	}
+	if _, ok := l.Tag("missing"); ok {
+		t.Errorf("Tag returned a tag the line doesn't have.")
+	}
+
+	exp := time.Date(2017, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	if st, ok := l.ServerTime(); !ok || !st.Equal(exp) {
+		t.Errorf("Wrong server time: %s %t", st, ok)
+	}
+	if l.MsgID() != "abc" || l.Account() != "bob" || l.Label() != "l1" ||
+		l.Batch() != "b1" {
+		t.Errorf("Wrong tag accessor values: %#v", l.Tags)
+	}
+
+	// Servers may leave the milliseconds off the time.
+	l = ParseLine("@time=2017-01-02T03:04:05Z PING :foo")
+	if st, ok := l.ServerTime(); !ok || !st.Equal(exp.Truncate(time.Second)) {
+		t.Errorf("Wrong server time without milliseconds: %s %t", st, ok)
+	}
+
+	// Lines without tags return nothing.
+	l = ParseLine(":nick!ident@host.com PRIVMSG me :Hello")
+	if _, ok := l.ServerTime(); ok || l.MsgID() != "" || l.Account() != "" {
+		t.Errorf("Tag accessors returned values for an untagged line.")
+	}
+	l = ParseLine("@time=yesterday PING :foo")
+	if _, ok := l.ServerTime(); ok {
+		t.Errorf("ServerTime parsed a bad time.")
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How often SendTyping will tell a target we're still actively typing.
+// The +typing spec asks clients not to send it more often than this.
+var typingInterval = 3 * time.Second
+
+// Tagmsg sends a TAGMSG carrying only the given IRCv3 message tags to the
+// target nick or channel t. The server must have acknowledged the
+// message-tags capability for it to be delivered. Tags are sent sorted
+// by key.
+//     @tag=value TAGMSG t
+func (conn *Conn) Tagmsg(t string, tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	m := NewMessage(TAGMSG)
+	for _, k := range keys {
+		m.Tag(k, tags[k])
+	}
+	conn.Raw(m.Params(t).String())
+}
+
+// SendTyping tells the target nick or channel t whether we are typing a
+// message, with state "active", "paused" or "done". Repeated "active"
+// notifications to the same target are only sent every few seconds,
+// so it's safe to call SendTyping on every keypress. It returns an error
+// if the state is unknown, or the message-tags capability isn't enabled.
+//     @+typing=active TAGMSG t
+func (conn *Conn) SendTyping(t, state string) error {
+	switch state {
+	case "active", "paused", "done":
+	default:
+		return fmt.Errorf("irc.SendTyping(): unknown typing state %q", state)
+	}
+	if !conn.HasCapability("message-tags") {
+		return fmt.Errorf("irc.SendTyping(): message-tags capability not enabled")
+	}
+	now, target := time.Now(), conn.Casefold(t)
+	conn.typingMu.Lock()
+	if state == "active" {
+		if last, ok := conn.typingLast[target]; ok && now.Sub(last) < typingInterval {
+			conn.typingMu.Unlock()
+			return nil
+		}
+		conn.typingLast[target] = now
+	} else {
+		delete(conn.typingLast, target)
+	}
+	conn.typingMu.Unlock()
+	conn.Tagmsg(t, map[string]string{"+typing": state})
+	return nil
+}
+
+// Handler for TAGMSGs, dispatching a TYPING event for typing notifications
+// with the target in Args[0] and the typing state in Args[1].
+//   @+typing=active :nick!user@host TAGMSG #channel
+func (conn *Conn) h_TAGMSG(line *Line) {
+	state, ok := line.Tags["+typing"]
+	if !ok || !line.argslen(0) {
+		return
+	}
+	l := line.Copy()
+	l.Cmd, l.Args = TYPING, []string{line.Args[0], state}
+	l.Internal = true
+	conn.dispatch(l)
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagmsg(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	c.Tagmsg("#test1", map[string]string{"+draft/react": "lol", "+a": "b c"})
+	s.nc.Expect("@+a=b\\sc;+draft/react=lol TAGMSG #test1")
+}
+
+func TestSendTyping(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	// Typing notifications need message-tags.
+	if err := c.SendTyping("#test1", "active"); err == nil {
+		t.Errorf("No error sending typing notification without message-tags.")
+	}
+	s.nc.ExpectNothing()
+
+	c.h_CAP(ParseLine(":irc.server.org CAP test ACK :message-tags"))
+	if err := c.SendTyping("#test1", "thinking"); err == nil {
+		t.Errorf("No error sending unknown typing state.")
+	}
+	s.nc.ExpectNothing()
+
+	if err := c.SendTyping("#test1", "active"); err != nil {
+		t.Errorf("Unexpected error from SendTyping: %v", err)
+	}
+	s.nc.Expect("@+typing=active TAGMSG #test1")
+
+	// Repeated active notifications are rate limited per target ...
+	c.SendTyping("#TEST1", "active")
+	s.nc.ExpectNothing()
+	c.SendTyping("#test2", "active")
+	s.nc.Expect("@+typing=active TAGMSG #test2")
+
+	// ... but other states are always sent, and reset the limit.
+	c.SendTyping("#test1", "paused")
+	s.nc.Expect("@+typing=paused TAGMSG #test1")
+	c.SendTyping("#test1", "active")
+	s.nc.Expect("@+typing=active TAGMSG #test1")
+	c.SendTyping("#test1", "done")
+	s.nc.Expect("@+typing=done TAGMSG #test1")
+
+	// Once the interval has passed, active is sent again.
+	defer func(d time.Duration) { typingInterval = d }(typingInterval)
+	typingInterval = 0
+	c.SendTyping("#test2", "active")
+	s.nc.Expect("@+typing=active TAGMSG #test2")
+}
+
+func TestTypingEvent(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	got := make(chan string, 1)
+	c.HandleFunc(TYPING, func(conn *Conn, line *Line) {
+		got <- line.Nick + " " + strings.Join(line.Args, " ")
+	})
+	c.h_TAGMSG(ParseLine("@+typing=paused :nick!ident@host.com TAGMSG #test1"))
+	if ev := <-got; ev != "nick #test1 paused" {
+		t.Errorf("Bad TYPING event: %q", ev)
+	}
+
+	// TAGMSGs without a typing tag don't dispatch anything.
+	c.h_TAGMSG(ParseLine("@+draft/react=x :nick!ident@host.com TAGMSG #test1"))
+	select {
+	case ev := <-got:
+		t.Errorf("Unexpected TYPING event: %q", ev)
+	default:
+	}
+}
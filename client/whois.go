@@ -0,0 +1,332 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replies to a WHOIS collected by RequestWhois. In all of them
+// the nick being queried is in Args[1].
+var whoisReplies = []string{
+	"311", // RPL_WHOISUSER
+	"312", // RPL_WHOISSERVER
+	"317", // RPL_WHOISIDLE
+	"318", // RPL_ENDOFWHOIS
+	"319", // RPL_WHOISCHANNELS
+	"330", // RPL_WHOISACCOUNT
+	"378", // RPL_WHOISHOST
+	"401", // ERR_NOSUCHNICK
+	"671", // RPL_WHOISSECURE
+}
+
+// WhoisInfo is the result of a WHOIS made with RequestWhois, aggregated
+// from the server's replies.
+type WhoisInfo struct {
+	Nick, Ident, Host, Name string
+
+	// Channels the nick is on that we can see, with any privilege prefixes
+	// sent by the server, e.g. "@#channel".
+	Channels []string
+
+	// The server the nick is connected to and its description, from 312
+	// RPL_WHOISSERVER.
+	Server, ServerInfo string
+
+	// The nick's real hostname and IP address behind any cloak, from 378
+	// RPL_WHOISHOST, which servers usually only send to opers. Either may
+	// be "" if the server didn't send it or it couldn't be parsed.
+	RealHost, RealIP string
+
+	// Secure is true if the nick is using a secure connection,
+	// from 671 RPL_WHOISSECURE.
+	Secure bool
+
+	// The services account the nick is logged in to, from 330
+	// RPL_WHOISACCOUNT, or "" if it isn't logged in.
+	Account string
+
+	// When the nick was last active and when it connected, from 317
+	// RPL_WHOISIDLE. The server sends how long the nick has been idle,
+	// which is subtracted from when the reply arrived. Zero if unknown, as
+	// SignonTime is for servers that don't send it.
+	IdleSince, SignonTime time.Time
+
+	// Err is set if the WHOIS failed, e.g. because there is no such nick,
+	// or to ctx.Err() if the context passed to RequestWhois was done first.
+	Err error
+}
+
+// whoisReq is a WHOIS sent by RequestWhois that's waiting for replies.
+// done is closed once nobody is waiting for it any more.
+type whoisReq struct {
+	info    *WhoisInfo
+	waiters []chan *WhoisInfo
+	done    chan struct{}
+}
+
+// RequestWhois sends a WHOIS for nick and returns a channel that receives
+// the aggregated replies once the server has sent them all. The channel is
+// closed after the result is sent. If the WHOIS fails, the result's Err is
+// set. If ctx is done before the server has finished replying, a result is
+// sent with Err set to ctx.Err() instead. Concurrent requests for the same
+// nick share a single WHOIS.
+//     WHOIS nick
+func (conn *Conn) RequestWhois(ctx context.Context, nick string) (<-chan *WhoisInfo, error) {
+	if nick == "" || conn.IsChannel(nick) {
+		return nil, fmt.Errorf("irc.RequestWhois(): bad nick %q", nick)
+	}
+	ch, send := conn.whoisWait(ctx, nick)
+	if send {
+		conn.Whois(nick)
+	}
+	return ch, nil
+}
+
+// RequestWhoisMulti is like RequestWhois for several nicks, but batches the
+// WHOISes into as few commands as the server's TARGMAX for WHOIS allows, as
+// WhoisMulti does. The returned channel receives a result for each nick as
+// the server finishes replying about it, and is closed after the last one.
+//     WHOIS nick1,nick2,...
+func (conn *Conn) RequestWhoisMulti(ctx context.Context, nicks []string) (<-chan *WhoisInfo, error) {
+	for _, nick := range nicks {
+		if nick == "" || conn.IsChannel(nick) {
+			return nil, fmt.Errorf("irc.RequestWhoisMulti(): bad nick %q", nick)
+		}
+	}
+	out := make(chan *WhoisInfo, len(nicks))
+	var wg sync.WaitGroup
+	var send []string
+	for _, nick := range nicks {
+		ch, isNew := conn.whoisWait(ctx, nick)
+		if isNew {
+			send = append(send, nick)
+		}
+		wg.Add(1)
+		go func() {
+			out <- <-ch
+			wg.Done()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	conn.WhoisMulti(send)
+	return out, nil
+}
+
+// whoisWait adds a waiter for the result of a WHOIS for nick, returning the
+// channel the result will be sent on and whether the WHOIS needs sending,
+// which it doesn't if one for the same nick is already pending.
+func (conn *Conn) whoisWait(ctx context.Context, nick string) (<-chan *WhoisInfo, bool) {
+	ch := make(chan *WhoisInfo, 1)
+	key := conn.Casefold(nick)
+	conn.whoisMu.Lock()
+	req, ok := conn.whoisPending[key]
+	if !ok {
+		if len(conn.whoisPending) == 0 {
+			for _, n := range whoisReplies {
+				conn.whoisRemovers = append(conn.whoisRemovers,
+					conn.handle(n, HandlerFunc((*Conn).h_WHOISREPLY)))
+			}
+		}
+		req = &whoisReq{info: &WhoisInfo{Nick: nick}, done: make(chan struct{})}
+		conn.whoisPending[key] = req
+	}
+	req.waiters = append(req.waiters, ch)
+	conn.whoisMu.Unlock()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.whoisCancel(key, req, ch, ctx.Err())
+			case <-req.done:
+			}
+		}()
+	}
+	return ch, !ok
+}
+
+// whoisDone sends the result of the WHOIS for the case-folded nick key to
+// everyone waiting for it. conn.whoisMu must be held.
+func (conn *Conn) whoisDone(key string, req *whoisReq) {
+	for _, ch := range req.waiters {
+		ch <- req.info
+		close(ch)
+	}
+	req.waiters = nil
+	conn.whoisStop(key, req)
+}
+
+// whoisFail ends every pending WHOIS with err, e.g. because we've been
+// disconnected.
+func (conn *Conn) whoisFail(err error) {
+	conn.whoisMu.Lock()
+	defer conn.whoisMu.Unlock()
+	for key, req := range conn.whoisPending {
+		req.info.Err = err
+		conn.whoisDone(key, req)
+	}
+}
+
+// whoisCancel sends err to ch, which has given up waiting for the WHOIS
+// of the case-folded nick key, if the WHOIS hasn't finished already.
+func (conn *Conn) whoisCancel(key string, req *whoisReq, ch chan *WhoisInfo, err error) {
+	conn.whoisMu.Lock()
+	defer conn.whoisMu.Unlock()
+	for i, w := range req.waiters {
+		if w == ch {
+			req.waiters = append(req.waiters[:i], req.waiters[i+1:]...)
+			ch <- &WhoisInfo{Nick: req.info.Nick, Err: err}
+			close(ch)
+			break
+		}
+	}
+	if len(req.waiters) == 0 {
+		conn.whoisStop(key, req)
+	}
+}
+
+// whoisStop forgets the WHOIS for the case-folded nick key once nobody is
+// waiting for it, and removes the handlers collecting replies if no other
+// WHOISes are pending. conn.whoisMu must be held.
+func (conn *Conn) whoisStop(key string, req *whoisReq) {
+	if conn.whoisPending[key] != req {
+		return
+	}
+	delete(conn.whoisPending, key)
+	close(req.done)
+	if len(conn.whoisPending) == 0 {
+		for _, r := range conn.whoisRemovers {
+			r.Remove()
+		}
+		conn.whoisRemovers = nil
+	}
+}
+
+// Handler to collect replies to WHOISes sent by RequestWhois. It is only
+// registered while they are waiting for replies.
+//   :server 311 me nick ident host * :name
+//   :server 318 me nick :End of /WHOIS list.
+// A WHOIS for several nicks may be ended by a single 318 for all of them.
+//   :server 318 me nick1,nick2 :End of /WHOIS list.
+func (conn *Conn) h_WHOISREPLY(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	conn.whoisMu.Lock()
+	defer conn.whoisMu.Unlock()
+	if line.Cmd == "318" {
+		for _, nick := range strings.Split(line.Args[1], ",") {
+			key := conn.Casefold(nick)
+			if req, ok := conn.whoisPending[key]; ok {
+				conn.whoisDone(key, req)
+			}
+		}
+		return
+	}
+	key := conn.Casefold(line.Args[1])
+	req, ok := conn.whoisPending[key]
+	if !ok {
+		return
+	}
+	info := req.info
+	switch line.Cmd {
+	case "311":
+		if len(line.Args) > 5 {
+			info.Nick, info.Ident, info.Host, info.Name =
+				line.Args[1], line.Args[2], line.Args[3], line.Args[5]
+		}
+	case "312":
+		if len(line.Args) > 2 {
+			info.Server = line.Args[2]
+		}
+		if len(line.Args) > 3 {
+			info.ServerInfo = line.Args[3]
+		}
+	case "378":
+		info.RealHost, info.RealIP = whoisHost(line)
+	case "319":
+		info.Channels = append(info.Channels, strings.Fields(line.Text())...)
+	case "317":
+		info.IdleSince, info.SignonTime = whoisIdle(line)
+	case "330":
+		info.Account = whoisAccount(line)
+	case "671":
+		info.Secure = true
+	case "401":
+		info.Err = fmt.Errorf("irc.RequestWhois(): %s: %s",
+			line.Args[1], line.Text())
+		// some servers don't send 318 after 401
+		conn.whoisDone(key, req)
+	}
+}
+
+// whoisIdle returns when the nick was last active and when it connected
+// from a 317 RPL_WHOISIDLE reply. The idle time is in seconds before the
+// reply was sent, while the signon time is a unix timestamp, which older
+// servers leave out.
+//   :server 317 me nick 120 1500000000 :seconds idle, signon time
+//   :server 317 me nick 120 :seconds idle
+func whoisIdle(line *Line) (since, signon time.Time) {
+	if len(line.Args) < 4 {
+		return
+	}
+	now := line.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if idle, err := strconv.ParseInt(line.Args[2], 10, 64); err == nil && idle >= 0 {
+		since = now.Add(-time.Duration(idle) * time.Second)
+	}
+	if len(line.Args) > 4 {
+		if ts, err := strconv.ParseInt(line.Args[3], 10, 64); err == nil && ts > 0 {
+			signon = time.Unix(ts, 0)
+		}
+	}
+	return
+}
+
+// whoisAccount returns the account from a 330 RPL_WHOISACCOUNT reply. Some
+// servers use 330 without an account to say the nick itself is registered
+// and identified, in which case the account is assumed to be the nick.
+//   :server 330 me nick account :is logged in as
+//   :server 330 me nick :is a registered nick
+func whoisAccount(line *Line) string {
+	if len(line.Args) > 3 {
+		return line.Args[2]
+	}
+	return line.Args[1]
+}
+
+// whoisHost returns the real hostname and IP address of a nick from the
+// free-form text of a 378 RPL_WHOISHOST reply, which differs between
+// servers. The hostname is taken from the first user@host mask in the text
+// and the IP from the first word that is an IP address, ignoring brackets.
+// If there is no mask, the hostname is assumed to be the word after "from".
+//   :server 378 me nick :is connecting from *@host.example.com 192.0.2.1
+//   :server 378 me nick :is connecting from ident@host.example.com [192.0.2.1]
+//   :server 378 me nick :is connecting from host.example.com 192.0.2.1
+func whoisHost(line *Line) (host, ip string) {
+	words := strings.Fields(line.Text())
+	for i, w := range words {
+		if at := strings.LastIndex(w, "@"); at >= 0 && host == "" {
+			host = w[at+1:]
+		} else if a := net.ParseIP(strings.Trim(w, "[]")); a != nil && ip == "" {
+			ip = a.String()
+		} else if strings.EqualFold(w, "from") && i+1 < len(words) && host == "" &&
+			!strings.Contains(words[i+1], "@") {
+			host = words[i+1]
+		}
+	}
+	// A host that's an IP address is the IP, if the server gave no other.
+	if a := net.ParseIP(host); a != nil && ip == "" {
+		ip = a.String()
+	}
+	return host, ip
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRequestWhois(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if _, err := c.RequestWhois(context.Background(), "#channel"); err == nil {
+		t.Errorf("No error requesting WHOIS for a channel.")
+	}
+	s.nc.ExpectNothing()
+
+	res1, err := c.RequestWhois(context.Background(), "user1")
+	if err != nil {
+		t.Fatalf("Unexpected error from RequestWhois: %v", err)
+	}
+	s.nc.Expect("WHOIS user1")
+	// A second request for the same nick shares the first WHOIS.
+	res2, _ := c.RequestWhois(context.Background(), "USER1")
+	s.nc.ExpectNothing()
+
+	// Replies for other nicks are ignored.
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 311 test user2 ident2 host2.com * :Other"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 311 test user1 ident1 host1.com * :User One"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 319 test user1 :@#test1 #test2"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 319 test user1 :+#test3"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 312 test user1 irc.server.org :Test Server"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 378 test user1 :is connecting from *@real.host.com 192.0.2.1"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 671 test user1 :is using a secure connection"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 330 test user1 acct1 :is logged in as"))
+	idle := ParseLine(":irc.server.org 317 test user1 120 1500000000 :seconds idle, signon time")
+	idle.Time = time.Unix(1500000600, 0)
+	c.h_WHOISREPLY(idle)
+	select {
+	case info := <-res1:
+		t.Fatalf("WHOIS result sent before 318: %#v", info)
+	default:
+	}
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 318 test user1 :End of /WHOIS list."))
+
+	exp := &WhoisInfo{Nick: "user1", Ident: "ident1", Host: "host1.com",
+		Name: "User One", Channels: []string{"@#test1", "#test2", "+#test3"},
+		Server: "irc.server.org", ServerInfo: "Test Server",
+		RealHost: "real.host.com", RealIP: "192.0.2.1",
+		Secure: true, Account: "acct1", IdleSince: time.Unix(1500000480, 0),
+		SignonTime: time.Unix(1500000000, 0)}
+	for i, res := range []<-chan *WhoisInfo{res1, res2} {
+		if info := <-res; !reflect.DeepEqual(info, exp) {
+			t.Errorf("waiter %d: expected %#v, got %#v", i, exp, info)
+		}
+		if _, ok := <-res; ok {
+			t.Errorf("waiter %d: channel not closed after result.", i)
+		}
+	}
+	c.whoisMu.Lock()
+	if len(c.whoisPending) != 0 || len(c.whoisRemovers) != 0 {
+		t.Errorf("WHOIS state not cleaned up: %v", c.whoisPending)
+	}
+	c.whoisMu.Unlock()
+
+	// Unknown nicks give an error.
+	res1, _ = c.RequestWhois(context.Background(), "nobody")
+	s.nc.Expect("WHOIS nobody")
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 401 test nobody :No such nick/channel"))
+	if info := <-res1; info.Err == nil {
+		t.Errorf("No error in result for unknown nick: %#v", info)
+	}
+
+	// Giving up on a WHOIS sends ctx.Err() to that waiter only.
+	ctx, cancel := context.WithCancel(context.Background())
+	res1, _ = c.RequestWhois(ctx, "user3")
+	s.nc.Expect("WHOIS user3")
+	res2, _ = c.RequestWhois(context.Background(), "user3")
+	cancel()
+	if info := <-res1; info.Err != context.Canceled {
+		t.Errorf("Cancelled WHOIS did not return context error: %#v", info)
+	}
+	if _, ok := <-res1; ok {
+		t.Errorf("Channel not closed after cancellation.")
+	}
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 318 test user3 :End of /WHOIS list."))
+	if info := <-res2; info.Err != nil {
+		t.Errorf("Cancelling one waiter affected another: %#v", info)
+	}
+
+	// Once nobody is waiting, the WHOIS is forgotten.
+	ctx, cancel = context.WithCancel(context.Background())
+	res1, _ = c.RequestWhois(ctx, "user4")
+	s.nc.Expect("WHOIS user4")
+	cancel()
+	<-res1
+	c.whoisMu.Lock()
+	if len(c.whoisPending) != 0 || len(c.whoisRemovers) != 0 {
+		t.Errorf("WHOIS state not cleaned up after cancellation: %v", c.whoisPending)
+	}
+	c.whoisMu.Unlock()
+
+	// Disconnecting fails any WHOIS still waiting for replies.
+	res1, _ = c.RequestWhois(context.Background(), "user5")
+	s.nc.Expect("WHOIS user5")
+	c.whoisFail(ErrDisconnected)
+	if info := <-res1; info.Err != ErrDisconnected {
+		t.Errorf("WHOIS did not fail on disconnect: %#v", info)
+	}
+	c.whoisMu.Lock()
+	if len(c.whoisPending) != 0 || len(c.whoisRemovers) != 0 {
+		t.Errorf("WHOIS state not cleaned up after disconnect: %v", c.whoisPending)
+	}
+	c.whoisMu.Unlock()
+}
+
+func TestWhoisIdle(t *testing.T) {
+	now := time.Unix(1500000600, 0)
+	tests := []struct {
+		in            string
+		since, signon time.Time
+	}{
+		{":irc.server.org 317 test user1 120 1500000000 :seconds idle, signon time",
+			time.Unix(1500000480, 0), time.Unix(1500000000, 0)},
+		// older servers don't send the signon time
+		{":irc.server.org 317 test user1 60 :seconds idle",
+			time.Unix(1500000540, 0), time.Time{}},
+		{":irc.server.org 317 test user1 lots 0 :seconds idle, signon time",
+			time.Time{}, time.Time{}},
+		{":irc.server.org 317 test user1 :seconds idle", time.Time{}, time.Time{}},
+	}
+	for i, test := range tests {
+		l := ParseLine(test.in)
+		l.Time = now
+		since, signon := whoisIdle(l)
+		if !since.Equal(test.since) || !signon.Equal(test.signon) {
+			t.Errorf("test %d: expected %s, %s; got %s, %s",
+				i, test.since, test.signon, since, signon)
+		}
+	}
+}
+
+func TestWhoisHost(t *testing.T) {
+	tests := []struct{ in, host, ip string }{
+		{":irc.server.org 378 test user1 :is connecting from *@real.host.com 192.0.2.1",
+			"real.host.com", "192.0.2.1"},
+		{":irc.server.org 378 test user1 :is connecting from ident@real.host.com [2001:db8::1]",
+			"real.host.com", "2001:db8::1"},
+		{":irc.server.org 378 test user1 :is connecting from real.host.com 192.0.2.1",
+			"real.host.com", "192.0.2.1"},
+		{":irc.server.org 378 test user1 :is connecting from *@192.0.2.1",
+			"192.0.2.1", "192.0.2.1"},
+		{":irc.server.org 378 test user1 :is using a cloaked host", "", ""},
+	}
+	for i, test := range tests {
+		host, ip := whoisHost(ParseLine(test.in))
+		if host != test.host || ip != test.ip {
+			t.Errorf("test %d: expected %q, %q; got %q, %q",
+				i, test.host, test.ip, host, ip)
+		}
+	}
+}
+
+func TestRequestWhoisMulti(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	if _, err := c.RequestWhoisMulti(context.Background(),
+		[]string{"user1", "#channel"}); err == nil {
+		t.Errorf("No error requesting WHOIS for a channel.")
+	}
+	s.nc.ExpectNothing()
+
+	// Nicks already being WHOISed aren't asked about again.
+	c.h_005(ParseLine(":irc.server.org 005 test TARGMAX=WHOIS:2 :are supported by this server"))
+	res1, _ := c.RequestWhois(context.Background(), "user2")
+	s.nc.Expect("WHOIS user2")
+	res, err := c.RequestWhoisMulti(context.Background(),
+		[]string{"user1", "user2", "user3", "user4"})
+	if err != nil {
+		t.Fatalf("Unexpected error from RequestWhoisMulti: %v", err)
+	}
+	s.nc.Expect("WHOIS user1,user3")
+	s.nc.Expect("WHOIS user4")
+
+	// Interleaved replies are matched up with each nick, and a 318 may end
+	// the WHOISes for several nicks at once.
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 311 test user1 ident1 host1.com * :User One"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 311 test user3 ident3 host3.com * :User Three"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 330 test user1 acct1 :is logged in as"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 401 test user4 :No such nick/channel"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 318 test user1,user3 :End of /WHOIS list."))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 311 test user2 ident2 host2.com * :User Two"))
+	c.h_WHOISREPLY(ParseLine(":irc.server.org 318 test user2 :End of /WHOIS list."))
+
+	got := map[string]*WhoisInfo{}
+	for info := range res {
+		got[info.Nick] = info
+	}
+	if len(got) != 4 {
+		t.Fatalf("Expected 4 WHOIS results, got %d: %v", len(got), got)
+	}
+	if info := got["user1"]; info.Ident != "ident1" || info.Account != "acct1" || info.Err != nil {
+		t.Errorf("Wrong result for user1: %#v", info)
+	}
+	if info := got["user2"]; info.Ident != "ident2" || info.Err != nil {
+		t.Errorf("Wrong result for user2: %#v", info)
+	}
+	if info := got["user3"]; info.Ident != "ident3" || info.Account != "" || info.Err != nil {
+		t.Errorf("Wrong result for user3: %#v", info)
+	}
+	if info := got["user4"]; info.Err == nil {
+		t.Errorf("No error in result for unknown nick: %#v", info)
+	}
+	if info := <-res1; info.Ident != "ident2" {
+		t.Errorf("Wrong result for shared WHOIS: %#v", info)
+	}
+	c.whoisMu.Lock()
+	if len(c.whoisPending) != 0 || len(c.whoisRemovers) != 0 {
+		t.Errorf("WHOIS state not cleaned up: %v", c.whoisPending)
+	}
+	c.whoisMu.Unlock()
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The WHOX fields a 354 RPL_WHOSPCRPL reply can contain, in the order the
+// server sends them regardless of the order they were requested in.
+const whoxFieldOrder = "tcuihsnfdlaor"
+
+// WhoXReply is one 354 RPL_WHOSPCRPL reply to a WHOX sent by WhoX. Only
+// the fields that were requested are set.
+type WhoXReply struct {
+	// c, u, i, h, s, n: the channel the reply is for, or "*" if none,
+	// and the ident, IP, host, server and nick of the user.
+	Channel, Ident, IP, Host, Server, Nick string
+
+	// f: flags, e.g. "H@" for a nick that's here and opped on Channel.
+	Flags string
+
+	// d, l: hop count and idle time in seconds.
+	Hops, Idle int
+
+	// a: services account name, or "" if the user isn't logged in.
+	Account string
+
+	// o: channel op level, r: real name.
+	OpLevel, Name string
+}
+
+// WhoXResult is the result of a WHOX made with WhoX.
+type WhoXResult struct {
+	Replies []WhoXReply
+
+	// Err is set to ctx.Err() if the context passed to WhoX was done
+	// before the server finished replying, or to ErrDisconnected if the
+	// connection closed first. Replies holds any that arrived before then.
+	Err error
+}
+
+// whoxReq is a WHOX sent by WhoX that's waiting for replies.
+// done is closed once it's finished.
+type whoxReq struct {
+	fields  string
+	replies []WhoXReply
+	result  chan WhoXResult
+	done    chan struct{}
+}
+
+// WhoX sends a WHOX for mask requesting the given fields, e.g. "%nuhaf",
+// and returns a channel that receives the parsed 354 replies once the
+// server has sent 315 RPL_ENDOFWHO, or once ctx is done. The channel is
+// closed after the result is sent. A token is added to the fields to
+// correlate replies with the request. It returns an error without sending
+// anything if the server doesn't advertise WHOX in ISUPPORT.
+//     WHO mask %fields,token
+func (conn *Conn) WhoX(ctx context.Context, mask, fields string) (<-chan WhoXResult, error) {
+	if _, ok := conn.Supports("WHOX"); !ok {
+		return nil, fmt.Errorf("irc.WhoX(): server does not support WHOX")
+	}
+	fields = strings.TrimPrefix(fields, "%")
+	if mask == "" || fields == "" || strings.ContainsAny(fields, ", ") {
+		return nil, fmt.Errorf("irc.WhoX(): bad mask %q or fields %q",
+			mask, fields)
+	}
+	if !strings.Contains(fields, "t") {
+		fields += "t"
+	}
+	req := &whoxReq{fields: fields, result: make(chan WhoXResult, 1),
+		done: make(chan struct{})}
+	conn.whoxMu.Lock()
+	if len(conn.whoxPending) >= 1000 {
+		conn.whoxMu.Unlock()
+		return nil, fmt.Errorf("irc.WhoX(): too many WHOX requests pending")
+	}
+	if len(conn.whoxPending) == 0 {
+		conn.whoxRemovers = append(conn.whoxRemovers,
+			conn.handle("354", HandlerFunc((*Conn).h_WHOXREPLY)))
+	}
+	// Tokens are at most three digits.
+	var token string
+	for {
+		conn.whoxToken = (conn.whoxToken + 1) % 1000
+		token = strconv.Itoa(conn.whoxToken)
+		if _, ok := conn.whoxPending[token]; !ok {
+			break
+		}
+	}
+	conn.whoxPending[token] = req
+	conn.whoxMu.Unlock()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.whoxMu.Lock()
+				if conn.whoxPending[token] == req {
+					conn.whoxDone(token, ctx.Err())
+				}
+				conn.whoxMu.Unlock()
+			case <-req.done:
+			}
+		}()
+	}
+	conn.Raw(WHO + " " + mask + " %" + fields + "," + token)
+	return req.result, nil
+}
+
+// parseWhoX maps the arguments of a 354 reply after our nick onto the
+// requested fields. The token has already been checked and is skipped.
+func parseWhoX(fields string, args []string) WhoXReply {
+	var r WhoXReply
+	for _, f := range whoxFieldOrder {
+		if f == 't' || !strings.ContainsRune(fields, f) {
+			continue
+		}
+		if len(args) == 0 {
+			break
+		}
+		v := args[0]
+		args = args[1:]
+		switch f {
+		case 'c':
+			r.Channel = v
+		case 'u':
+			r.Ident = v
+		case 'i':
+			r.IP = v
+		case 'h':
+			r.Host = v
+		case 's':
+			r.Server = v
+		case 'n':
+			r.Nick = v
+		case 'f':
+			r.Flags = v
+		case 'd':
+			r.Hops, _ = strconv.Atoi(v)
+		case 'l':
+			r.Idle, _ = strconv.Atoi(v)
+		case 'a':
+			if v != "0" {
+				r.Account = v
+			}
+		case 'o':
+			r.OpLevel = v
+		case 'r':
+			r.Name = v
+		}
+	}
+	return r
+}
+
+// whoxDone sends the replies to the WHOX with the given token, and err,
+// and forgets it, removing the handler collecting replies if no other
+// WHOXes are pending. conn.whoxMu must be held.
+func (conn *Conn) whoxDone(token string, err error) {
+	req := conn.whoxPending[token]
+	req.result <- WhoXResult{Replies: req.replies, Err: err}
+	close(req.result)
+	close(req.done)
+	delete(conn.whoxPending, token)
+	if len(conn.whoxPending) == 0 {
+		for _, r := range conn.whoxRemovers {
+			r.Remove()
+		}
+		conn.whoxRemovers = nil
+	}
+}
+
+// whoxFail ends every pending WHOX with err, e.g. because we've been
+// disconnected.
+func (conn *Conn) whoxFail(err error) {
+	conn.whoxMu.Lock()
+	defer conn.whoxMu.Unlock()
+	for t := range conn.whoxPending {
+		conn.whoxDone(t, err)
+	}
+}
+
+// whoSent records the mask and any WHOX token of a WHO we're sending to
+// the server, so h_315 can tell which WHO each 315 RPL_ENDOFWHO ends. It's
+// called for every line before it's written, since the reply could
+// otherwise be handled first.
+//   WHO mask %fields,token
+func (conn *Conn) whoSent(line string) {
+	f := strings.Fields(line)
+	if len(f) < 2 || !strings.EqualFold(f[0], WHO) {
+		return
+	}
+	token := ""
+	if len(f) > 2 && strings.HasPrefix(f[2], "%") {
+		if i := strings.LastIndex(f[2], ","); i != -1 {
+			token = f[2][i+1:]
+		}
+	}
+	k := conn.Casefold(f[1])
+	conn.whoxMu.Lock()
+	defer conn.whoxMu.Unlock()
+	conn.whoxSent[k] = append(conn.whoxSent[k], token)
+}
+
+// Handler to collect 354 replies to WHOXes sent by WhoX, by token. It is
+// only registered while they are waiting for replies.
+//   :server 354 me token #channel ident host nick :real name
+func (conn *Conn) h_WHOXREPLY(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	conn.whoxMu.Lock()
+	defer conn.whoxMu.Unlock()
+	if req, ok := conn.whoxPending[line.Args[1]]; ok {
+		req.replies = append(req.replies, parseWhoX(req.fields, line.Args[2:]))
+	}
+}
+
+// Handler for 315 RPL_ENDOFWHO, which ends a WHOX sent by WhoX. 315 doesn't
+// carry the WHOX token, but servers answer WHOs in the order they're sent,
+// so it ends the oldest WHO for the mask, which is only a WhoX if that WHO
+// had its token. WHOs sent by the state tracker or with Raw don't end a
+// WhoX for the same mask.
+//   :server 315 me mask :End of /WHO list.
+func (conn *Conn) h_315(line *Line) {
+	if !line.argslen(1) {
+		return
+	}
+	k := conn.Casefold(line.Args[1])
+	conn.whoxMu.Lock()
+	defer conn.whoxMu.Unlock()
+	sent := conn.whoxSent[k]
+	if len(sent) == 0 {
+		return
+	}
+	if len(sent) == 1 {
+		delete(conn.whoxSent, k)
+	} else {
+		conn.whoxSent[k] = sent[1:]
+	}
+	if _, ok := conn.whoxPending[sent[0]]; ok && sent[0] != "" {
+		conn.whoxDone(sent[0], nil)
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWhoX(t *testing.T) {
+	c, s := setUp(t)
+	defer s.tearDown()
+
+	ctx := context.Background()
+	if _, err := c.WhoX(ctx, "#test1", "%nuh"); err == nil {
+		t.Errorf("No error sending WHOX without server support.")
+	}
+	s.nc.ExpectNothing()
+
+	c.h_005(ParseLine(":irc.server.org 005 test WHOX :are supported by this server"))
+	if _, err := c.WhoX(ctx, "#test1", "%nu,h"); err == nil {
+		t.Errorf("No error sending WHOX with bad fields.")
+	}
+	s.nc.ExpectNothing()
+
+	// A plain WHO for the same mask, e.g. from the state tracker, is sent
+	// first, and its 315 mustn't end the WHOXes.
+	c.Raw("WHO #test1")
+	s.nc.Expect("WHO #test1")
+	res1, err := c.WhoX(ctx, "#test1", "%nuhaf")
+	if err != nil {
+		t.Fatalf("Unexpected error from WhoX: %v", err)
+	}
+	s.nc.Expect("WHO #test1 %nuhaft,1")
+	res2, _ := c.WhoX(ctx, "#TEST1", "nr")
+	s.nc.Expect("WHO #TEST1 %nrt,2")
+
+	// Fields arrive in the server's order, not the order requested.
+	c.h_WHOXREPLY(ParseLine(":irc.server.org 354 test 1 ident1 host1.com user1 H@ acct1"))
+	c.h_WHOXREPLY(ParseLine(":irc.server.org 354 test 2 user1 :User One"))
+	c.h_WHOXREPLY(ParseLine(":irc.server.org 354 test 1 ident2 host2.com user2 G 0"))
+	// Replies with unknown tokens are ignored.
+	c.h_WHOXREPLY(ParseLine(":irc.server.org 354 test 3 ident3 host3.com user3 H 0"))
+	c.h_315(ParseLine(":irc.server.org 315 test #test1 :End of /WHO list."))
+	select {
+	case r := <-res1:
+		t.Fatalf("WHOX ended by the 315 for a plain WHO: %#v", r)
+	default:
+	}
+
+	// Each 315 then ends the WHOXes in the order they were sent.
+	c.h_315(ParseLine(":irc.server.org 315 test #test1 :End of /WHO list."))
+	exp := WhoXResult{Replies: []WhoXReply{
+		{Ident: "ident1", Host: "host1.com", Nick: "user1", Flags: "H@", Account: "acct1"},
+		{Ident: "ident2", Host: "host2.com", Nick: "user2", Flags: "G"},
+	}}
+	if r := <-res1; !reflect.DeepEqual(r, exp) {
+		t.Errorf("Expected %#v, got %#v", exp, r)
+	}
+	if _, ok := <-res1; ok {
+		t.Errorf("Channel not closed after result.")
+	}
+	select {
+	case r := <-res2:
+		t.Fatalf("Second WHOX ended by first 315: %#v", r)
+	default:
+	}
+	c.h_315(ParseLine(":irc.server.org 315 test #test1 :End of /WHO list."))
+	exp = WhoXResult{Replies: []WhoXReply{{Nick: "user1", Name: "User One"}}}
+	if r := <-res2; !reflect.DeepEqual(r, exp) {
+		t.Errorf("Expected %#v, got %#v", exp, r)
+	}
+
+	// WHOXes end early with an error when ctx is done.
+	cctx, cancel := context.WithCancel(ctx)
+	res1, _ = c.WhoX(cctx, "#test2", "n")
+	s.nc.Expect("WHO #test2 %nt,3")
+	cancel()
+	select {
+	case r := <-res1:
+		if r.Err != context.Canceled {
+			t.Errorf("Bad result for cancelled WHOX: %#v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Cancelled WHOX not ended.")
+	}
+	// Its 315 is still expected, and doesn't end a later WHOX.
+	res2, _ = c.WhoX(ctx, "#test2", "n")
+	s.nc.Expect("WHO #test2 %nt,4")
+	c.h_315(ParseLine(":irc.server.org 315 test #test2 :End of /WHO list."))
+	select {
+	case r := <-res2:
+		t.Fatalf("WHOX ended by the 315 for a cancelled one: %#v", r)
+	default:
+	}
+
+	// And when we're disconnected.
+	c.whoxFail(ErrDisconnected)
+	if r := <-res2; r.Err != ErrDisconnected {
+		t.Errorf("Bad result after disconnection: %#v", r)
+	}
+
+	c.whoxMu.Lock()
+	if len(c.whoxPending) != 0 || len(c.whoxRemovers) != 0 {
+		t.Errorf("WHOX state not cleaned up: %v", c.whoxPending)
+	}
+	c.whoxMu.Unlock()
+}
@@ -5,6 +5,7 @@ import (
 
 	"reflect"
 	"strconv"
+	"time"
 )
 
 // A Channel is returned from the state tracker and contains
@@ -13,14 +14,49 @@ type Channel struct {
 	Name, Topic string
 	Modes       *ChanMode
 	Nicks       map[string]*ChanPrivs
+	// The channel's website, from 328 RPL_CHANNEL_URL, if the server sent it.
+	URL string
+	// When the channel was created, from 329 RPL_CREATIONTIME, and when
+	// its modes were last changed by a MODE. Zero if unknown.
+	Created, ModesChanged time.Time
+	// Who set the topic and when, from 333 RPL_TOPICWHOTIME or the TOPIC
+	// that changed it. TopicSetBy is just the nick, even if the server sent
+	// a full nick!ident@host.
+	TopicSetBy string
+	TopicTime  time.Time
+	events     []Event
+	ops        int
 }
 
 // Internal bookkeeping struct for channels.
 type channel struct {
-	name, topic string
-	modes       *ChanMode
-	lookup      map[string]*nick
-	nicks       map[*nick]*ChanPrivs
+	name, topic, url      string
+	modes                 *ChanMode
+	lookup                map[string]*nick
+	nicks                 map[*nick]*ChanPrivs
+	created, modesChanged time.Time
+	topicSetBy            string
+	topicTime             time.Time
+	events                []Event
+	ops                   int    // nicks with Op, kept in step with nicks
+	used                  uint64 // when last used, for eviction
+	// Normalizes nicks for the lookup map, set by the tracker.
+	normalize func(string) string
+}
+
+// An Event records something a nick did on a channel, e.g. a KICK or
+// MODE change. Recent events are kept for each channel if the tracker
+// has been told to with SetEventHistory.
+type Event struct {
+	Time time.Time
+	// JOIN, PART, KICK, MODE or NICK
+	Cmd string
+	// The nick responsible for the event.
+	Nick string
+	// The event's arguments without the channel, e.g. the kicked nick and
+	// reason for a KICK, the mode string and args for a MODE, or the new
+	// nick for a NICK.
+	Args []string
 }
 
 // A struct representing the modes of an IRC Channel
@@ -47,6 +83,10 @@ type ChanMode struct {
 type ChanPrivs struct {
 	// MODE +q, +a, +o, +h, +v
 	Owner, Admin, Op, HalfOp, Voice bool
+
+	// When the nick last sent a message to the channel, if the tracker
+	// has been told with NickActive. Zero if unknown.
+	LastActive time.Time
 }
 
 // Map ChanMode fields to IRC mode characters
@@ -117,14 +157,24 @@ func newChannel(name string) *channel {
 // Relies on tracker-level locking for concurrent access.
 func (ch *channel) Channel() *Channel {
 	c := &Channel{
-		Name:  ch.name,
-		Topic: ch.topic,
-		Modes: ch.modes.Copy(),
-		Nicks: make(map[string]*ChanPrivs),
+		Name:         ch.name,
+		Topic:        ch.topic,
+		URL:          ch.url,
+		Modes:        ch.modes.Copy(),
+		Nicks:        make(map[string]*ChanPrivs),
+		Created:      ch.created,
+		ModesChanged: ch.modesChanged,
+		TopicSetBy:   ch.topicSetBy,
+		TopicTime:    ch.topicTime,
+		ops:          ch.ops,
 	}
 	for n, cp := range ch.nicks {
 		c.Nicks[n.nick] = cp.Copy()
 	}
+	if len(ch.events) > 0 {
+		c.events = make([]Event, len(ch.events))
+		copy(c.events, ch.events)
+	}
 	return c
 }
 
@@ -133,11 +183,19 @@ func (ch *channel) isOn(nk *nick) (*ChanPrivs, bool) {
 	return cp.Copy(), ok
 }
 
+// Returns the key a nick is stored under in the lookup map.
+func (ch *channel) key(n string) string {
+	return normalize(ch.normalize, n)
+}
+
 // Associates a Nick with a Channel
 func (ch *channel) addNick(nk *nick, cp *ChanPrivs) {
 	if _, ok := ch.nicks[nk]; !ok {
 		ch.nicks[nk] = cp
-		ch.lookup[nk.nick] = nk
+		ch.lookup[ch.key(nk.nick)] = nk
+		if cp.Op {
+			ch.ops++
+		}
 	} else {
 		logging.Warn("Channel.addNick(): %s already on %s.", nk.nick, ch.name)
 	}
@@ -145,92 +203,105 @@ func (ch *channel) addNick(nk *nick, cp *ChanPrivs) {
 
 // Disassociates a Nick from a Channel.
 func (ch *channel) delNick(nk *nick) {
-	if _, ok := ch.nicks[nk]; ok {
+	if cp, ok := ch.nicks[nk]; ok {
+		if cp.Op {
+			ch.ops--
+		}
 		delete(ch.nicks, nk)
-		delete(ch.lookup, nk.nick)
+		delete(ch.lookup, ch.key(nk.nick))
 	} else {
 		logging.Warn("Channel.delNick(): %s not on %s.", nk.nick, ch.name)
 	}
 }
 
+// Records an event for the channel, discarding the oldest
+// if there are more than max.
+func (ch *channel) addEvent(ev Event, max int) {
+	ch.events = append(ch.events, ev)
+	ch.trimEvents(max)
+}
+
+// Discards the oldest events for the channel if there are more than max.
+func (ch *channel) trimEvents(max int) {
+	if over := len(ch.events) - max; over > 0 {
+		ch.events = append(ch.events[:0], ch.events[over:]...)
+	}
+}
+
 // Parses mode strings for a channel.
 func (ch *channel) parseModes(modes string, modeargs ...string) {
-	var modeop bool // true => add mode, false => remove mode
-	var modestr string
-	for i := 0; i < len(modes); i++ {
-		switch m := modes[i]; m {
-		case '+':
-			modeop = true
-			modestr = string(m)
-		case '-':
-			modeop = false
-			modestr = string(m)
+	for _, op := range ParseModeChange(modes, modeargs, nil) {
+		// servers may send -k without the old key, which is fine
+		if op.Arg == "" && DefaultModeTypes.TakesArg(op.Mode, op.Add) &&
+			(op.Add || op.Mode != 'k') {
+			logging.Warn("Channel.ParseModes(): not enough arguments to "+
+				"process MODE %s %s", ch.name, op)
+			continue
+		}
+		switch op.Mode {
 		case 'i':
-			ch.modes.InviteOnly = modeop
+			ch.modes.InviteOnly = op.Add
 		case 'm':
-			ch.modes.Moderated = modeop
+			ch.modes.Moderated = op.Add
 		case 'n':
-			ch.modes.NoExternalMsg = modeop
+			ch.modes.NoExternalMsg = op.Add
 		case 'p':
-			ch.modes.Private = modeop
+			ch.modes.Private = op.Add
 		case 'r':
-			ch.modes.Registered = modeop
+			ch.modes.Registered = op.Add
 		case 's':
-			ch.modes.Secret = modeop
+			ch.modes.Secret = op.Add
 		case 't':
-			ch.modes.ProtectedTopic = modeop
+			ch.modes.ProtectedTopic = op.Add
 		case 'z':
-			ch.modes.SSLOnly = modeop
+			ch.modes.SSLOnly = op.Add
 		case 'Z':
-			ch.modes.AllSSL = modeop
+			ch.modes.AllSSL = op.Add
 		case 'O':
-			ch.modes.OperOnly = modeop
+			ch.modes.OperOnly = op.Add
 		case 'k':
-			if modeop && len(modeargs) != 0 {
-				ch.modes.Key, modeargs = modeargs[0], modeargs[1:]
-			} else if !modeop {
-				ch.modes.Key = ""
+			if op.Add {
+				ch.modes.Key = op.Arg
 			} else {
-				logging.Warn("Channel.ParseModes(): not enough arguments to "+
-					"process MODE %s %s%c", ch.name, modestr, m)
+				ch.modes.Key = ""
 			}
 		case 'l':
-			if modeop && len(modeargs) != 0 {
-				ch.modes.Limit, _ = strconv.Atoi(modeargs[0])
-				modeargs = modeargs[1:]
-			} else if !modeop {
-				ch.modes.Limit = 0
+			if op.Add {
+				ch.modes.Limit, _ = strconv.Atoi(op.Arg)
 			} else {
-				logging.Warn("Channel.ParseModes(): not enough arguments to "+
-					"process MODE %s %s%c", ch.name, modestr, m)
+				ch.modes.Limit = 0
 			}
+		case 'b', 'e', 'I':
+			// list modes aren't tracked, but their argument is consumed
 		case 'q', 'a', 'o', 'h', 'v':
-			if len(modeargs) != 0 {
-				if nk, ok := ch.lookup[modeargs[0]]; ok {
-					cp := ch.nicks[nk]
-					switch m {
-					case 'q':
-						cp.Owner = modeop
-					case 'a':
-						cp.Admin = modeop
-					case 'o':
-						cp.Op = modeop
-					case 'h':
-						cp.HalfOp = modeop
-					case 'v':
-						cp.Voice = modeop
+			nk, ok := ch.lookup[ch.key(op.Arg)]
+			if !ok {
+				logging.Warn("Channel.ParseModes(): untracked nick %s "+
+					"received MODE on channel %s", op.Arg, ch.name)
+				continue
+			}
+			cp := ch.nicks[nk]
+			switch op.Mode {
+			case 'q':
+				cp.Owner = op.Add
+			case 'a':
+				cp.Admin = op.Add
+			case 'o':
+				if cp.Op != op.Add {
+					if op.Add {
+						ch.ops++
+					} else {
+						ch.ops--
 					}
-					modeargs = modeargs[1:]
-				} else {
-					logging.Warn("Channel.ParseModes(): untracked nick %s "+
-						"received MODE on channel %s", modeargs[0], ch.name)
 				}
-			} else {
-				logging.Warn("Channel.ParseModes(): not enough arguments to "+
-					"process MODE %s %s%c", ch.name, modestr, m)
+				cp.Op = op.Add
+			case 'h':
+				cp.HalfOp = op.Add
+			case 'v':
+				cp.Voice = op.Add
 			}
 		default:
-			logging.Info("Channel.ParseModes(): unknown mode char %c", m)
+			logging.Info("Channel.ParseModes(): unknown mode char %c", op.Mode)
 		}
 	}
 }
@@ -241,6 +312,36 @@ func (ch *Channel) IsOn(nk string) (*ChanPrivs, bool) {
 	return cp, ok
 }
 
+// Returns the number of nicks on the channel.
+func (ch *Channel) UserCount() int {
+	return len(ch.Nicks)
+}
+
+// Returns the number of nicks with operator privileges (+o) on the
+// channel. This is counted by the tracker as privileges change, so
+// doesn't require iterating over Nicks.
+func (ch *Channel) OpCount() int {
+	return ch.ops
+}
+
+// Returns up to n of the most recent events recorded for the
+// channel, oldest first. If n <= 0, all recorded events are returned.
+func (ch *Channel) RecentEvents(n int) []Event {
+	if n <= 0 || n > len(ch.events) {
+		n = len(ch.events)
+	}
+	evs := make([]Event, n)
+	copy(evs, ch.events[len(ch.events)-n:])
+	return evs
+}
+
+// Returns true if the channel's modes were last changed before t, e.g. to
+// avoid undoing a mode change made after a decision to change modes. This
+// is also true if the time of the last change is unknown.
+func (ch *Channel) ModesSetBefore(t time.Time) bool {
+	return ch.ModesChanged.Before(t)
+}
+
 // Test Channel equality.
 func (ch *Channel) Equals(other *Channel) bool {
 	return reflect.DeepEqual(ch, other)
@@ -270,6 +371,39 @@ func (cp *ChanPrivs) Equals(other *ChanPrivs) bool {
 	return reflect.DeepEqual(cp, other)
 }
 
+// Returns true if any of the privilege mode characters in modes
+// (e.g. "qao") are set in the ChanPrivs.
+func (cp *ChanPrivs) HasAny(modes string) bool {
+	if cp == nil {
+		return false
+	}
+	for i := 0; i < len(modes); i++ {
+		switch modes[i] {
+		case 'q':
+			if cp.Owner {
+				return true
+			}
+		case 'a':
+			if cp.Admin {
+				return true
+			}
+		case 'o':
+			if cp.Op {
+				return true
+			}
+		case 'h':
+			if cp.HalfOp {
+				return true
+			}
+		case 'v':
+			if cp.Voice {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Returns a string representing the channel. Looks like:
 //	Channel: <channel name> e.g. #moo
 //	Topic: <channel topic> e.g. Discussing the merits of cows!
@@ -173,4 +173,57 @@ func TestChannelParseModes(t *testing.T) {
 		// NOTE: HalfOp not actually unset above thanks to deliberate error.
 		t.Errorf("Channel privileges not flipped correctly by ParseModes (2).")
 	}
+
+	// List modes and -k consume arguments meant for them
+	ch.parseModes("+b-k+o-v", "*!*@host", "foobar", "test1", "test1")
+
+	compareChannel(t, ch)
+	if md.Key != "" {
+		t.Errorf("Key not unset correctly by ParseModes (3).")
+	}
+	if !cp.Op || cp.Voice {
+		t.Errorf("Channel privileges not flipped correctly by ParseModes (3).")
+	}
+}
+
+func TestChanPrivsHasAny(t *testing.T) {
+	cp := &ChanPrivs{Op: true, Voice: true}
+	if !cp.HasAny("qao") || !cp.HasAny("v") {
+		t.Errorf("HasAny did not find privileges that are set.")
+	}
+	if cp.HasAny("qah") || cp.HasAny("") {
+		t.Errorf("HasAny found privileges that are not set.")
+	}
+	if (*ChanPrivs)(nil).HasAny("o") {
+		t.Errorf("HasAny found privileges in nil ChanPrivs.")
+	}
+}
+
+func TestChannelCounts(t *testing.T) {
+	ch := newChannel("#test1")
+	nk1, nk2, nk3 := newNick("test1"), newNick("test2"), newNick("test3")
+	ch.addNick(nk1, new(ChanPrivs))
+	ch.addNick(nk2, &ChanPrivs{Op: true})
+	ch.addNick(nk3, new(ChanPrivs))
+	check := func(users, ops int) {
+		c := ch.Channel()
+		if c.UserCount() != users || c.OpCount() != ops {
+			t.Errorf("Expected %d users and %d ops, got %d and %d.",
+				users, ops, c.UserCount(), c.OpCount())
+		}
+	}
+	check(3, 1)
+
+	// Opping someone twice only counts once, as does deopping.
+	ch.parseModes("+oo-o", "test1", "test1", "test3")
+	check(3, 2)
+	ch.parseModes("+v-o", "test1", "test2")
+	check(3, 1)
+
+	// Ops leaving are no longer counted.
+	ch.delNick(nk1)
+	check(2, 0)
+	ch.parseModes("+o", "test3")
+	ch.delNick(nk2)
+	check(1, 1)
 }
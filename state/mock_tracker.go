@@ -5,6 +5,7 @@ package state
 
 import (
 	gomock "github.com/golang/mock/gomock"
+	time "time"
 )
 
 // Mock of Tracker interface
@@ -88,6 +89,36 @@ func (_mr *_MockTrackerRecorder) NickModes(arg0, arg1 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "NickModes", arg0, arg1)
 }
 
+func (_m *MockTracker) NickAway(arg0 string, arg1 bool, arg2 string) *Nick {
+	ret := _m.ctrl.Call(_m, "NickAway", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*Nick)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) NickAway(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NickAway", arg0, arg1, arg2)
+}
+
+func (_m *MockTracker) NickAccount(arg0 string, arg1 string) *Nick {
+	ret := _m.ctrl.Call(_m, "NickAccount", arg0, arg1)
+	ret0, _ := ret[0].(*Nick)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) NickAccount(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NickAccount", arg0, arg1)
+}
+
+func (_m *MockTracker) NickVersion(arg0 string, arg1 string) *Nick {
+	ret := _m.ctrl.Call(_m, "NickVersion", arg0, arg1)
+	ret0, _ := ret[0].(*Nick)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) NickVersion(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NickVersion", arg0, arg1)
+}
+
 func (_m *MockTracker) NewChannel(channel string) *Channel {
 	ret := _m.ctrl.Call(_m, "NewChannel", channel)
 	ret0, _ := ret[0].(*Channel)
@@ -118,6 +149,16 @@ func (_mr *_MockTrackerRecorder) DelChannel(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DelChannel", arg0)
 }
 
+func (_m *MockTracker) RenameChannel(old string, neu string) *Channel {
+	ret := _m.ctrl.Call(_m, "RenameChannel", old, neu)
+	ret0, _ := ret[0].(*Channel)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) RenameChannel(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RenameChannel", arg0, arg1)
+}
+
 func (_m *MockTracker) Topic(channel string, topic string) *Channel {
 	ret := _m.ctrl.Call(_m, "Topic", channel, topic)
 	ret0, _ := ret[0].(*Channel)
@@ -128,6 +169,26 @@ func (_mr *_MockTrackerRecorder) Topic(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Topic", arg0, arg1)
 }
 
+func (_m *MockTracker) TopicInfo(channel string, setBy string, t time.Time) *Channel {
+	ret := _m.ctrl.Call(_m, "TopicInfo", channel, setBy, t)
+	ret0, _ := ret[0].(*Channel)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) TopicInfo(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TopicInfo", arg0, arg1, arg2)
+}
+
+func (_m *MockTracker) ChannelURL(channel string, url string) *Channel {
+	ret := _m.ctrl.Call(_m, "ChannelURL", channel, url)
+	ret0, _ := ret[0].(*Channel)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) ChannelURL(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ChannelURL", arg0, arg1)
+}
+
 func (_m *MockTracker) ChannelModes(channel string, modestr string, modeargs ...string) *Channel {
 	_s := []interface{}{channel, modestr}
 	for _, _x := range modeargs {
@@ -143,6 +204,36 @@ func (_mr *_MockTrackerRecorder) ChannelModes(arg0, arg1 interface{}, arg2 ...in
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "ChannelModes", _s...)
 }
 
+func (_m *MockTracker) RecordEvent(arg0 string, arg1 Event) *Channel {
+	ret := _m.ctrl.Call(_m, "RecordEvent", arg0, arg1)
+	ret0, _ := ret[0].(*Channel)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) RecordEvent(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RecordEvent", arg0, arg1)
+}
+
+func (_m *MockTracker) ChannelCreated(arg0 string, arg1 time.Time) *Channel {
+	ret := _m.ctrl.Call(_m, "ChannelCreated", arg0, arg1)
+	ret0, _ := ret[0].(*Channel)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) ChannelCreated(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ChannelCreated", arg0, arg1)
+}
+
+func (_m *MockTracker) ModesChanged(arg0 string, arg1 time.Time) *Channel {
+	ret := _m.ctrl.Call(_m, "ModesChanged", arg0, arg1)
+	ret0, _ := ret[0].(*Channel)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) ModesChanged(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ModesChanged", arg0, arg1)
+}
+
 func (_m *MockTracker) Me() *Nick {
 	ret := _m.ctrl.Call(_m, "Me")
 	ret0, _ := ret[0].(*Nick)
@@ -153,6 +244,16 @@ func (_mr *_MockTrackerRecorder) Me() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Me")
 }
 
+func (_m *MockTracker) RequestNick(nick string) *Nick {
+	ret := _m.ctrl.Call(_m, "RequestNick", nick)
+	ret0, _ := ret[0].(*Nick)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) RequestNick(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RequestNick", arg0)
+}
+
 func (_m *MockTracker) IsOn(channel string, nick string) (*ChanPrivs, bool) {
 	ret := _m.ctrl.Call(_m, "IsOn", channel, nick)
 	ret0, _ := ret[0].(*ChanPrivs)
@@ -174,6 +275,16 @@ func (_mr *_MockTrackerRecorder) Associate(arg0, arg1 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Associate", arg0, arg1)
 }
 
+func (_m *MockTracker) NickActive(channel string, nick string, t time.Time) *ChanPrivs {
+	ret := _m.ctrl.Call(_m, "NickActive", channel, nick, t)
+	ret0, _ := ret[0].(*ChanPrivs)
+	return ret0
+}
+
+func (_mr *_MockTrackerRecorder) NickActive(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NickActive", arg0, arg1, arg2)
+}
+
 func (_m *MockTracker) Dissociate(channel string, nick string) {
 	_m.ctrl.Call(_m, "Dissociate", channel, nick)
 }
@@ -190,6 +301,14 @@ func (_mr *_MockTrackerRecorder) Wipe() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Wipe")
 }
 
+func (_m *MockTracker) SetNormalizer(f func(string) string) {
+	_m.ctrl.Call(_m, "SetNormalizer", f)
+}
+
+func (_mr *_MockTrackerRecorder) SetNormalizer(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetNormalizer", arg0)
+}
+
 func (_m *MockTracker) String() string {
 	ret := _m.ctrl.Call(_m, "String")
 	ret0, _ := ret[0].(string)
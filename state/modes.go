@@ -0,0 +1,98 @@
+package state
+
+import "strings"
+
+// ModeTypes describes which channel modes take arguments, as advertised by
+// the server in the CHANMODES and PREFIX ISUPPORT tokens. Each string field
+// contains the mode characters of that type.
+type ModeTypes struct {
+	// Type A modes add or remove an entry from a list, e.g. +b,
+	// and always take an argument.
+	List string
+	// Type B modes always take an argument, e.g. +k.
+	Always string
+	// Type C modes only take an argument when set, e.g. +l.
+	OnSet string
+	// Type D modes never take an argument, e.g. +n.
+	Never string
+	// Prefix modes grant channel privileges to a nick, e.g. +o,
+	// from highest to lowest. Symbols are the matching NAMES prefixes.
+	Prefix, Symbols string
+}
+
+// DefaultModeTypes are used when the server does not advertise CHANMODES
+// or PREFIX. They match the modes the state tracker understands, and are
+// what it uses to parse channel mode changes.
+var DefaultModeTypes = ModeTypes{
+	List:    "beI",
+	Always:  "k",
+	OnSet:   "l",
+	Never:   "imnprstzOZ",
+	Prefix:  "qaohv",
+	Symbols: "~&@%+",
+}
+
+// ModeOp is a single mode change parsed from a MODE line.
+type ModeOp struct {
+	// Add is true for +mode and false for -mode.
+	Add bool
+	// Mode is the mode character.
+	Mode byte
+	// Arg is the argument consumed by the mode, if any.
+	Arg string
+}
+
+// String returns the mode op as it would appear in a MODE line,
+// e.g. "+o nick" or "-n".
+func (op ModeOp) String() string {
+	s := "-"
+	if op.Add {
+		s = "+"
+	}
+	s += string(op.Mode)
+	if op.Arg != "" {
+		s += " " + op.Arg
+	}
+	return s
+}
+
+// TakesArg returns true if mode m takes an argument when being added
+// (add is true) or removed (add is false).
+func (mt *ModeTypes) TakesArg(m byte, add bool) bool {
+	switch {
+	case strings.IndexByte(mt.List, m) != -1,
+		strings.IndexByte(mt.Always, m) != -1,
+		strings.IndexByte(mt.Prefix, m) != -1:
+		return true
+	case strings.IndexByte(mt.OnSet, m) != -1:
+		return add
+	}
+	return false
+}
+
+// ParseModeChange parses a mode string like "+ov-k" and its arguments into
+// a list of ModeOps, consuming arguments according to the mode types. If
+// modes is nil, DefaultModeTypes are used. Modes missing a required
+// argument are returned with an empty Arg.
+func ParseModeChange(spec string, args []string, modes *ModeTypes) []ModeOp {
+	if modes == nil {
+		modes = &DefaultModeTypes
+	}
+	var ops []ModeOp
+	add := true
+	for i := 0; i < len(spec); i++ {
+		switch m := spec[i]; m {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			op := ModeOp{Add: add, Mode: m}
+			if modes.TakesArg(m, add) && len(args) > 0 {
+				op.Arg, args = args[0], args[1:]
+			}
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
@@ -0,0 +1,48 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseModeChange(t *testing.T) {
+	tests := []struct {
+		spec string
+		args []string
+		out  []ModeOp
+	}{
+		{"+nt", nil, []ModeOp{{true, 'n', ""}, {true, 't', ""}}},
+		{"+o-v", []string{"a", "b"}, []ModeOp{{true, 'o', "a"}, {false, 'v', "b"}}},
+		{"+kl-l", []string{"key", "10"},
+			[]ModeOp{{true, 'k', "key"}, {true, 'l', "10"}, {false, 'l', ""}}},
+		{"-k+b", []string{"key", "*!*@host"},
+			[]ModeOp{{false, 'k', "key"}, {true, 'b', "*!*@host"}}},
+		// Missing arguments are left empty.
+		{"+ooo", []string{"a"}, []ModeOp{{true, 'o', "a"}, {true, 'o', ""}, {true, 'o', ""}}},
+		// No leading sign means add.
+		{"i", nil, []ModeOp{{true, 'i', ""}}},
+	}
+	for i, test := range tests {
+		out := ParseModeChange(test.spec, test.args, nil)
+		if !reflect.DeepEqual(test.out, out) {
+			t.Errorf("test %d: expected %v, got %v", i, test.out, out)
+		}
+	}
+
+	// Custom mode types should change how arguments are consumed.
+	mt := &ModeTypes{List: "b", Always: "k", OnSet: "lj", Never: "n", Prefix: "ov"}
+	out := ParseModeChange("+jbn", []string{"3:5", "mask"}, mt)
+	exp := []ModeOp{{true, 'j', "3:5"}, {true, 'b', "mask"}, {true, 'n', ""}}
+	if !reflect.DeepEqual(exp, out) {
+		t.Errorf("expected %v, got %v", exp, out)
+	}
+}
+
+func TestModeOpString(t *testing.T) {
+	if s := (ModeOp{true, 'o', "nick"}).String(); s != "+o nick" {
+		t.Errorf("Bad string for ModeOp: %q", s)
+	}
+	if s := (ModeOp{false, 'n', ""}).String(); s != "-n" {
+		t.Errorf("Bad string for ModeOp: %q", s)
+	}
+}
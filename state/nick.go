@@ -12,14 +12,31 @@ type Nick struct {
 	Nick, Ident, Host, Name string
 	Modes                   *NickMode
 	Channels                map[string]*ChanPrivs
+	Away                    bool
+	AwayMessage             string
+	// Account is the services account the nick is logged in to,
+	// if known, e.g. from a WHOIS.
+	Account string
+	// ClientVersion is the nick's reply to a CTCP VERSION, if it's sent one.
+	ClientVersion string
+	// RequestedNick is only set for the client's own nick, and holds
+	// the nick as last sent to the server, which may differ in case
+	// (or entirely) from the Nick the server actually gave us.
+	RequestedNick string
 }
 
 // Internal bookkeeping struct for nicks.
 type nick struct {
 	nick, ident, host, name string
 	modes                   *NickMode
+	away                    bool
+	awayMsg                 string
+	account                 string
+	version                 string
+	requested               string
 	lookup                  map[string]*channel
 	chans                   map[*channel]*ChanPrivs
+	used                    uint64 // when last used, for eviction
 }
 
 // A struct representing the modes of an IRC Nick (User Modes)
@@ -66,12 +83,17 @@ func newNick(n string) *nick {
 // Relies on tracker-level locking for concurrent access.
 func (nk *nick) Nick() *Nick {
 	n := &Nick{
-		Nick:     nk.nick,
-		Ident:    nk.ident,
-		Host:     nk.host,
-		Name:     nk.name,
-		Modes:    nk.modes.Copy(),
-		Channels: make(map[string]*ChanPrivs),
+		Nick:          nk.nick,
+		Ident:         nk.ident,
+		Host:          nk.host,
+		Name:          nk.name,
+		Modes:         nk.modes.Copy(),
+		Channels:      make(map[string]*ChanPrivs),
+		Away:          nk.away,
+		AwayMessage:   nk.awayMsg,
+		Account:       nk.account,
+		ClientVersion: nk.version,
+		RequestedNick: nk.requested,
 	}
 	for c, cp := range nk.chans {
 		n.Channels[c.name] = cp.Copy()
@@ -137,6 +159,12 @@ func (nk *Nick) IsOn(ch string) (*ChanPrivs, bool) {
 	return cp, ok
 }
 
+// Returns true if the Nick has the bot user mode set, e.g. because
+// WHO replies flagged it as a bot.
+func (nk *Nick) IsBot() bool {
+	return nk.Modes != nil && nk.Modes.Bot
+}
+
 // Tests Nick equality.
 func (nk *Nick) Equals(other *Nick) bool {
 	return reflect.DeepEqual(nk, other)
@@ -86,3 +86,14 @@ func TestNickParseModes(t *testing.T) {
 		t.Errorf("Modes not flipped correctly by ParseModes.")
 	}
 }
+
+func TestNickIsBot(t *testing.T) {
+	nk := newNick("test1")
+	if nk.Nick().IsBot() {
+		t.Errorf("New nick is a bot.")
+	}
+	nk.parseModes("+B")
+	if !nk.Nick().IsBot() {
+		t.Errorf("Nick with +B is not a bot.")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/lfkeitel/goirc/logging"
 
 	"sync"
+	"time"
 )
 
 // The state manager interface
@@ -15,19 +16,32 @@ type Tracker interface {
 	DelNick(nick string) *Nick
 	NickInfo(nick, ident, host, name string) *Nick
 	NickModes(nick, modestr string) *Nick
+	NickAway(nick string, away bool, message string) *Nick
+	NickAccount(nick, account string) *Nick
+	NickVersion(nick, version string) *Nick
 	// Channel methods
 	NewChannel(channel string) *Channel
 	GetChannel(channel string) *Channel
 	DelChannel(channel string) *Channel
+	RenameChannel(old, neu string) *Channel
 	Topic(channel, topic string) *Channel
+	TopicInfo(channel, setBy string, t time.Time) *Channel
+	ChannelURL(channel, url string) *Channel
 	ChannelModes(channel, modestr string, modeargs ...string) *Channel
+	RecordEvent(channel string, ev Event) *Channel
+	ChannelCreated(channel string, t time.Time) *Channel
+	ModesChanged(channel string, t time.Time) *Channel
 	// Information about ME!
 	Me() *Nick
+	RequestNick(nick string) *Nick
 	// And the tracking operations
 	IsOn(channel, nick string) (*ChanPrivs, bool)
 	Associate(channel, nick string) *ChanPrivs
+	NickActive(channel, nick string, t time.Time) *ChanPrivs
 	Dissociate(channel, nick string)
 	Wipe()
+	// How nick and channel names are normalized before they are compared
+	SetNormalizer(f func(string) string)
 	// The state tracker can output a debugging string
 	String() string
 }
@@ -42,6 +56,17 @@ type stateTracker struct {
 	// We need to keep state on who we are :-)
 	me *nick
 
+	// Number of recent events to keep per channel, if any.
+	history int
+
+	// Maximum number of nicks and channels to track, if limited,
+	// and a counter recording when each was last used.
+	maxNicks, maxChans int
+	clock              uint64
+
+	// Normalizes nicks and channels for use as map keys, if set.
+	normalize func(string) string
+
 	// And we need to protect against data races *cough*.
 	mu sync.Mutex
 }
@@ -55,18 +80,138 @@ func NewTracker(mynick string) *stateTracker {
 		nicks: make(map[string]*nick),
 	}
 	st.me = newNick(mynick)
-	st.nicks[mynick] = st.me
+	st.me.requested = mynick
+	st.nicks[st.key(mynick)] = st.me
 	return st
 }
 
+// Sets the number of recent events recorded with RecordEvent to keep for
+// each channel. By default no events are kept, as this costs memory.
+func (st *stateTracker) SetEventHistory(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.history = n
+	for _, ch := range st.chans {
+		ch.trimEvents(n)
+	}
+}
+
+// Limits the number of nicks and channels tracked, to bound memory use on
+// large networks. A limit of 0 means no limit. Once over the limit, the
+// least recently used nicks we don't share any channels with are forgotten,
+// as are the least recently used channels.
+func (st *stateTracker) SetLimits(nicks, chans int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.maxNicks, st.maxChans = nicks, chans
+	st.evictChannels()
+	st.evictNicks(nil)
+}
+
+// Sets a function to normalize nick and channel names with before they're
+// compared, e.g. to fold their case according to the server's CASEMAPPING.
+// By default names are compared exactly. Nicks and channels that are
+// already tracked are re-keyed, so this may be called again if the
+// normalization changes; names that collide after normalizing are lost.
+func (st *stateTracker) SetNormalizer(f func(string) string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.normalize = f
+	nicks, chans := st.nicks, st.chans
+	st.nicks = make(map[string]*nick, len(nicks))
+	st.chans = make(map[string]*channel, len(chans))
+	for _, nk := range nicks {
+		st.nicks[st.key(nk.nick)] = nk
+	}
+	for _, ch := range chans {
+		ch.normalize = f
+		ch.lookup = make(map[string]*nick, len(ch.nicks))
+		for nk, _ := range ch.nicks {
+			ch.lookup[ch.key(nk.nick)] = nk
+		}
+		st.chans[st.key(ch.name)] = ch
+	}
+}
+
+// Returns the key a nick or channel name is stored under.
+func (st *stateTracker) key(s string) string {
+	return normalize(st.normalize, s)
+}
+
+// normalize applies f to s, or returns s unchanged if f is nil.
+func normalize(f func(string) string, s string) string {
+	if f == nil {
+		return s
+	}
+	return f(s)
+}
+
+// Returns the next tick of the tracker's clock, for recording when nicks
+// and channels are used. st.mu lock must be held.
+func (st *stateTracker) tick() uint64 {
+	st.clock++
+	return st.clock
+}
+
+// Forgets the least recently used nicks not on any of our channels until
+// we're within the nick limit, apart from keep, which has just been created
+// and is probably about to be associated with a channel. st.mu lock must
+// be held.
+func (st *stateTracker) evictNicks(keep *nick) {
+	for st.maxNicks > 0 && len(st.nicks) > st.maxNicks {
+		var lru *nick
+		for _, nk := range st.nicks {
+			if nk != st.me && nk != keep && len(nk.chans) == 0 &&
+				(lru == nil || nk.used < lru.used) {
+				lru = nk
+			}
+		}
+		if lru == nil {
+			logging.Warn("Tracker.evictNicks(): tracking %d nicks, over the "+
+				"limit of %d, but we share channels with all of them.",
+				len(st.nicks), st.maxNicks)
+			return
+		}
+		logging.Warn("Tracker.evictNicks(): over the limit of %d nicks, "+
+			"forgetting %s.", st.maxNicks, lru.nick)
+		st.delNick(lru)
+	}
+}
+
+// Forgets the least recently used channels until we're within the channel
+// limit. st.mu lock must be held.
+func (st *stateTracker) evictChannels() {
+	for st.maxChans > 0 && len(st.chans) > st.maxChans {
+		var lru *channel
+		for _, ch := range st.chans {
+			if lru == nil || ch.used < lru.used {
+				lru = ch
+			}
+		}
+		logging.Warn("Tracker.evictChannels(): over the limit of %d "+
+			"channels, forgetting %s.", st.maxChans, lru.name)
+		st.delChannel(lru)
+	}
+}
+
 // ... and a method to wipe the state clean.
 func (st *stateTracker) Wipe() {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	// Deleting all the channels implicitly deletes every nick but me.
+	// Deleting all the channels implicitly deletes every nick we share
+	// a channel with, but not those we only know of from elsewhere.
 	for _, ch := range st.chans {
 		st.delChannel(ch)
 	}
+	for _, nk := range st.nicks {
+		if nk != st.me {
+			st.delNick(nk)
+		}
+	}
+	// Our user modes, away status and login don't survive a reconnection.
+	st.me.modes = new(NickMode)
+	st.me.away, st.me.awayMsg = false, ""
+	st.me.account = ""
 }
 
 /******************************************************************************\
@@ -82,19 +227,23 @@ func (st *stateTracker) NewNick(n string) *Nick {
 	}
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	if _, ok := st.nicks[n]; ok {
+	if _, ok := st.nicks[st.key(n)]; ok {
 		logging.Warn("Tracker.NewNick(): %s already tracked.", n)
 		return nil
 	}
-	st.nicks[n] = newNick(n)
-	return st.nicks[n].Nick()
+	nk := newNick(n)
+	nk.used = st.tick()
+	st.nicks[st.key(n)] = nk
+	st.evictNicks(nk)
+	return nk.Nick()
 }
 
 // Returns a nick for the nick n, if we're tracking it.
 func (st *stateTracker) GetNick(n string) *Nick {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	if nk, ok := st.nicks[n]; ok {
+	if nk, ok := st.nicks[st.key(n)]; ok {
+		nk.used = st.tick()
 		return nk.Nick()
 	}
 	return nil
@@ -105,25 +254,27 @@ func (st *stateTracker) GetNick(n string) *Nick {
 func (st *stateTracker) ReNick(old, neu string) *Nick {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	nk, ok := st.nicks[old]
+	nk, ok := st.nicks[st.key(old)]
 	if !ok {
 		logging.Warn("Tracker.ReNick(): %s not tracked.", old)
 		return nil
 	}
-	if _, ok := st.nicks[neu]; ok {
+	// Changing only the case of a nick is fine if the normalizer folds it.
+	if other, ok := st.nicks[st.key(neu)]; ok && other != nk {
 		logging.Warn("Tracker.ReNick(): %s already exists.", neu)
 		return nil
 	}
 
-	nk.nick = neu
-	delete(st.nicks, old)
-	st.nicks[neu] = nk
 	for ch, _ := range nk.chans {
 		// We also need to update the lookup maps of all the channels
 		// the nick is on, to keep things in sync.
-		delete(ch.lookup, old)
-		ch.lookup[neu] = nk
+		delete(ch.lookup, ch.key(nk.nick))
+		ch.lookup[ch.key(neu)] = nk
 	}
+	delete(st.nicks, st.key(old))
+	st.nicks[st.key(neu)] = nk
+	nk.nick = neu
+	nk.used = st.tick()
 	return nk.Nick()
 }
 
@@ -131,7 +282,7 @@ func (st *stateTracker) ReNick(old, neu string) *Nick {
 func (st *stateTracker) DelNick(n string) *Nick {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	if nk, ok := st.nicks[n]; ok {
+	if nk, ok := st.nicks[st.key(n)]; ok {
 		if nk == st.me {
 			logging.Warn("Tracker.DelNick(): won't delete myself.")
 			return nil
@@ -150,7 +301,7 @@ func (st *stateTracker) delNick(nk *nick) {
 		logging.Error("Tracker.DelNick(): TRYING TO DELETE ME :-(")
 		return
 	}
-	delete(st.nicks, nk.nick)
+	delete(st.nicks, st.key(nk.nick))
 	for ch, _ := range nk.chans {
 		nk.delChannel(ch)
 		ch.delNick(nk)
@@ -167,13 +318,14 @@ func (st *stateTracker) delNick(nk *nick) {
 func (st *stateTracker) NickInfo(n, ident, host, name string) *Nick {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	nk, ok := st.nicks[n]
+	nk, ok := st.nicks[st.key(n)]
 	if !ok {
 		return nil
 	}
 	nk.ident = ident
 	nk.host = host
 	nk.name = name
+	nk.used = st.tick()
 	return nk.Nick()
 }
 
@@ -181,11 +333,57 @@ func (st *stateTracker) NickInfo(n, ident, host, name string) *Nick {
 func (st *stateTracker) NickModes(n, modes string) *Nick {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	nk, ok := st.nicks[n]
+	nk, ok := st.nicks[st.key(n)]
 	if !ok {
 		return nil
 	}
 	nk.parseModes(modes)
+	nk.used = st.tick()
+	return nk.Nick()
+}
+
+// Sets whether the nick is away. An empty message leaves any known away
+// message alone if the nick is still away, since e.g. WHO replies only
+// tell us whether a nick is away and not why.
+func (st *stateTracker) NickAway(n string, away bool, message string) *Nick {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	nk, ok := st.nicks[st.key(n)]
+	if !ok {
+		return nil
+	}
+	nk.away = away
+	if !away || message != "" {
+		nk.awayMsg = message
+	}
+	nk.used = st.tick()
+	return nk.Nick()
+}
+
+// Sets the services account the nick is logged in to.
+// An empty account means the nick isn't logged in.
+func (st *stateTracker) NickAccount(n, account string) *Nick {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	nk, ok := st.nicks[st.key(n)]
+	if !ok {
+		return nil
+	}
+	nk.account = account
+	nk.used = st.tick()
+	return nk.Nick()
+}
+
+// Sets the client version the nick replied to a CTCP VERSION with.
+func (st *stateTracker) NickVersion(n, version string) *Nick {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	nk, ok := st.nicks[st.key(n)]
+	if !ok {
+		return nil
+	}
+	nk.version = version
+	nk.used = st.tick()
 	return nk.Nick()
 }
 
@@ -198,19 +396,24 @@ func (st *stateTracker) NewChannel(c string) *Channel {
 	}
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	if _, ok := st.chans[c]; ok {
+	if _, ok := st.chans[st.key(c)]; ok {
 		logging.Warn("Tracker.NewChannel(): %s already tracked.", c)
 		return nil
 	}
-	st.chans[c] = newChannel(c)
-	return st.chans[c].Channel()
+	ch := newChannel(c)
+	ch.normalize = st.normalize
+	ch.used = st.tick()
+	st.chans[st.key(c)] = ch
+	st.evictChannels()
+	return ch.Channel()
 }
 
 // Returns a Channel for the channel c, if we're tracking it.
 func (st *stateTracker) GetChannel(c string) *Channel {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	if ch, ok := st.chans[c]; ok {
+	if ch, ok := st.chans[st.key(c)]; ok {
+		ch.used = st.tick()
 		return ch.Channel()
 	}
 	return nil
@@ -220,7 +423,7 @@ func (st *stateTracker) GetChannel(c string) *Channel {
 func (st *stateTracker) DelChannel(c string) *Channel {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	if ch, ok := st.chans[c]; ok {
+	if ch, ok := st.chans[st.key(c)]; ok {
 		st.delChannel(ch)
 		return ch.Channel()
 	}
@@ -230,7 +433,7 @@ func (st *stateTracker) DelChannel(c string) *Channel {
 
 func (st *stateTracker) delChannel(ch *channel) {
 	// st.mu lock held by DelChannel or Wipe
-	delete(st.chans, ch.name)
+	delete(st.chans, st.key(ch.name))
 	for nk, _ := range ch.nicks {
 		ch.delNick(nk)
 		nk.delChannel(ch)
@@ -241,15 +444,70 @@ func (st *stateTracker) delChannel(ch *channel) {
 	}
 }
 
+// Signals to the tracker that a channel has been renamed by the server,
+// keeping its members and modes.
+func (st *stateTracker) RenameChannel(old, neu string) *Channel {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ch, ok := st.chans[st.key(old)]
+	if !ok {
+		logging.Warn("Tracker.RenameChannel(): %s not tracked.", old)
+		return nil
+	}
+	if other, ok := st.chans[st.key(neu)]; ok && other != ch {
+		logging.Warn("Tracker.RenameChannel(): %s already exists.", neu)
+		return nil
+	}
+
+	for nk, _ := range ch.nicks {
+		// We also need to update the lookup maps of all the nicks
+		// on the channel, to keep things in sync.
+		delete(nk.lookup, ch.name)
+		nk.lookup[neu] = ch
+	}
+	delete(st.chans, st.key(old))
+	st.chans[st.key(neu)] = ch
+	ch.name = neu
+	ch.used = st.tick()
+	return ch.Channel()
+}
+
 // Sets the topic of a channel.
 func (st *stateTracker) Topic(c, topic string) *Channel {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	ch, ok := st.chans[c]
+	ch, ok := st.chans[st.key(c)]
 	if !ok {
 		return nil
 	}
 	ch.topic = topic
+	ch.used = st.tick()
+	return ch.Channel()
+}
+
+// Records who set a channel's topic and when.
+func (st *stateTracker) TopicInfo(c, setBy string, t time.Time) *Channel {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ch, ok := st.chans[st.key(c)]
+	if !ok {
+		return nil
+	}
+	ch.topicSetBy, ch.topicTime = setBy, t
+	ch.used = st.tick()
+	return ch.Channel()
+}
+
+// Sets the website of a channel.
+func (st *stateTracker) ChannelURL(c, url string) *Channel {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ch, ok := st.chans[st.key(c)]
+	if !ok {
+		return nil
+	}
+	ch.url = url
+	ch.used = st.tick()
 	return ch.Channel()
 }
 
@@ -257,11 +515,53 @@ func (st *stateTracker) Topic(c, topic string) *Channel {
 func (st *stateTracker) ChannelModes(c, modes string, args ...string) *Channel {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	ch, ok := st.chans[c]
+	ch, ok := st.chans[st.key(c)]
 	if !ok {
 		return nil
 	}
 	ch.parseModes(modes, args...)
+	ch.used = st.tick()
+	return ch.Channel()
+}
+
+// Records an event for a channel, if the tracker is keeping event history.
+func (st *stateTracker) RecordEvent(c string, ev Event) *Channel {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ch, ok := st.chans[st.key(c)]
+	if !ok {
+		return nil
+	}
+	if st.history > 0 {
+		ch.addEvent(ev, st.history)
+	}
+	ch.used = st.tick()
+	return ch.Channel()
+}
+
+// Records when a channel was created, as reported by the server.
+func (st *stateTracker) ChannelCreated(c string, t time.Time) *Channel {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ch, ok := st.chans[st.key(c)]
+	if !ok {
+		return nil
+	}
+	ch.created = t
+	ch.used = st.tick()
+	return ch.Channel()
+}
+
+// Records when a channel's modes were last changed by a MODE.
+func (st *stateTracker) ModesChanged(c string, t time.Time) *Channel {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ch, ok := st.chans[st.key(c)]
+	if !ok {
+		return nil
+	}
+	ch.modesChanged = t
+	ch.used = st.tick()
 	return ch.Channel()
 }
 
@@ -273,13 +573,22 @@ func (st *stateTracker) Me() *Nick {
 	return st.me.Nick()
 }
 
+// Records the nick we last asked the server for, which is kept
+// separately from the nick the server actually acknowledges.
+func (st *stateTracker) RequestNick(n string) *Nick {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.me.requested = n
+	return st.me.Nick()
+}
+
 // Returns true if both the channel c and the nick n are tracked
 // and the nick is associated with the channel.
 func (st *stateTracker) IsOn(c, n string) (*ChanPrivs, bool) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	nk, nok := st.nicks[n]
-	ch, cok := st.chans[c]
+	nk, nok := st.nicks[st.key(n)]
+	ch, cok := st.chans[st.key(c)]
 	if nok && cok {
 		return nk.isOn(ch)
 	}
@@ -290,8 +599,8 @@ func (st *stateTracker) IsOn(c, n string) (*ChanPrivs, bool) {
 func (st *stateTracker) Associate(c, n string) *ChanPrivs {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	nk, nok := st.nicks[n]
-	ch, cok := st.chans[c]
+	nk, nok := st.nicks[st.key(n)]
+	ch, cok := st.chans[st.key(c)]
 
 	if !cok {
 		// As we can implicitly delete both nicks and channels from being
@@ -312,6 +621,26 @@ func (st *stateTracker) Associate(c, n string) *ChanPrivs {
 	cp := new(ChanPrivs)
 	ch.addNick(nk, cp)
 	nk.addChannel(ch, cp)
+	nk.used, ch.used = st.tick(), st.tick()
+	return cp.Copy()
+}
+
+// Records that nick sent a message to channel at time t.
+func (st *stateTracker) NickActive(c, n string, t time.Time) *ChanPrivs {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	nk, nok := st.nicks[st.key(n)]
+	ch, cok := st.chans[st.key(c)]
+	if !nok || !cok {
+		return nil
+	}
+	cp, ok := nk.chans[ch]
+	if !ok {
+		logging.Warn("Tracker.NickActive(): %s not on %s.", nk.nick, ch.name)
+		return nil
+	}
+	cp.LastActive = t
+	nk.used, ch.used = st.tick(), st.tick()
 	return cp.Copy()
 }
 
@@ -321,8 +650,8 @@ func (st *stateTracker) Associate(c, n string) *ChanPrivs {
 func (st *stateTracker) Dissociate(c, n string) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	nk, nok := st.nicks[n]
-	ch, cok := st.chans[c]
+	nk, nok := st.nicks[st.key(n)]
+	ch, cok := st.chans[st.key(c)]
 
 	if !cok {
 		// As we can implicitly delete both nicks and channels from being
@@ -1,7 +1,9 @@
 package state
 
 import (
+	"strings"
 	"testing"
+	"time"
 )
 
 // There is some awkwardness in these tests. Items retrieved directly from the
@@ -267,6 +269,53 @@ func TestSTGetChannel(t *testing.T) {
 	}
 }
 
+func TestSTRenameChannel(t *testing.T) {
+	st := NewTracker("mynick")
+	st.NewChannel("#test1")
+	st.NewNick("test1")
+	st.Associate("#test1", "mynick")
+	st.Associate("#test1", "test1")
+	st.ChannelModes("#test1", "+nt")
+
+	// We need to check out the manipulation of the internals.
+	n1 := st.nicks["test1"]
+	c1 := st.chans["#test1"]
+
+	ren := st.RenameChannel("#test1", "#test2")
+
+	if _, ok := st.chans["#test1"]; ok {
+		t.Errorf("Channel #test1 still exists after RenameChannel.")
+	}
+	if c, ok := st.chans["#test2"]; !ok || c != c1 || c.name != "#test2" {
+		t.Errorf("Channel #test2 doesn't exist after RenameChannel.")
+	}
+	if _, ok := n1.lookup["#test1"]; ok {
+		t.Errorf("Nick test1 still knows about #test1 after RenameChannel.")
+	}
+	if c, ok := n1.lookup["#test2"]; !ok || c != c1 {
+		t.Errorf("Nick test1 doesn't know about #test2 after RenameChannel.")
+	}
+	if _, ok := st.IsOn("#test2", "test1"); !ok {
+		t.Errorf("Nick test1 not on #test2 after RenameChannel.")
+	}
+	if ren == nil || ren.Name != "#test2" || len(ren.Nicks) != 2 ||
+		!ren.Modes.ProtectedTopic || !ren.Modes.NoExternalMsg {
+		t.Errorf("RenameChannel returned incorrect channel.")
+	}
+
+	// Renaming unknown channels or onto known ones shouldn't work.
+	st.NewChannel("#test3")
+	if fail := st.RenameChannel("#test1", "#test4"); fail != nil {
+		t.Errorf("Renaming unknown channel did not produce nil return.")
+	}
+	if fail := st.RenameChannel("#test2", "#test3"); fail != nil {
+		t.Errorf("Renaming onto known channel did not produce nil return.")
+	}
+	if len(st.chans) != 2 {
+		t.Errorf("Channel list changed size during RenameChannel.")
+	}
+}
+
 func TestSTDelChannel(t *testing.T) {
 	st := NewTracker("mynick")
 
@@ -367,6 +416,27 @@ func TestSTTopic(t *testing.T) {
 	}
 }
 
+func TestSTChannelURL(t *testing.T) {
+	st := NewTracker("mynick")
+	test1 := st.NewChannel("#test1")
+	test2 := st.ChannelURL("#test1", "http://example.com/")
+
+	if test1.Equals(test2) {
+		t.Errorf("ChannelURL did not return modified channel.")
+	}
+	if !st.GetChannel("#test1").Equals(test2) {
+		t.Errorf("Getting channel after ChannelURL returned different channel.")
+	}
+	test1.URL = "http://example.com/"
+	if !test1.Equals(test2) {
+		t.Errorf("ChannelURL did not set channel URL correctly.")
+	}
+
+	if fail := st.ChannelURL("#test2", "http://example.org/"); fail != nil {
+		t.Errorf("ChannelURL for nonexistent channel did not return nil.")
+	}
+}
+
 func TestSTChannelModes(t *testing.T) {
 	st := NewTracker("mynick")
 	test1 := st.NewChannel("#test1")
@@ -389,6 +459,54 @@ func TestSTChannelModes(t *testing.T) {
 	}
 }
 
+func TestSTChannelTimes(t *testing.T) {
+	st := NewTracker("mynick")
+	st.NewChannel("#test1")
+	created, changed := time.Unix(1234567890, 0), time.Unix(1234567990, 0)
+
+	test1 := st.ChannelCreated("#test1", created)
+	if test1 == nil || !test1.Created.Equal(created) {
+		t.Errorf("ChannelCreated did not set creation time correctly.")
+	}
+	if !test1.ModesSetBefore(created) {
+		t.Errorf("Unknown mode change time not treated as before.")
+	}
+	test2 := st.ModesChanged("#test1", changed)
+	if test2 == nil || !test2.ModesChanged.Equal(changed) ||
+		!test2.Created.Equal(created) {
+		t.Errorf("ModesChanged did not set mode change time correctly.")
+	}
+	if test2.ModesSetBefore(created) || !test2.ModesSetBefore(changed.Add(time.Second)) {
+		t.Errorf("ModesSetBefore returned wrong result.")
+	}
+	if !st.GetChannel("#test1").Equals(test2) {
+		t.Errorf("Getting channel after ModesChanged returned different channel.")
+	}
+
+	if st.ChannelCreated("#test2", created) != nil ||
+		st.ModesChanged("#test2", changed) != nil {
+		t.Errorf("Setting times for nonexistent channel did not return nil.")
+	}
+}
+
+func TestSTTopicInfo(t *testing.T) {
+	st := NewTracker("mynick")
+	st.NewChannel("#test1")
+	set := time.Unix(1234567890, 0)
+
+	test1 := st.TopicInfo("#test1", "user1", set)
+	if test1 == nil || test1.TopicSetBy != "user1" || !test1.TopicTime.Equal(set) {
+		t.Errorf("TopicInfo did not set topic info correctly.")
+	}
+	if !st.GetChannel("#test1").Equals(test1) {
+		t.Errorf("Getting channel after TopicInfo returned different channel.")
+	}
+
+	if st.TopicInfo("#test2", "user1", set) != nil {
+		t.Errorf("Setting topic info for nonexistent channel did not return nil.")
+	}
+}
+
 func TestSTIsOn(t *testing.T) {
 	st := NewTracker("mynick")
 
@@ -505,6 +623,59 @@ func TestSTDissociate(t *testing.T) {
 	}
 }
 
+func TestSTLimits(t *testing.T) {
+	st := NewTracker("mynick")
+	st.SetLimits(4, 2)
+
+	// Nicks we share channels with are kept ...
+	st.NewChannel("#test1")
+	st.Associate("#test1", "mynick")
+	st.NewNick("test1")
+	st.Associate("#test1", "test1")
+	// ... while the least recently used of those we don't are forgotten.
+	st.NewNick("test2")
+	st.NewNick("test3")
+	st.GetNick("test2")
+	st.NewNick("test4")
+	if len(st.nicks) != 4 || st.nicks["test3"] != nil ||
+		st.nicks["test1"] == nil || st.nicks["test2"] == nil {
+		t.Errorf("Least recently used nick not evicted: %v", st.nicks)
+	}
+
+	// Newly created nicks aren't evicted before they can be associated.
+	st.Associate("#test1", "test2")
+	st.Associate("#test1", "test4")
+	st.NewNick("test5")
+	if st.nicks["test5"] == nil || len(st.nicks) != 5 {
+		t.Errorf("Nick evicted before it could be associated: %v", st.nicks)
+	}
+	st.Associate("#test1", "test5")
+
+	// The least recently used channel is forgotten, along with the
+	// nicks we only shared that channel with.
+	st.NewChannel("#test2")
+	st.Associate("#test2", "mynick")
+	st.Topic("#test1", "still here")
+	st.NewChannel("#test3")
+	if len(st.chans) != 2 || st.chans["#test2"] != nil {
+		t.Errorf("Least recently used channel not evicted: %v", st.chans)
+	}
+	st.Topic("#test3", "foo")
+	st.NewChannel("#test4")
+	if len(st.chans) != 2 || st.chans["#test1"] != nil {
+		t.Errorf("Least recently used channel not evicted: %v", st.chans)
+	}
+	if len(st.nicks) != 1 || st.nicks["mynick"] == nil {
+		t.Errorf("Nicks on evicted channel not forgotten: %v", st.nicks)
+	}
+
+	// Lowering the limits evicts immediately.
+	st.SetLimits(0, 1)
+	if len(st.chans) != 1 || st.chans["#test4"] == nil {
+		t.Errorf("Channels not evicted when limit lowered: %v", st.chans)
+	}
+}
+
 func TestSTWipe(t *testing.T) {
 	st := NewTracker("mynick")
 
@@ -529,6 +700,12 @@ func TestSTWipe(t *testing.T) {
 
 	st.Associate("#test1", "test3")
 
+	// A nick we don't share a channel with, and some state of our own.
+	st.NewNick("test4")
+	st.NickModes("mynick", "+iw")
+	st.NickAway("mynick", true, "Gone")
+	st.NickAccount("mynick", "myacct")
+
 	// We need to check out the manipulation of the internals.
 	nick1 := st.nicks["test1"]
 	nick2 := st.nicks["test2"]
@@ -538,7 +715,7 @@ func TestSTWipe(t *testing.T) {
 	chan3 := st.chans["#test3"]
 
 	// Check the state we have at this point is what we would expect.
-	if len(st.nicks) != 4 || len(st.chans) != 3 || len(st.me.chans) != 3 {
+	if len(st.nicks) != 5 || len(st.chans) != 3 || len(st.me.chans) != 3 {
 		t.Errorf("Tracker nick/channel lists wrong length before wipe.")
 	}
 	if len(chan1.nicks) != 4 || len(chan2.nicks) != 3 || len(chan3.nicks) != 2 {
@@ -561,4 +738,209 @@ func TestSTWipe(t *testing.T) {
 	if len(nick1.chans) != 0 || len(nick2.chans) != 0 || len(nick3.chans) != 0 {
 		t.Errorf("Nick chan lists wrong length after wipe.")
 	}
+	me := st.Me()
+	if me.Nick != "mynick" || me.Modes.Invisible || me.Modes.WallOps || me.Away ||
+		me.Account != "" {
+		t.Errorf("Our own nick state not reset by wipe: %#v", me)
+	}
+}
+
+func TestSTRecordEvent(t *testing.T) {
+	st := NewTracker("mynick")
+	st.NewChannel("#test1")
+
+	// Events aren't kept unless asked for.
+	st.RecordEvent("#test1", Event{Cmd: "JOIN", Nick: "test1"})
+	if evs := st.GetChannel("#test1").RecentEvents(0); len(evs) != 0 {
+		t.Errorf("Events recorded without event history: %v", evs)
+	}
+
+	st.SetEventHistory(3)
+	for _, n := range []string{"test1", "test2", "test3", "test4"} {
+		st.RecordEvent("#test1", Event{Cmd: "JOIN", Nick: n})
+	}
+	ch := st.RecordEvent("#test1", Event{
+		Cmd: "KICK", Nick: "test4", Args: []string{"test2", "bye"}})
+	evs := ch.RecentEvents(0)
+	if len(evs) != 3 || evs[0].Nick != "test3" || evs[2].Cmd != "KICK" {
+		t.Errorf("Incorrect events recorded: %v", evs)
+	}
+	if evs := ch.RecentEvents(2); len(evs) != 2 || evs[0].Nick != "test4" {
+		t.Errorf("Incorrect recent events returned: %v", evs)
+	}
+
+	// Shrinking the history should discard the oldest events.
+	st.SetEventHistory(1)
+	evs = st.GetChannel("#test1").RecentEvents(5)
+	if len(evs) != 1 || evs[0].Cmd != "KICK" {
+		t.Errorf("Events not discarded when history shrunk: %v", evs)
+	}
+
+	if fail := st.RecordEvent("#test2", Event{Cmd: "JOIN"}); fail != nil {
+		t.Errorf("Recording event on unknown channel did not return nil.")
+	}
+}
+
+func TestSTNickAway(t *testing.T) {
+	st := NewTracker("mynick")
+	st.NewNick("test1")
+
+	test1 := st.NickAway("test1", true, "Gone fishing")
+	if !test1.Away || test1.AwayMessage != "Gone fishing" {
+		t.Errorf("NickAway did not set away status correctly.")
+	}
+	// Without a message, the existing one should be kept while still away.
+	test1 = st.NickAway("test1", true, "")
+	if !test1.Away || test1.AwayMessage != "Gone fishing" {
+		t.Errorf("NickAway without message lost away message.")
+	}
+	test1 = st.NickAway("test1", false, "")
+	if test1.Away || test1.AwayMessage != "" || !test1.Equals(st.GetNick("test1")) {
+		t.Errorf("NickAway did not clear away status correctly.")
+	}
+
+	if fail := st.NickAway("test2", true, ""); fail != nil {
+		t.Errorf("NickAway for nonexistent nick did not return nil.")
+	}
+}
+
+func TestSTNickAccount(t *testing.T) {
+	st := NewTracker("mynick")
+	st.NewNick("test1")
+
+	test1 := st.NickAccount("test1", "acct1")
+	if test1.Account != "acct1" || !test1.Equals(st.GetNick("test1")) {
+		t.Errorf("NickAccount did not set account correctly.")
+	}
+	// The account follows the nick through nick changes.
+	if test1 = st.ReNick("test1", "test2"); test1.Account != "acct1" {
+		t.Errorf("Account lost on nick change.")
+	}
+	if test1 = st.NickAccount("test2", ""); test1.Account != "" {
+		t.Errorf("NickAccount did not clear account correctly.")
+	}
+
+	if fail := st.NickAccount("test3", "acct3"); fail != nil {
+		t.Errorf("NickAccount for nonexistent nick did not return nil.")
+	}
+}
+
+func TestSTNickVersion(t *testing.T) {
+	st := NewTracker("mynick")
+	st.NewNick("test1")
+
+	test1 := st.NickVersion("test1", "irssi v1.2.3")
+	if test1.ClientVersion != "irssi v1.2.3" || !test1.Equals(st.GetNick("test1")) {
+		t.Errorf("NickVersion did not set version correctly.")
+	}
+	if test1 = st.ReNick("test1", "test2"); test1.ClientVersion != "irssi v1.2.3" {
+		t.Errorf("Version lost on nick change.")
+	}
+
+	if fail := st.NickVersion("test3", "HexChat"); fail != nil {
+		t.Errorf("NickVersion for nonexistent nick did not return nil.")
+	}
+}
+
+func TestSTRequestNick(t *testing.T) {
+	st := NewTracker("mynick")
+
+	if me := st.Me(); me.RequestedNick != "mynick" {
+		t.Errorf("Requested nick not initialised to 'mynick'.")
+	}
+
+	// The server folding the case of our nick shouldn't lose what we asked for.
+	me := st.RequestNick("MyNick")
+	if me.RequestedNick != "MyNick" || me.Nick != "mynick" {
+		t.Errorf("RequestNick did not record requested nick correctly.")
+	}
+	me = st.ReNick("mynick", "mynick_")
+	if me.RequestedNick != "MyNick" || !me.Equals(st.Me()) {
+		t.Errorf("ReNick changed requested nick unexpectedly.")
+	}
+	if st.NewNick("test1").RequestedNick != "" {
+		t.Errorf("Requested nick set for a nick that isn't me.")
+	}
+}
+
+func TestSTSetNormalizer(t *testing.T) {
+	st := NewTracker("MyNick")
+	st.NewChannel("#Test1")
+	st.NewNick("Test1")
+	st.Associate("#Test1", "MyNick")
+	st.Associate("#Test1", "Test1")
+
+	// By default names are compared exactly.
+	if st.GetNick("mynick") != nil || st.GetChannel("#test1") != nil {
+		t.Errorf("Names were normalized without a normalizer.")
+	}
+
+	// Setting a normalizer re-keys everything already tracked.
+	st.SetNormalizer(strings.ToLower)
+	if nk := st.GetNick("mynick"); nk == nil || nk.Nick != "MyNick" {
+		t.Errorf("Normalized nick lookup failed: %#v", nk)
+	}
+	if ch := st.GetChannel("#TEST1"); ch == nil || ch.Name != "#Test1" {
+		t.Errorf("Normalized channel lookup failed: %#v", ch)
+	}
+	if _, ok := st.IsOn("#test1", "TEST1"); !ok {
+		t.Errorf("Normalized IsOn failed.")
+	}
+	if cp := st.ChannelModes("#test1", "+o", "test1").Nicks["Test1"]; !cp.Op {
+		t.Errorf("Normalized mode change wasn't applied.")
+	}
+
+	// New names are normalized too, and changing only case is allowed.
+	st.NewChannel("#Test2")
+	if st.NewChannel("#TEST2") != nil {
+		t.Errorf("Created a channel differing only in case.")
+	}
+	if nk := st.ReNick("test1", "TEST1"); nk == nil || nk.Nick != "TEST1" {
+		t.Errorf("Changing case of nick failed: %#v", nk)
+	}
+	if cp := st.ChannelModes("#test1", "-o", "test1").Nicks["TEST1"]; cp.Op {
+		t.Errorf("Mode change after case change wasn't applied.")
+	}
+	if ch := st.RenameChannel("#test2", "#TEST2"); ch == nil || ch.Name != "#TEST2" {
+		t.Errorf("Changing case of channel failed: %#v", ch)
+	}
+	if st.RenameChannel("#test1", "#test2") != nil {
+		t.Errorf("Renamed a channel over another.")
+	}
+	st.Dissociate("#TEST1", "test1")
+	if st.GetNick("test1") != nil {
+		t.Errorf("Nick not deleted after normalized dissociate.")
+	}
+}
+
+func TestSTNickActive(t *testing.T) {
+	st := NewTracker("mynick")
+
+	st.NewNick("test1")
+	st.NewChannel("#test1")
+	st.Associate("#test1", "test1")
+
+	now := time.Now()
+	cp := st.NickActive("#test1", "test1", now)
+	if cp == nil || !cp.LastActive.Equal(now) {
+		t.Errorf("NickActive did not set LastActive correctly.")
+	}
+	if cp, _ := st.IsOn("#test1", "test1"); !cp.LastActive.Equal(now) {
+		t.Errorf("LastActive not visible from IsOn.")
+	}
+	if ch := st.GetChannel("#test1"); !ch.Nicks["test1"].LastActive.Equal(now) {
+		t.Errorf("LastActive not visible from GetChannel.")
+	}
+
+	// Test error cases
+	st.NewNick("test2")
+	if st.NickActive("#test1", "test2", now) != nil {
+		t.Errorf("NickActive for nick not on channel did not return nil.")
+	}
+	if st.NickActive("#test2", "test1", now) != nil {
+		t.Errorf("NickActive for unknown channel did not return nil.")
+	}
+	if st.NickActive("#test1", "test3", now) != nil {
+		t.Errorf("NickActive for unknown nick did not return nil.")
+	}
 }